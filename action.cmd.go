@@ -0,0 +1,119 @@
+package main
+
+import (
+	"ami-reader/conf"
+	"ami-reader/service"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/pflag"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const actionUsage = `Usage: ami-reader action [flags] <action> [key=value]...
+
+Sends a single AMI action and prints the response, along with the events it lists, e.g. those of
+CoreShowChannels. Exits with 1 when AMI responds with an error.
+
+Examples:
+  ami-reader action CoreShowChannels
+  ami-reader action Command Command='core show version'
+  ami-reader action Getvar Channel=PJSIP/1001-00000001 Variable=CALLERID\(num\) --json
+
+Flags:
+`
+
+func runAction(args []string) int {
+	flags := pflag.NewFlagSet("action", pflag.ContinueOnError)
+	asJson := flags.Bool("json", false, "Print the response and events as a JSON array")
+	timeout := flags.Duration("timeout", 10*time.Second, "Time to wait for the response")
+	conf.RegisterFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, actionUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	action, err := parseAction(flags.Arg(0), flags.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	amiConfig, err := loadAmiConfig(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	client, err := service.DialAmi(amiConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer client.Close()
+	if err = client.Login(*amiConfig.AmiUsername, *amiConfig.AmiPassword, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to login to Asterisk: %v\n", err)
+		return 1
+	}
+	messages, err := client.Send(action, *timeout)
+	if *asJson {
+		printMessagesJson(os.Stdout, messages)
+	} else {
+		for _, message := range messages {
+			for _, field := range message {
+				fmt.Printf("%s: %s\n", field.Key, field.Value)
+			}
+			fmt.Println()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the response: %v\n", err)
+		return 1
+	}
+	if messages[0].Get("Response") == "Error" {
+		return 1
+	}
+	return 0
+}
+
+// parseAction builds the action named name out of key=value arguments.
+func parseAction(name string, args []string) ([]service.AmiField, error) {
+	action := []service.AmiField{{Key: "Action", Value: name}}
+	for _, arg := range args {
+		// Keys may be repeated, e.g. Variable of Originate
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid argument %s, expected key=value", arg)
+		}
+		action = append(action, service.AmiField{Key: arg[:i], Value: arg[i+1:]})
+	}
+	return action, nil
+}
+
+// printMessagesJson prints messages as an array of objects. A key showing up more than once, e.g. Output,
+// has an array of its values.
+func printMessagesJson(out io.Writer, messages []service.AmiMessage) {
+	objects := make([]map[string]interface{}, 0, len(messages))
+	for _, message := range messages {
+		object := make(map[string]interface{})
+		for _, field := range message {
+			switch previous := object[field.Key].(type) {
+			case nil:
+				object[field.Key] = field.Value
+			case string:
+				object[field.Key] = []string{previous, field.Value}
+			case []string:
+				object[field.Key] = append(previous, field.Value)
+			}
+		}
+		objects = append(objects, object)
+	}
+	indented, _ := json.MarshalIndent(objects, "", "  ")
+	fmt.Fprintln(out, string(indented))
+}
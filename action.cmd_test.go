@@ -0,0 +1,56 @@
+package main
+
+import (
+	"ami-reader/service"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseAction(t *testing.T) {
+	action, err := parseAction("Originate", []string{"Channel=PJSIP/1001", "Variable=A=1", "Variable=B=2", "Data="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []service.AmiField{
+		{Key: "Action", Value: "Originate"},
+		{Key: "Channel", Value: "PJSIP/1001"},
+		{Key: "Variable", Value: "A=1"},
+		{Key: "Variable", Value: "B=2"},
+		{Key: "Data", Value: ""},
+	}
+	if !reflect.DeepEqual(action, want) {
+		t.Errorf("parseAction = %v, want %v", action, want)
+	}
+	for _, arg := range []string{"Channel", "=PJSIP/1001"} {
+		if _, err = parseAction("Originate", []string{arg}); err == nil {
+			t.Errorf("parseAction accepted %s", arg)
+		}
+	}
+}
+
+func TestPrintMessagesJson(t *testing.T) {
+	messages := []service.AmiMessage{
+		{{Key: "Response", Value: "Success"}, {Key: "Output", Value: "line 1"}, {Key: "Output", Value: "line 2"}, {Key: "Output", Value: "line 3"}},
+		{{Key: "Event", Value: "CoreShowChannel"}, {Key: "Channel", Value: "PJSIP/1001-00000001"}},
+	}
+	var out bytes.Buffer
+	printMessagesJson(&out, messages)
+	var objects []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &objects); err != nil {
+		t.Fatalf("printed %s: %v", out.String(), err)
+	}
+	want := []map[string]interface{}{
+		{"Response": "Success", "Output": []interface{}{"line 1", "line 2", "line 3"}},
+		{"Event": "CoreShowChannel", "Channel": "PJSIP/1001-00000001"},
+	}
+	if !reflect.DeepEqual(objects, want) {
+		t.Errorf("printed %v, want %v", objects, want)
+	}
+	out.Reset()
+	printMessagesJson(&out, nil)
+	if out.String() != "[]\n" {
+		t.Errorf("printed %q for no message", out.String())
+	}
+}
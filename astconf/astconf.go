@@ -0,0 +1,269 @@
+package astconf
+
+import (
+    "bufio"
+    "fmt"
+    "github.com/pkg/errors"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// maxIncludeDepth stops #include loops, Asterisk itself gives up far earlier than any sane config nests
+const maxIncludeDepth = 16
+
+// Variable is a key = value (or key => value) line of a section.
+type Variable struct {
+    Name  string
+    Value string
+    // Where the line was read, e.g. /etc/asterisk/manager.conf:12
+    Origin string
+    // Inherited tells whether the variable comes from a template
+    Inherited bool
+}
+
+// Section is a [name] of a config file. A section marked (!) is a template, sections list the templates they
+// inherit from as [name](template1,template2), and get their variables first.
+type Section struct {
+    Name      string
+    Template  bool
+    Templates []string
+    Variables []Variable
+    Origin    string
+}
+
+// Value returns the last value of a variable, which is the one Asterisk applies when a key is set twice.
+func (section *Section) Value(name string) (string, bool) {
+    values := section.Values(name)
+    if len(values) == 0 {
+        return "", false
+    }
+    return values[len(values)-1], true
+}
+
+// Values returns every value of a variable in order, e.g. of permit, deny or eventfilter which add up.
+func (section *Section) Values(name string) []string {
+    var values []string
+    for _, variable := range section.Variables {
+        if strings.EqualFold(variable.Name, name) {
+            values = append(values, variable.Value)
+        }
+    }
+    return values
+}
+
+// Config is an Asterisk config file along with the files it includes. It is read the way Asterisk reads
+// them: ; comments and ;-- --; blocks, #include and #tryinclude (globs allowed), templates, [name](+) adding
+// to a section defined earlier, and keys set more than once, all values being kept.
+type Config struct {
+    File     string
+    Sections []*Section
+    // Lines that were skipped, e.g. #exec
+    Warnings []string
+}
+
+// Find returns the sections of a name that are not templates. A name can be defined more than once, Asterisk
+// then applies the last one.
+func (config *Config) Find(name string) []*Section {
+    var sections []*Section
+    for _, section := range config.Sections {
+        if !section.Template && strings.EqualFold(section.Name, name) {
+            sections = append(sections, section)
+        }
+    }
+    return sections
+}
+
+// Section returns the last section of a name that is not a template, nil when there is none.
+func (config *Config) Section(name string) *Section {
+    sections := config.Find(name)
+    if len(sections) == 0 {
+        return nil
+    }
+    return sections[len(sections)-1]
+}
+
+// Load reads a config file. Included files are relative to the directory of file, as they are to the
+// Asterisk config directory.
+func Load(file string) (*Config, error) {
+    parser := &parser{config: &Config{File: file}, dir: filepath.Dir(file)}
+    if err := parser.parse(file, 0); err != nil {
+        return nil, err
+    }
+    return parser.config, nil
+}
+
+type parser struct {
+    config  *Config
+    dir     string
+    current *Section
+    // Depth of nested ;-- --; comment blocks
+    commentDepth int
+}
+
+func (parser *parser) parse(file string, depth int) error {
+    if depth > maxIncludeDepth {
+        return errors.Errorf("Too many nested includes reading %s", file)
+    }
+    f, err := os.Open(file)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for number := 1; scanner.Scan(); number++ {
+        origin := fmt.Sprintf("%s:%d", file, number)
+        line := strings.TrimSpace(parser.stripComments(scanner.Text()))
+        if line == "" {
+            continue
+        }
+        if err := parser.parseLine(line, origin, depth); err != nil {
+            return errors.Wrap(err, origin)
+        }
+    }
+    return scanner.Err()
+}
+
+// stripComments removes ; comments and ;-- --; blocks, \; being a literal ;.
+func (parser *parser) stripComments(line string) string {
+    var result strings.Builder
+    for i := 0; i < len(line); i++ {
+        switch {
+        case strings.HasPrefix(line[i:], ";--"):
+            parser.commentDepth++
+            i += 2
+        case parser.commentDepth > 0 && strings.HasPrefix(line[i:], "--;"):
+            parser.commentDepth--
+            i += 2
+        case parser.commentDepth > 0:
+        case line[i] == '\\' && i+1 < len(line) && line[i+1] == ';':
+            result.WriteByte(';')
+            i++
+        case line[i] == ';':
+            return result.String()
+        default:
+            result.WriteByte(line[i])
+        }
+    }
+    return result.String()
+}
+
+func (parser *parser) parseLine(line string, origin string, depth int) error {
+    switch {
+    case strings.HasPrefix(line, "#"):
+        return parser.parseDirective(line, origin, depth)
+    case strings.HasPrefix(line, "["):
+        return parser.parseSection(line, origin)
+    }
+    if parser.current == nil {
+        return errors.Errorf("%q is outside of any section", line)
+    }
+    name, value := line, ""
+    if i := strings.Index(line, "="); i >= 0 {
+        name, value = line[:i], strings.TrimPrefix(line[i+1:], ">")
+    }
+    name = strings.TrimSpace(name)
+    if name == "" {
+        return errors.Errorf("Missing key in %q", line)
+    }
+    parser.current.Variables = append(parser.current.Variables, Variable{Name: name, Value: strings.TrimSpace(value), Origin: origin})
+    return nil
+}
+
+func (parser *parser) parseDirective(line string, origin string, depth int) error {
+    directive, argument := line, ""
+    if i := strings.IndexAny(line, " \t\"<"); i >= 0 {
+        directive, argument = line[:i], strings.Trim(strings.TrimSpace(line[i:]), `"<>`)
+    }
+    directive = strings.ToLower(directive)
+    switch directive {
+    case "#include", "#tryinclude":
+        if argument == "" {
+            return errors.Errorf("Missing file in %q", line)
+        }
+        if !filepath.IsAbs(argument) {
+            argument = filepath.Join(parser.dir, argument)
+        }
+        files, err := filepath.Glob(argument)
+        if err != nil {
+            return errors.Wrap(err, fmt.Sprintf("Invalid include %q.", argument))
+        }
+        if len(files) == 0 {
+            if directive == "#tryinclude" {
+                return nil
+            }
+            return errors.Errorf("Included file %s not found", argument)
+        }
+        for _, file := range files {
+            if err := parser.parse(file, depth+1); err != nil {
+                return err
+            }
+        }
+        return nil
+    case "#exec":
+        parser.config.Warnings = append(parser.config.Warnings, fmt.Sprintf("%s: %s was not run, its output is not checked", origin, line))
+        return nil
+    default:
+        return errors.Errorf("Unknown directive %q", directive)
+    }
+}
+
+// parseSection reads [name] along with its options, e.g. [name](!), [name](template) or [name](+).
+func (parser *parser) parseSection(line string, origin string) error {
+    end := strings.Index(line, "]")
+    if end < 0 {
+        return errors.Errorf("Missing ] in %q", line)
+    }
+    name := strings.TrimSpace(line[1:end])
+    if name == "" {
+        return errors.Errorf("Missing section name in %q", line)
+    }
+    section := &Section{Name: name, Origin: origin}
+    rest := strings.TrimSpace(line[end+1:])
+    if rest != "" {
+        if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+            return errors.Errorf("Invalid section options in %q", line)
+        }
+        for _, option := range strings.Split(rest[1:len(rest)-1], ",") {
+            switch option = strings.TrimSpace(option); option {
+            case "":
+            case "!":
+                section.Template = true
+            case "+":
+                // Adds to the section defined last
+                for i := len(parser.config.Sections) - 1; i >= 0; i-- {
+                    if strings.EqualFold(parser.config.Sections[i].Name, name) {
+                        parser.current = parser.config.Sections[i]
+                        return nil
+                    }
+                }
+                return errors.Errorf("Section %s to add to is not defined", name)
+            default:
+                template := parser.template(option)
+                if template == nil {
+                    return errors.Errorf("Template %s of section %s is not defined", option, name)
+                }
+                section.Templates = append(section.Templates, option)
+                for _, variable := range template.Variables {
+                    variable.Inherited = true
+                    section.Variables = append(section.Variables, variable)
+                }
+            }
+        }
+    }
+    parser.config.Sections = append(parser.config.Sections, section)
+    parser.current = section
+    return nil
+}
+
+// template returns the last section of a name defined so far. Any section can be inherited from, not only
+// those marked (!).
+func (parser *parser) template(name string) *Section {
+    for i := len(parser.config.Sections) - 1; i >= 0; i-- {
+        if strings.EqualFold(parser.config.Sections[i].Name, name) {
+            return parser.config.Sections[i]
+        }
+    }
+    return nil
+}
@@ -0,0 +1,133 @@
+package astconf
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// writeConfig writes files into a temporary directory and returns it.
+func writeConfig(t *testing.T, files map[string]string) string {
+    t.Helper()
+    dir, err := ioutil.TempDir("", "astconf")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, content := range files {
+        path := filepath.Join(dir, name)
+        _ = os.MkdirAll(filepath.Dir(path), 0700)
+        if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return dir
+}
+
+func TestLoad(t *testing.T) {
+    dir := writeConfig(t, map[string]string{
+        "manager.conf": `
+[general]
+enabled = yes ; AMI on
+;-- port = 5039
+bindaddr = 10.0.0.1 --;
+#include "manager.d/*.conf"
+#tryinclude missing.conf
+#exec /usr/bin/users.sh
+
+[reader-template](!)
+read = call,cdr
+permit => 10.0.0.0/8
+
+[reader](reader-template)
+secret = pass\;word
+read = call
+deny = 0.0.0.0/0.0.0.0
+
+[reader](+)
+eventfilter = Event: Hangup
+`,
+        "manager.d/extra.conf": `
+[monitor]
+secret = other
+`,
+    })
+    defer os.RemoveAll(dir)
+    config, err := Load(filepath.Join(dir, "manager.conf"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var names []string
+    for _, section := range config.Sections {
+        names = append(names, section.Name)
+    }
+    if want := []string{"general", "monitor", "reader-template", "reader"}; !reflect.DeepEqual(names, want) {
+        t.Fatalf("sections %v, want %v", names, want)
+    }
+    tests := []struct {
+        section string
+        name    string
+        want    []string
+    }{
+        {"general", "enabled", []string{"yes"}},
+        {"general", "port", nil},
+        {"general", "bindaddr", nil},
+        {"monitor", "secret", []string{"other"}},
+        {"reader", "secret", []string{"pass;word"}},
+        {"reader", "READ", []string{"call,cdr", "call"}},
+        {"reader", "permit", []string{"10.0.0.0/8"}},
+        {"reader", "eventfilter", []string{"Event: Hangup"}},
+    }
+    for _, test := range tests {
+        if got := config.Section(test.section).Values(test.name); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%s %s = %v, want %v", test.section, test.name, got, test.want)
+        }
+    }
+    reader := config.Section("reader")
+    if value, _ := reader.Value("read"); value != "call" {
+        t.Errorf("read = %s, want the last value call", value)
+    }
+    if !reader.Variables[0].Inherited || reader.Variables[2].Inherited {
+        t.Errorf("inherited variables %v", reader.Variables)
+    }
+    if !strings.HasSuffix(reader.Variables[2].Origin, "manager.conf:15") {
+        t.Errorf("origin %s, want manager.conf:15", reader.Variables[2].Origin)
+    }
+    if config.Section("reader-template") != nil {
+        t.Error("a template is returned as a section")
+    }
+    if len(config.Warnings) != 1 || !strings.Contains(config.Warnings[0], "#exec") {
+        t.Errorf("warnings %v, want the #exec line", config.Warnings)
+    }
+}
+
+func TestLoadFailsOnInvalidConfig(t *testing.T) {
+    tests := []struct {
+        name    string
+        content string
+        wantErr string
+    }{
+        {"outside of section", "secret = pass", "outside of any section"},
+        {"missing bracket", "[reader", "Missing ]"},
+        {"missing section name", "[ ]", "Missing section name"},
+        {"missing key", "[reader]\n= pass", "Missing key"},
+        {"invalid options", "[reader] extra", "Invalid section options"},
+        {"undefined template", "[reader](base)", "Template base"},
+        {"undefined section to add to", "[reader](+)", "to add to is not defined"},
+        {"missing include", "#include missing.conf", "not found"},
+        {"unknown directive", "#define x", "Unknown directive"},
+        {"include loop", "#include manager.conf", "Too many nested includes"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dir := writeConfig(t, map[string]string{"manager.conf": test.content})
+            defer os.RemoveAll(dir)
+            _, err := Load(filepath.Join(dir, "manager.conf"))
+            if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+                t.Fatalf("error %v, want %s", err, test.wantErr)
+            }
+        })
+    }
+}
@@ -0,0 +1,270 @@
+package astconf
+
+import (
+    "ami-reader/util"
+    "fmt"
+    "net"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// ClassEvents are events of each AMI class, checked against the eventfilter lines of a user.
+var ClassEvents = map[string][]string{
+    "call":      {"Newchannel", "Newstate", "DialBegin", "DialEnd", "BridgeEnter", "Hangup"},
+    "cdr":       {"Cdr"},
+    "cel":       {"CEL"},
+    "agent":     {"QueueCallerJoin", "AgentCalled", "AgentConnect", "AgentComplete"},
+    "dialplan":  {"Newexten", "VarSet"},
+    "user":      {"UserEvent"},
+    "reporting": {"RTCPSent", "RTCPReceived"},
+    "system":    {"FullyBooted", "Reload"},
+    "security":  {"SuccessfulAuth", "InvalidPassword"},
+}
+
+// knownClasses are the classes read and write accept, along with all and none
+var knownClasses = []string{"system", "call", "log", "verbose", "command", "agent", "user", "config", "dtmf",
+    "reporting", "cdr", "dialplan", "originate", "agi", "cc", "aoc", "test", "security", "message"}
+
+// riskyWriteClasses let a user change the PBX, reading events needs none of them
+var riskyWriteClasses = []string{"system", "command", "config", "originate", "agi"}
+
+// Manager is what the AMI user connects with, checked against manager.conf.
+type Manager struct {
+    User string
+    Port int
+    // Addresses AMI is reached at
+    HostAddrs []net.IP
+    // Address connections come from, nil when unknown
+    LocalAddr net.IP
+    // Event classes read
+    Classes []string
+}
+
+// CheckManager lists what in manager.conf would keep the user from logging in or from receiving events of
+// the classes read: AMI disabled or listening elsewhere, a missing user or secret, read permissions,
+// permit/deny ACLs and eventfilter lines.
+func CheckManager(config *Config, manager Manager) []string {
+    var problems []string
+    problems = append(problems, config.Warnings...)
+    problems = append(problems, checkGeneral(config, manager)...)
+    sections := config.Find(manager.User)
+    if len(sections) == 0 || strings.EqualFold(manager.User, "general") {
+        return append(problems, fmt.Sprintf("User %s is not defined in %s", manager.User, config.File))
+    }
+    user := sections[len(sections)-1]
+    if len(sections) > 1 {
+        problems = append(problems, fmt.Sprintf("User %s is defined %d times, the one of %s applies", manager.User, len(sections), user.Origin))
+    }
+    if secret, _ := user.Value("secret"); secret == "" {
+        problems = append(problems, fmt.Sprintf("User %s has no secret", manager.User))
+    }
+    problems = append(problems, checkPermissions(user, manager)...)
+    problems = append(problems, checkAcl(user, manager)...)
+    problems = append(problems, checkEventFilters(user, manager)...)
+    return problems
+}
+
+func checkGeneral(config *Config, manager Manager) []string {
+    var problems []string
+    general := config.Section("general")
+    if general == nil {
+        return []string{fmt.Sprintf("[general] is missing from %s, AMI is disabled", config.File)}
+    }
+    if enabled, _ := general.Value("enabled"); !isTrue(enabled) {
+        problems = append(problems, "AMI is disabled, enabled is not yes in [general]")
+    }
+    port := 5038
+    if value, found := general.Value("port"); found {
+        port, _ = strconv.Atoi(value)
+    }
+    if manager.Port != 0 && port != manager.Port {
+        problems = append(problems, fmt.Sprintf("AMI listens on port %d, not on AMI_PORT %d", port, manager.Port))
+    }
+    if value, found := general.Value("bindaddr"); found && len(manager.HostAddrs) > 0 {
+        bindAddr := net.ParseIP(value)
+        if bindAddr != nil && !bindAddr.IsUnspecified() && !containsIP(manager.HostAddrs, bindAddr) {
+            problems = append(problems, fmt.Sprintf("AMI only listens on %s, which AMI_HOST does not resolve to", bindAddr))
+        }
+    }
+    return problems
+}
+
+func checkPermissions(user *Section, manager Manager) []string {
+    var problems []string
+    read := permissionClasses(user, "read")
+    for _, class := range append(read, permissionClasses(user, "write")...) {
+        if _, known := util.Find(knownClasses, class); !known && class != "all" && class != "none" {
+            problems = append(problems, fmt.Sprintf("User %s has unknown permission class %s", manager.User, class))
+        }
+    }
+    _, readsAll := util.Find(read, "all")
+    for _, class := range manager.Classes {
+        if _, found := util.Find(read, class); !found && !readsAll {
+            problems = append(problems, fmt.Sprintf("User %s can't receive %s events, e.g. %s: %s is missing from read",
+                manager.User, class, strings.Join(ClassEvents[class], ", "), class))
+        }
+    }
+    write := permissionClasses(user, "write")
+    _, writesAll := util.Find(write, "all")
+    for _, class := range riskyWriteClasses {
+        if _, found := util.Find(write, class); found || writesAll {
+            problems = append(problems, fmt.Sprintf("User %s may write %s, reading events needs no write permission", manager.User, class))
+        }
+    }
+    return problems
+}
+
+// permissionClasses returns the classes of read or write. Set twice, e.g. by a template and by the user,
+// the last one replaces the other.
+func permissionClasses(user *Section, name string) []string {
+    var classes []string
+    value, _ := user.Value(name)
+    for _, class := range strings.Split(value, ",") {
+        if class = strings.ToLower(strings.TrimSpace(class)); class != "" {
+            classes = append(classes, class)
+        }
+    }
+    return classes
+}
+
+// checkAcl applies permit and deny in order, as Asterisk does: an address is allowed unless the last rule
+// matching it is a deny.
+func checkAcl(user *Section, manager Manager) []string {
+    var problems []string
+    if acls := user.Values("acl"); len(acls) > 0 {
+        problems = append(problems, fmt.Sprintf("User %s uses named ACLs of acl.conf (%s), they are not checked", manager.User, strings.Join(acls, ", ")))
+    }
+    if manager.LocalAddr == nil {
+        if len(user.Values("permit")) > 0 || len(user.Values("deny")) > 0 {
+            problems = append(problems, fmt.Sprintf("User %s has permit/deny rules, they are not checked as the address connecting from is unknown", manager.User))
+        }
+        return problems
+    }
+    allowed := true
+    matched := ""
+    for _, variable := range user.Variables {
+        name := strings.ToLower(variable.Name)
+        if name != "permit" && name != "deny" {
+            continue
+        }
+        network, negated, err := parseAcl(variable.Value)
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("%s: invalid %s %q", variable.Origin, name, variable.Value))
+            continue
+        }
+        if network.Contains(manager.LocalAddr) == negated {
+            continue
+        }
+        allowed = name == "permit"
+        matched = fmt.Sprintf("%s=%s (%s)", name, variable.Value, variable.Origin)
+    }
+    if !allowed {
+        problems = append(problems, fmt.Sprintf("User %s can't connect from %s, denied by %s", manager.User, manager.LocalAddr, matched))
+    }
+    return problems
+}
+
+// parseAcl reads an address with an optional mask, in CIDR bits or dotted, e.g. 10.0.0.0/255.0.0.0. A leading
+// ! matches every other address.
+func parseAcl(value string) (*net.IPNet, bool, error) {
+    value = strings.TrimSpace(value)
+    negated := strings.HasPrefix(value, "!")
+    value = strings.TrimPrefix(value, "!")
+    address, mask := value, ""
+    if i := strings.Index(value, "/"); i >= 0 {
+        address, mask = value[:i], value[i+1:]
+    }
+    ip := net.ParseIP(address)
+    if ip == nil {
+        return nil, false, fmt.Errorf("invalid address %s", address)
+    }
+    bits := 128
+    if ip.To4() != nil {
+        ip, bits = ip.To4(), 32
+    }
+    network := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+    if mask != "" {
+        if ones, err := strconv.Atoi(mask); err == nil && ones >= 0 && ones <= bits {
+            network.Mask = net.CIDRMask(ones, bits)
+        } else if dotted := net.ParseIP(mask).To4(); dotted != nil && bits == 32 {
+            network.Mask = net.IPMask(dotted)
+        } else {
+            return nil, false, fmt.Errorf("invalid mask %s", mask)
+        }
+    }
+    network.IP = network.IP.Mask(network.Mask)
+    return network, negated, nil
+}
+
+// checkEventFilters matches the events of the classes read against the eventfilter lines of the user. Lines
+// starting with ! drop the events they match, the others let through only the events they match.
+func checkEventFilters(user *Section, manager Manager) []string {
+    var problems []string
+    var allow, deny []*regexp.Regexp
+    for _, variable := range user.Variables {
+        name := strings.ToLower(variable.Name)
+        if strings.HasPrefix(name, "eventfilter(") {
+            problems = append(problems, fmt.Sprintf("%s: %s filters are not checked", variable.Origin, variable.Name))
+            continue
+        }
+        if name != "eventfilter" {
+            continue
+        }
+        pattern := variable.Value
+        negated := strings.HasPrefix(pattern, "!")
+        pattern = strings.TrimPrefix(pattern, "!")
+        expression, err := regexp.Compile(pattern)
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("%s: eventfilter %q is not checked: %v", variable.Origin, variable.Value, err))
+            continue
+        }
+        if negated {
+            deny = append(deny, expression)
+        } else {
+            allow = append(allow, expression)
+        }
+    }
+    if len(allow) == 0 && len(deny) == 0 {
+        return problems
+    }
+    for _, class := range manager.Classes {
+        var dropped []string
+        for _, event := range ClassEvents[class] {
+            text := "Event: " + event
+            if (len(allow) > 0 && !matchesAny(allow, text)) || matchesAny(deny, text) {
+                dropped = append(dropped, event)
+            }
+        }
+        if len(dropped) > 0 {
+            problems = append(problems, fmt.Sprintf("User %s won't receive %s events, dropped by eventfilter", manager.User, strings.Join(dropped, ", ")))
+        }
+    }
+    return problems
+}
+
+func matchesAny(expressions []*regexp.Regexp, text string) bool {
+    for _, expression := range expressions {
+        if expression.MatchString(text) {
+            return true
+        }
+    }
+    return false
+}
+
+func isTrue(value string) bool {
+    switch strings.ToLower(strings.TrimSpace(value)) {
+    case "yes", "true", "y", "t", "1", "on":
+        return true
+    }
+    return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+    for _, i := range ips {
+        if i.Equal(ip) {
+            return true
+        }
+    }
+    return false
+}
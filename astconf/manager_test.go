@@ -0,0 +1,138 @@
+package astconf
+
+import (
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestCheckManager(t *testing.T) {
+    general := "[general]\nenabled = yes\nport = 5038\nbindaddr = 0.0.0.0\n"
+    manager := Manager{
+        User:      "reader",
+        Port:      5038,
+        HostAddrs: []net.IP{net.ParseIP("10.0.0.1")},
+        LocalAddr: net.ParseIP("10.0.0.2"),
+        Classes:   []string{"call", "cdr"},
+    }
+    tests := []struct {
+        name    string
+        content string
+        manager *Manager
+        want    []string
+    }{
+        {
+            name:    "valid",
+            content: general + "[reader]\nsecret = pass\nread = call,cdr\nwrite = none\ndeny = 0.0.0.0/0\npermit = 10.0.0.0/255.0.0.0\n",
+        },
+        {
+            name:    "read all",
+            content: general + "[reader]\nsecret = pass\nread = all\n",
+        },
+        {
+            name:    "no general",
+            content: "[reader]\nsecret = pass\nread = call,cdr\n",
+            want:    []string{"[general] is missing"},
+        },
+        {
+            name:    "disabled elsewhere",
+            content: "[general]\nport = 5039\nbindaddr = 127.0.0.1\n[reader]\nsecret = pass\nread = call,cdr\n",
+            want:    []string{"AMI is disabled", "port 5039", "only listens on 127.0.0.1"},
+        },
+        {
+            name:    "missing user",
+            content: general + "[monitor]\nsecret = pass\n",
+            want:    []string{"User reader is not defined"},
+        },
+        {
+            name:    "defined twice",
+            content: general + "[reader]\nsecret = pass\nread = call,cdr\n[reader]\nread = call,cdr\n",
+            want:    []string{"defined 2 times", "has no secret"},
+        },
+        {
+            name:    "permissions",
+            content: general + "[reader]\nsecret = pass\nread = call,calls\nwrite = originate\n",
+            want:    []string{"unknown permission class calls", "can't receive cdr events", "may write originate"},
+        },
+        {
+            name:    "template replaced read",
+            content: general + "[base](!)\nread = call,cdr\n[reader](base)\nsecret = pass\nread = call\n",
+            want:    []string{"can't receive cdr events"},
+        },
+        {
+            name:    "denied",
+            content: general + "[reader]\nsecret = pass\nread = call,cdr\npermit = 10.0.0.0/8\ndeny = !192.168.0.0/16\n",
+            want:    []string{"can't connect from 10.0.0.2, denied by deny=!192.168.0.0/16"},
+        },
+        {
+            name:    "invalid acl",
+            content: general + "[reader]\nsecret = pass\nread = call,cdr\npermit = 10.0.0.0/33\nacl = office\n",
+            want:    []string{"named ACLs of acl.conf (office)", `invalid permit "10.0.0.0/33"`},
+        },
+        {
+            name:    "unknown local address",
+            content: general + "[reader]\nsecret = pass\nread = call,cdr\ndeny = 0.0.0.0/0\n",
+            manager: &Manager{User: "reader", Classes: []string{"call"}},
+            want:    []string{"not checked as the address connecting from is unknown"},
+        },
+        {
+            name:    "event filters",
+            content: general + "[reader]\nsecret = pass\nread = call,cdr\neventfilter = Event: (Newchannel|Hangup|Cdr)\neventfilter = !Event: Hangup\neventfilter(action(regex),name(Event)) = x\neventfilter = (\n",
+            want: []string{"filters are not checked", `eventfilter "(" is not checked`,
+                "Newstate, DialBegin, DialEnd, BridgeEnter, Hangup events, dropped by eventfilter"},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dir := writeConfig(t, map[string]string{"manager.conf": test.content})
+            defer os.RemoveAll(dir)
+            config, err := Load(filepath.Join(dir, "manager.conf"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            checked := manager
+            if test.manager != nil {
+                checked = *test.manager
+            }
+            problems := CheckManager(config, checked)
+            if len(problems) != len(test.want) {
+                t.Fatalf("problems %q, want %q", problems, test.want)
+            }
+            for i, want := range test.want {
+                if !strings.Contains(problems[i], want) {
+                    t.Errorf("problem %q, want %q", problems[i], want)
+                }
+            }
+        })
+    }
+}
+
+func TestParseAcl(t *testing.T) {
+    tests := []struct {
+        value       string
+        want        string
+        wantNegated bool
+        wantErr     bool
+    }{
+        {value: "10.1.2.3", want: "10.1.2.3/32"},
+        {value: "10.1.2.3/8", want: "10.0.0.0/8"},
+        {value: "10.1.2.3/255.255.0.0", want: "10.1.0.0/16"},
+        {value: "!192.168.0.0/16", want: "192.168.0.0/16", wantNegated: true},
+        {value: "fd00::1/64", want: "fd00::/64"},
+        {value: "fd00::1/255.255.0.0", wantErr: true},
+        {value: "10.0.0.0/33", wantErr: true},
+        {value: "pbx.local", wantErr: true},
+    }
+    for _, test := range tests {
+        network, negated, err := parseAcl(test.value)
+        if (err != nil) != test.wantErr {
+            t.Errorf("parseAcl(%q) error = %v, want error %v", test.value, err, test.wantErr)
+            continue
+        }
+        if err == nil && (network.String() != test.want || negated != test.wantNegated) {
+            t.Errorf("parseAcl(%q) = %s, %v, want %s, %v", test.value, network, negated, test.want, test.wantNegated)
+        }
+    }
+}
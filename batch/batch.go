@@ -0,0 +1,93 @@
+package batch
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "github.com/pkg/errors"
+)
+
+// ContentType of batch messages. The content type of the packed events is in the manifest.
+const ContentType = "application/vnd.ami-reader.batch"
+
+// Entry locates one event in the data of a batch.
+type Entry struct {
+    Id     string `json:"id"`
+    Type   string `json:"type"`
+    Offset int    `json:"offset"`
+    Length int    `json:"length"`
+}
+
+// Manifest describes the events packed in a batch.
+type Manifest struct {
+    SchemaVersion string  `json:"schema_version"`
+    ContentType   string  `json:"content_type"`
+    Count         int     `json:"count"`
+    Events        []Entry `json:"events"`
+}
+
+// Builder packs serialized events into a batch body: the length of the manifest as uint32 big endian,
+// the manifest as JSON, then the events back to back. Entry offsets are relative to the end of the manifest.
+type Builder struct {
+    manifest Manifest
+    data     bytes.Buffer
+}
+
+func NewBuilder(schemaVersion string, contentType string) *Builder {
+    return &Builder{manifest: Manifest{SchemaVersion: schemaVersion, ContentType: contentType}}
+}
+
+func (builder *Builder) Add(id string, eventType string, event []byte) {
+    builder.manifest.Events = append(builder.manifest.Events, Entry{Id: id, Type: eventType, Offset: builder.data.Len(), Length: len(event)})
+    builder.manifest.Count++
+    builder.data.Write(event)
+}
+
+// Len returns the number of events in the batch.
+func (builder *Builder) Len() int {
+    return builder.manifest.Count
+}
+
+// Size returns the number of bytes of the packed events.
+func (builder *Builder) Size() int {
+    return builder.data.Len()
+}
+
+func (builder *Builder) Manifest() *Manifest {
+    return &builder.manifest
+}
+
+func (builder *Builder) Bytes() ([]byte, error) {
+    manifest, err := json.Marshal(&builder.manifest)
+    if err != nil {
+        return nil, err
+    }
+    body := make([]byte, 4, 4+len(manifest)+builder.data.Len())
+    binary.BigEndian.PutUint32(body, uint32(len(manifest)))
+    body = append(body, manifest...)
+    return append(body, builder.data.Bytes()...), nil
+}
+
+// Decode unpacks an uncompressed batch body into its manifest and the serialized events, in manifest order.
+func Decode(body []byte) (*Manifest, [][]byte, error) {
+    if len(body) < 4 {
+        return nil, nil, errors.New("Truncated batch")
+    }
+    manifestLen := int(binary.BigEndian.Uint32(body))
+    if manifestLen > len(body)-4 {
+        return nil, nil, errors.New("Truncated batch manifest")
+    }
+    manifest := &Manifest{}
+    if err := json.Unmarshal(body[4:4+manifestLen], manifest); err != nil {
+        return nil, nil, errors.Wrap(err, "Invalid batch manifest.")
+    }
+    data := body[4+manifestLen:]
+    events := make([][]byte, 0, len(manifest.Events))
+    for i, entry := range manifest.Events {
+        if entry.Offset < 0 || entry.Length < 0 || entry.Offset+entry.Length > len(data) {
+            return nil, nil, errors.Errorf("Event %d is out of the batch data", i)
+        }
+        events = append(events, data[entry.Offset:entry.Offset+entry.Length])
+    }
+    return manifest, events, nil
+}
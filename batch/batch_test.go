@@ -0,0 +1,65 @@
+package batch
+
+import (
+    "encoding/binary"
+    "reflect"
+    "testing"
+)
+
+func TestBuilderDecodeRoundTrip(t *testing.T) {
+    builder := NewBuilder("1.0", "application/json")
+    events := [][]byte{[]byte(`{"Event":"Newchannel"}`), []byte(`{"Event":"Hangup","Cause":"16"}`), []byte{}}
+    builder.Add("id-1", "Newchannel", events[0])
+    builder.Add("id-2", "Hangup", events[1])
+    builder.Add("id-3", "Empty", events[2])
+    if builder.Len() != 3 || builder.Size() != len(events[0])+len(events[1]) {
+        t.Fatalf("Len %d, Size %d", builder.Len(), builder.Size())
+    }
+    body, err := builder.Bytes()
+    if err != nil {
+        t.Fatal(err)
+    }
+    manifest, decoded, err := Decode(body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := &Manifest{SchemaVersion: "1.0", ContentType: "application/json", Count: 3, Events: []Entry{
+        {Id: "id-1", Type: "Newchannel", Offset: 0, Length: len(events[0])},
+        {Id: "id-2", Type: "Hangup", Offset: len(events[0]), Length: len(events[1])},
+        {Id: "id-3", Type: "Empty", Offset: len(events[0]) + len(events[1]), Length: 0},
+    }}
+    if !reflect.DeepEqual(manifest, want) || !reflect.DeepEqual(manifest, builder.Manifest()) {
+        t.Errorf("manifest = %+v, want %+v", manifest, want)
+    }
+    if !reflect.DeepEqual(decoded, events) {
+        t.Errorf("events = %q, want %q", decoded, events)
+    }
+}
+
+func TestDecodeFailsOnInvalidBody(t *testing.T) {
+    builder := NewBuilder("1.0", "application/json")
+    builder.Add("id-1", "Newchannel", []byte(`{"Event":"Newchannel"}`))
+    body, _ := builder.Bytes()
+    manifestLen := int(binary.BigEndian.Uint32(body))
+    longer := append([]byte{}, body...)
+    binary.BigEndian.PutUint32(longer, uint32(len(body)))
+    notJson := append([]byte{}, body...)
+    notJson[4] = '['
+    tests := []struct {
+        name string
+        body []byte
+    }{
+        {"empty", nil},
+        {"truncated length", body[:3]},
+        {"truncated manifest", longer},
+        {"invalid manifest", notJson},
+        {"truncated events", body[:4+manifestLen+5]},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if _, _, err := Decode(test.body); err == nil {
+                t.Fatal("Decode succeeded")
+            }
+        })
+    }
+}
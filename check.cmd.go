@@ -0,0 +1,89 @@
+package main
+
+import (
+	"ami-reader/conf"
+	"ami-reader/redact"
+	"ami-reader/service"
+	"fmt"
+	"github.com/spf13/pflag"
+	"net"
+	"os"
+	"strconv"
+)
+
+const checkUsage = `Usage: ami-reader check [flags]
+
+Validates the configuration, checks manager.conf when it can be read, logs in to AMI and connects to the
+sinks relying on a remote service, e.g. RabbitMQ. Nothing is published. Exits with 1 when a check fails.
+
+Flags:
+`
+
+func runCheck(args []string) int {
+	flags := pflag.NewFlagSet("check", pflag.ContinueOnError)
+	conf.RegisterFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, checkUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	appConfig, err := loadConfig(flags)
+	if err != nil {
+		fmt.Printf("FAIL configuration: %v\n", err)
+		return 1
+	}
+	defer appConfig.Scripts.Close()
+	// Errors may quote secrets, e.g. AMQP_URL
+	printf := func(format string, args ...interface{}) {
+		fmt.Print(redact.NewSecretsReplacer(conf.Secrets()).Replace(fmt.Sprintf(format, args...)))
+	}
+	source := conf.ConfigFile()
+	if source == "" {
+		source = "no config file"
+	}
+	printf("OK   configuration (%s)\n", source)
+	failed := false
+
+	problems, err := preflight(appConfig)
+	if err != nil {
+		printf("SKIP %s: %v\n", *appConfig.AmiConfPath, err)
+	} else if len(problems) == 0 {
+		printf("OK   %s\n", *appConfig.AmiConfPath)
+	}
+	for _, problem := range problems {
+		printf("WARN %s\n", problem)
+	}
+
+	dialString := net.JoinHostPort(*appConfig.AmiHost, strconv.Itoa(*appConfig.AmiPort))
+	client, err := service.DialAmi(appConfig.AmiConf)
+	if err == nil {
+		if err = client.Login(*appConfig.AmiUsername, *appConfig.AmiPassword, false); err == nil {
+			printf("OK   AMI %s (%s), logged in as %s\n", dialString, client.Banner(), *appConfig.AmiUsername)
+		} else {
+			err = fmt.Errorf("login as %s failed: %v", *appConfig.AmiUsername, err)
+		}
+		_ = client.Close()
+	}
+	if err != nil {
+		printf("FAIL AMI %s: %v\n", dialString, err)
+		failed = true
+	}
+
+	for _, check := range service.CheckSinks(appConfig) {
+		switch {
+		case check.Err != nil:
+			printf("FAIL sink %s: %v\n", check.Name, check.Err)
+			failed = true
+		case check.Checked:
+			printf("OK   sink %s, connected\n", check.Name)
+		default:
+			printf("OK   sink %s, nothing to connect to\n", check.Name)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
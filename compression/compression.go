@@ -0,0 +1,117 @@
+package compression
+
+import (
+    "bytes"
+    "compress/gzip"
+    "github.com/klauspost/compress/zstd"
+    "github.com/pkg/errors"
+    "io/ioutil"
+    "sort"
+)
+
+// Compressor compresses message bodies. Encoding is the AMQP content encoding of the compressed body.
+type Compressor interface {
+    Compress(data []byte) ([]byte, error)
+    Decompress(data []byte) ([]byte, error)
+    Encoding() string
+}
+
+var compressors = map[string]func() (Compressor, error){
+    "none": func() (Compressor, error) { return &noneCompressor{}, nil },
+    "gzip": func() (Compressor, error) { return &gzipCompressor{}, nil },
+    "zstd": newZstdCompressor,
+}
+
+func New(name string) (Compressor, error) {
+    factory, found := compressors[name]
+    if !found {
+        names := make([]string, 0, len(compressors))
+        for name := range compressors {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        return nil, errors.Errorf("Unknown compression %s. Available compressions: %v", name, names)
+    }
+    return factory()
+}
+
+// ForEncoding returns the compressor of a content encoding, for consumers unpacking what was published.
+func ForEncoding(encoding string) (Compressor, error) {
+    if encoding == "" {
+        return New("none")
+    }
+    return New(encoding)
+}
+
+type noneCompressor struct {
+}
+
+func (compressor *noneCompressor) Compress(data []byte) ([]byte, error) {
+    return data, nil
+}
+
+func (compressor *noneCompressor) Decompress(data []byte) ([]byte, error) {
+    return data, nil
+}
+
+func (compressor *noneCompressor) Encoding() string {
+    return ""
+}
+
+type gzipCompressor struct {
+}
+
+func (compressor *gzipCompressor) Compress(data []byte) ([]byte, error) {
+    var buf bytes.Buffer
+    writer := gzip.NewWriter(&buf)
+    if _, err := writer.Write(data); err != nil {
+        return nil, err
+    }
+    if err := writer.Close(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func (compressor *gzipCompressor) Decompress(data []byte) ([]byte, error) {
+    reader, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    defer reader.Close()
+    return ioutil.ReadAll(reader)
+}
+
+func (compressor *gzipCompressor) Encoding() string {
+    return "gzip"
+}
+
+// zstdCompressor shares one encoder and decoder, EncodeAll and DecodeAll are safe for concurrent use.
+type zstdCompressor struct {
+    encoder *zstd.Encoder
+    decoder *zstd.Decoder
+}
+
+func newZstdCompressor() (Compressor, error) {
+    encoder, err := zstd.NewWriter(nil)
+    if err != nil {
+        return nil, err
+    }
+    decoder, err := zstd.NewReader(nil)
+    if err != nil {
+        return nil, err
+    }
+    return &zstdCompressor{encoder: encoder, decoder: decoder}, nil
+}
+
+func (compressor *zstdCompressor) Compress(data []byte) ([]byte, error) {
+    return compressor.encoder.EncodeAll(data, nil), nil
+}
+
+func (compressor *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+    return compressor.decoder.DecodeAll(data, nil)
+}
+
+func (compressor *zstdCompressor) Encoding() string {
+    return "zstd"
+}
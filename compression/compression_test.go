@@ -0,0 +1,70 @@
+package compression
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+func TestCompressDecompress(t *testing.T) {
+    data := []byte(strings.Repeat(`{"Event":"Newchannel","Channel":"PJSIP/1001-00000001"}`, 100))
+    tests := []struct {
+        name     string
+        encoding string
+    }{
+        {"none", ""},
+        {"gzip", "gzip"},
+        {"zstd", "zstd"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            compressor, err := New(test.name)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if compressor.Encoding() != test.encoding {
+                t.Errorf("Encoding = %q, want %q", compressor.Encoding(), test.encoding)
+            }
+            compressed, err := compressor.Compress(data)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if test.encoding != "" && len(compressed) >= len(data) {
+                t.Errorf("compressed %d bytes to %d", len(data), len(compressed))
+            }
+            // Consumers pick the compressor by the content encoding of the message
+            decompressor, err := ForEncoding(compressor.Encoding())
+            if err != nil {
+                t.Fatal(err)
+            }
+            decompressed, err := decompressor.Decompress(compressed)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !bytes.Equal(decompressed, data) {
+                t.Errorf("decompressed %q", decompressed)
+            }
+        })
+    }
+}
+
+func TestDecompressFailsOnInvalidData(t *testing.T) {
+    for _, name := range []string{"gzip", "zstd"} {
+        compressor, err := New(name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err = compressor.Decompress([]byte("not compressed")); err == nil {
+            t.Errorf("%s decompressed data it didn't compress", name)
+        }
+    }
+}
+
+func TestNewFailsOnUnknownCompression(t *testing.T) {
+    if _, err := New("lz4"); err == nil || !strings.Contains(err.Error(), "[gzip none zstd]") {
+        t.Fatalf("err = %v, want the available compressions listed", err)
+    }
+    if _, err := ForEncoding("br"); err == nil {
+        t.Fatal("ForEncoding succeeded on an unknown encoding")
+    }
+}
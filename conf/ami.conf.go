@@ -0,0 +1,87 @@
+package conf
+
+import (
+    "ami-reader/astconf"
+    "ami-reader/redact"
+    log "github.com/sirupsen/logrus"
+    "time"
+)
+
+type AmiConf struct {
+    AmiUsername *string
+    AmiPassword *string
+    AmiHost     *string
+    AmiPort     *int
+    AmiConfPath *string
+    DialTimeout *time.Duration
+    ReadTimeout *time.Duration
+    DialRetry   *int
+    LogLevel    *log.Level
+    Redactor    *redact.Redactor
+}
+
+// NewAmiConf reads only the settings needed to talk to AMI, e.g. for tail and action. Settings of the app
+// such as HOST_DEVICE_ID are not required and neither SCRIPTS nor ENRICH tables are loaded.
+func NewAmiConf() (*AmiConf, error) {
+    values := &values{}
+    amiConfig := readAmiConf(values)
+    if err := values.err(); err != nil {
+        return nil, err
+    }
+    return amiConfig, nil
+}
+
+func readAmiConf(values *values) *AmiConf {
+    managerConfFile := values.str("AMI_CONF_PATH", "/etc/asterisk/manager.conf")
+    amiHost := values.str("AMI_HOST", "")
+    if amiHost == "" {
+        values.invalid("AMI_HOST", "is required")
+    }
+    amiPort := values.integer("AMI_PORT", 5038)
+    if amiPort < 1 || amiPort > 65535 {
+        values.invalid("AMI_PORT", "%d is not a port", amiPort)
+    }
+    dialTimeout := values.duration("DIAL_TIMEOUT", time.Duration(0)*time.Second)
+    readTimeout := values.duration("READ_TIMEOUT", time.Duration(10)*time.Second)
+    dialRetry := values.integer("DIAL_RETRY", 3)
+    if dialRetry < 1 {
+        values.invalid("DIAL_RETRY", "should be at least 1")
+    }
+    amiUser := values.str("AMI_USER", "admin")
+    amiPassword := values.secret("AMI_PASS", "")
+    if amiPassword == "" && !values.failed("AMI_PASS") {
+        managerConf, err := astconf.Load(managerConfFile)
+        if err != nil {
+            log.Errorf("Fail to read %v. Reason: %v", managerConfFile, err)
+            values.invalid("AMI_PASS", "not set and %s can't be read: %v", managerConfFile, err)
+        } else if user := managerConf.Section(amiUser); user == nil {
+            values.invalid("AMI_PASS", "not set and user %s is not defined in %s", amiUser, managerConfFile)
+        } else {
+            amiPassword, _ = user.Value("secret")
+            addSecret(amiPassword)
+        }
+    }
+    logLevel, err := log.ParseLevel(values.str("LOG_LEVEL", "info"))
+    if err != nil {
+        values.invalid("LOG_LEVEL", "%v", err)
+    }
+    var redactRules []redact.RuleConf
+    values.unmarshal("REDACT", &redactRules)
+    redactHmacKey := values.secret("REDACT_HMAC_KEY", "")
+    redactor, err := redact.New(redactRules, redactHmacKey)
+    if err != nil {
+        values.invalid("REDACT", "%v", err)
+    }
+    return &AmiConf{
+        AmiUsername: &amiUser,
+        AmiPassword: &amiPassword,
+        AmiHost:     &amiHost,
+        AmiPort:     &amiPort,
+        AmiConfPath: &managerConfFile,
+        DialTimeout: &dialTimeout,
+        ReadTimeout: &readTimeout,
+        DialRetry:   &dialRetry,
+        LogLevel:    &logLevel,
+        Redactor:    redactor,
+    }
+}
@@ -0,0 +1,30 @@
+package conf
+
+import (
+    "testing"
+)
+
+func TestNewAmiConfReadsOnlyAmiSettings(t *testing.T) {
+    // Neither HOST_DEVICE_ID nor loading SCRIPTS and ENRICH tables stop tail and action
+    setValues(t, map[string]interface{}{
+        "AMI_HOST": "127.0.0.1",
+        "AMI_PASS": "secret",
+        "SCRIPTS":  []string{"missing.lua"},
+        "ENRICH":   []map[string]interface{}{{"table": "missing.csv", "fields": []string{"CallerIDNum"}}},
+    })
+    defer setValues(t, nil)
+    amiConfig, err := NewAmiConf()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if *amiConfig.AmiHost != "127.0.0.1" || *amiConfig.AmiPort != 5038 || *amiConfig.AmiUsername != "admin" {
+        t.Errorf("read %s:%d as %s", *amiConfig.AmiHost, *amiConfig.AmiPort, *amiConfig.AmiUsername)
+    }
+    if _, err = NewAppConf(); err == nil {
+        t.Fatal("NewAppConf succeeded without HOST_DEVICE_ID and with missing scripts")
+    }
+    setValues(t, map[string]interface{}{"AMI_PASS": "secret", "AMI_PORT": 0})
+    if _, err = NewAmiConf(); err == nil {
+        t.Fatal("NewAmiConf succeeded without AMI_HOST and with an invalid AMI_PORT")
+    }
+}
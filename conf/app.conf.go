@@ -1,130 +1,121 @@
 package conf
 
 import (
-    "errors"
-    log "github.com/sirupsen/logrus"
+    "ami-reader/astconf"
+    "ami-reader/enrich"
+    "ami-reader/filter"
+    "ami-reader/sampling"
+    "ami-reader/script"
+    "ami-reader/transform"
     "github.com/spf13/viper"
-    "gopkg.in/ini.v1"
-    "strconv"
     "time"
 )
 
 type AppConf struct {
-    AmiUsername        *string
-    AmiPassword        *string
-    AmiHost            *string
-    AmiPort            *int
+    // Settings needed to talk to AMI, all tail and action read
+    *AmiConf
+    // Event classes the AMI user is expected to read, checked against AmiConfPath
+    AmiEventClasses    *[]string
     HostDeviceId       *string
-    DialTimeout        *time.Duration
-    ReadTimeout        *time.Duration
-    DialRetry          *int
     NumberOfWorkers    *int
     NumberOfJobs       *int
     LogEvents          *bool
-    AmqpUrl            *string
-    AmqpXchName        *string
-    AmqpXchType        *string
-    AmqpExcludedEvents *[]string
+    EventFilter        *filter.Filter
+    Sampler            *sampling.Sampler
+    Scripts            *script.Runner
+    Enricher           *enrich.Enricher
+    Transform          *transform.Pipeline
+    Sinks              *[]string
+    OrderingKeys       *[]string
+    MetricsAddr        *string
+    SequenceFile       *string
+    ClockSkewWarn      *time.Duration
 }
 
+// NewAppConf reads the settings of the app. Any of them can be read from a file instead, named by the
+// setting with _FILE appended (e.g. AMI_PASS_FILE), and can reference secrets of the store, see Load.
 func NewAppConf() (*AppConf, error) {
-    managerConfFile := getStringEnv("AMI_CONF_PATH", "/etc/asterisk/manager.conf")
-    amiHost := getStringEnv("AMI_HOST", "")
-    if amiHost == "" {
-        return nil, errors.New("AMI_HOST environment variable not found")
+    values := &values{}
+    amiConfig := readAmiConf(values)
+    numberOfWorkers := values.integer("NUMBER_OF_WORKERS", 50)
+    if numberOfWorkers < 1 {
+        values.invalid("NUMBER_OF_WORKERS", "should be at least 1")
     }
-    amiPort := getIntEnv("AMI_PORT", 5038)
-    dialTimeout := getDurationEnv("DIAL_TIMEOUT", time.Duration(0)*time.Second)
-    readTimeout := getDurationEnv("READ_TIMEOUT", time.Duration(10)*time.Second)
-    dialRetry := getIntEnv("DIAL_RETRY", 3)
-    numberOfWorkers := getIntEnv("NUMBER_OF_WORKERS", 50)
-    numberOfJobs := getIntEnv("NUMBER_OF_JOBS", 60)
-    if numberOfJobs < numberOfWorkers {
-        return nil, errors.New("NUMBER_OF_WORKERS should be more than or equal to NUMBER_OF_JOBS")
+    numberOfJobs := values.integer("NUMBER_OF_JOBS", 60)
+    if numberOfJobs < numberOfWorkers && !values.failed("NUMBER_OF_WORKERS") && !values.failed("NUMBER_OF_JOBS") {
+        values.invalid("NUMBER_OF_JOBS", "should be more than or equal to NUMBER_OF_WORKERS")
     }
-    amiUser := getStringEnv("AMI_USER", "admin")
-    amiPassword := getStringEnv("AMI_PASS", "")
-    if amiPassword == "" {
-        cfg, err := ini.Load(managerConfFile)
-        if err != nil {
-            log.Errorf("Fail to read %v. Reason: %v", managerConfFile, err)
-            return nil, err
+    amiEventClasses := values.stringSlice("AMI_EVENT_CLASSES", []string{"call", "cdr", "agent", "dialplan"})
+    for _, class := range amiEventClasses {
+        if _, found := astconf.ClassEvents[class]; !found {
+            values.invalid("AMI_EVENT_CLASSES", "unknown event class %s", class)
         }
-        amiPassword = cfg.Section(amiUser).Key("secret").String()
     }
 
-    hostDeviceId := getStringEnv("HOST_DEVICE_ID", "")
+    hostDeviceId := values.str("HOST_DEVICE_ID", "")
     if hostDeviceId == "" {
-        return nil, errors.New("HOST_DEVICE_ID environment variable not found")
+        values.invalid("HOST_DEVICE_ID", "is required")
     }
-    logEvents := getBoolEnv("LOG_EVENTS")
-    amqpUrl := getStringEnv("AMQP_URL", "")
-    if amqpUrl == "" {
-        return nil, errors.New("AMQP_URL environment variable not found")
+    logEvents := values.boolean("LOG_EVENTS")
+    // Auth related events are excluded unless EVENT_FILTER says otherwise
+    filterConf := filter.Conf{Exclude: &filter.RuleConf{Event: []string{"SuccessfulAuth", "ChallengeSent", "QueueMemberStatus"}}}
+    if viper.IsSet("EVENT_FILTER") {
+        filterConf = filter.Conf{}
+        values.unmarshal("EVENT_FILTER", &filterConf)
+    }
+    eventFilter, err := filter.New(filterConf)
+    if err != nil {
+        values.invalid("EVENT_FILTER", "%v", err)
+    }
+    var samplingRules []sampling.RuleConf
+    values.unmarshal("SAMPLING", &samplingRules)
+    sampler, err := sampling.New(samplingRules)
+    if err != nil {
+        values.invalid("SAMPLING", "%v", err)
+    }
+    scriptFiles := values.stringSlice("SCRIPTS", nil)
+    scriptTimeout := values.durationOrMillis("SCRIPT_TIMEOUT", "SCRIPT_TIMEOUT_MS", 50*time.Millisecond)
+    scripts, err := script.New(scriptFiles, scriptTimeout)
+    if err != nil {
+        values.invalid("SCRIPTS", "%v", err)
+    }
+    var lookupConfs []enrich.LookupConf
+    values.unmarshal("ENRICH", &lookupConfs)
+    enricher, err := enrich.New(lookupConfs)
+    if err != nil {
+        values.invalid("ENRICH", "%v", err)
+    }
+    var transformSteps []transform.StepConf
+    values.unmarshal("TRANSFORM", &transformSteps)
+    pipeline, err := transform.New(transformSteps)
+    if err != nil {
+        values.invalid("TRANSFORM", "%v", err)
+    }
+    sinks := values.stringSlice("SINKS", []string{"rabbitmq"})
+    orderingKeys := values.stringSlice("ORDERING_KEY", []string{"Linkedid", "Uniqueid"})
+    metricsAddr := values.str("METRICS_ADDR", "")
+    sequenceFile := values.str("SEQUENCE_FILE", "sequence.state")
+    clockSkewWarn := values.durationOrMillis("CLOCK_SKEW_WARN", "CLOCK_SKEW_WARN_MS", time.Second)
+    if err = values.err(); err != nil {
+        scripts.Close()
+        return nil, err
     }
-    amqpXchName := getStringEnv("AMQP_EXCHANGE_NAME", "amq.direct")
-    amqpXchType := getStringEnv("AMQP_EXCHANGE_TYPE", "direct")
-    // TODO: make amqpExcludedEvents configurable in config.json
-    // For now, exclude Auth related events
-    amqpExcludedEvents := make([]string, 3)
-    amqpExcludedEvents[0] = "SuccessfulAuth"
-    amqpExcludedEvents[1] = "ChallengeSent"
-    amqpExcludedEvents[2] = "QueueMemberStatus"
     return &AppConf{
-        &amiUser,
-        &amiPassword,
-        &amiHost,
-        &amiPort,
+        amiConfig,
+        &amiEventClasses,
         &hostDeviceId,
-        &dialTimeout,
-        &readTimeout,
-        &dialRetry,
         &numberOfWorkers,
         &numberOfJobs,
         &logEvents,
-        &amqpUrl,
-        &amqpXchName,
-        &amqpXchType,
-        &amqpExcludedEvents,
+        eventFilter,
+        sampler,
+        scripts,
+        enricher,
+        pipeline,
+        &sinks,
+        &orderingKeys,
+        &metricsAddr,
+        &sequenceFile,
+        &clockSkewWarn,
     }, nil
 }
-
-func getStringEnv(name string, defaultVal string) string {
-    // viper is already initialized in main
-    result := viper.GetString(name)
-    if result == "" {
-        result = defaultVal
-    }
-
-    return result
-}
-
-func getDurationEnv(envKey string, defaultDuration time.Duration) time.Duration {
-    dialTimeout := getStringEnv(envKey, "0")
-    timeout, err := strconv.Atoi(dialTimeout)
-    if err == nil {
-        return time.Duration(timeout) * time.Second
-    } else {
-        return defaultDuration
-    }
-}
-
-func getIntEnv(envKey string, defaultVal int) int {
-    str := getStringEnv(envKey, strconv.Itoa(defaultVal))
-    i, err := strconv.Atoi(str)
-    if err == nil {
-        return i
-    } else {
-        return defaultVal
-    }
-}
-
-func getBoolEnv(envKey string) bool {
-    str := getStringEnv(envKey, "false")
-    b, err := strconv.ParseBool(str)
-    if err == nil {
-        return b
-    } else {
-        return false
-    }
-}
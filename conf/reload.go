@@ -0,0 +1,205 @@
+package conf
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/fsnotify/fsnotify"
+    log "github.com/sirupsen/logrus"
+    "github.com/spf13/viper"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "sort"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// The config file is read again once it has not changed for that long, so a file being written is not read half way
+const reloadDelay = 500 * time.Millisecond
+
+// Scope tells what it takes for a changed setting to apply.
+type Scope int
+
+const (
+    // ScopeLive settings apply to the next event read
+    ScopeLive Scope = iota
+    // ScopeSinks settings apply once the sinks are created again
+    ScopeSinks
+    // ScopeReconnect settings apply once connected to AMI again
+    ScopeReconnect
+    // ScopeRestart settings only apply after a restart
+    ScopeRestart
+)
+
+var liveSettings = []string{"EVENT_FILTER", "SAMPLING", "REDACT", "REDACT_HMAC_KEY", "SCRIPTS", "SCRIPT_TIMEOUT",
+    "SCRIPT_TIMEOUT_MS", "LOG_LEVEL", "HOST_DEVICE_ID", "READ_TIMEOUT", "CLOCK_SKEW_WARN", "CLOCK_SKEW_WARN_MS"}
+var reconnectSettings = []string{"AMI_HOST", "AMI_PORT", "AMI_USER", "AMI_PASS", "AMI_CONF_PATH", "DIAL_TIMEOUT", "DIAL_RETRY"}
+var restartSettings = []string{"SEQUENCE_FILE", "METRICS_ADDR", "AMI_EVENT_CLASSES", "SECRETS_FILE", "SECRETS_KEY_FILE", "SECRETS_DIR"}
+
+// ScopeOf returns the scope of a setting. Settings not known at the top level belong to sinks, e.g. AMQP_URL
+// or the RABBITMQ section. A setting read from a file, e.g. AMI_PASS_FILE, has the scope of the setting.
+func ScopeOf(key string) Scope {
+    key = strings.ToUpper(key)
+    if scope, found := scopeOf(key); found {
+        return scope
+    }
+    if scope, found := scopeOf(strings.TrimSuffix(key, "_FILE")); found {
+        return scope
+    }
+    return ScopeSinks
+}
+
+func scopeOf(key string) (Scope, bool) {
+    for _, scope := range []struct {
+        scope    Scope
+        settings []string
+    }{{ScopeLive, liveSettings}, {ScopeReconnect, reconnectSettings}, {ScopeRestart, restartSettings}} {
+        for _, setting := range scope.settings {
+            if key == setting || strings.HasPrefix(key, setting+".") {
+                return scope.scope, true
+            }
+        }
+    }
+    return ScopeSinks, false
+}
+
+// Change is a setting whose value changed. Values of secrets are hidden.
+type Change struct {
+    Key string
+    Old string
+    New string
+}
+
+func (change Change) String() string {
+    return fmt.Sprintf("%s: %s -> %s", change.Key, change.Old, change.New)
+}
+
+// Snapshot returns the value of every setting known from the config file and the flags, by upper case key.
+// Nested sections are flattened, e.g. RABBITMQ.AMQP_URL. Settings only set in env are left out, env does not
+// change while running.
+func Snapshot() map[string]string {
+    snapshot := make(map[string]string)
+    for _, key := range viper.AllKeys() {
+        value := viper.Get(key)
+        str, ok := value.(string)
+        if !ok {
+            encoded, _ := json.Marshal(value)
+            str = string(encoded)
+        }
+        snapshot[strings.ToUpper(key)] = str
+    }
+    return snapshot
+}
+
+// Diff lists the settings added, removed or changed between two snapshots, by key.
+func Diff(before map[string]string, after map[string]string) []Change {
+    var changes []Change
+    for key, old := range before {
+        if value, found := after[key]; !found || value != old {
+            changes = append(changes, Change{Key: key, Old: display(key, old, true), New: display(key, value, found)})
+        }
+    }
+    for key, value := range after {
+        if _, found := before[key]; !found {
+            changes = append(changes, Change{Key: key, Old: display(key, "", false), New: display(key, value, true)})
+        }
+    }
+    sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+    return changes
+}
+
+// display shows a value in a diff, hiding passwords, keys and URLs, which may hold credentials.
+func display(key string, value string, found bool) string {
+    if !found {
+        return "(not set)"
+    }
+    for _, secret := range []string{"PASS", "SECRET", "HMAC_KEY", "_URL"} {
+        if strings.Contains(key, secret) {
+            return "******"
+        }
+    }
+    return fmt.Sprintf("%q", value)
+}
+
+// Reread reads the config file again, if settings come from one.
+func Reread() error {
+    if viper.ConfigFileUsed() == "" {
+        return nil
+    }
+    if err := viper.ReadInConfig(); err != nil {
+        return errors.New("Failed to read config file " + viper.ConfigFileUsed() + ". Reason: " + err.Error())
+    }
+    return nil
+}
+
+// Watcher calls back when the config file changes or the process gets SIGHUP.
+type Watcher struct {
+    watcher *fsnotify.Watcher
+    signals chan os.Signal
+    stop    chan struct{}
+    done    chan struct{}
+}
+
+// Watch calls reload, one call at a time, whenever settings may have changed. The config file is not read
+// again before, see Reread.
+func Watch(reload func()) (*Watcher, error) {
+    watcher := &Watcher{signals: make(chan os.Signal, 1), stop: make(chan struct{}), done: make(chan struct{})}
+    if configFile := viper.ConfigFileUsed(); configFile != "" {
+        fileWatcher, err := fsnotify.NewWatcher()
+        if err != nil {
+            return nil, errors.New("Failed to watch config file. Reason: " + err.Error())
+        }
+        // The directory is watched as editors often replace the file
+        if err = fileWatcher.Add(filepath.Dir(configFile)); err != nil {
+            _ = fileWatcher.Close()
+            return nil, errors.New("Failed to watch config file. Reason: " + err.Error())
+        }
+        watcher.watcher = fileWatcher
+    }
+    signal.Notify(watcher.signals, syscall.SIGHUP)
+    go watcher.watch(reload)
+    return watcher, nil
+}
+
+func (watcher *Watcher) watch(reload func()) {
+    defer close(watcher.done)
+    var events <-chan fsnotify.Event
+    var errs <-chan error
+    configFile := ""
+    if watcher.watcher != nil {
+        events, errs = watcher.watcher.Events, watcher.watcher.Errors
+        configFile, _ = filepath.Abs(viper.ConfigFileUsed())
+    }
+    var changed <-chan time.Time
+    for {
+        select {
+        case <-watcher.stop:
+            return
+        case <-watcher.signals:
+            log.Info("Received SIGHUP, reloading configuration.")
+            reload()
+        case event := <-events:
+            name, _ := filepath.Abs(event.Name)
+            if name == configFile && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+                changed = time.After(reloadDelay)
+            }
+        case err := <-errs:
+            log.Errorf("Failed to watch config file. Reason: %v", err)
+        case <-changed:
+            changed = nil
+            log.Infof("Config file %s changed, reloading configuration.", viper.ConfigFileUsed())
+            reload()
+        }
+    }
+}
+
+func (watcher *Watcher) Close() {
+    signal.Stop(watcher.signals)
+    close(watcher.stop)
+    <-watcher.done
+    if watcher.watcher != nil {
+        _ = watcher.watcher.Close()
+    }
+}
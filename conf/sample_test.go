@@ -0,0 +1,53 @@
+package conf
+
+import (
+    "github.com/spf13/pflag"
+    "github.com/spf13/viper"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// TestSampleConfigLoads loads config.json.sample as it is meant to be used, copied to config.json.
+func TestSampleConfigLoads(t *testing.T) {
+    sample, err := ioutil.ReadFile(filepath.Join("..", "config.json.sample"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    dir, _ := ioutil.TempDir("", "conf")
+    defer os.RemoveAll(dir)
+    configFile := filepath.Join(dir, "config.json")
+    if err = ioutil.WriteFile(configFile, sample, 0600); err != nil {
+        t.Fatal(err)
+    }
+    viper.Reset()
+    defer viper.Reset()
+    // Read from AMI_CONF_PATH otherwise, which is not there
+    os.Setenv("AMI_PASS", "secret")
+    defer os.Unsetenv("AMI_PASS")
+    flags := pflag.NewFlagSet("run", pflag.ContinueOnError)
+    RegisterFlags(flags)
+    if err = flags.Parse([]string{"--config", configFile}); err != nil {
+        t.Fatal(err)
+    }
+    if err = Load(flags); err != nil {
+        t.Fatal(err)
+    }
+    appConfig, err := NewAppConf()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer appConfig.Scripts.Close()
+    if *appConfig.AmiHost != "x.x.x.x" || *appConfig.ClockSkewWarn != time.Second || appConfig.Transform.Empty() {
+        t.Errorf("read AMI_HOST %s, CLOCK_SKEW_WARN %v and TRANSFORM empty %v", *appConfig.AmiHost, *appConfig.ClockSkewWarn, appConfig.Transform.Empty())
+    }
+    sinkConfig := NewSinkConf("rabbitmq")
+    if linger := sinkConfig.GetDuration("AMQP_BATCH_LINGER", 0); linger != 200*time.Millisecond {
+        t.Errorf("read AMQP_BATCH_LINGER %v of the RABBITMQ section", linger)
+    }
+    if err = sinkConfig.Err(); err != nil {
+        t.Fatal(err)
+    }
+}
@@ -0,0 +1,60 @@
+package conf
+
+import (
+    "ami-reader/secrets"
+    "net/url"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// store resolves ${secret:name} references in settings, see loadSecrets
+var store *secrets.Store
+
+// known are the secret values read so far, masked in every log line (see Secrets)
+var known = struct {
+    mutex  sync.RWMutex
+    values map[string]bool
+}{values: make(map[string]bool)}
+
+// loadSecrets opens the secret store of SECRETS_FILE, SECRETS_KEY_FILE and SECRETS_DIR.
+func loadSecrets() error {
+    values := &values{}
+    var err error
+    store, err = secrets.Open(values.str("SECRETS_FILE", ""), values.str("SECRETS_KEY_FILE", ""), values.str("SECRETS_DIR", ""))
+    return err
+}
+
+// SecretsKeyFile returns SECRETS_KEY_FILE, read from the sources LoadSources set up.
+func SecretsKeyFile() string {
+    values := &values{}
+    return values.str("SECRETS_KEY_FILE", "")
+}
+
+// addSecret marks a value as secret. The password of a URL, e.g. AMQP_URL, is a secret of its own as the URL
+// may be logged in parts.
+func addSecret(value string) {
+    if strings.TrimSpace(value) == "" {
+        return
+    }
+    known.mutex.Lock()
+    defer known.mutex.Unlock()
+    known.values[value] = true
+    if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+        if password, found := parsed.User.Password(); found && password != "" {
+            known.values[password] = true
+        }
+    }
+}
+
+// Secrets returns every secret value read so far, longest first so a secret holding another is masked whole.
+func Secrets() []string {
+    known.mutex.RLock()
+    defer known.mutex.RUnlock()
+    var values []string
+    for value := range known.values {
+        values = append(values, value)
+    }
+    sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+    return values
+}
@@ -0,0 +1,52 @@
+package conf
+
+import (
+    "github.com/spf13/pflag"
+    "github.com/spf13/viper"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestSecretsKeyFile(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "conf")
+    defer os.RemoveAll(dir)
+    configFile := filepath.Join(dir, "config.json")
+    if err := ioutil.WriteFile(configFile, []byte(`{"SECRETS_KEY_FILE": "/etc/ami-reader/secrets.key"}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name   string
+        env    string
+        config string
+        want   string
+    }{
+        {"unset", "", "", ""},
+        {"env", "/run/secrets.key", "", "/run/secrets.key"},
+        {"config file", "", configFile, "/etc/ami-reader/secrets.key"},
+        {"env over config file", "/run/secrets.key", configFile, "/run/secrets.key"},
+    }
+    defer viper.Reset()
+    defer os.Unsetenv("SECRETS_KEY_FILE")
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            viper.Reset()
+            os.Unsetenv("SECRETS_KEY_FILE")
+            if test.env != "" {
+                os.Setenv("SECRETS_KEY_FILE", test.env)
+            }
+            flags := pflag.NewFlagSet("secrets", pflag.ContinueOnError)
+            flags.String("config", "", "")
+            if err := flags.Parse([]string{"--config=" + test.config}); err != nil {
+                t.Fatal(err)
+            }
+            if err := LoadSources(flags); err != nil {
+                t.Fatal(err)
+            }
+            if got := SecretsKeyFile(); got != test.want {
+                t.Fatalf("SecretsKeyFile() = %q, want %q", got, test.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,82 @@
+package conf
+
+import (
+    "github.com/spf13/viper"
+    "strings"
+    "time"
+)
+
+// SinkConf resolves settings of a single sink. A key is looked up in the sink's own
+// section first (e.g. "RABBITMQ": {"AMQP_URL": ...} in config.json or RABBITMQ_AMQP_URL
+// in env) and falls back to the top level key so older configs keep working.
+// Values can be read from files and reference secrets as top level ones can, see AppConf.
+// Invalid values are collected, see Err.
+type SinkConf struct {
+    Name   string
+    values values
+}
+
+func NewSinkConf(name string) *SinkConf {
+    return &SinkConf{Name: name}
+}
+
+func (sinkConf *SinkConf) sectionKey(key string) string {
+    return strings.ToUpper(sinkConf.Name) + "." + key
+}
+
+func (sinkConf *SinkConf) key(key string) string {
+    sinkKey := sinkConf.sectionKey(key)
+    if viper.IsSet(sinkKey) || viper.IsSet(sinkKey+"_FILE") {
+        return sinkKey
+    }
+    return key
+}
+
+func (sinkConf *SinkConf) GetString(key string, defaultVal string) string {
+    return sinkConf.values.str(sinkConf.key(key), defaultVal)
+}
+
+// GetSecret reads a value that must never show up in logs, e.g. a URL with credentials.
+func (sinkConf *SinkConf) GetSecret(key string, defaultVal string) string {
+    return sinkConf.values.secret(sinkConf.key(key), defaultVal)
+}
+
+func (sinkConf *SinkConf) GetInt(key string, defaultVal int) int {
+    return sinkConf.values.integer(sinkConf.key(key), defaultVal)
+}
+
+func (sinkConf *SinkConf) GetBool(key string) bool {
+    return sinkConf.values.boolean(sinkConf.key(key))
+}
+
+func (sinkConf *SinkConf) GetStringSlice(key string, defaultVal []string) []string {
+    return sinkConf.values.stringSlice(sinkConf.key(key), defaultVal)
+}
+
+// GetDuration accepts Go durations, e.g. 10s or 500ms, or a number of seconds.
+func (sinkConf *SinkConf) GetDuration(key string, defaultVal time.Duration) time.Duration {
+    return sinkConf.values.duration(sinkConf.key(key), defaultVal)
+}
+
+// GetDurationOrMillis reads a duration, or else the whole milliseconds of millisKey, the deprecated setting
+// it replaces, e.g. AMQP_BATCH_LINGER_MS for AMQP_BATCH_LINGER. Either of them set in the sink's section wins
+// over both top level ones.
+func (sinkConf *SinkConf) GetDurationOrMillis(key string, millisKey string, defaultVal time.Duration) time.Duration {
+    sectionKey, sectionMillisKey := sinkConf.sectionKey(key), sinkConf.sectionKey(millisKey)
+    if sinkConf.key(key) == sectionKey || sinkConf.key(millisKey) == sectionMillisKey {
+        return sinkConf.values.durationOrMillis(sectionKey, sectionMillisKey, defaultVal)
+    }
+    return sinkConf.values.durationOrMillis(key, millisKey, defaultVal)
+}
+
+// Unmarshal decodes a structured setting, e.g. a list of objects. The value can be given as nested values
+// in a config file or as a JSON string, which is how it has to be set in env. Decoding errors are also
+// reported by Err.
+func (sinkConf *SinkConf) Unmarshal(key string, rawVal interface{}) error {
+    return sinkConf.values.unmarshal(sinkConf.key(key), rawVal)
+}
+
+// Err lists every invalid value read so far, nil when there is none.
+func (sinkConf *SinkConf) Err() error {
+    return sinkConf.values.err()
+}
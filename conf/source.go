@@ -0,0 +1,123 @@
+package conf
+
+import (
+    "errors"
+    "github.com/spf13/pflag"
+    "github.com/spf13/viper"
+    "os"
+    "strings"
+)
+
+// configName is the name of the config file looked for in the working directory, with one of configExts
+const configName = "config"
+
+var configExts = []string{"json", "yaml", "yml", "toml"}
+
+// flagSettings are the settings that can also be given as command line flags, e.g. --ami-host for AMI_HOST.
+// Secrets are left out, command lines are visible to every user of the host.
+var flagSettings = []struct {
+    key   string
+    usage string
+}{
+    {"AMI_HOST", "AMI or asterisk host"},
+    {"AMI_PORT", "AMI port"},
+    {"AMI_USER", "AMI user"},
+    {"AMI_CONF_PATH", "Asterisk manager conf, read for the secret of AMI_USER when AMI_PASS is not set"},
+    {"AMI_EVENT_CLASSES", "Comma separated AMI event classes AMI_USER should read, checked against AMI_CONF_PATH"},
+    {"HOST_DEVICE_ID", "Host device id"},
+    {"DIAL_TIMEOUT", "Timeout connecting to AMI, e.g. 10s"},
+    {"READ_TIMEOUT", "Timeout of a read from AMI, e.g. 5s"},
+    {"DIAL_RETRY", "Attempts to connect to AMI"},
+    {"NUMBER_OF_WORKERS", "Workers of each sink"},
+    {"NUMBER_OF_JOBS", "Events queued for the workers of each sink"},
+    {"LOG_EVENTS", "Log every event to YYYY-MM-DD_events.log"},
+    {"LOG_LEVEL", "Level of the app log: debug, info, warning or error"},
+    {"SINKS", "Comma separated list of sinks"},
+    {"ORDERING_KEY", "Comma separated event fields keeping events in order"},
+    {"SCRIPTS", "Comma separated list of Lua scripts"},
+    {"SCRIPT_TIMEOUT", "Time a script may spend on an event, e.g. 50ms"},
+    {"SEQUENCE_FILE", "File keeping the last host sequence number"},
+    {"CLOCK_SKEW_WARN", "Warn when PBX and reader clocks are further apart, e.g. 1s"},
+    {"METRICS_ADDR", "Address where counters are served on /debug/vars"},
+}
+
+// FlagName returns the command line flag of a setting, e.g. ami-host for AMI_HOST.
+func FlagName(key string) string {
+    return strings.ToLower(strings.Replace(key, "_", "-", -1))
+}
+
+// RegisterFlags adds a flag for each of flagSettings, along with --config. Flags take values the same way
+// as env, e.g. --dial-timeout=10s.
+func RegisterFlags(flags *pflag.FlagSet) {
+    flags.String("config", "", "Config file (.json, .yaml, .yml or .toml). Defaults to config.<ext> in the working directory when it exists")
+    for _, setting := range flagSettings {
+        // A command may have its own flag of that name, e.g. replay --sinks
+        if flags.Lookup(FlagName(setting.key)) != nil {
+            continue
+        }
+        flags.String(FlagName(setting.key), "", setting.usage)
+        if setting.key == "LOG_EVENTS" {
+            flags.Lookup(FlagName(setting.key)).NoOptDefVal = "true"
+        }
+    }
+}
+
+// Load sets up where settings are read from. A setting is taken from the command line flags, else from env,
+// else from the config file, else it keeps its default. flags may be nil. The secret store settings may
+// reference is then opened: the encrypted SECRETS_FILE, unlocked by SECRETS_KEY_FILE, and SECRETS_DIR.
+func Load(flags *pflag.FlagSet) error {
+    if err := LoadSources(flags); err != nil {
+        return err
+    }
+    if err := loadSecrets(); err != nil {
+        return errors.New("Failed to open secrets. Reason: " + err.Error())
+    }
+    return nil
+}
+
+// LoadSources sets up where settings are read from as Load does, without opening the secret store, e.g. for
+// the secrets command that makes SECRETS_FILE.
+func LoadSources(flags *pflag.FlagSet) error {
+    viper.AutomaticEnv() // Read from system's environment variable
+    // Sink sections are nested in config files (e.g. RABBITMQ.AMQP_URL) and flat in env (RABBITMQ_AMQP_URL)
+    viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+    configFile := ""
+    if flags != nil {
+        for _, setting := range flagSettings {
+            if flag := flags.Lookup(FlagName(setting.key)); flag != nil {
+                if err := viper.BindPFlag(setting.key, flag); err != nil {
+                    return err
+                }
+            }
+        }
+        if flag := flags.Lookup("config"); flag != nil {
+            configFile = flag.Value.String()
+        }
+    }
+    if configFile == "" {
+        configFile = findConfigFile()
+    }
+    if configFile != "" {
+        viper.SetConfigFile(configFile)
+        if err := viper.ReadInConfig(); err != nil {
+            return errors.New("Failed to read config file " + configFile + ". Reason: " + err.Error())
+        }
+    }
+    return nil
+}
+
+// findConfigFile returns the config file of the working directory, if any.
+func findConfigFile() string {
+    for _, ext := range configExts {
+        file := configName + "." + ext
+        if _, err := os.Stat(file); err == nil {
+            return file
+        }
+    }
+    return ""
+}
+
+// ConfigFile returns the config file settings were read from, empty when there is none.
+func ConfigFile() string {
+    return viper.ConfigFileUsed()
+}
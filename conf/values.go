@@ -0,0 +1,195 @@
+package conf
+
+import (
+    "encoding/json"
+    "fmt"
+    log "github.com/sirupsen/logrus"
+    "github.com/spf13/viper"
+    "io/ioutil"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Error lists every invalid setting found, so they can all be fixed at once.
+type Error struct {
+    Problems []string
+}
+
+func (err *Error) Error() string {
+    return "Invalid configuration:\n  " + strings.Join(err.Problems, "\n  ")
+}
+
+// values reads typed settings. A value that can't be read as its type is reported instead of falling back
+// to the default, only missing and empty values take the default.
+type values struct {
+    problems []string
+}
+
+func (values *values) invalid(key string, format string, args ...interface{}) {
+    values.problems = append(values.problems, key+": "+fmt.Sprintf(format, args...))
+}
+
+// failed tells whether a value of key was found invalid, checks against it would only add noise.
+func (values *values) failed(key string) bool {
+    for _, problem := range values.problems {
+        if strings.HasPrefix(problem, key+": ") {
+            return true
+        }
+    }
+    return false
+}
+
+func (values *values) err() error {
+    if len(values.problems) == 0 {
+        return nil
+    }
+    return &Error{Problems: values.problems}
+}
+
+// raw returns the value of a key as a string, whatever type the file it comes from gave it. The value can
+// instead be read from the file named by <key>_FILE, e.g. a Docker or Kubernetes secret, and may reference
+// secrets of the store, e.g. amqp://reader:${secret:rabbitmq_pass}@broker. Secrets read either way are
+// masked in logs.
+func (values *values) raw(key string) (string, bool) {
+    str := ""
+    if value := viper.Get(key); value != nil {
+        str = strings.TrimSpace(fmt.Sprint(value))
+    }
+    if file := strings.TrimSpace(viper.GetString(key + "_FILE")); file != "" {
+        if str != "" {
+            values.invalid(key, "is set along with %s_FILE, only one of them should be", key)
+            return "", false
+        }
+        content, err := ioutil.ReadFile(file)
+        if err != nil {
+            values.invalid(key, "can't read %s_FILE: %v", key, err)
+            return "", false
+        }
+        str = strings.TrimSpace(string(content))
+        addSecret(str)
+    }
+    str, err := store.Resolve(str, addSecret)
+    if err != nil {
+        values.invalid(key, "%v", err)
+        return "", false
+    }
+    return str, str != ""
+}
+
+func (values *values) str(key string, defaultVal string) string {
+    if str, found := values.raw(key); found {
+        return str
+    }
+    return defaultVal
+}
+
+// secret reads a value that must never show up in logs, e.g. a password.
+func (values *values) secret(key string, defaultVal string) string {
+    str := values.str(key, defaultVal)
+    addSecret(str)
+    return str
+}
+
+func (values *values) integer(key string, defaultVal int) int {
+    str, found := values.raw(key)
+    if !found {
+        return defaultVal
+    }
+    i, err := strconv.Atoi(str)
+    if err != nil {
+        values.invalid(key, "%q is not a whole number", str)
+        return defaultVal
+    }
+    return i
+}
+
+// duration accepts Go durations (e.g. 10s, 1m30s, 500ms). A bare number is taken as seconds, as it used to be.
+func (values *values) duration(key string, defaultVal time.Duration) time.Duration {
+    str, found := values.raw(key)
+    if !found {
+        return defaultVal
+    }
+    duration, err := time.ParseDuration(str)
+    if seconds, atoiErr := strconv.Atoi(str); atoiErr == nil {
+        duration, err = time.Duration(seconds)*time.Second, nil
+    }
+    if err != nil {
+        values.invalid(key, "%q is not a duration, e.g. 10s, 1m30s or 500ms", str)
+        return defaultVal
+    }
+    if duration < 0 {
+        values.invalid(key, "%q should not be negative", str)
+        return defaultVal
+    }
+    return duration
+}
+
+// durationOrMillis reads a duration, or else the whole milliseconds of millisKey, the deprecated setting it
+// replaces, e.g. SCRIPT_TIMEOUT_MS for SCRIPT_TIMEOUT.
+func (values *values) durationOrMillis(key string, millisKey string, defaultVal time.Duration) time.Duration {
+    if _, found := values.raw(millisKey); !found {
+        return values.duration(key, defaultVal)
+    }
+    if _, found := values.raw(key); found {
+        values.invalid(key, "is set along with %s, only one of them should be", millisKey)
+        return defaultVal
+    }
+    millis := values.integer(millisKey, -1)
+    if values.failed(millisKey) {
+        return defaultVal
+    }
+    if millis < 0 {
+        values.invalid(millisKey, "%d should not be negative", millis)
+        return defaultVal
+    }
+    log.Warnf("%s is deprecated, set %s=%dms instead.", millisKey, key, millis)
+    return time.Duration(millis) * time.Millisecond
+}
+
+func (values *values) boolean(key string) bool {
+    str, found := values.raw(key)
+    if !found {
+        return false
+    }
+    b, err := strconv.ParseBool(str)
+    if err != nil {
+        values.invalid(key, "%q is not true or false", str)
+        return false
+    }
+    return b
+}
+
+// stringSlice accepts either a list or a comma separated string.
+func (values *values) stringSlice(key string, defaultVal []string) []string {
+    var result []string
+    for _, item := range viper.GetStringSlice(key) {
+        for _, val := range strings.Split(item, ",") {
+            if val = strings.TrimSpace(val); val != "" {
+                result = append(result, val)
+            }
+        }
+    }
+    if len(result) == 0 {
+        return defaultVal
+    }
+    return result
+}
+
+// unmarshal decodes a structured setting, e.g. a list of objects. The value can be given as nested values in
+// a file or as a JSON string, which is how it has to be set in env.
+func (values *values) unmarshal(key string, rawVal interface{}) error {
+    var err error
+    if str, ok := viper.Get(key).(string); ok {
+        if str == "" {
+            return nil
+        }
+        err = json.Unmarshal([]byte(str), rawVal)
+    } else {
+        err = viper.UnmarshalKey(key, rawVal)
+    }
+    if err != nil {
+        values.invalid(key, "%v", err)
+    }
+    return err
+}
@@ -0,0 +1,233 @@
+package conf
+
+import (
+    "github.com/spf13/viper"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+)
+
+// setValues replaces every setting with values for the length of a test.
+func setValues(t *testing.T, settings map[string]interface{}) {
+    t.Helper()
+    viper.Reset()
+    for key, value := range settings {
+        viper.Set(key, value)
+    }
+}
+
+func TestValuesDuration(t *testing.T) {
+    tests := []struct {
+        value   interface{}
+        want    time.Duration
+        wantErr bool
+    }{
+        {nil, time.Minute, false},
+        {"", time.Minute, false},
+        {"1m30s", 90 * time.Second, false},
+        {"500ms", 500 * time.Millisecond, false},
+        {"10", 10 * time.Second, false},
+        {10, 10 * time.Second, false},
+        {"0", 0, false},
+        {"-1s", time.Minute, true},
+        {"-5", time.Minute, true},
+        {-5, time.Minute, true},
+        {"soon", time.Minute, true},
+    }
+    for _, test := range tests {
+        setValues(t, map[string]interface{}{"READ_TIMEOUT": test.value})
+        values := &values{}
+        if got := values.duration("READ_TIMEOUT", time.Minute); got != test.want {
+            t.Errorf("duration of %v = %v, want %v", test.value, got, test.want)
+        }
+        if (values.err() != nil) != test.wantErr {
+            t.Errorf("duration of %v: error = %v, want error %v", test.value, values.err(), test.wantErr)
+        }
+    }
+}
+
+func TestValuesDurationOrMillis(t *testing.T) {
+    tests := []struct {
+        name     string
+        settings map[string]interface{}
+        want     time.Duration
+        wantErr  bool
+    }{
+        {"neither", nil, 50 * time.Millisecond, false},
+        {"duration", map[string]interface{}{"SCRIPT_TIMEOUT": "20ms"}, 20 * time.Millisecond, false},
+        {"deprecated milliseconds", map[string]interface{}{"SCRIPT_TIMEOUT_MS": 120}, 120 * time.Millisecond, false},
+        {"both", map[string]interface{}{"SCRIPT_TIMEOUT": "20ms", "SCRIPT_TIMEOUT_MS": "120"}, 50 * time.Millisecond, true},
+        {"negative milliseconds", map[string]interface{}{"SCRIPT_TIMEOUT_MS": "-1"}, 50 * time.Millisecond, true},
+        {"milliseconds as a duration", map[string]interface{}{"SCRIPT_TIMEOUT_MS": "20ms"}, 50 * time.Millisecond, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            setValues(t, test.settings)
+            values := &values{}
+            if got := values.durationOrMillis("SCRIPT_TIMEOUT", "SCRIPT_TIMEOUT_MS", 50*time.Millisecond); got != test.want {
+                t.Errorf("durationOrMillis = %v, want %v", got, test.want)
+            }
+            if (values.err() != nil) != test.wantErr {
+                t.Errorf("error = %v, want error %v", values.err(), test.wantErr)
+            }
+        })
+    }
+}
+
+func TestSinkConfGetDurationOrMillis(t *testing.T) {
+    tests := []struct {
+        name     string
+        settings map[string]interface{}
+        want     time.Duration
+    }{
+        {"top level milliseconds", map[string]interface{}{"AMQP_BATCH_LINGER_MS": 100}, 100 * time.Millisecond},
+        {"section duration over top level milliseconds", map[string]interface{}{
+            "AMQP_BATCH_LINGER_MS":       100,
+            "RABBITMQ.AMQP_BATCH_LINGER": "1s",
+        }, time.Second},
+        {"section milliseconds over top level duration", map[string]interface{}{
+            "AMQP_BATCH_LINGER":             "1s",
+            "RABBITMQ.AMQP_BATCH_LINGER_MS": 300,
+        }, 300 * time.Millisecond},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            setValues(t, test.settings)
+            sinkConf := NewSinkConf("rabbitmq")
+            if got := sinkConf.GetDurationOrMillis("AMQP_BATCH_LINGER", "AMQP_BATCH_LINGER_MS", 200*time.Millisecond); got != test.want {
+                t.Errorf("GetDurationOrMillis = %v, want %v", got, test.want)
+            }
+            if err := sinkConf.Err(); err != nil {
+                t.Error(err)
+            }
+        })
+    }
+}
+
+func TestValuesInteger(t *testing.T) {
+    tests := []struct {
+        value   interface{}
+        want    int
+        wantErr bool
+    }{
+        {nil, 4, false},
+        {"12", 12, false},
+        {12, 12, false},
+        {" 12 ", 12, false},
+        {"-3", -3, false},
+        {"1.5", 4, true},
+        {"abc", 4, true},
+    }
+    for _, test := range tests {
+        setValues(t, map[string]interface{}{"NUMBER_OF_WORKERS": test.value})
+        values := &values{}
+        if got := values.integer("NUMBER_OF_WORKERS", 4); got != test.want {
+            t.Errorf("integer of %v = %d, want %d", test.value, got, test.want)
+        }
+        if (values.err() != nil) != test.wantErr {
+            t.Errorf("integer of %v: error = %v, want error %v", test.value, values.err(), test.wantErr)
+        }
+    }
+}
+
+func TestValuesBoolean(t *testing.T) {
+    tests := []struct {
+        value   interface{}
+        want    bool
+        wantErr bool
+    }{
+        {nil, false, false},
+        {"true", true, false},
+        {true, true, false},
+        {"0", false, false},
+        {"maybe", false, true},
+    }
+    for _, test := range tests {
+        setValues(t, map[string]interface{}{"LOG_EVENTS": test.value})
+        values := &values{}
+        if got := values.boolean("LOG_EVENTS"); got != test.want {
+            t.Errorf("boolean of %v = %v, want %v", test.value, got, test.want)
+        }
+        if (values.err() != nil) != test.wantErr {
+            t.Errorf("boolean of %v: error = %v, want error %v", test.value, values.err(), test.wantErr)
+        }
+    }
+}
+
+func TestValuesStringSlice(t *testing.T) {
+    tests := []struct {
+        value interface{}
+        want  []string
+    }{
+        {nil, []string{"rabbitmq"}},
+        {"stdout, rabbitmq", []string{"stdout", "rabbitmq"}},
+        {[]string{"stdout", "rabbitmq,"}, []string{"stdout", "rabbitmq"}},
+        {" , ", []string{"rabbitmq"}},
+    }
+    for _, test := range tests {
+        setValues(t, map[string]interface{}{"SINKS": test.value})
+        values := &values{}
+        if got := values.stringSlice("SINKS", []string{"rabbitmq"}); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("stringSlice of %v = %v, want %v", test.value, got, test.want)
+        }
+    }
+}
+
+func TestValuesReadFromFile(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "conf")
+    defer os.RemoveAll(dir)
+    file := filepath.Join(dir, "ami_pass")
+    if err := ioutil.WriteFile(file, []byte("s3cr3t-pass\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name     string
+        settings map[string]interface{}
+        want     string
+        wantErr  bool
+    }{
+        {"file", map[string]interface{}{"AMI_PASS_FILE": file}, "s3cr3t-pass", false},
+        {"value and file", map[string]interface{}{"AMI_PASS": "other", "AMI_PASS_FILE": file}, "", true},
+        {"missing file", map[string]interface{}{"AMI_PASS_FILE": filepath.Join(dir, "missing")}, "", true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            setValues(t, test.settings)
+            values := &values{}
+            if got := values.str("AMI_PASS", ""); got != test.want {
+                t.Errorf("str = %q, want %q", got, test.want)
+            }
+            if (values.err() != nil) != test.wantErr {
+                t.Errorf("error = %v, want error %v", values.err(), test.wantErr)
+            }
+        })
+    }
+    found := false
+    for _, secret := range Secrets() {
+        found = found || secret == "s3cr3t-pass"
+    }
+    if !found {
+        t.Error("value read from a file is not a secret")
+    }
+}
+
+func TestValuesReportsEveryProblem(t *testing.T) {
+    setValues(t, map[string]interface{}{"NUMBER_OF_WORKERS": "abc", "LOG_EVENTS": "maybe"})
+    values := &values{}
+    values.integer("NUMBER_OF_WORKERS", 4)
+    values.boolean("LOG_EVENTS")
+    err, ok := values.err().(*Error)
+    if !ok {
+        t.Fatalf("err = %v, want *Error", values.err())
+    }
+    want := []string{`NUMBER_OF_WORKERS: "abc" is not a whole number`, `LOG_EVENTS: "maybe" is not true or false`}
+    if !reflect.DeepEqual(err.Problems, want) {
+        t.Fatalf("Problems = %q, want %q", err.Problems, want)
+    }
+    if !values.failed("NUMBER_OF_WORKERS") || values.failed("NUMBER_OF_JOBS") {
+        t.Fatal("failed doesn't tell the keys found invalid")
+    }
+}
@@ -0,0 +1,221 @@
+package enrich
+
+import (
+    "expvar"
+    "fmt"
+    "github.com/fsnotify/fsnotify"
+    "github.com/pkg/errors"
+    log "github.com/sirupsen/logrus"
+    "path"
+    "path/filepath"
+    "time"
+)
+
+// Files are reloaded once they have not changed for that long, so a table being written is not read half way
+const reloadDelay = 500 * time.Millisecond
+
+var enrichStats = expvar.NewMap("enrich")
+
+// LookupConf adds the attributes of the row of a table whose key is the value of one of the event fields.
+type LookupConf struct {
+    // Path of a .csv or .json file
+    Table string `mapstructure:"table" json:"table"`
+    // Column holding the key of rows. Defaults to the first column of CSV tables.
+    Key string `mapstructure:"key" json:"key"`
+    // Event fields whose value is looked up, the first one found in the table is used
+    Fields []string `mapstructure:"fields" json:"fields"`
+    // Attributes added to the event. Every column but the key when not set.
+    Columns []string `mapstructure:"columns" json:"columns"`
+    // Prepended to the names of the added attributes
+    Prefix string `mapstructure:"prefix" json:"prefix"`
+    // Event names or patterns (*, ?, [...]). No events means every event.
+    Events []string `mapstructure:"events" json:"events"`
+}
+
+type lookup struct {
+    table   *table
+    fields  []string
+    columns []string
+    prefix  string
+    events  []string
+}
+
+// Enricher tags events with attributes of local lookup tables, e.g. the user and team of an extension.
+// Attributes never replace fields the event already has.
+type Enricher struct {
+    lookups []lookup
+    tables  map[string]*table
+    watcher *fsnotify.Watcher
+    done    chan struct{}
+}
+
+func New(lookupConfs []LookupConf) (*Enricher, error) {
+    enricher := &Enricher{tables: make(map[string]*table)}
+    for i, lookupConf := range lookupConfs {
+        name := fmt.Sprintf("ENRICH[%d]", i)
+        if lookupConf.Table == "" || len(lookupConf.Fields) == 0 {
+            return nil, errors.Errorf("Missing table or fields in %s", name)
+        }
+        for _, pattern := range lookupConf.Events {
+            if _, err := path.Match(pattern, ""); err != nil {
+                return nil, errors.Wrap(err, fmt.Sprintf("Invalid event pattern %s in %s.", pattern, name))
+            }
+        }
+        tablePath, err := filepath.Abs(lookupConf.Table)
+        if err != nil {
+            return nil, err
+        }
+        // Lookups reading the same table with the same key share it
+        tableId := tablePath + "\x00" + lookupConf.Key
+        lookupTable, found := enricher.tables[tableId]
+        if !found {
+            lookupTable = &table{path: tablePath, key: lookupConf.Key}
+            if err = lookupTable.load(); err != nil {
+                return nil, errors.Wrap(err, fmt.Sprintf("Invalid %s.", name))
+            }
+            enricher.tables[tableId] = lookupTable
+        }
+        enricher.lookups = append(enricher.lookups, lookup{
+            table:   lookupTable,
+            fields:  lookupConf.Fields,
+            columns: lookupConf.Columns,
+            prefix:  lookupConf.Prefix,
+            events:  lookupConf.Events,
+        })
+    }
+    return enricher, nil
+}
+
+// Empty tells whether the enricher leaves events as they are.
+func (enricher *Enricher) Empty() bool {
+    return enricher == nil || len(enricher.lookups) == 0
+}
+
+// Enrich adds the attributes of every matching lookup to an event in place.
+func (enricher *Enricher) Enrich(event map[string]string) {
+    for i := range enricher.lookups {
+        lookup := &enricher.lookups[i]
+        if len(lookup.events) > 0 && !matchesAny(lookup.events, event["Event"]) {
+            continue
+        }
+        row, found := lookup.find(event)
+        if !found {
+            enrichStats.Add("missed", 1)
+            continue
+        }
+        enrichStats.Add("matched", 1)
+        if len(lookup.columns) == 0 {
+            for column, value := range row {
+                setIfMissing(event, lookup.prefix+column, value)
+            }
+            continue
+        }
+        for _, column := range lookup.columns {
+            if value, found := row[column]; found {
+                setIfMissing(event, lookup.prefix+column, value)
+            }
+        }
+    }
+}
+
+func (lookup *lookup) find(event map[string]string) (map[string]string, bool) {
+    for _, field := range lookup.fields {
+        if value, found := event[field]; found && value != "" {
+            if row, found := lookup.table.lookup(value); found {
+                return row, true
+            }
+        }
+    }
+    return nil, false
+}
+
+func setIfMissing(event map[string]string, field string, value string) {
+    if _, found := event[field]; !found {
+        event[field] = value
+    }
+}
+
+// Watch reloads tables when their files change until Close is called. Directories are watched rather than
+// files, so tables replaced by a rename, as editors and deployment tools do, are picked up too.
+func (enricher *Enricher) Watch() error {
+    if len(enricher.tables) == 0 {
+        return nil
+    }
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return errors.Wrap(err, "Failed to watch lookup tables.")
+    }
+    dirs := make(map[string]bool)
+    for _, lookupTable := range enricher.tables {
+        dir := filepath.Dir(lookupTable.path)
+        if dirs[dir] {
+            continue
+        }
+        if err = watcher.Add(dir); err != nil {
+            _ = watcher.Close()
+            return errors.Wrap(err, fmt.Sprintf("Failed to watch lookup tables in %s.", dir))
+        }
+        dirs[dir] = true
+    }
+    enricher.watcher = watcher
+    enricher.done = make(chan struct{})
+    go enricher.watch()
+    return nil
+}
+
+func (enricher *Enricher) watch() {
+    defer close(enricher.done)
+    changed := make(map[string]bool)
+    var reload <-chan time.Time
+    for {
+        select {
+        case event, ok := <-enricher.watcher.Events:
+            if !ok {
+                return
+            }
+            if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+                changed[filepath.Clean(event.Name)] = true
+                reload = time.After(reloadDelay)
+            }
+        case err, ok := <-enricher.watcher.Errors:
+            if !ok {
+                return
+            }
+            log.Errorf("Failed to watch lookup tables. Reason: %v", err)
+        case <-reload:
+            reload = nil
+            for _, lookupTable := range enricher.tables {
+                if !changed[lookupTable.path] {
+                    continue
+                }
+                // A table that fails to load keeps its previous rows
+                if err := lookupTable.load(); err != nil {
+                    enrichStats.Add("reload_failed", 1)
+                    log.Errorf("Keeping previous rows of %s. Reason: %v", lookupTable.path, err)
+                    continue
+                }
+                enrichStats.Add("reloads", 1)
+                log.Infof("Reloaded lookup table %s.", lookupTable.path)
+            }
+            changed = make(map[string]bool)
+        }
+    }
+}
+
+func (enricher *Enricher) Close() {
+    if enricher.watcher == nil {
+        return
+    }
+    _ = enricher.watcher.Close()
+    <-enricher.done
+    enricher.watcher = nil
+}
+
+func matchesAny(patterns []string, value string) bool {
+    for _, pattern := range patterns {
+        if matched, _ := path.Match(pattern, value); matched {
+            return true
+        }
+    }
+    return false
+}
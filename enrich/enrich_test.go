@@ -0,0 +1,220 @@
+package enrich
+
+import (
+    "expvar"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func writeTable(t *testing.T, dir string, name string, content string) string {
+    t.Helper()
+    path := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+// replaceTable writes a table aside then renames it over the old one, as deployment tools do.
+func replaceTable(t *testing.T, path string, content string) {
+    t.Helper()
+    if err := ioutil.WriteFile(path+".tmp", []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Rename(path+".tmp", path); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func statOf(name string) int64 {
+    if value, ok := enrichStats.Get(name).(*expvar.Int); ok {
+        return value.Value()
+    }
+    return 0
+}
+
+func TestNewLoadsTables(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "enrich")
+    defer os.RemoveAll(dir)
+    want := map[string]string{"user": "alice", "team": "sales"}
+    tests := []struct {
+        name    string
+        file    string
+        content string
+        key     string
+        wantErr bool
+    }{
+        {name: "csv", file: "users.csv", content: "ext,user,team\n1001, alice ,sales\n1002,bob,support\n"},
+        {name: "csv key column", file: "users.csv", content: "user,team,ext\nalice,sales,1001\n", key: "ext"},
+        {name: "json object", file: "users.json", content: `{"1001": {"user": "alice", "team": "sales"}}`},
+        {name: "json array", file: "users.json", content: `[{"ext": 1001, "user": "alice", "team": "sales"}]`, key: "ext"},
+        {name: "csv missing key column", file: "users.csv", content: "user,team\nalice,sales\n", key: "ext", wantErr: true},
+        {name: "csv ragged rows", file: "users.csv", content: "ext,user,team\n1001,alice\n", wantErr: true},
+        {name: "csv without header", file: "users.csv", content: "", wantErr: true},
+        {name: "json malformed", file: "users.json", content: `{"1001": {"user": "alice"`, wantErr: true},
+        {name: "json row not an object", file: "users.json", content: `{"1001": "alice"}`, wantErr: true},
+        {name: "json array without key", file: "users.json", content: `[{"ext": 1001}]`, wantErr: true},
+        {name: "json row without key", file: "users.json", content: `[{"user": "alice"}]`, key: "ext", wantErr: true},
+        {name: "unknown format", file: "users.txt", content: "1001 alice", wantErr: true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            path := writeTable(t, dir, test.file, test.content)
+            defer os.Remove(path)
+            enricher, err := New([]LookupConf{{Table: path, Key: test.key, Fields: []string{"CallerIDNum"}}})
+            if (err != nil) != test.wantErr {
+                t.Fatalf("error = %v, want error %v", err, test.wantErr)
+            }
+            if err != nil {
+                return
+            }
+            event := map[string]string{"CallerIDNum": "1001"}
+            enricher.Enrich(event)
+            delete(event, "CallerIDNum")
+            if !reflect.DeepEqual(event, want) {
+                t.Errorf("enriched %v, want %v", event, want)
+            }
+        })
+    }
+    if _, err := New([]LookupConf{{Table: filepath.Join(dir, "missing.csv"), Fields: []string{"CallerIDNum"}}}); err == nil {
+        t.Error("New loaded a missing table")
+    }
+    if _, err := New([]LookupConf{{Table: filepath.Join(dir, "missing.csv")}}); err == nil {
+        t.Error("New accepted a lookup without fields")
+    }
+}
+
+func TestEnrich(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "enrich")
+    defer os.RemoveAll(dir)
+    path := writeTable(t, dir, "users.csv", "ext,user,team\n1001,alice,sales\n1002,bob,support\n")
+    tests := []struct {
+        name   string
+        lookup LookupConf
+        event  map[string]string
+        want   map[string]string
+    }{
+        {
+            name:   "first field found",
+            lookup: LookupConf{Fields: []string{"ConnectedLineNum", "CallerIDNum"}},
+            event:  map[string]string{"Event": "Newchannel", "ConnectedLineNum": "", "CallerIDNum": "1002"},
+            want:   map[string]string{"Event": "Newchannel", "ConnectedLineNum": "", "CallerIDNum": "1002", "user": "bob", "team": "support"},
+        },
+        {
+            name:   "columns and prefix",
+            lookup: LookupConf{Fields: []string{"CallerIDNum"}, Columns: []string{"team", "missing"}, Prefix: "caller_"},
+            event:  map[string]string{"Event": "Newchannel", "CallerIDNum": "1001"},
+            want:   map[string]string{"Event": "Newchannel", "CallerIDNum": "1001", "caller_team": "sales"},
+        },
+        {
+            name:   "existing fields kept",
+            lookup: LookupConf{Fields: []string{"CallerIDNum"}},
+            event:  map[string]string{"Event": "Newchannel", "CallerIDNum": "1001", "team": "from event"},
+            want:   map[string]string{"Event": "Newchannel", "CallerIDNum": "1001", "user": "alice", "team": "from event"},
+        },
+        {
+            name:   "key not found",
+            lookup: LookupConf{Fields: []string{"CallerIDNum"}},
+            event:  map[string]string{"Event": "Newchannel", "CallerIDNum": "1003"},
+            want:   map[string]string{"Event": "Newchannel", "CallerIDNum": "1003"},
+        },
+        {
+            name:   "event matched",
+            lookup: LookupConf{Fields: []string{"CallerIDNum"}, Columns: []string{"user"}, Events: []string{"Dial*"}},
+            event:  map[string]string{"Event": "DialBegin", "CallerIDNum": "1001"},
+            want:   map[string]string{"Event": "DialBegin", "CallerIDNum": "1001", "user": "alice"},
+        },
+        {
+            name:   "event not matched",
+            lookup: LookupConf{Fields: []string{"CallerIDNum"}, Events: []string{"Dial*"}},
+            event:  map[string]string{"Event": "Hangup", "CallerIDNum": "1001"},
+            want:   map[string]string{"Event": "Hangup", "CallerIDNum": "1001"},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            test.lookup.Table = path
+            enricher, err := New([]LookupConf{test.lookup})
+            if err != nil {
+                t.Fatal(err)
+            }
+            enricher.Enrich(test.event)
+            if !reflect.DeepEqual(test.event, test.want) {
+                t.Errorf("enriched %v, want %v", test.event, test.want)
+            }
+        })
+    }
+    // Lookups of the same table and key share it
+    enricher, err := New([]LookupConf{
+        {Table: path, Fields: []string{"CallerIDNum"}},
+        {Table: filepath.Join(dir, ".", "users.csv"), Fields: []string{"ConnectedLineNum"}},
+        {Table: path, Key: "user", Fields: []string{"Exten"}},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(enricher.tables) != 2 {
+        t.Errorf("loaded %d tables, want 2", len(enricher.tables))
+    }
+    var empty *Enricher
+    if !empty.Empty() {
+        t.Error("a nil enricher is not empty")
+    }
+}
+
+func TestWatchSwapsTablesOnReload(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "enrich")
+    defer os.RemoveAll(dir)
+    path := writeTable(t, dir, "users.csv", "ext,user,team\n1001,alice,sales\n")
+    enricher, err := New([]LookupConf{{Table: path, Fields: []string{"CallerIDNum"}}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err = enricher.Watch(); err != nil {
+        t.Fatal(err)
+    }
+    defer enricher.Close()
+    enrich := func() map[string]string {
+        event := map[string]string{"CallerIDNum": "1001"}
+        enricher.Enrich(event)
+        return event
+    }
+    // Lookups meanwhile see either table as a whole
+    stop, checked := make(chan struct{}), make(chan struct{})
+    go func() {
+        defer close(checked)
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+            }
+            if event := enrich(); event["user"] == "alice" && event["team"] != "sales" || event["user"] == "bob" && event["team"] != "support" {
+                t.Errorf("looked up a half loaded table: %v", event)
+                return
+            }
+        }
+    }()
+    waitFor := func(what string, done func() bool) {
+        t.Helper()
+        for deadline := time.Now().Add(10 * time.Second); !done(); time.Sleep(20 * time.Millisecond) {
+            if time.Now().After(deadline) {
+                t.Fatalf("timed out waiting for %s", what)
+            }
+        }
+    }
+    replaceTable(t, path, "ext,user,team\n1001,bob,support\n")
+    waitFor("the table to reload", func() bool { return enrich()["user"] == "bob" })
+    failed := statOf("reload_failed")
+    replaceTable(t, path, "ext,user,team\n1001,carol\n")
+    waitFor("the reload to fail", func() bool { return statOf("reload_failed") > failed })
+    close(stop)
+    <-checked
+    if event := enrich(); event["user"] != "bob" || event["team"] != "support" {
+        t.Errorf("enriched %v after a failed reload, want the previous rows", event)
+    }
+}
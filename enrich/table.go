@@ -0,0 +1,139 @@
+package enrich
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "github.com/pkg/errors"
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "sync/atomic"
+)
+
+// table maps keys to the attributes of a row. Rows are swapped as a whole when the file is reloaded,
+// so lookups never see a half loaded table.
+type table struct {
+    path string
+    key  string
+    rows atomic.Value // map[string]map[string]string
+}
+
+func (table *table) lookup(key string) (map[string]string, bool) {
+    row, found := table.rows.Load().(map[string]map[string]string)[key]
+    return row, found
+}
+
+func (table *table) load() error {
+    data, err := ioutil.ReadFile(table.path)
+    if err != nil {
+        return err
+    }
+    var rows map[string]map[string]string
+    switch strings.ToLower(filepath.Ext(table.path)) {
+    case ".csv":
+        rows, err = parseCsv(data, table.key)
+    case ".json":
+        rows, err = parseJson(data, table.key)
+    default:
+        err = errors.New("Unknown table format, expected .csv or .json")
+    }
+    if err != nil {
+        return errors.Wrap(err, fmt.Sprintf("Failed to load table %s.", table.path))
+    }
+    table.rows.Store(rows)
+    return nil
+}
+
+// parseCsv reads a table with a header row. The key column defaults to the first one.
+func parseCsv(data []byte, key string) (map[string]map[string]string, error) {
+    records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+    if err != nil {
+        return nil, err
+    }
+    if len(records) == 0 {
+        return nil, errors.New("Missing header row")
+    }
+    header := records[0]
+    keyColumn := 0
+    if key != "" {
+        keyColumn = -1
+        for i, column := range header {
+            if strings.TrimSpace(column) == key {
+                keyColumn = i
+            }
+        }
+        if keyColumn < 0 {
+            return nil, errors.Errorf("Missing key column %s", key)
+        }
+    }
+    rows := make(map[string]map[string]string, len(records)-1)
+    for _, record := range records[1:] {
+        row := make(map[string]string, len(header)-1)
+        for i, column := range header {
+            if i != keyColumn {
+                row[strings.TrimSpace(column)] = strings.TrimSpace(record[i])
+            }
+        }
+        rows[strings.TrimSpace(record[keyColumn])] = row
+    }
+    return rows, nil
+}
+
+// parseJson reads either an object of rows by key, or an array of rows holding their key.
+func parseJson(data []byte, key string) (map[string]map[string]string, error) {
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.UseNumber()
+    var content interface{}
+    if err := decoder.Decode(&content); err != nil {
+        return nil, err
+    }
+    rows := make(map[string]map[string]string)
+    switch content := content.(type) {
+    case map[string]interface{}:
+        for rowKey, value := range content {
+            row, ok := value.(map[string]interface{})
+            if !ok {
+                return nil, errors.Errorf("Row %s is not an object", rowKey)
+            }
+            rows[rowKey] = toRow(row, "")
+        }
+    case []interface{}:
+        if key == "" {
+            return nil, errors.New("Missing key of the array of rows")
+        }
+        for i, value := range content {
+            row, ok := value.(map[string]interface{})
+            if !ok {
+                return nil, errors.Errorf("Row %d is not an object", i)
+            }
+            rowKey, found := row[key]
+            if !found {
+                return nil, errors.Errorf("Row %d has no %s", i, key)
+            }
+            rows[fmt.Sprint(rowKey)] = toRow(row, key)
+        }
+    default:
+        return nil, errors.New("Expected an object or an array of rows")
+    }
+    return rows, nil
+}
+
+func toRow(values map[string]interface{}, key string) map[string]string {
+    row := make(map[string]string, len(values))
+    for column, value := range values {
+        if column == key || value == nil {
+            continue
+        }
+        if text, ok := value.(string); ok {
+            row[column] = text
+        } else if _, ok := value.(json.Number); ok {
+            row[column] = fmt.Sprint(value)
+        } else {
+            nested, _ := json.Marshal(value)
+            row[column] = string(nested)
+        }
+    }
+    return row
+}
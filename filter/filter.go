@@ -0,0 +1,260 @@
+package filter
+
+import (
+    "fmt"
+    "github.com/pkg/errors"
+    "path"
+    "regexp"
+    "strings"
+    "sync"
+)
+
+// maxCached bounds the decisions cached by event name, AMI has far fewer event types
+const maxCached = 1024
+
+// RuleConf matches an event when every condition it sets matches. A rule setting nothing matches every event.
+type RuleConf struct {
+    // Event names or patterns (*, ?, [...])
+    Event []string `mapstructure:"event" json:"event"`
+    // Regular expressions on header values, by header name. Header names are not case sensitive.
+    Header map[string]string `mapstructure:"header" json:"header"`
+    // Categories of the Privilege header, e.g. call or security. Any of them matches.
+    Privilege []string   `mapstructure:"privilege" json:"privilege"`
+    All       []RuleConf `mapstructure:"all" json:"all"`
+    Any       []RuleConf `mapstructure:"any" json:"any"`
+    Not       *RuleConf  `mapstructure:"not" json:"not"`
+}
+
+// Conf selects the events to keep. An event is kept when it matches include, or include is not set,
+// and does not match exclude.
+type Conf struct {
+    Include *RuleConf `mapstructure:"include" json:"include"`
+    Exclude *RuleConf `mapstructure:"exclude" json:"exclude"`
+}
+
+type rule interface {
+    match(event map[string]string) bool
+}
+
+type eventRule struct {
+    names    map[string]struct{}
+    patterns []string
+}
+
+func (rule *eventRule) match(event map[string]string) bool {
+    name := event["Event"]
+    if _, found := rule.names[name]; found {
+        return true
+    }
+    for _, pattern := range rule.patterns {
+        if matched, _ := path.Match(pattern, name); matched {
+            return true
+        }
+    }
+    return false
+}
+
+type headerRule struct {
+    header string
+    regexp *regexp.Regexp
+}
+
+func (rule *headerRule) match(event map[string]string) bool {
+    value, found := event[rule.header]
+    if !found {
+        // Config keys of nested objects are lowercased when loaded
+        for key, val := range event {
+            if strings.EqualFold(key, rule.header) {
+                value, found = val, true
+                break
+            }
+        }
+    }
+    return found && rule.regexp.MatchString(value)
+}
+
+type privilegeRule struct {
+    categories map[string]struct{}
+}
+
+func (rule *privilegeRule) match(event map[string]string) bool {
+    for _, category := range strings.Split(event["Privilege"], ",") {
+        if _, found := rule.categories[strings.ToLower(strings.TrimSpace(category))]; found {
+            return true
+        }
+    }
+    return false
+}
+
+type allRule []rule
+
+func (rules allRule) match(event map[string]string) bool {
+    for _, rule := range rules {
+        if !rule.match(event) {
+            return false
+        }
+    }
+    return true
+}
+
+type anyRule []rule
+
+func (rules anyRule) match(event map[string]string) bool {
+    for _, rule := range rules {
+        if rule.match(event) {
+            return true
+        }
+    }
+    return false
+}
+
+type notRule struct {
+    rule rule
+}
+
+func (rule *notRule) match(event map[string]string) bool {
+    return !rule.rule.match(event)
+}
+
+func compile(conf *RuleConf, name string) (rule, error) {
+    var rules allRule
+    if len(conf.Event) > 0 {
+        events := &eventRule{names: make(map[string]struct{})}
+        for _, event := range conf.Event {
+            if _, err := path.Match(event, ""); err != nil {
+                return nil, errors.Wrap(err, fmt.Sprintf("Invalid event pattern %s in %s.", event, name))
+            }
+            if strings.ContainsAny(event, "*?[\\") {
+                events.patterns = append(events.patterns, event)
+            } else {
+                events.names[event] = struct{}{}
+            }
+        }
+        rules = append(rules, events)
+    }
+    for header, expr := range conf.Header {
+        re, err := regexp.Compile(expr)
+        if err != nil {
+            return nil, errors.Wrap(err, fmt.Sprintf("Invalid regular expression for %s in %s.", header, name))
+        }
+        rules = append(rules, &headerRule{header: header, regexp: re})
+    }
+    if len(conf.Privilege) > 0 {
+        privileges := &privilegeRule{categories: make(map[string]struct{})}
+        for _, category := range conf.Privilege {
+            privileges.categories[strings.ToLower(category)] = struct{}{}
+        }
+        rules = append(rules, privileges)
+    }
+    if len(conf.All) > 0 {
+        allRules := make(allRule, 0, len(conf.All))
+        for i := range conf.All {
+            compiled, err := compile(&conf.All[i], fmt.Sprintf("%s.all[%d]", name, i))
+            if err != nil {
+                return nil, err
+            }
+            allRules = append(allRules, compiled)
+        }
+        rules = append(rules, allRules)
+    }
+    if len(conf.Any) > 0 {
+        anyRules := make(anyRule, 0, len(conf.Any))
+        for i := range conf.Any {
+            compiled, err := compile(&conf.Any[i], fmt.Sprintf("%s.any[%d]", name, i))
+            if err != nil {
+                return nil, err
+            }
+            anyRules = append(anyRules, compiled)
+        }
+        rules = append(rules, anyRules)
+    }
+    if conf.Not != nil {
+        compiled, err := compile(conf.Not, name+".not")
+        if err != nil {
+            return nil, err
+        }
+        rules = append(rules, &notRule{compiled})
+    }
+    if len(rules) == 1 {
+        return rules[0], nil
+    }
+    return rules, nil
+}
+
+// byEventOnly tells whether a rule only looks at the event name.
+func byEventOnly(conf *RuleConf) bool {
+    if conf == nil {
+        return true
+    }
+    if len(conf.Header) > 0 || len(conf.Privilege) > 0 {
+        return false
+    }
+    for i := range conf.All {
+        if !byEventOnly(&conf.All[i]) {
+            return false
+        }
+    }
+    for i := range conf.Any {
+        if !byEventOnly(&conf.Any[i]) {
+            return false
+        }
+    }
+    return byEventOnly(conf.Not)
+}
+
+// Filter decides which AMI events are kept. When no rule looks further than the event name, which is
+// the common case, decisions are cached by event name so filtering costs a map lookup per event.
+type Filter struct {
+    include   rule
+    exclude   rule
+    cacheable bool
+    mutex     sync.RWMutex
+    cache     map[string]bool
+}
+
+func New(conf Conf) (*Filter, error) {
+    filter := &Filter{
+        cacheable: byEventOnly(conf.Include) && byEventOnly(conf.Exclude),
+        cache:     make(map[string]bool),
+    }
+    var err error
+    if conf.Include != nil {
+        if filter.include, err = compile(conf.Include, "include"); err != nil {
+            return nil, err
+        }
+    }
+    if conf.Exclude != nil {
+        if filter.exclude, err = compile(conf.Exclude, "exclude"); err != nil {
+            return nil, err
+        }
+    }
+    return filter, nil
+}
+
+// Match returns true when the event is kept.
+func (filter *Filter) Match(event map[string]string) bool {
+    if !filter.cacheable {
+        return filter.match(event)
+    }
+    name := event["Event"]
+    filter.mutex.RLock()
+    keep, found := filter.cache[name]
+    filter.mutex.RUnlock()
+    if found {
+        return keep
+    }
+    keep = filter.match(event)
+    filter.mutex.Lock()
+    if len(filter.cache) < maxCached {
+        filter.cache[name] = keep
+    }
+    filter.mutex.Unlock()
+    return keep
+}
+
+func (filter *Filter) match(event map[string]string) bool {
+    if filter.include != nil && !filter.include.match(event) {
+        return false
+    }
+    return filter.exclude == nil || !filter.exclude.match(event)
+}
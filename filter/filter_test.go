@@ -0,0 +1,107 @@
+package filter
+
+import (
+    "testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+    hangup := map[string]string{"Event": "Hangup", "Privilege": "call,all", "Channel": "PJSIP/1001-00000001", "Cause": "16"}
+    varSet := map[string]string{"Event": "VarSet", "Privilege": "dialplan,all", "Channel": "PJSIP/1001-00000001"}
+    peerStatus := map[string]string{"Event": "PeerStatus", "Privilege": "system,all", "Peer": "PJSIP/1001"}
+    tests := []struct {
+        name string
+        conf Conf
+        // Whether hangup, varSet and peerStatus are kept
+        want [3]bool
+    }{
+        {"no rules", Conf{}, [3]bool{true, true, true}},
+        {"include by name", Conf{Include: &RuleConf{Event: []string{"Hangup", "VarSet"}}}, [3]bool{true, true, false}},
+        {"include by pattern", Conf{Include: &RuleConf{Event: []string{"*Status"}}}, [3]bool{false, false, true}},
+        {"exclude by name", Conf{Exclude: &RuleConf{Event: []string{"VarSet"}}}, [3]bool{true, false, true}},
+        {"exclude wins over include", Conf{
+            Include: &RuleConf{Event: []string{"Hangup", "VarSet"}},
+            Exclude: &RuleConf{Event: []string{"Var*"}},
+        }, [3]bool{true, false, false}},
+        {"header", Conf{Include: &RuleConf{Header: map[string]string{"Channel": "^PJSIP/"}}}, [3]bool{true, true, false}},
+        {"lowercased header name", Conf{Include: &RuleConf{Header: map[string]string{"cause": "^16$"}}}, [3]bool{true, false, false}},
+        {"privilege", Conf{Include: &RuleConf{Privilege: []string{"Call", "system"}}}, [3]bool{true, false, true}},
+        {"conditions of a rule all match", Conf{Include: &RuleConf{
+            Event:  []string{"Hangup", "VarSet"},
+            Header: map[string]string{"Cause": "."},
+        }}, [3]bool{true, false, false}},
+        {"any", Conf{Include: &RuleConf{Any: []RuleConf{
+            {Event: []string{"PeerStatus"}},
+            {Privilege: []string{"dialplan"}},
+        }}}, [3]bool{false, true, true}},
+        {"all", Conf{Include: &RuleConf{All: []RuleConf{
+            {Privilege: []string{"call", "dialplan"}},
+            {Header: map[string]string{"Channel": "1001"}},
+        }}}, [3]bool{true, true, false}},
+        {"not", Conf{Include: &RuleConf{Not: &RuleConf{Event: []string{"VarSet"}}}}, [3]bool{true, false, true}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            filter, err := New(test.conf)
+            if err != nil {
+                t.Fatal(err)
+            }
+            // Twice, the second time from the cache when the filter has one
+            for i := 0; i < 2; i++ {
+                for j, event := range []map[string]string{hangup, varSet, peerStatus} {
+                    if got := filter.Match(event); got != test.want[j] {
+                        t.Fatalf("Match(%s) = %v, want %v", event["Event"], got, test.want[j])
+                    }
+                }
+            }
+        })
+    }
+}
+
+func TestFilterCachesOnlyByEventName(t *testing.T) {
+    tests := []struct {
+        name string
+        conf Conf
+        want bool
+    }{
+        {"event", Conf{Include: &RuleConf{Event: []string{"Hangup"}}, Exclude: &RuleConf{Not: &RuleConf{Event: []string{"Var*"}}}}, true},
+        {"header", Conf{Include: &RuleConf{Header: map[string]string{"Cause": "16"}}}, false},
+        {"nested privilege", Conf{Exclude: &RuleConf{Any: []RuleConf{{Privilege: []string{"call"}}}}}, false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            filter, err := New(test.conf)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if filter.cacheable != test.want {
+                t.Fatalf("cacheable = %v, want %v", filter.cacheable, test.want)
+            }
+        })
+    }
+    // A header rule must see every event, not the decision cached for the first one of that name
+    filter, _ := New(Conf{Include: &RuleConf{Header: map[string]string{"Cause": "^16$"}}})
+    if !filter.Match(map[string]string{"Event": "Hangup", "Cause": "16"}) {
+        t.Fatal("Hangup with cause 16 not kept")
+    }
+    if filter.Match(map[string]string{"Event": "Hangup", "Cause": "17"}) {
+        t.Fatal("Hangup with cause 17 kept")
+    }
+}
+
+func TestNewFailsOnInvalidRule(t *testing.T) {
+    tests := []struct {
+        name string
+        conf Conf
+    }{
+        {"event pattern", Conf{Include: &RuleConf{Event: []string{"[Hangup"}}}},
+        {"regular expression", Conf{Exclude: &RuleConf{Header: map[string]string{"Channel": "("}}}},
+        {"nested", Conf{Include: &RuleConf{Any: []RuleConf{{}, {Not: &RuleConf{Header: map[string]string{"Cause": "*"}}}}}}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if _, err := New(test.conf); err == nil {
+                t.Fatal("New accepted an invalid rule")
+            }
+        })
+    }
+}
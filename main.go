@@ -2,69 +2,190 @@ package main
 
 import (
 	"ami-reader/conf"
+	"ami-reader/sequence"
 	"ami-reader/service"
+	_ "expvar" // Registers /debug/vars
     "fmt"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+	"github.com/spf13/pflag"
+	"net/http"
 	"os"
 	"strings"
 	"time"
 )
 
-func init() {
-    // Log as JSON instead of the default ASCII formatter.
-    log.SetFormatter(&log.JSONFormatter{})
-    currentTime := time.Now()
-    fileName := currentTime.Format("2006-01-02") + "_ami-reader.log"
-    file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-    if err != nil {
-        fmt.Printf("Failed to open file: %s", fileName)
-        os.Exit(1)
-    }
-    log.SetOutput(file)
-    log.SetLevel(log.InfoLevel)
+// App version, also sent with every published message. Update appropriately should there be event related contract updates.
+var version = "1.1.0"
+
+// Build information, set with -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// setupLogFile logs to YYYY-MM-DD_ami-reader.log as JSON. Only run does, the other commands log to stderr.
+func setupLogFile() error {
+	// Log as JSON instead of the default ASCII formatter.
+	log.SetFormatter(&log.JSONFormatter{})
+	currentTime := time.Now()
+	fileName := currentTime.Format("2006-01-02") + "_ami-reader.log"
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("Failed to open file: %s", fileName)
+	}
+	log.SetOutput(file)
+	log.SetLevel(log.InfoLevel)
+	return nil
+}
+
+const usage = `Usage: ami-reader [command] [flags]
+
+Commands:
+  run       Read AMI events and hand them to the sinks. The default when no command is given
+  check     Validate the configuration and test AMI and sink connectivity
+  tail      Print live AMI events
+  action    Send an AMI action and print the response
+  replay    Republish events from YYYY-MM-DD_events.log files
+  secrets   Manage the encrypted secrets file
+  version   Print build information
+
+Run ami-reader <command> --help for the flags of a command.
+`
+
+var commands = map[string]func(args []string) int{
+	"run":     runApp,
+	"check":   runCheck,
+	"tail":    runTail,
+	"action":  runAction,
+	"replay":  runReplay,
+	"secrets": runSecrets,
+	"version": runVersion,
 }
 
 func main() {
+	service.AppVersion = version
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		os.Exit(runApp(args))
+	}
+	if args[0] == "help" {
+		fmt.Print(usage)
+		os.Exit(0)
+	}
+	command, found := commands[args[0]]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n%s", args[0], usage)
+		os.Exit(2)
+	}
+	os.Exit(command(args[1:]))
+}
+
+// loadConfig reads the settings from the flags, env and config file and applies the log settings.
+func loadConfig(flags *pflag.FlagSet) (*conf.AppConf, error) {
 	log.Info("Loading app configurations.")
-	loadEnv()
+	if err := conf.Load(flags); err != nil {
+		log.Error(err)
+		return nil, err
+	}
 	appConfig, err := conf.NewAppConf()
 	if err != nil {
 		log.Errorf("Failed to initialize app config. Reason: %v", err)
-		return
+		return nil, err
+	}
+	applyLogSettings(appConfig.AmiConf)
+	return appConfig, nil
+}
+
+// loadAmiConfig reads only the AMI settings, for commands that talk to AMI and nothing else.
+func loadAmiConfig(flags *pflag.FlagSet) (*conf.AmiConf, error) {
+	if err := conf.Load(flags); err != nil {
+		return nil, err
+	}
+	amiConfig, err := conf.NewAmiConf()
+	if err != nil {
+		return nil, err
+	}
+	applyLogSettings(amiConfig)
+	return amiConfig, nil
+}
+
+func runApp(args []string) int {
+	flags := pflag.NewFlagSet("run", pflag.ContinueOnError)
+	conf.RegisterFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage+"\nFlags of run:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := setupLogFile(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	appConfig, err := loadConfig(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
 	log.Infof("Loaded Configs:\nAMI Host: %s\nAMI Port: %d\nAMI User: %s\nHost Device ID: %s", *appConfig.AmiHost, *appConfig.AmiPort, *appConfig.AmiUsername, *appConfig.HostDeviceId)
-	amiEventConsumer := service.NewRabbitMQAmiEventConsumerService(appConfig)
-	amiService := service.NewAmiService(appConfig, amiEventConsumer)
+	if problems, err := preflight(appConfig); err != nil {
+		log.Infof("Skipped checking %s. Reason: %v", *appConfig.AmiConfPath, err)
+	} else {
+		for _, problem := range problems {
+			log.Warnf("AMI preflight: %s", problem)
+		}
+	}
+	if *appConfig.MetricsAddr != "" {
+		go serveMetrics(*appConfig.MetricsAddr)
+	}
+	log.Infof("Sinks: %v", *appConfig.Sinks)
+	amiEventConsumer, err := service.NewAmiEventConsumer(appConfig)
+	if err != nil {
+		log.Errorf("Failed to initialize sinks. Reason: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	sequencer, err := sequence.Open(*appConfig.SequenceFile)
+	if err != nil {
+		log.Errorf("Failed to open sequence file %s. Reason: %v", *appConfig.SequenceFile, err)
+		return 1
+	}
+	amiService := service.NewAmiService(appConfig, sequencer, amiEventConsumer)
 	log.Infof("Connecting to AMI.")
 	if err := amiService.Connect(); err != nil {
 		log.Errorf("Failed to connect to Asterisk. Reason: %v.", err)
-		return
+		return 1
 	}
 	log.Info("Logging in to AMI.")
 	if err := amiService.Login(); err != nil {
 		log.Errorf("Failed to login to Asterisk. Reason: %v.", err)
 	}
-	if amiService.IsLoggedIn() {
-		log.Info("Login Successful.")
-		if err := amiService.Listen(); err != nil {
-			if !strings.Contains(err.Error(), "use of closed network connection") {
-				log.Errorf("Error listening for events. Reason: %v.", err)
-				//} else if amiService.IsConnected() {
-				//	log.Errorf("Error listening for events. Reason: %v.", err)
-			}
+	if !amiService.IsLoggedIn() {
+		amiService.Disconnect()
+		return 1
+	}
+	log.Info("Login Successful.")
+	watcher, err := conf.Watch(newConfigReloader(amiService).reload)
+	if err != nil {
+		log.Errorf("Configuration changes won't be applied. Reason: %v", err)
+	} else {
+		defer watcher.Close()
+	}
+	if err := amiService.Listen(); err != nil {
+		if !strings.Contains(err.Error(), "use of closed network connection") {
+			log.Errorf("Error listening for events. Reason: %v.", err)
+			//} else if amiService.IsConnected() {
+			//	log.Errorf("Error listening for events. Reason: %v.", err)
 		}
 	}
 	amiService.Disconnect()
+	return 0
 }
 
-func loadEnv() {
-    viper.AutomaticEnv() // Read from system's environment variable
-    if _, err := os.Stat("config.json"); !os.IsNotExist(err) {
-        // Read from config.json if exists. Note: system's env variable still takes precedence
-        viper.SetConfigName("config")
-        viper.SetConfigType("json")
-        viper.AddConfigPath(".")
-        _ = viper.ReadInConfig()
-    }
+func serveMetrics(addr string) {
+	log.Infof("Serving metrics on http://%s/debug/vars", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Errorf("Failed to serve metrics on %s. Reason: %v", addr, err)
+	}
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"ami-reader/astconf"
+	"ami-reader/conf"
+	"net"
+	"strconv"
+)
+
+// preflight lists what in manager.conf would keep AMI_USER from logging in or from receiving the events of
+// AMI_EVENT_CLASSES. manager.conf can only be checked when it is readable, e.g. when running on the PBX.
+func preflight(appConfig *conf.AppConf) ([]string, error) {
+	managerConf, err := astconf.Load(*appConfig.AmiConfPath)
+	if err != nil {
+		return nil, err
+	}
+	manager := astconf.Manager{
+		User:    *appConfig.AmiUsername,
+		Port:    *appConfig.AmiPort,
+		Classes: *appConfig.AmiEventClasses,
+	}
+	manager.HostAddrs, _ = net.LookupIP(*appConfig.AmiHost)
+	// Nothing is sent over UDP, dialing only picks the local address connections to AMI come from
+	if con, err := net.Dial("udp", net.JoinHostPort(*appConfig.AmiHost, strconv.Itoa(*appConfig.AmiPort))); err == nil {
+		manager.LocalAddr = con.LocalAddr().(*net.UDPAddr).IP
+		con.Close()
+	}
+	return astconf.CheckManager(managerConf, manager), nil
+}
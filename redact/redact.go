@@ -0,0 +1,186 @@
+package redact
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "github.com/pkg/errors"
+    "path"
+    "strings"
+    "sync"
+)
+
+const (
+    ActionDrop     = "drop"
+    ActionMask     = "mask"
+    ActionTruncate = "truncate"
+    ActionHash     = "hash"
+)
+
+// maxCached bounds the rule lists cached by event name, AMI has far fewer event types
+const maxCached = 1024
+
+// alwaysDropped are never passed on whatever the rules, e.g. the secret of a Login action echoed in an event
+var alwaysDropped = []string{"secret"}
+
+// RuleConf applies an action to the fields of the events it matches.
+type RuleConf struct {
+    // Event names or patterns (*, ?, [...]). No events means every event.
+    Events []string `mapstructure:"events" json:"events"`
+    // Field names or patterns, not case sensitive
+    Fields []string `mapstructure:"fields" json:"fields"`
+    Action string   `mapstructure:"action" json:"action"`
+    // Trailing characters left in clear by mask
+    Keep int `mapstructure:"keep" json:"keep"`
+    // Leading characters kept by truncate
+    Length int `mapstructure:"length" json:"length"`
+}
+
+type rule struct {
+    events []string
+    fields []string
+    action string
+    keep   int
+    length int
+}
+
+func (rule *rule) matchesField(field string) bool {
+    field = strings.ToLower(field)
+    for _, pattern := range rule.fields {
+        if matched, _ := path.Match(pattern, field); matched {
+            return true
+        }
+    }
+    return false
+}
+
+// Redactor drops, masks, truncates or pseudonymises fields of events. For each field, the first rule matching
+// both the event and the field is applied. Hashing uses HMAC-SHA256 so the same value always gets the same
+// pseudonym without being reversible by anyone who doesn't have the key.
+type Redactor struct {
+    rules   []rule
+    hmacKey []byte
+    mutex   sync.RWMutex
+    // Rules matching each event name
+    cache map[string][]*rule
+}
+
+func New(rules []RuleConf, hmacKey string) (*Redactor, error) {
+    redactor := &Redactor{hmacKey: []byte(hmacKey), cache: make(map[string][]*rule)}
+    for i, ruleConf := range rules {
+        name := fmt.Sprintf("REDACT[%d]", i)
+        for _, pattern := range append(append([]string{}, ruleConf.Events...), ruleConf.Fields...) {
+            if _, err := path.Match(pattern, ""); err != nil {
+                return nil, errors.Wrap(err, fmt.Sprintf("Invalid pattern %s in %s.", pattern, name))
+            }
+        }
+        if len(ruleConf.Fields) == 0 {
+            return nil, errors.Errorf("Missing fields in %s", name)
+        }
+        switch ruleConf.Action {
+        case ActionDrop, ActionMask:
+        case ActionTruncate:
+            if ruleConf.Length < 0 {
+                return nil, errors.Errorf("Negative length in %s", name)
+            }
+        case ActionHash:
+            if hmacKey == "" {
+                return nil, errors.Errorf("%s hashes fields but REDACT_HMAC_KEY is not set", name)
+            }
+        default:
+            return nil, errors.Errorf("Unknown action %s in %s, expected %s, %s, %s or %s", ruleConf.Action, name, ActionDrop, ActionMask, ActionTruncate, ActionHash)
+        }
+        compiled := rule{events: ruleConf.Events, action: ruleConf.Action, keep: ruleConf.Keep, length: ruleConf.Length}
+        for _, field := range ruleConf.Fields {
+            compiled.fields = append(compiled.fields, strings.ToLower(field))
+        }
+        redactor.rules = append(redactor.rules, compiled)
+    }
+    return redactor, nil
+}
+
+// rulesOf returns the rules matching an event name.
+func (redactor *Redactor) rulesOf(name string) []*rule {
+    redactor.mutex.RLock()
+    rules, found := redactor.cache[name]
+    redactor.mutex.RUnlock()
+    if found {
+        return rules
+    }
+    rules = []*rule{}
+    for i := range redactor.rules {
+        rule := &redactor.rules[i]
+        if len(rule.events) == 0 || matchesAny(rule.events, name) {
+            rules = append(rules, rule)
+        }
+    }
+    redactor.mutex.Lock()
+    if len(redactor.cache) < maxCached {
+        redactor.cache[name] = rules
+    }
+    redactor.mutex.Unlock()
+    return rules
+}
+
+// Redact applies the rules to the fields of an event in place.
+func (redactor *Redactor) Redact(event map[string]string) {
+    rules := redactor.rulesOf(event["Event"])
+    for field, value := range event {
+        if matchesAny(alwaysDropped, strings.ToLower(field)) {
+            delete(event, field)
+            continue
+        }
+        for _, rule := range rules {
+            if !rule.matchesField(field) {
+                continue
+            }
+            switch rule.action {
+            case ActionDrop:
+                delete(event, field)
+            case ActionMask:
+                event[field] = mask(value, rule.keep)
+            case ActionTruncate:
+                event[field] = truncate(value, rule.length)
+            case ActionHash:
+                event[field] = redactor.hash(value)
+            }
+            break
+        }
+    }
+}
+
+func (redactor *Redactor) hash(value string) string {
+    mac := hmac.New(sha256.New, redactor.hmacKey)
+    mac.Write([]byte(value))
+    return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// mask replaces every character but the last keep ones with *.
+func mask(value string, keep int) string {
+    runes := []rune(value)
+    if keep < 0 {
+        keep = 0
+    }
+    for i := 0; i < len(runes)-keep; i++ {
+        runes[i] = '*'
+    }
+    return string(runes)
+}
+
+func truncate(value string, length int) string {
+    runes := []rune(value)
+    if len(runes) <= length {
+        return value
+    }
+    return string(runes[:length])
+}
+
+func matchesAny(patterns []string, value string) bool {
+    for _, pattern := range patterns {
+        if matched, _ := path.Match(pattern, value); matched {
+            return true
+        }
+    }
+    return false
+}
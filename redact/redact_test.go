@@ -0,0 +1,129 @@
+package redact
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestRedactorRedact(t *testing.T) {
+    event := func() map[string]string {
+        return map[string]string{
+            "Event":        "Newchannel",
+            "CallerIDNum":  "0612345678",
+            "CallerIDName": "Jean Dupont",
+            "Exten":        "100",
+            "Secret":       "hunter22",
+        }
+    }
+    tests := []struct {
+        name  string
+        rules []RuleConf
+        want  map[string]string
+    }{
+        {
+            name:  "no rules still drops secrets",
+            rules: nil,
+            want:  map[string]string{"Event": "Newchannel", "CallerIDNum": "0612345678", "CallerIDName": "Jean Dupont", "Exten": "100"},
+        },
+        {
+            name:  "drop",
+            rules: []RuleConf{{Fields: []string{"CallerIDName"}, Action: ActionDrop}},
+            want:  map[string]string{"Event": "Newchannel", "CallerIDNum": "0612345678", "Exten": "100"},
+        },
+        {
+            name:  "mask keeping the last digits",
+            rules: []RuleConf{{Fields: []string{"calleridnum"}, Action: ActionMask, Keep: 2}},
+            want:  map[string]string{"Event": "Newchannel", "CallerIDNum": "********78", "CallerIDName": "Jean Dupont", "Exten": "100"},
+        },
+        {
+            name:  "truncate",
+            rules: []RuleConf{{Fields: []string{"CallerID*"}, Action: ActionTruncate, Length: 4}},
+            want:  map[string]string{"Event": "Newchannel", "CallerIDNum": "0612", "CallerIDName": "Jean", "Exten": "100"},
+        },
+        {
+            name:  "rule of another event",
+            rules: []RuleConf{{Events: []string{"Hangup"}, Fields: []string{"*"}, Action: ActionDrop}},
+            want:  map[string]string{"Event": "Newchannel", "CallerIDNum": "0612345678", "CallerIDName": "Jean Dupont", "Exten": "100"},
+        },
+        {
+            name: "first matching rule wins",
+            rules: []RuleConf{
+                {Events: []string{"New*"}, Fields: []string{"CallerIDNum"}, Action: ActionMask},
+                {Fields: []string{"CallerID*"}, Action: ActionDrop},
+            },
+            want: map[string]string{"Event": "Newchannel", "CallerIDNum": "**********", "Exten": "100"},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            redactor, err := New(test.rules, "key")
+            if err != nil {
+                t.Fatal(err)
+            }
+            got := event()
+            redactor.Redact(got)
+            if !reflect.DeepEqual(got, test.want) {
+                t.Fatalf("Redact = %v, want %v", got, test.want)
+            }
+        })
+    }
+}
+
+func TestRedactorHashIsKeyed(t *testing.T) {
+    first, _ := New([]RuleConf{{Fields: []string{"CallerIDNum"}, Action: ActionHash}}, "first")
+    second, _ := New([]RuleConf{{Fields: []string{"CallerIDNum"}, Action: ActionHash}}, "second")
+    event := map[string]string{"Event": "Newchannel", "CallerIDNum": "0612345678"}
+    first.Redact(event)
+    if event["CallerIDNum"] != first.hash("0612345678") || len(event["CallerIDNum"]) != 32 {
+        t.Fatalf("CallerIDNum hashed as %s", event["CallerIDNum"])
+    }
+    if first.hash("0612345678") != first.hash("0612345678") {
+        t.Fatal("same value got different pseudonyms")
+    }
+    if first.hash("0612345678") == first.hash("0612345679") {
+        t.Fatal("different values got the same pseudonym")
+    }
+    if first.hash("0612345678") == second.hash("0612345678") {
+        t.Fatal("different keys gave the same pseudonym")
+    }
+}
+
+func TestNewFailsOnInvalidRule(t *testing.T) {
+    tests := []struct {
+        name string
+        rule RuleConf
+    }{
+        {"no fields", RuleConf{Action: ActionDrop}},
+        {"invalid pattern", RuleConf{Fields: []string{"[Caller"}, Action: ActionDrop}},
+        {"unknown action", RuleConf{Fields: []string{"Exten"}, Action: "encrypt"}},
+        {"negative length", RuleConf{Fields: []string{"Exten"}, Action: ActionTruncate, Length: -1}},
+        {"hash without key", RuleConf{Fields: []string{"Exten"}, Action: ActionHash}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if _, err := New([]RuleConf{test.rule}, ""); err == nil {
+                t.Fatal("New accepted an invalid rule")
+            }
+        })
+    }
+}
+
+func TestMask(t *testing.T) {
+    tests := []struct {
+        value string
+        keep  int
+        want  string
+    }{
+        {"0612345678", 0, "**********"},
+        {"0612345678", 4, "******5678"},
+        {"0612345678", 20, "0612345678"},
+        {"0612345678", -1, "**********"},
+        {"Zoë", 1, "**ë"},
+        {"", 2, ""},
+    }
+    for _, test := range tests {
+        if got := mask(test.value, test.keep); got != test.want {
+            t.Errorf("mask(%q, %d) = %q, want %q", test.value, test.keep, got, test.want)
+        }
+    }
+}
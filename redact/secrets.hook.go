@@ -0,0 +1,69 @@
+package redact
+
+import (
+    log "github.com/sirupsen/logrus"
+    "sort"
+    "strings"
+    "sync"
+)
+
+const secretMask = "******"
+
+// SecretsHook masks secrets, e.g. the AMI password, in the message and fields of every log entry. Secrets
+// are asked for on every entry, as they may be learnt after the hook is added, e.g. when a sink is created.
+type SecretsHook struct {
+    secrets  func() []string
+    mutex    sync.Mutex
+    replacer *strings.Replacer
+    // Number of secrets the replacer was made of
+    count int
+}
+
+func NewSecretsHook(secrets func() []string) *SecretsHook {
+    return &SecretsHook{secrets: secrets, replacer: strings.NewReplacer(), count: -1}
+}
+
+// current returns the replacer of the current secrets, which are only ever added to.
+func (hook *SecretsHook) current() *strings.Replacer {
+    secrets := hook.secrets()
+    hook.mutex.Lock()
+    defer hook.mutex.Unlock()
+    if len(secrets) != hook.count {
+        hook.replacer = NewSecretsReplacer(secrets)
+        hook.count = len(secrets)
+    }
+    return hook.replacer
+}
+
+// NewSecretsReplacer returns a replacer masking secrets, e.g. in text printed rather than logged. Every secret
+// is masked however short, a short one also masks the same text where it is not meant as a secret. Longer
+// secrets are matched first, so a secret holding a shorter one is masked whole.
+func NewSecretsReplacer(secrets []string) *strings.Replacer {
+    secrets = append([]string{}, secrets...)
+    sort.SliceStable(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+    var oldNew []string
+    for _, secret := range secrets {
+        if secret != "" {
+            oldNew = append(oldNew, secret, secretMask)
+        }
+    }
+    return strings.NewReplacer(oldNew...)
+}
+
+func (hook *SecretsHook) Levels() []log.Level {
+    return log.AllLevels
+}
+
+func (hook *SecretsHook) Fire(entry *log.Entry) error {
+    replacer := hook.current()
+    entry.Message = replacer.Replace(entry.Message)
+    for key, value := range entry.Data {
+        switch value := value.(type) {
+        case string:
+            entry.Data[key] = replacer.Replace(value)
+        case error:
+            entry.Data[key] = replacer.Replace(value.Error())
+        }
+    }
+    return nil
+}
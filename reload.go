@@ -0,0 +1,54 @@
+package main
+
+import (
+	"ami-reader/conf"
+	"ami-reader/redact"
+	"ami-reader/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// configReloader applies the settings changed in the config file, or on SIGHUP, to the running app.
+type configReloader struct {
+	amiService service.AmiService
+	// Settings currently applied
+	snapshot map[string]string
+}
+
+func newConfigReloader(amiService service.AmiService) *configReloader {
+	return &configReloader{amiService: amiService, snapshot: conf.Snapshot()}
+}
+
+func (reloader *configReloader) reload() {
+	if err := conf.Reread(); err != nil {
+		log.Errorf("Keeping current configuration. Reason: %v", err)
+		return
+	}
+	snapshot := conf.Snapshot()
+	changes := conf.Diff(reloader.snapshot, snapshot)
+	if len(changes) == 0 {
+		log.Info("Configuration reloaded, nothing changed.")
+		return
+	}
+	for _, change := range changes {
+		log.Infof("Configuration changed %s", change)
+	}
+	appConfig, err := conf.NewAppConf()
+	if err != nil {
+		log.Errorf("Keeping current configuration. Reason: %v", err)
+		return
+	}
+	if !reloader.amiService.Reload(appConfig, changes) {
+		return
+	}
+	reloader.snapshot = snapshot
+	applyLogSettings(appConfig.AmiConf)
+	log.Infof("Configuration reloaded, %d settings changed.", len(changes))
+}
+
+// applyLogSettings sets the log level and the secrets masked in logs.
+func applyLogSettings(amiConfig *conf.AmiConf) {
+	log.SetLevel(*amiConfig.LogLevel)
+	hooks := make(log.LevelHooks)
+	hooks.Add(redact.NewSecretsHook(conf.Secrets))
+	log.StandardLogger().ReplaceHooks(hooks)
+}
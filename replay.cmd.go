@@ -0,0 +1,164 @@
+package main
+
+import (
+	"ami-reader/conf"
+	"ami-reader/redact"
+	"ami-reader/replay"
+	"ami-reader/service"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+const replayUsage = `Usage: ami-reader replay [flags] <file or directory>...
+
+Republishes events from YYYY-MM-DD_events.log files through the configured sinks.
+
+Flags:
+`
+
+func runReplay(args []string) int {
+	flags := pflag.NewFlagSet("replay", pflag.ContinueOnError)
+	from := flags.String("from", "", "Replay events received at or after this time (RFC3339 or YYYY-MM-DD)")
+	to := flags.String("to", "", "Replay events received before this time (RFC3339 or YYYY-MM-DD)")
+	events := flags.StringSlice("event", nil, "Replay only these AMI events, e.g. Hangup,Newchannel")
+	hosts := flags.StringSlice("host", nil, "Replay only events of these host device ids")
+	rate := flags.Float64("rate", 100, "Maximum events per second, 0 for no limit")
+	sinks := flags.StringSlice("sinks", nil, "Sinks to replay to. Defaults to SINKS")
+	checkpointFile := flags.String("checkpoint", "replay.checkpoint", "File where progress is kept to resume an interrupted replay")
+	dryRun := flags.Bool("dry-run", false, "Print the matching events instead of replaying them")
+	conf.RegisterFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, replayUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	filter := replay.Filter{Events: *events, HostDeviceIds: *hosts}
+	var err error
+	if filter.From, err = parseReplayTime(*from); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --from: %v\n", err)
+		return 2
+	}
+	if filter.To, err = parseReplayTime(*to); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --to: %v\n", err)
+		return 2
+	}
+	files, err := replay.ResolveFiles(flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read event logs: %v\n", err)
+		return 1
+	}
+	checkpoint, err := replay.LoadCheckpoint(*checkpointFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load checkpoint: %v\n", err)
+		return 1
+	}
+	stop := make(chan struct{})
+	replayer := &replay.Replayer{Filter: filter, Rate: *rate, DryRun: *dryRun, Checkpoint: checkpoint, Stop: stop}
+
+	if !*dryRun {
+		if err = conf.Load(flags); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		appConfig, err := conf.NewAppConf()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to initialize app config: %v\n", err)
+			return 1
+		}
+		log.AddHook(redact.NewSecretsHook(conf.Secrets))
+		if len(*sinks) > 0 {
+			appConfig.Sinks = sinks
+		}
+		// Logged events were enriched and went through the transform pipeline already, only their field types are needed
+		appConfig.Enricher = nil
+		appConfig.Transform = appConfig.Transform.WithoutSteps()
+		session := &replaySinks{appConfig: appConfig}
+		// Makes sure the sinks can be initialized before anything is read
+		if err = session.open(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to initialize sinks: %v\n", err)
+			return 1
+		}
+		defer session.drain()
+		replayer.Consume = session.consume
+		replayer.Drain = session.drain
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, os.Interrupt)
+		go func() {
+			<-signalChan
+			log.Info("Received an interrupt, stopping replay...")
+			close(stop)
+		}()
+	}
+
+	log.Infof("Replaying %s.", strings.Join(files, ", "))
+	stats, err := replayer.Run(files)
+	fmt.Fprintf(os.Stderr, "Read %d events, %d matched, %d invalid, %d replayed.\n", stats.Read, stats.Matched, stats.Invalid, stats.Replayed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func parseReplayTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// replaySinks hands replayed events to the sinks. drain destroys them, which waits until they delivered or spooled
+// every event, so a checkpoint saved afterwards never skips events that were only queued. The next event opens
+// them again.
+type replaySinks struct {
+	appConfig *conf.AppConf
+	consumer  service.AmiEventConsumer
+	err       error
+}
+
+func (sinks *replaySinks) open() error {
+	consumer, err := service.NewAmiEventConsumer(sinks.appConfig)
+	if err == nil {
+		err = consumer.Initialize()
+	}
+	if err != nil {
+		return err
+	}
+	sinks.consumer = consumer
+	return nil
+}
+
+func (sinks *replaySinks) consume(event map[string]string) {
+	if sinks.consumer == nil {
+		if err := sinks.open(); err != nil {
+			// Reported by the next drain, so the checkpoint stays where it is
+			sinks.err = err
+			return
+		}
+	}
+	sinks.consumer.Consume(event)
+}
+
+func (sinks *replaySinks) drain() error {
+	if sinks.consumer != nil {
+		sinks.consumer.Destroy()
+		sinks.consumer = nil
+	}
+	err := sinks.err
+	sinks.err = nil
+	return err
+}
@@ -0,0 +1,250 @@
+package replay
+
+import (
+    "ami-reader/serializer"
+    "ami-reader/util"
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "github.com/pkg/errors"
+    log "github.com/sirupsen/logrus"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "time"
+)
+
+const eventLogSuffix = "_events.log"
+
+// Filter selects the events to replay. Zero values match everything.
+type Filter struct {
+    From          time.Time
+    To            time.Time
+    Events        []string
+    HostDeviceIds []string
+}
+
+func (filter *Filter) Match(event map[string]string) bool {
+    if len(filter.Events) > 0 {
+        if _, found := util.Find(filter.Events, event["Event"]); !found {
+            return false
+        }
+    }
+    if len(filter.HostDeviceIds) > 0 {
+        if _, found := util.Find(filter.HostDeviceIds, event["host_device_id"]); !found {
+            return false
+        }
+    }
+    if filter.From.IsZero() && filter.To.IsZero() {
+        return true
+    }
+    timestamp, ok := serializer.EventTime(event)
+    if !ok {
+        return false
+    }
+    return (filter.From.IsZero() || !timestamp.Before(filter.From)) && (filter.To.IsZero() || timestamp.Before(filter.To))
+}
+
+// Checkpoint keeps the byte offset up to which each file was replayed.
+type Checkpoint struct {
+    path  string
+    Files map[string]int64 `json:"files"`
+}
+
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+    checkpoint := &Checkpoint{path: path, Files: make(map[string]int64)}
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return checkpoint, nil
+    } else if err != nil {
+        return nil, err
+    }
+    if err = json.Unmarshal(data, checkpoint); err != nil {
+        return nil, errors.Wrap(err, fmt.Sprintf("Invalid checkpoint file %s.", path))
+    }
+    if checkpoint.Files == nil {
+        checkpoint.Files = make(map[string]int64)
+    }
+    return checkpoint, nil
+}
+
+func (checkpoint *Checkpoint) Save() error {
+    data, err := json.MarshalIndent(checkpoint, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmpFile := checkpoint.path + ".tmp"
+    if err = ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmpFile, checkpoint.path)
+}
+
+// ResolveFiles expands directories to the YYYY-MM-DD_events.log files they contain, oldest first.
+func ResolveFiles(paths []string) ([]string, error) {
+    var files []string
+    for _, path := range paths {
+        info, err := os.Stat(path)
+        if err != nil {
+            return nil, err
+        }
+        if !info.IsDir() {
+            files = append(files, path)
+            continue
+        }
+        matches, err := filepath.Glob(filepath.Join(path, "*"+eventLogSuffix))
+        if err != nil {
+            return nil, err
+        }
+        // File names start with the date so sorting by name is chronological
+        sort.Strings(matches)
+        files = append(files, matches...)
+    }
+    return files, nil
+}
+
+type Stats struct {
+    Read     int
+    Matched  int
+    Invalid  int
+    Replayed int
+}
+
+type Replayer struct {
+    Filter     Filter
+    Rate       float64 // events per second, 0 means no limit
+    DryRun     bool
+    Checkpoint *Checkpoint
+    Consume    func(event map[string]string)
+    // Drain returns once the sinks delivered every event consumed so far. The checkpoint of a file is only
+    // saved afterwards, so events queued but not delivered yet are replayed again on the next run.
+    Drain func() error
+    Stop  <-chan struct{}
+}
+
+// Run replays the matching events of the files. On dry run matching events are printed instead.
+func (replayer *Replayer) Run(files []string) (Stats, error) {
+    var stats Stats
+    var throttle <-chan time.Time
+    if replayer.Rate > 0 {
+        ticker := time.NewTicker(time.Duration(float64(time.Second) / replayer.Rate))
+        defer ticker.Stop()
+        throttle = ticker.C
+    }
+    for _, file := range files {
+        stopped, err := replayer.replayFile(file, throttle, &stats)
+        if err != nil || stopped {
+            return stats, err
+        }
+    }
+    return stats, nil
+}
+
+func (replayer *Replayer) replayFile(fileName string, throttle <-chan time.Time, stats *Stats) (bool, error) {
+    path, err := filepath.Abs(fileName)
+    if err != nil {
+        return false, err
+    }
+    file, err := os.Open(path)
+    if err != nil {
+        return false, err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return false, err
+    }
+    // Today's file may still be written to, e.g. by a sink failing to publish what is replayed. Stop at its current end.
+    end := info.Size()
+    offset := replayer.Checkpoint.Files[path]
+    if offset >= end {
+        log.Infof("Skipping %s, already replayed.", path)
+        return false, nil
+    }
+    if _, err = file.Seek(offset, io.SeekStart); err != nil {
+        return false, err
+    }
+    log.Infof("Replaying %s from offset %d.", path, offset)
+    reader := bufio.NewReader(io.LimitReader(file, end-offset))
+    for {
+        line, readErr := reader.ReadBytes('\n')
+        if len(line) > 0 {
+            if stopped := replayer.replayLine(line, throttle, stats); stopped {
+                return true, replayer.save(path, offset)
+            }
+            offset += int64(len(line))
+        }
+        if readErr == io.EOF {
+            break
+        } else if readErr != nil {
+            // Keeps what was replayed up to the unreadable part
+            if err = replayer.save(path, offset); err != nil {
+                log.Error(err)
+            }
+            return false, readErr
+        }
+    }
+    return false, replayer.save(path, offset)
+}
+
+// replayLine returns true when the replay was stopped before the line was replayed.
+func (replayer *Replayer) replayLine(line []byte, throttle <-chan time.Time, stats *Stats) bool {
+    line = bytes.TrimSpace(line)
+    if len(line) == 0 {
+        return false
+    }
+    var event map[string]string
+    if err := json.Unmarshal(line, &event); err != nil {
+        stats.Read++
+        stats.Invalid++
+        log.Warnf("Skipping invalid event %s. Reason: %v", string(line), err)
+        return false
+    }
+    if !replayer.Filter.Match(event) {
+        stats.Read++
+        return false
+    }
+    if !replayer.DryRun {
+        select {
+        case <-replayer.Stop:
+            return true
+        default:
+        }
+        if throttle != nil {
+            select {
+            case <-throttle:
+            case <-replayer.Stop:
+                return true
+            }
+        }
+    }
+    stats.Read++
+    stats.Matched++
+    if replayer.DryRun {
+        fmt.Println(string(line))
+        return false
+    }
+    replayer.Consume(event)
+    stats.Replayed++
+    return false
+}
+
+// save drains the sinks and keeps offset as the point the file was replayed up to.
+func (replayer *Replayer) save(path string, offset int64) error {
+    if replayer.DryRun {
+        return nil
+    }
+    if replayer.Drain != nil {
+        if err := replayer.Drain(); err != nil {
+            return errors.Wrap(err, fmt.Sprintf("Failed to deliver the events replayed from %s, checkpoint not saved.", path))
+        }
+    }
+    replayer.Checkpoint.Files[path] = offset
+    if err := replayer.Checkpoint.Save(); err != nil {
+        return errors.Wrap(err, "Failed to save replay checkpoint.")
+    }
+    return nil
+}
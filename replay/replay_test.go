@@ -0,0 +1,116 @@
+package replay
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func writeEventLog(t *testing.T, dir string, name string, lines ...string) string {
+    t.Helper()
+    path := filepath.Join(dir, name)
+    var data []byte
+    for _, line := range lines {
+        data = append(data, line+"\n"...)
+    }
+    if err := ioutil.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestFilterMatch(t *testing.T) {
+    from, _ := time.Parse(time.RFC3339, "2020-03-01T10:00:00Z")
+    to, _ := time.Parse(time.RFC3339, "2020-03-01T11:00:00Z")
+    tests := []struct {
+        name   string
+        filter Filter
+        event  map[string]string
+        want   bool
+    }{
+        {"no filter", Filter{}, map[string]string{"Event": "Hangup"}, true},
+        {"event listed", Filter{Events: []string{"Hangup"}}, map[string]string{"Event": "Hangup"}, true},
+        {"event not listed", Filter{Events: []string{"Hangup"}}, map[string]string{"Event": "Newchannel"}, false},
+        {"host not listed", Filter{HostDeviceIds: []string{"pbx1"}}, map[string]string{"host_device_id": "pbx2"}, false},
+        {"within range", Filter{From: from, To: to}, map[string]string{"timestamp": "2020-03-01T10:30:00Z"}, true},
+        {"range is inclusive at from", Filter{From: from, To: to}, map[string]string{"timestamp": "2020-03-01T10:00:00Z"}, true},
+        {"range is exclusive at to", Filter{From: from, To: to}, map[string]string{"timestamp": "2020-03-01T11:00:00Z"}, false},
+        {"timestamp_dt", Filter{From: from}, map[string]string{"timestamp_dt": "2020-03-01T10:30:00Z"}, true},
+        {"no timestamp with range", Filter{From: from}, map[string]string{"Event": "Hangup"}, false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if got := test.filter.Match(test.event); got != test.want {
+                t.Fatalf("Match = %v, want %v", got, test.want)
+            }
+        })
+    }
+}
+
+func TestReplaySavesCheckpointAfterDrain(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "replay")
+    defer os.RemoveAll(dir)
+    first := writeEventLog(t, dir, "2020-03-01_events.log", `{"Event":"Newchannel"}`, `not json`, `{"Event":"Hangup"}`)
+    second := writeEventLog(t, dir, "2020-03-02_events.log", `{"Event":"Newchannel"}`)
+    checkpoint, _ := LoadCheckpoint(filepath.Join(dir, "checkpoint"))
+    queued, delivered := 0, 0
+    var saved []map[string]int64
+    replayer := &Replayer{
+        Checkpoint: checkpoint,
+        Consume:    func(event map[string]string) { queued++ },
+        Drain: func() error {
+            delivered = queued
+            loaded, _ := LoadCheckpoint(checkpoint.path)
+            saved = append(saved, loaded.Files)
+            return nil
+        },
+    }
+    files, err := ResolveFiles([]string{dir})
+    if err != nil {
+        t.Fatal(err)
+    }
+    stats, err := replayer.Run(files)
+    if err != nil {
+        t.Fatalf("Run: %v", err)
+    }
+    if stats.Replayed != 3 || stats.Invalid != 1 || delivered != 3 {
+        t.Fatalf("stats = %+v, delivered %d", stats, delivered)
+    }
+    // Drained once per file, each time before the checkpoint of the file was written
+    if len(saved) != 2 || len(saved[0]) != 0 || len(saved[1]) != 1 {
+        t.Fatalf("checkpoints seen while draining = %v", saved)
+    }
+    loaded, _ := LoadCheckpoint(checkpoint.path)
+    firstPath, _ := filepath.Abs(first)
+    secondPath, _ := filepath.Abs(second)
+    if loaded.Files[firstPath] != 51 || loaded.Files[secondPath] != 23 {
+        t.Fatalf("checkpoint = %v", loaded.Files)
+    }
+
+    // Everything was replayed, a second run skips both files
+    queued = 0
+    if _, err = replayer.Run(files); err != nil || queued != 0 {
+        t.Fatalf("second run replayed %d events, err %v", queued, err)
+    }
+}
+
+func TestReplayKeepsCheckpointWhenDrainFails(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "replay")
+    defer os.RemoveAll(dir)
+    writeEventLog(t, dir, "2020-03-01_events.log", `{"Event":"Newchannel"}`)
+    checkpoint, _ := LoadCheckpoint(filepath.Join(dir, "checkpoint"))
+    replayer := &Replayer{
+        Checkpoint: checkpoint,
+        Consume:    func(event map[string]string) {},
+        Drain:      func() error { return os.ErrClosed },
+    }
+    files, _ := ResolveFiles([]string{dir})
+    if _, err := replayer.Run(files); err == nil {
+        t.Fatal("Run succeeded although the sinks failed")
+    }
+    if _, err := os.Stat(checkpoint.path); !os.IsNotExist(err) {
+        t.Fatalf("checkpoint saved: %v", err)
+    }
+}
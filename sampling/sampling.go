@@ -0,0 +1,222 @@
+package sampling
+
+import (
+    "expvar"
+    "fmt"
+    "github.com/pkg/errors"
+    "hash/fnv"
+    "math"
+    "path"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// ReportEvent is the name of the events reporting how many events were suppressed in a window.
+const ReportEvent = "SuppressedEvents"
+
+// Window is the interval suppressed events are counted over.
+const Window = time.Minute
+
+// Suppression counters, exposed through expvar (see METRICS_ADDR)
+var stats = expvar.NewMap("sampling")
+
+// RuleConf samples and rate limits the events it matches.
+type RuleConf struct {
+    // Event names or patterns (*, ?, [...]). No events means every event.
+    Events []string `mapstructure:"events" json:"events"`
+    // Ratio of calls kept, by Uniqueid. 0 or 1 keeps every call.
+    Sample float64 `mapstructure:"sample" json:"sample"`
+    // Events per second kept of each event type. 0 means no limit.
+    Rate float64 `mapstructure:"rate" json:"rate"`
+    // Events let through at once before Rate applies. Defaults to Rate rounded up.
+    Burst int `mapstructure:"burst" json:"burst"`
+}
+
+type rule struct {
+    events []string
+    sample float64
+    rate   float64
+    burst  float64
+}
+
+func (rule *rule) matches(name string) bool {
+    if len(rule.events) == 0 {
+        return true
+    }
+    for _, pattern := range rule.events {
+        if matched, _ := path.Match(pattern, name); matched {
+            return true
+        }
+    }
+    return false
+}
+
+// counts of an event type in the current window, along with its token bucket
+type eventType struct {
+    rule        *rule
+    tokens      float64
+    refilled    time.Time
+    kept        int64
+    sampledOut  int64
+    rateLimited int64
+}
+
+// Sampler keeps a ratio of the calls, by hashing their Uniqueid, and limits the rate of every event type.
+// The hash doesn't depend on the event type, so a call kept at a ratio is kept by every rule with a higher
+// ratio too and keeps all of its events. Suppressed events are counted per minute and reported through
+// ReportEvent events so the kept ones can be reweighted.
+type Sampler struct {
+    rules  []rule
+    mutex  sync.Mutex
+    types  map[string]*eventType
+    window time.Time
+    // Reports of ended windows not taken yet
+    reports []map[string]string
+}
+
+func New(rules []RuleConf) (*Sampler, error) {
+    sampler := &Sampler{types: make(map[string]*eventType)}
+    for i, ruleConf := range rules {
+        name := fmt.Sprintf("SAMPLING[%d]", i)
+        for _, pattern := range ruleConf.Events {
+            if _, err := path.Match(pattern, ""); err != nil {
+                return nil, errors.Wrap(err, fmt.Sprintf("Invalid pattern %s in %s.", pattern, name))
+            }
+        }
+        if ruleConf.Sample < 0 || ruleConf.Sample > 1 {
+            return nil, errors.Errorf("Sample of %s should be between 0 and 1", name)
+        }
+        if ruleConf.Rate < 0 || ruleConf.Burst < 0 {
+            return nil, errors.Errorf("Rate and burst of %s should not be negative", name)
+        }
+        sample := ruleConf.Sample
+        if sample == 0 {
+            sample = 1
+        }
+        burst := float64(ruleConf.Burst)
+        if burst == 0 {
+            burst = math.Max(1, math.Ceil(ruleConf.Rate))
+        }
+        sampler.rules = append(sampler.rules, rule{events: ruleConf.Events, sample: sample, rate: ruleConf.Rate, burst: burst})
+    }
+    return sampler, nil
+}
+
+// Empty tells whether the sampler keeps every event.
+func (sampler *Sampler) Empty() bool {
+    return sampler == nil || len(sampler.rules) == 0
+}
+
+// Allow tells whether an event read at now is kept. Only the first rule matching the event applies.
+func (sampler *Sampler) Allow(event map[string]string, now time.Time) bool {
+    if sampler.Empty() {
+        return true
+    }
+    sampler.mutex.Lock()
+    defer sampler.mutex.Unlock()
+    sampler.roll(now)
+    name := event["Event"]
+    counts, found := sampler.types[name]
+    if !found {
+        counts = &eventType{rule: sampler.match(name), refilled: now}
+        if counts.rule != nil {
+            counts.tokens = counts.rule.burst
+        }
+        sampler.types[name] = counts
+    }
+    rule := counts.rule
+    if rule == nil {
+        return true
+    }
+    if rule.sample < 1 && !sampled(event["Uniqueid"], rule.sample) {
+        counts.sampledOut++
+        stats.Add("sampled_out", 1)
+        return false
+    }
+    if rule.rate > 0 {
+        counts.tokens = math.Min(rule.burst, counts.tokens+now.Sub(counts.refilled).Seconds()*rule.rate)
+        counts.refilled = now
+        if counts.tokens < 1 {
+            counts.rateLimited++
+            stats.Add("rate_limited", 1)
+            return false
+        }
+        counts.tokens--
+    }
+    counts.kept++
+    return true
+}
+
+// Reports returns a ReportEvent event for every event type suppressed in the windows ended before now.
+func (sampler *Sampler) Reports(now time.Time) []map[string]string {
+    if sampler.Empty() {
+        return nil
+    }
+    sampler.mutex.Lock()
+    defer sampler.mutex.Unlock()
+    sampler.roll(now)
+    reports := sampler.reports
+    sampler.reports = nil
+    return reports
+}
+
+func (sampler *Sampler) match(name string) *rule {
+    for i := range sampler.rules {
+        if sampler.rules[i].matches(name) {
+            return &sampler.rules[i]
+        }
+    }
+    return nil
+}
+
+// roll ends the current window when now is past it. Caller holds mutex.
+func (sampler *Sampler) roll(now time.Time) {
+    window := now.Truncate(Window)
+    if !window.After(sampler.window) {
+        return
+    }
+    names := make([]string, 0, len(sampler.types))
+    for name, counts := range sampler.types {
+        if counts.sampledOut > 0 || counts.rateLimited > 0 {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        counts := sampler.types[name]
+        sampler.reports = append(sampler.reports, map[string]string{
+            "Event":            ReportEvent,
+            "suppressed_event": name,
+            "window_start":     sampler.window.UTC().Format(time.RFC3339),
+            "window_end":       sampler.window.Add(Window).UTC().Format(time.RFC3339),
+            "kept":             strconv.FormatInt(counts.kept, 10),
+            "sampled_out":      strconv.FormatInt(counts.sampledOut, 10),
+            "rate_limited":     strconv.FormatInt(counts.rateLimited, 10),
+            "sample":           strconv.FormatFloat(counts.rule.sample, 'f', -1, 64),
+        })
+        stats.Add("reports", 1)
+    }
+    for _, counts := range sampler.types {
+        counts.kept, counts.sampledOut, counts.rateLimited = 0, 0, 0
+    }
+    sampler.window = window
+}
+
+// sampled tells whether the call of uniqueid is in the kept ratio. Events without a Uniqueid are kept.
+func sampled(uniqueid string, ratio float64) bool {
+    if uniqueid == "" {
+        return true
+    }
+    hash := fnv.New64a()
+    _, _ = hash.Write([]byte(uniqueid))
+    // FNV alone spreads ids differing only in their last digits poorly, mix the bits (MurmurHash3 finalizer)
+    x := hash.Sum64()
+    x ^= x >> 33
+    x *= 0xff51afd7ed558ccd
+    x ^= x >> 33
+    x *= 0xc4ceb9fe1a85ec53
+    x ^= x >> 33
+    return float64(x)/math.MaxUint64 < ratio
+}
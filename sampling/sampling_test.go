@@ -0,0 +1,162 @@
+package sampling
+
+import (
+    "fmt"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestSamplerRateLimit(t *testing.T) {
+    start := time.Date(2020, 3, 1, 10, 30, 0, 0, time.UTC)
+    tests := []struct {
+        name  string
+        rule  RuleConf
+        event string
+        // Offsets the events are read at
+        at   []time.Duration
+        want []bool
+    }{
+        {
+            name:  "burst then rate",
+            rule:  RuleConf{Rate: 2, Burst: 3},
+            event: "VarSet",
+            at:    []time.Duration{0, 0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond},
+            want:  []bool{true, true, true, false, true, false},
+        },
+        {
+            name:  "burst defaults to the rate",
+            rule:  RuleConf{Rate: 2},
+            event: "VarSet",
+            at:    []time.Duration{0, 0, 0, time.Second, time.Second, time.Second},
+            want:  []bool{true, true, false, true, true, false},
+        },
+        {
+            name:  "fraction of a rate",
+            rule:  RuleConf{Rate: 0.5},
+            event: "VarSet",
+            at:    []time.Duration{0, time.Second, 2 * time.Second},
+            want:  []bool{true, false, true},
+        },
+        {
+            name:  "other events",
+            rule:  RuleConf{Events: []string{"Var*"}, Rate: 1},
+            event: "Hangup",
+            at:    []time.Duration{0, 0, 0},
+            want:  []bool{true, true, true},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            sampler, err := New([]RuleConf{test.rule})
+            if err != nil {
+                t.Fatal(err)
+            }
+            var got []bool
+            for _, at := range test.at {
+                got = append(got, sampler.Allow(map[string]string{"Event": test.event}, start.Add(at)))
+            }
+            if !reflect.DeepEqual(got, test.want) {
+                t.Fatalf("Allow = %v, want %v", got, test.want)
+            }
+        })
+    }
+}
+
+func TestSamplerKeepsWholeCalls(t *testing.T) {
+    sampler, err := New([]RuleConf{{Events: []string{"Newchannel"}, Sample: 0.3}, {Sample: 0.6}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Date(2020, 3, 1, 10, 30, 0, 0, time.UTC)
+    const calls = 10000
+    kept := 0
+    for i := 0; i < calls; i++ {
+        uniqueid := fmt.Sprintf("1584011234.%d", i)
+        newchannel := sampler.Allow(map[string]string{"Event": "Newchannel", "Uniqueid": uniqueid}, now)
+        hangup := sampler.Allow(map[string]string{"Event": "Hangup", "Uniqueid": uniqueid}, now)
+        // A call kept at 0.3 is kept at 0.6 too
+        if newchannel && !hangup {
+            t.Fatalf("call %s kept by Newchannel but not by Hangup", uniqueid)
+        }
+        if newchannel {
+            kept++
+        }
+    }
+    if ratio := float64(kept) / calls; ratio < 0.27 || ratio > 0.33 {
+        t.Fatalf("kept %.3f of the calls, want about 0.3", ratio)
+    }
+    if !sampler.Allow(map[string]string{"Event": "Newchannel"}, now) {
+        t.Fatal("event without Uniqueid not kept")
+    }
+}
+
+func TestSamplerReports(t *testing.T) {
+    sampler, err := New([]RuleConf{{Events: []string{"VarSet"}, Rate: 1}, {Events: []string{"Newexten"}, Sample: 0.5}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    start := time.Date(2020, 3, 1, 10, 30, 0, 0, time.UTC)
+    for i := 0; i < 3; i++ {
+        sampler.Allow(map[string]string{"Event": "VarSet"}, start)
+    }
+    sampledOut := 0
+    for i := 0; i < 100; i++ {
+        if !sampler.Allow(map[string]string{"Event": "Newexten", "Uniqueid": fmt.Sprintf("1584011234.%d", i)}, start) {
+            sampledOut++
+        }
+    }
+    sampler.Allow(map[string]string{"Event": "Hangup"}, start)
+    if reports := sampler.Reports(start.Add(59 * time.Second)); len(reports) != 0 {
+        t.Fatalf("reports before the window ended: %v", reports)
+    }
+    reports := sampler.Reports(start.Add(Window))
+    want := []map[string]string{
+        {
+            "Event":            ReportEvent,
+            "suppressed_event": "Newexten",
+            "window_start":     "2020-03-01T10:30:00Z",
+            "window_end":       "2020-03-01T10:31:00Z",
+            "kept":             fmt.Sprint(100 - sampledOut),
+            "sampled_out":      fmt.Sprint(sampledOut),
+            "rate_limited":     "0",
+            "sample":           "0.5",
+        },
+        {
+            "Event":            ReportEvent,
+            "suppressed_event": "VarSet",
+            "window_start":     "2020-03-01T10:30:00Z",
+            "window_end":       "2020-03-01T10:31:00Z",
+            "kept":             "1",
+            "sampled_out":      "0",
+            "rate_limited":     "2",
+            "sample":           "1",
+        },
+    }
+    if !reflect.DeepEqual(reports, want) {
+        t.Fatalf("Reports = %v, want %v", reports, want)
+    }
+    if reports := sampler.Reports(start.Add(3 * Window)); len(reports) != 0 {
+        t.Fatalf("reports of windows without suppressed events: %v", reports)
+    }
+}
+
+func TestNewFailsOnInvalidRule(t *testing.T) {
+    tests := []struct {
+        name string
+        rule RuleConf
+    }{
+        {"invalid pattern", RuleConf{Events: []string{"[Var"}}},
+        {"sample above 1", RuleConf{Sample: 1.5}},
+        {"negative sample", RuleConf{Sample: -0.1}},
+        {"negative rate", RuleConf{Rate: -1}},
+        {"negative burst", RuleConf{Burst: -1}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if _, err := New([]RuleConf{test.rule}); err == nil {
+                t.Fatal("New accepted an invalid rule")
+            }
+        })
+    }
+}
@@ -0,0 +1,358 @@
+package script
+
+import (
+    "context"
+    "expvar"
+    "fmt"
+    "github.com/fsnotify/fsnotify"
+    "github.com/pkg/errors"
+    log "github.com/sirupsen/logrus"
+    "github.com/yuin/gopher-lua"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ProcessFunction is the global function every script defines, it is called with each event.
+const ProcessFunction = "process"
+
+// Files are reloaded once they have not changed for that long, so a script being written is not read half way
+const reloadDelay = 500 * time.Millisecond
+
+// Bounds of the Lua stacks of a script, a runaway recursion fails instead of growing without limit
+const (
+    callStackSize   = 200
+    registrySize    = 1024 * 20
+    registryMaxSize = 1024 * 80
+)
+
+// Bounds of what a script may allocate through string.rep and hand back. Memory is not metered otherwise,
+// tables and strings built by concatenation are only bounded by the timeout.
+const (
+    maxStringSize  = 1 << 20
+    maxEmitted     = 100
+    maxOutputBytes = 1 << 20
+)
+
+var scriptStats = expvar.NewMap("script")
+
+// script is a loaded script file. Its state is only used by one event at a time.
+type script struct {
+    path    string
+    mutex   sync.Mutex
+    state   *lua.LState
+    process *lua.LFunction
+    // Events emitted by the running invocation and the bytes of their fields
+    emitted    []map[string]string
+    outputSize int
+}
+
+// load compiles the file and runs its top level code in a fresh sandboxed state.
+func load(path string) (*script, error) {
+    state := lua.NewState(lua.Options{
+        SkipOpenLibs:        true,
+        CallStackSize:       callStackSize,
+        RegistrySize:        registrySize,
+        RegistryMaxSize:     registryMaxSize,
+        IncludeGoStackTrace: false,
+    })
+    // No io, os or package library, scripts only see the event
+    for _, lib := range []struct {
+        name string
+        open lua.LGFunction
+    }{{lua.BaseLibName, lua.OpenBase}, {lua.TabLibName, lua.OpenTable}, {lua.StringLibName, lua.OpenString}, {lua.MathLibName, lua.OpenMath}} {
+        state.Push(state.NewFunction(lib.open))
+        state.Push(lua.LString(lib.name))
+        state.Call(1, 0)
+    }
+    for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+        state.SetGlobal(name, lua.LNil)
+    }
+    // Also reached as a method of strings, e.g. s:rep(n), through the string metatable
+    state.GetGlobal(lua.StringLibName).(*lua.LTable).RawSetString("rep", state.NewFunction(rep))
+    loaded := &script{path: path, state: state}
+    state.SetGlobal("emit", state.NewFunction(loaded.emit))
+    state.SetGlobal("log", state.NewFunction(loaded.log))
+    if err := state.DoFile(path); err != nil {
+        state.Close()
+        return nil, errors.Wrap(err, fmt.Sprintf("Failed to load script %s.", path))
+    }
+    process, ok := state.GetGlobal(ProcessFunction).(*lua.LFunction)
+    if !ok {
+        state.Close()
+        return nil, errors.Errorf("Script %s does not define a %s(event) function", path, ProcessFunction)
+    }
+    loaded.process = process
+    return loaded, nil
+}
+
+// rep(s, n) is string.rep refusing to build a string longer than maxStringSize.
+func rep(state *lua.LState) int {
+    str := state.CheckString(1)
+    n := state.CheckInt(2)
+    if n > 0 && int64(len(str))*int64(n) > maxStringSize {
+        state.RaiseError("string.rep result exceeds %d bytes", maxStringSize)
+        return 0
+    }
+    state.Push(lua.LString(strings.Repeat(str, n)))
+    return 1
+}
+
+// emit(event) sends an extra event after the one being processed.
+func (script *script) emit(state *lua.LState) int {
+    if len(script.emitted) >= maxEmitted {
+        state.RaiseError("more than %d events emitted", maxEmitted)
+        return 0
+    }
+    event := toEvent(state.CheckTable(1))
+    if err := script.addOutput(event); err != nil {
+        state.RaiseError("%v", err)
+        return 0
+    }
+    script.emitted = append(script.emitted, event)
+    return 0
+}
+
+// addOutput counts the bytes of an event handed back by the running invocation.
+func (script *script) addOutput(event map[string]string) error {
+    for key, value := range event {
+        script.outputSize += len(key) + len(value)
+    }
+    if script.outputSize > maxOutputBytes {
+        return errors.Errorf("events handed back exceed %d bytes", maxOutputBytes)
+    }
+    return nil
+}
+
+// log(message) logs a message of the script at info level.
+func (script *script) log(state *lua.LState) int {
+    log.Infof("[%s] %s", filepath.Base(script.path), state.CheckString(1))
+    return 0
+}
+
+// run calls process with an event. It returns the event, changed in place by the script, followed by the
+// events it emitted. The event is left out when process returns false.
+func (script *script) run(event map[string]string, timeout time.Duration) ([]map[string]string, error) {
+    script.mutex.Lock()
+    defer script.mutex.Unlock()
+    state := script.state
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    state.SetContext(ctx)
+    defer state.RemoveContext()
+    script.emitted = nil
+    script.outputSize = 0
+    table := toTable(state, event)
+    err := state.CallByParam(lua.P{Fn: script.process, NRet: 1, Protect: true}, table)
+    if err != nil {
+        state.SetTop(0)
+        if ctx.Err() == context.DeadlineExceeded {
+            scriptStats.Add("timed_out", 1)
+            return nil, errors.Errorf("Script %s took more than %v", script.path, timeout)
+        }
+        return nil, err
+    }
+    keep := state.Get(-1) != lua.LFalse
+    state.Pop(1)
+    var events []map[string]string
+    if keep {
+        result := toEvent(table)
+        if err = script.addOutput(result); err != nil {
+            return nil, errors.Wrap(err, fmt.Sprintf("Script %s failed.", script.path))
+        }
+        events = append(events, result)
+    } else {
+        scriptStats.Add("dropped", 1)
+    }
+    scriptStats.Add("emitted", int64(len(script.emitted)))
+    return append(events, script.emitted...), nil
+}
+
+func toTable(state *lua.LState, event map[string]string) *lua.LTable {
+    table := state.CreateTable(0, len(event))
+    for key, value := range event {
+        table.RawSetString(key, lua.LString(value))
+    }
+    return table
+}
+
+// toEvent converts the string, number and boolean fields of a table, others are left out.
+func toEvent(table *lua.LTable) map[string]string {
+    event := make(map[string]string)
+    table.ForEach(func(key lua.LValue, value lua.LValue) {
+        name, ok := key.(lua.LString)
+        if !ok {
+            return
+        }
+        switch value := value.(type) {
+        case lua.LString:
+            event[string(name)] = string(value)
+        case lua.LNumber:
+            event[string(name)] = strconv.FormatFloat(float64(value), 'f', -1, 64)
+        case lua.LBool:
+            event[string(name)] = strconv.FormatBool(bool(value))
+        }
+    })
+    return event
+}
+
+// Runner passes events through Lua scripts, in order. Each script sees the events returned by the previous
+// one, it can change an event, drop it or emit extra ones. An invocation taking more than the timeout is
+// stopped. A script failing on an event leaves the event as it was.
+type Runner struct {
+    timeout time.Duration
+    mutex   sync.RWMutex
+    scripts []*script
+    watcher *fsnotify.Watcher
+    done    chan struct{}
+    // closed is set by Close, events are then passed on unchanged, e.g. one read while a reload closes the runner
+    closed bool
+}
+
+func New(files []string, timeout time.Duration) (*Runner, error) {
+    if timeout <= 0 {
+        return nil, errors.New("Script timeout should be positive")
+    }
+    runner := &Runner{timeout: timeout}
+    for _, file := range files {
+        loaded, err := load(filepath.Clean(file))
+        if err != nil {
+            runner.Close()
+            return nil, err
+        }
+        runner.scripts = append(runner.scripts, loaded)
+    }
+    return runner, nil
+}
+
+// Empty tells whether there is no script to run.
+func (runner *Runner) Empty() bool {
+    return runner == nil || len(runner.scripts) == 0
+}
+
+// Process returns the events to send in place of event.
+func (runner *Runner) Process(event map[string]string) []map[string]string {
+    events := []map[string]string{event}
+    if runner.Empty() {
+        return events
+    }
+    runner.mutex.RLock()
+    defer runner.mutex.RUnlock()
+    if runner.closed {
+        return events
+    }
+    for _, loaded := range runner.scripts {
+        var next []map[string]string
+        for _, event := range events {
+            results, err := loaded.run(event, runner.timeout)
+            if err != nil {
+                scriptStats.Add("failed", 1)
+                log.Errorf("Passing event %s on unchanged. Reason: %v", event["Event"], err)
+                results = []map[string]string{event}
+            }
+            next = append(next, results...)
+        }
+        events = next
+    }
+    return events
+}
+
+// Watch reloads scripts when their file changes. A script that fails to load keeps running its previous version.
+func (runner *Runner) Watch() error {
+    if runner.Empty() {
+        return nil
+    }
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return errors.Wrap(err, "Failed to watch scripts.")
+    }
+    dirs := make(map[string]bool)
+    for _, loaded := range runner.scripts {
+        dir := filepath.Dir(loaded.path)
+        if dirs[dir] {
+            continue
+        }
+        if err = watcher.Add(dir); err != nil {
+            _ = watcher.Close()
+            return errors.Wrap(err, fmt.Sprintf("Failed to watch scripts in %s.", dir))
+        }
+        dirs[dir] = true
+    }
+    runner.watcher = watcher
+    runner.done = make(chan struct{})
+    go runner.watch()
+    return nil
+}
+
+func (runner *Runner) watch() {
+    defer close(runner.done)
+    changed := make(map[string]bool)
+    var reload <-chan time.Time
+    for {
+        select {
+        case event, ok := <-runner.watcher.Events:
+            if !ok {
+                return
+            }
+            if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+                changed[filepath.Clean(event.Name)] = true
+                reload = time.After(reloadDelay)
+            }
+        case err, ok := <-runner.watcher.Errors:
+            if !ok {
+                return
+            }
+            log.Errorf("Failed to watch scripts. Reason: %v", err)
+        case <-reload:
+            reload = nil
+            runner.reload(changed)
+            changed = make(map[string]bool)
+        }
+    }
+}
+
+func (runner *Runner) reload(changed map[string]bool) {
+    for i, current := range runner.scripts {
+        if !changed[current.path] {
+            continue
+        }
+        loaded, err := load(current.path)
+        if err != nil {
+            scriptStats.Add("reload_failed", 1)
+            log.Errorf("Keeping previous version of script %s. Reason: %v", current.path, err)
+            continue
+        }
+        runner.mutex.Lock()
+        runner.scripts[i] = loaded
+        runner.mutex.Unlock()
+        // Waits for an invocation still running the previous version
+        current.mutex.Lock()
+        current.state.Close()
+        current.mutex.Unlock()
+        scriptStats.Add("reloads", 1)
+        log.Infof("Reloaded script %s.", current.path)
+    }
+}
+
+func (runner *Runner) Close() {
+    if runner == nil {
+        return
+    }
+    if runner.watcher != nil {
+        _ = runner.watcher.Close()
+        <-runner.done
+        runner.watcher = nil
+    }
+    // Waits for the events being processed
+    runner.mutex.Lock()
+    defer runner.mutex.Unlock()
+    if runner.closed {
+        return
+    }
+    runner.closed = true
+    for _, loaded := range runner.scripts {
+        loaded.state.Close()
+    }
+}
@@ -0,0 +1,184 @@
+package script
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func writeScript(t *testing.T, dir string, name string, source string) string {
+    t.Helper()
+    path := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestRunnerProcess(t *testing.T) {
+    tests := []struct {
+        name   string
+        source string
+        want   []map[string]string
+    }{
+        {
+            name:   "changes the event",
+            source: `function process(event) event.Queue = "support" event.Channel = nil end`,
+            want:   []map[string]string{{"Event": "Hangup", "Queue": "support"}},
+        },
+        {
+            name:   "drops the event",
+            source: `function process(event) if event.Event == "Hangup" then return false end end`,
+            want:   nil,
+        },
+        {
+            name:   "emits events",
+            source: `function process(event) emit({Event = "CallEnded", Count = 2, Billed = true}) emit({Event = "Audit"}) end`,
+            want: []map[string]string{
+                {"Event": "Hangup", "Channel": "PJSIP/1001-00000001"},
+                {"Event": "CallEnded", "Count": "2", "Billed": "true"},
+                {"Event": "Audit"},
+            },
+        },
+        {
+            name:   "passes the event unchanged on error",
+            source: `function process(event) event.Queue = "support" error("broken") end`,
+            want:   []map[string]string{{"Event": "Hangup", "Channel": "PJSIP/1001-00000001"}},
+        },
+        {
+            name:   "passes the event unchanged on timeout",
+            source: `function process(event) event.Queue = "support" while true do end end`,
+            want:   []map[string]string{{"Event": "Hangup", "Channel": "PJSIP/1001-00000001"}},
+        },
+        {
+            name:   "refuses a huge string.rep",
+            source: `function process(event) event.Big = ("x"):rep(1e9) end`,
+            want:   []map[string]string{{"Event": "Hangup", "Channel": "PJSIP/1001-00000001"}},
+        },
+        {
+            name:   "allows a small string.rep",
+            source: `function process(event) event.Pad = string.rep("ab", 3) end`,
+            want:   []map[string]string{{"Event": "Hangup", "Channel": "PJSIP/1001-00000001", "Pad": "ababab"}},
+        },
+        {
+            name:   "limits emitted events",
+            source: `function process(event) for i = 1, 1000 do emit({Event = "Flood"}) end end`,
+            want:   []map[string]string{{"Event": "Hangup", "Channel": "PJSIP/1001-00000001"}},
+        },
+        {
+            name:   "limits the size of events handed back",
+            source: `local chunk = string.rep("x", 1024 * 1024) function process(event) event.A = chunk event.B = chunk end`,
+            want:   []map[string]string{{"Event": "Hangup", "Channel": "PJSIP/1001-00000001"}},
+        },
+        {
+            name:   "has no os library",
+            source: `function process(event) os.exit(1) end`,
+            want:   []map[string]string{{"Event": "Hangup", "Channel": "PJSIP/1001-00000001"}},
+        },
+    }
+    dir, _ := ioutil.TempDir("", "script")
+    defer os.RemoveAll(dir)
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            path := writeScript(t, dir, strings.Replace(test.name, " ", "_", -1)+".lua", test.source)
+            runner, err := New([]string{path}, 50*time.Millisecond)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer runner.Close()
+            got := runner.Process(map[string]string{"Event": "Hangup", "Channel": "PJSIP/1001-00000001"})
+            if !reflect.DeepEqual(got, test.want) {
+                t.Fatalf("Process = %v, want %v", got, test.want)
+            }
+        })
+    }
+}
+
+func TestRunnerChainsScripts(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "script")
+    defer os.RemoveAll(dir)
+    first := writeScript(t, dir, "first.lua", `function process(event) emit({Event = "Extra"}) end`)
+    second := writeScript(t, dir, "second.lua", `function process(event) event.Seen = "yes" end`)
+    runner, err := New([]string{first, second}, 50*time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer runner.Close()
+    want := []map[string]string{{"Event": "Hangup", "Seen": "yes"}, {"Event": "Extra", "Seen": "yes"}}
+    if got := runner.Process(map[string]string{"Event": "Hangup"}); !reflect.DeepEqual(got, want) {
+        t.Fatalf("Process = %v, want %v", got, want)
+    }
+}
+
+func TestNewFailsOnInvalidScript(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "script")
+    defer os.RemoveAll(dir)
+    for name, source := range map[string]string{
+        "syntax.lua":     `function process(event`,
+        "no_process.lua": `local x = 1`,
+    } {
+        if _, err := New([]string{writeScript(t, dir, name, source)}, time.Second); err == nil {
+            t.Errorf("New accepted %s", name)
+        }
+    }
+    if _, err := New(nil, 0); err == nil {
+        t.Error("New accepted a zero timeout")
+    }
+}
+
+func TestRunnerReloadsChangedScript(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "script")
+    defer os.RemoveAll(dir)
+    path := writeScript(t, dir, "tag.lua", `function process(event) event.Version = "1" end`)
+    runner, err := New([]string{path}, 50*time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer runner.Close()
+    if err = runner.Watch(); err != nil {
+        t.Fatal(err)
+    }
+    version := func() string {
+        return runner.Process(map[string]string{"Event": "Hangup"})[0]["Version"]
+    }
+    waitFor := func(want string) {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for version() != want {
+            if time.Now().After(deadline) {
+                t.Fatalf("Version = %s, want %s", version(), want)
+            }
+            time.Sleep(50 * time.Millisecond)
+        }
+    }
+    writeScript(t, dir, "tag.lua", `function process(event) event.Version = "2" end`)
+    waitFor("2")
+    // A broken version keeps the previous one running
+    writeScript(t, dir, "tag.lua", `function process(event`)
+    time.Sleep(3 * reloadDelay)
+    if got := version(); got != "2" {
+        t.Fatalf("Version after a failed reload = %s, want 2", got)
+    }
+    writeScript(t, dir, "tag.lua", `function process(event) event.Version = "3" end`)
+    waitFor("3")
+}
+
+func TestRunnerPassesEventsOnOnceClosed(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "script")
+    defer os.RemoveAll(dir)
+    path := writeScript(t, dir, "tag.lua", `function process(event) event.Seen = "yes" end`)
+    runner, err := New([]string{path}, 50*time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    runner.Close()
+    runner.Close()
+    want := []map[string]string{{"Event": "Hangup"}}
+    if got := runner.Process(map[string]string{"Event": "Hangup"}); !reflect.DeepEqual(got, want) {
+        t.Fatalf("Process = %v, want %v", got, want)
+    }
+}
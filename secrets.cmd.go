@@ -0,0 +1,102 @@
+package main
+
+import (
+	"ami-reader/conf"
+	"ami-reader/secrets"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"os"
+)
+
+const secretsUsage = `Usage: ami-reader secrets <command> [flags] [file]
+
+Manages the encrypted secrets file of SECRETS_FILE.
+
+Commands:
+  keygen    Print a new key, to be saved as SECRETS_KEY_FILE
+  encrypt   Encrypt a JSON object of secrets by name, read from file or stdin, to stdout
+  decrypt   Decrypt a secrets file, read from file or stdin, to stdout as JSON
+
+Flags:
+`
+
+func runSecrets(args []string) int {
+	flags := pflag.NewFlagSet("secrets", pflag.ContinueOnError)
+	keyFile := flags.String("key-file", "", "Key file. Defaults to SECRETS_KEY_FILE, read from env or the config file")
+	flags.String("config", "", "Config file SECRETS_KEY_FILE is read from. Defaults to config.<ext> in the working directory when it exists")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, secretsUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+	command := flags.Arg(0)
+	if command == "keygen" {
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	}
+	if command != "encrypt" && command != "decrypt" {
+		flags.Usage()
+		return 2
+	}
+	if *keyFile == "" {
+		// The store is not opened, SECRETS_FILE may be the file being made
+		if err := conf.LoadSources(flags); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		*keyFile = conf.SecretsKeyFile()
+	}
+	if *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "--key-file or SECRETS_KEY_FILE is required")
+		return 2
+	}
+	key, err := secrets.ReadKeyFile(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var input []byte
+	if flags.NArg() == 2 {
+		input, err = ioutil.ReadFile(flags.Arg(1))
+	} else {
+		input, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read input: %v\n", err)
+		return 1
+	}
+	var output []byte
+	if command == "encrypt" {
+		values := make(map[string]string)
+		if err = json.Unmarshal(input, &values); err != nil {
+			fmt.Fprintf(os.Stderr, "Secrets should be a JSON object of strings: %v\n", err)
+			return 1
+		}
+		output, err = secrets.Encrypt(key, values)
+	} else {
+		var values map[string]string
+		if values, err = secrets.Decrypt(key, input); err == nil {
+			output, err = json.MarshalIndent(values, "", "  ")
+			output = append(output, '\n')
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(output)
+	return 0
+}
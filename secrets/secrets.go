@@ -0,0 +1,199 @@
+package secrets
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "github.com/pkg/errors"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// fileVersion prefixes encrypted secrets files, so the format can change without breaking older files
+const fileVersion = "v1:"
+
+// keySize is the size of AES-256 keys
+const keySize = 32
+
+// reference matches secret references in setting values, e.g. amqp://reader:${secret:rabbitmq_pass}@broker
+var reference = regexp.MustCompile(`\$\{secret:([^}]*)\}`)
+
+// GenerateKey returns a new random key, hex encoded as expected in key files.
+func GenerateKey() (string, error) {
+    key := make([]byte, keySize)
+    if _, err := io.ReadFull(rand.Reader, key); err != nil {
+        return "", errors.Wrap(err, "Failed to generate key.")
+    }
+    return hex.EncodeToString(key), nil
+}
+
+// ReadKeyFile reads a key file holding 32 hex encoded bytes, e.g. made with `openssl rand -hex 32`.
+func ReadKeyFile(file string) ([]byte, error) {
+    content, err := ioutil.ReadFile(file)
+    if err != nil {
+        return nil, errors.Wrap(err, "Failed to read key file.")
+    }
+    key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+    if err != nil || len(key) != keySize {
+        return nil, errors.Errorf("Key file %s should hold %d hex encoded bytes", file, keySize)
+    }
+    return key, nil
+}
+
+// Encrypt seals secrets, by name, with AES-256-GCM. The result is text, so it can be kept in a ConfigMap or
+// a repository alongside the config.
+func Encrypt(key []byte, secrets map[string]string) ([]byte, error) {
+    aead, err := newAEAD(key)
+    if err != nil {
+        return nil, err
+    }
+    plaintext, err := json.Marshal(secrets)
+    if err != nil {
+        return nil, errors.Wrap(err, "Failed to encode secrets.")
+    }
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return nil, errors.Wrap(err, "Failed to generate nonce.")
+    }
+    sealed := aead.Seal(nonce, nonce, plaintext, nil)
+    return []byte(fileVersion + base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// Decrypt opens secrets sealed by Encrypt.
+func Decrypt(key []byte, data []byte) (map[string]string, error) {
+    aead, err := newAEAD(key)
+    if err != nil {
+        return nil, err
+    }
+    text := strings.TrimSpace(string(data))
+    if !strings.HasPrefix(text, fileVersion) {
+        return nil, errors.New("Not an encrypted secrets file")
+    }
+    sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(text, fileVersion))
+    if err != nil || len(sealed) < aead.NonceSize() {
+        return nil, errors.New("Encrypted secrets file is corrupted")
+    }
+    plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+    if err != nil {
+        return nil, errors.New("Failed to decrypt secrets, the key is wrong or the file was altered")
+    }
+    secrets := make(map[string]string)
+    if err = json.Unmarshal(plaintext, &secrets); err != nil {
+        return nil, errors.Wrap(err, "Failed to decode secrets.")
+    }
+    return secrets, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, errors.Wrap(err, "Invalid key.")
+    }
+    return cipher.NewGCM(block)
+}
+
+// Store resolves secret references. Secrets are looked up in the encrypted secrets file first, then in the
+// directory, where each file holds the secret named after it, e.g. /run/secrets of Docker.
+type Store struct {
+    values map[string]string
+    dir    string
+}
+
+// Open reads the encrypted secrets file with its key file, and sets the directory secrets are read from.
+// Empty arguments are skipped, a Store with neither resolves no reference.
+func Open(file string, keyFile string, dir string) (*Store, error) {
+    store := &Store{dir: dir}
+    if file == "" && keyFile != "" {
+        return nil, errors.New("SECRETS_KEY_FILE is set but SECRETS_FILE is not")
+    }
+    if file != "" {
+        if keyFile == "" {
+            return nil, errors.New("SECRETS_FILE needs SECRETS_KEY_FILE to be decrypted")
+        }
+        key, err := ReadKeyFile(keyFile)
+        if err != nil {
+            return nil, err
+        }
+        data, err := ioutil.ReadFile(file)
+        if err != nil {
+            return nil, errors.Wrap(err, "Failed to read secrets file.")
+        }
+        if store.values, err = Decrypt(key, data); err != nil {
+            return nil, errors.Wrap(err, file)
+        }
+    }
+    if dir != "" {
+        if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+            return nil, errors.Errorf("Secrets directory %s not found", dir)
+        }
+    }
+    return store, nil
+}
+
+// Empty tells whether the store has nowhere to look secrets up.
+func (store *Store) Empty() bool {
+    return store == nil || (store.values == nil && store.dir == "")
+}
+
+// Lookup returns the secret of a name.
+func (store *Store) Lookup(name string) (string, bool, error) {
+    if store == nil {
+        return "", false, nil
+    }
+    if value, found := store.values[name]; found {
+        return value, true, nil
+    }
+    if store.dir == "" {
+        return "", false, nil
+    }
+    // Names are file names, never paths leading out of the directory
+    if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+        return "", false, errors.Errorf("Invalid secret name %q", name)
+    }
+    content, err := ioutil.ReadFile(filepath.Join(store.dir, name))
+    if os.IsNotExist(err) {
+        return "", false, nil
+    }
+    if err != nil {
+        return "", false, errors.Wrap(err, "Failed to read secret "+name+".")
+    }
+    return strings.TrimRight(string(content), "\r\n"), true, nil
+}
+
+// Resolve replaces the secret references of a value with the secrets they name, calling found with each of
+// them. A reference that can't be resolved is an error.
+func (store *Store) Resolve(value string, found func(secret string)) (string, error) {
+    var err error
+    resolved := reference.ReplaceAllStringFunc(value, func(ref string) string {
+        name := reference.FindStringSubmatch(ref)[1]
+        if err != nil {
+            return ref
+        }
+        if store.Empty() {
+            err = errors.Errorf("Secret %q is referenced but neither SECRETS_FILE nor SECRETS_DIR is set", name)
+            return ref
+        }
+        secret, ok, lookupErr := store.Lookup(name)
+        if lookupErr != nil {
+            err = lookupErr
+            return ref
+        }
+        if !ok {
+            err = errors.Errorf("Secret %q not found", name)
+            return ref
+        }
+        found(secret)
+        return secret
+    })
+    if err != nil {
+        return "", err
+    }
+    return resolved, nil
+}
@@ -0,0 +1,101 @@
+package sequence
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "github.com/pkg/errors"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// Fields stamped on every event
+const (
+    HostSeqField    = "host_seq"
+    SessionIdField  = "session_id"
+    SessionSeqField = "session_seq"
+)
+
+// reserveBlock is how many host sequence numbers are reserved on disk at a time. After a crash the
+// numbers reserved but not used are skipped, a clean shutdown continues right after the last one.
+const reserveBlock = 1000
+
+// Sequencer stamps events with a sequence number per host device, which keeps increasing across restarts,
+// and a sequence number per AMI session along with the id of the session.
+type Sequencer struct {
+    path       string
+    mutex      sync.Mutex
+    hostSeq    uint64
+    reserved   uint64
+    sessionId  string
+    sessionSeq uint64
+}
+
+// Open reads the last host sequence number from the state file at path, a missing file starts from zero.
+func Open(path string) (*Sequencer, error) {
+    sequencer := &Sequencer{path: path}
+    data, err := ioutil.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if err == nil {
+        if sequencer.hostSeq, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+            return nil, errors.Wrap(err, fmt.Sprintf("Invalid sequence file %s.", path))
+        }
+    }
+    sequencer.reserved = sequencer.hostSeq
+    return sequencer, nil
+}
+
+// NewSession starts numbering a new session from one and returns its id.
+func (sequencer *Sequencer) NewSession() (string, error) {
+    id := make([]byte, 8)
+    if _, err := rand.Read(id); err != nil {
+        return "", err
+    }
+    sequencer.mutex.Lock()
+    defer sequencer.mutex.Unlock()
+    sequencer.sessionId = hex.EncodeToString(id)
+    sequencer.sessionSeq = 0
+    return sequencer.sessionId, nil
+}
+
+// Stamp adds the next sequence numbers and the session id to an event.
+func (sequencer *Sequencer) Stamp(event map[string]string) error {
+    sequencer.mutex.Lock()
+    defer sequencer.mutex.Unlock()
+    if sequencer.hostSeq >= sequencer.reserved {
+        if err := sequencer.save(sequencer.hostSeq + reserveBlock); err != nil {
+            return errors.Wrap(err, "Failed to reserve sequence numbers.")
+        }
+        sequencer.reserved = sequencer.hostSeq + reserveBlock
+    }
+    sequencer.hostSeq++
+    sequencer.sessionSeq++
+    event[HostSeqField] = strconv.FormatUint(sequencer.hostSeq, 10)
+    event[SessionIdField] = sequencer.sessionId
+    event[SessionSeqField] = strconv.FormatUint(sequencer.sessionSeq, 10)
+    return nil
+}
+
+// Close keeps the last host sequence number so the next run continues without skipping any.
+func (sequencer *Sequencer) Close() error {
+    sequencer.mutex.Lock()
+    defer sequencer.mutex.Unlock()
+    if err := sequencer.save(sequencer.hostSeq); err != nil {
+        return err
+    }
+    sequencer.reserved = sequencer.hostSeq
+    return nil
+}
+
+func (sequencer *Sequencer) save(hostSeq uint64) error {
+    tmpFile := sequencer.path + ".tmp"
+    if err := ioutil.WriteFile(tmpFile, []byte(strconv.FormatUint(hostSeq, 10)), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmpFile, sequencer.path)
+}
@@ -0,0 +1,45 @@
+package sequence
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+)
+
+func TestSequencerContinuesAcrossRestarts(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "sequence")
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "sequence")
+    sequencer, err := Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    first, _ := sequencer.NewSession()
+    event := map[string]string{}
+    for i := 0; i < 3; i++ {
+        if err = sequencer.Stamp(event); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if event[HostSeqField] != "3" || event[SessionSeqField] != "3" || event[SessionIdField] != first {
+        t.Fatalf("stamped %v", event)
+    }
+    if err = sequencer.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    sequencer, _ = Open(path)
+    second, _ := sequencer.NewSession()
+    _ = sequencer.Stamp(event)
+    if event[HostSeqField] != "4" || event[SessionSeqField] != "1" || second == first {
+        t.Fatalf("stamped %v after restart", event)
+    }
+    // Without Close the numbers reserved are skipped
+    sequencer, _ = Open(path)
+    _ = sequencer.Stamp(event)
+    if event[HostSeqField] != strconv.Itoa(3+reserveBlock+1) {
+        t.Fatalf("stamped %v after a crash", event)
+    }
+}
@@ -0,0 +1,145 @@
+package sequence
+
+import (
+    "github.com/pkg/errors"
+    "sort"
+    "strconv"
+)
+
+// maxSessions bounds the sessions tracked per host device, events of older sessions are reported as new sessions
+const maxSessions = 16
+
+// Status tells how an event relates to the events of its session seen before.
+type Status int
+
+const (
+    // The event is the next one of its session
+    InOrder Status = iota
+    // The first event seen of a session
+    NewSession
+    // Events between the last one seen and this one are missing so far
+    Gap
+    // The event was missing and arrived out of order
+    Late
+    // The event was seen already
+    Duplicate
+)
+
+func (status Status) String() string {
+    return [...]string{"in order", "new session", "gap", "late", "duplicate"}[status]
+}
+
+// Result of tracking an event. Missing is the number of events found missing because of it.
+type Result struct {
+    Status  Status
+    Missing uint64
+}
+
+// Range is a span of session sequence numbers, From and To included.
+type Range struct {
+    From uint64
+    To   uint64
+}
+
+// Len is the number of sequence numbers in the range.
+func (r Range) Len() uint64 {
+    return r.To - r.From + 1
+}
+
+// trackedSession keeps the numbers missing as ranges, lowest first, so a consumer joining late in a session or
+// a big jump costs a single range.
+type trackedSession struct {
+    highest uint64
+    missing []Range
+}
+
+// fill removes seq from the missing ranges and tells whether it was missing.
+func (session *trackedSession) fill(seq uint64) bool {
+    i := sort.Search(len(session.missing), func(i int) bool { return session.missing[i].To >= seq })
+    if i == len(session.missing) || session.missing[i].From > seq {
+        return false
+    }
+    r := session.missing[i]
+    switch {
+    case r.From == seq && r.To == seq:
+        session.missing = append(session.missing[:i], session.missing[i+1:]...)
+    case r.From == seq:
+        session.missing[i].From++
+    case r.To == seq:
+        session.missing[i].To--
+    default:
+        session.missing = append(session.missing, Range{})
+        copy(session.missing[i+2:], session.missing[i+1:])
+        session.missing[i] = Range{From: r.From, To: seq - 1}
+        session.missing[i+1] = Range{From: seq + 1, To: r.To}
+    }
+    return true
+}
+
+// Tracker is meant for consumers of published events. It detects gaps and duplicates from the session
+// id and session sequence number every event is stamped with, per host device. Events published by
+// several workers may arrive out of order, an event filling a gap is reported as late. Numbers still
+// missing, e.g. events that were dropped, are returned by Missing.
+type Tracker struct {
+    hosts map[string]map[string]*trackedSession
+    // Session ids by host device, oldest first
+    order map[string][]string
+}
+
+func NewTracker() *Tracker {
+    return &Tracker{hosts: make(map[string]map[string]*trackedSession), order: make(map[string][]string)}
+}
+
+func (tracker *Tracker) Track(event map[string]string) (Result, error) {
+    host := event["host_device_id"]
+    sessionId := event[SessionIdField]
+    if sessionId == "" {
+        return Result{}, errors.Errorf("Missing %s", SessionIdField)
+    }
+    seq, err := strconv.ParseUint(event[SessionSeqField], 10, 64)
+    if err != nil || seq == 0 {
+        return Result{}, errors.Errorf("Invalid %s %s", SessionSeqField, event[SessionSeqField])
+    }
+    sessions, found := tracker.hosts[host]
+    if !found {
+        sessions = make(map[string]*trackedSession)
+        tracker.hosts[host] = sessions
+    }
+    session, found := sessions[sessionId]
+    if !found {
+        session = &trackedSession{highest: seq}
+        if seq > 1 {
+            session.missing = []Range{{From: 1, To: seq - 1}}
+        }
+        sessions[sessionId] = session
+        tracker.order[host] = append(tracker.order[host], sessionId)
+        if len(tracker.order[host]) > maxSessions {
+            delete(sessions, tracker.order[host][0])
+            tracker.order[host] = tracker.order[host][1:]
+        }
+        return Result{Status: NewSession, Missing: seq - 1}, nil
+    }
+    switch {
+    case seq == session.highest+1:
+        session.highest = seq
+        return Result{Status: InOrder}, nil
+    case seq > session.highest:
+        session.missing = append(session.missing, Range{From: session.highest + 1, To: seq - 1})
+        result := Result{Status: Gap, Missing: seq - session.highest - 1}
+        session.highest = seq
+        return result, nil
+    }
+    if session.fill(seq) {
+        return Result{Status: Late}, nil
+    }
+    return Result{Status: Duplicate}, nil
+}
+
+// Missing returns the ranges of session sequence numbers not seen so far of a session, lowest first.
+func (tracker *Tracker) Missing(hostDeviceId string, sessionId string) []Range {
+    session, found := tracker.hosts[hostDeviceId][sessionId]
+    if !found {
+        return nil
+    }
+    return append([]Range(nil), session.missing...)
+}
@@ -0,0 +1,115 @@
+package sequence
+
+import (
+    "fmt"
+    "reflect"
+    "strconv"
+    "testing"
+)
+
+func trackedEvent(host string, session string, seq uint64) map[string]string {
+    return map[string]string{"host_device_id": host, SessionIdField: session, SessionSeqField: strconv.FormatUint(seq, 10)}
+}
+
+func TestTracker(t *testing.T) {
+    tests := []struct {
+        name    string
+        seqs    []uint64
+        want    []Result
+        missing []Range
+    }{
+        {
+            name:    "in order",
+            seqs:    []uint64{1, 2, 3},
+            want:    []Result{{Status: NewSession}, {Status: InOrder}, {Status: InOrder}},
+            missing: nil,
+        },
+        {
+            name:    "gap",
+            seqs:    []uint64{1, 2, 6},
+            want:    []Result{{Status: NewSession}, {Status: InOrder}, {Status: Gap, Missing: 3}},
+            missing: []Range{{From: 3, To: 5}},
+        },
+        {
+            name:    "late fill at both ends and in the middle",
+            seqs:    []uint64{1, 7, 2, 6, 4},
+            want:    []Result{{Status: NewSession}, {Status: Gap, Missing: 5}, {Status: Late}, {Status: Late}, {Status: Late}},
+            missing: []Range{{From: 3, To: 3}, {From: 5, To: 5}},
+        },
+        {
+            name:    "every gap filled",
+            seqs:    []uint64{1, 3, 2, 5, 4},
+            want:    []Result{{Status: NewSession}, {Status: Gap, Missing: 1}, {Status: Late}, {Status: Gap, Missing: 1}, {Status: Late}},
+            missing: nil,
+        },
+        {
+            name:    "duplicate",
+            seqs:    []uint64{1, 2, 2, 4, 1, 4},
+            want:    []Result{{Status: NewSession}, {Status: InOrder}, {Status: Duplicate}, {Status: Gap, Missing: 1}, {Status: Duplicate}, {Status: Duplicate}},
+            missing: []Range{{From: 3, To: 3}},
+        },
+        {
+            name:    "joined late in a session",
+            seqs:    []uint64{50000000, 50000001, 1},
+            want:    []Result{{Status: NewSession, Missing: 49999999}, {Status: InOrder}, {Status: Late}},
+            missing: []Range{{From: 2, To: 49999999}},
+        },
+        {
+            name:    "big jump",
+            seqs:    []uint64{1, 1 << 40},
+            want:    []Result{{Status: NewSession}, {Status: Gap, Missing: 1<<40 - 2}},
+            missing: []Range{{From: 2, To: 1<<40 - 1}},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            tracker := NewTracker()
+            for i, seq := range test.seqs {
+                result, err := tracker.Track(trackedEvent("pbx", "s1", seq))
+                if err != nil {
+                    t.Fatalf("Track(%d): %v", seq, err)
+                }
+                if result != test.want[i] {
+                    t.Fatalf("Track(%d) = %+v, want %+v", seq, result, test.want[i])
+                }
+            }
+            if missing := tracker.Missing("pbx", "s1"); !reflect.DeepEqual(missing, test.missing) {
+                t.Fatalf("Missing = %v, want %v", missing, test.missing)
+            }
+        })
+    }
+}
+
+func TestTrackerInvalidEvents(t *testing.T) {
+    tracker := NewTracker()
+    for _, event := range []map[string]string{
+        {SessionSeqField: "1"},
+        {SessionIdField: "s1"},
+        {SessionIdField: "s1", SessionSeqField: "0"},
+        {SessionIdField: "s1", SessionSeqField: "x"},
+    } {
+        if _, err := tracker.Track(event); err == nil {
+            t.Errorf("Track(%v) succeeded", event)
+        }
+    }
+}
+
+func TestTrackerEvictsOldestSessions(t *testing.T) {
+    tracker := NewTracker()
+    for i := 0; i <= maxSessions; i++ {
+        if _, err := tracker.Track(trackedEvent("pbx", fmt.Sprint("s", i), 1)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // The first session was forgotten, its next event starts it over
+    if result, _ := tracker.Track(trackedEvent("pbx", "s0", 2)); result.Status != NewSession {
+        t.Fatalf("Track of an evicted session = %+v, want a new session", result)
+    }
+    if result, _ := tracker.Track(trackedEvent("pbx", fmt.Sprint("s", maxSessions), 2)); result.Status != InOrder {
+        t.Fatalf("Track of a kept session = %+v, want in order", result)
+    }
+    // Sessions are tracked per host device
+    if result, _ := tracker.Track(trackedEvent("other", "s1", 2)); result.Status != NewSession {
+        t.Fatalf("Track on another host = %+v, want a new session", result)
+    }
+}
@@ -0,0 +1,43 @@
+package serializer
+
+import (
+    "ami-reader/transform"
+    "encoding/json"
+    "time"
+)
+
+// cloudEvent is the structured mode JSON format of CloudEvents 1.0, see https://github.com/cloudevents/spec
+type cloudEvent struct {
+    SpecVersion     string                 `json:"specversion"`
+    Id              string                 `json:"id"`
+    Source          string                 `json:"source"`
+    Type            string                 `json:"type"`
+    Subject         string                 `json:"subject,omitempty"`
+    Time            string                 `json:"time"`
+    DataContentType string                 `json:"datacontenttype"`
+    SchemaVersion   string                 `json:"schemaversion"`
+    Data            map[string]interface{} `json:"data"`
+}
+
+type cloudEventsSerializer struct {
+    types transform.Typer
+}
+
+func (serializer *cloudEventsSerializer) Serialize(event map[string]string) ([]byte, error) {
+    timestamp, _ := EventTime(event)
+    return json.Marshal(&cloudEvent{
+        SpecVersion:     "1.0",
+        Id:              EventId(event),
+        Source:          "/ami-reader/" + event["host_device_id"],
+        Type:            "ami." + event["Event"],
+        Subject:         event["Uniqueid"],
+        Time:            timestamp.UTC().Format(time.RFC3339Nano),
+        DataContentType: "application/json",
+        SchemaVersion:   SchemaVersion,
+        Data:            typed(event, serializer.types),
+    })
+}
+
+func (serializer *cloudEventsSerializer) ContentType() string {
+    return "application/cloudevents+json"
+}
@@ -0,0 +1,21 @@
+package serializer
+
+import (
+    "ami-reader/transform"
+    "encoding/json"
+)
+
+// jsonSerializer writes the event as a flat JSON object with a schema_version field.
+type jsonSerializer struct {
+    types transform.Typer
+}
+
+func (serializer *jsonSerializer) Serialize(event map[string]string) ([]byte, error) {
+    versioned := typed(event, serializer.types)
+    versioned["schema_version"] = SchemaVersion
+    return json.Marshal(versioned)
+}
+
+func (serializer *jsonSerializer) ContentType() string {
+    return "application/json"
+}
@@ -0,0 +1,94 @@
+package serializer
+
+import (
+    "ami-reader/transform"
+    "encoding/binary"
+    "math"
+)
+
+// msgpackSerializer writes the event as a MessagePack map with a schema_version entry, coerced fields
+// are written as integers, floats or booleans, see https://github.com/msgpack/msgpack/blob/master/spec.md
+type msgpackSerializer struct {
+    types transform.Typer
+}
+
+func (serializer *msgpackSerializer) Serialize(event map[string]string) ([]byte, error) {
+    _, hasVersion := event["schema_version"]
+    size := len(event)
+    if !hasVersion {
+        size++
+    }
+    buf := appendMsgpackMapHeader(nil, size)
+    types := typesOf(event, serializer.types)
+    for _, key := range sortedKeys(event) {
+        if key == "schema_version" {
+            continue
+        }
+        buf = appendMsgpackString(buf, key)
+        switch value := transform.Typed(event[key], types.Of(key)).(type) {
+        case int64:
+            buf = appendMsgpackInt(buf, value)
+        case float64:
+            buf = append(buf, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0)
+            binary.BigEndian.PutUint64(buf[len(buf)-8:], math.Float64bits(value))
+        case bool:
+            if value {
+                buf = append(buf, 0xc3)
+            } else {
+                buf = append(buf, 0xc2)
+            }
+        default:
+            buf = appendMsgpackString(buf, event[key])
+        }
+    }
+    buf = appendMsgpackString(buf, "schema_version")
+    return appendMsgpackString(buf, SchemaVersion), nil
+}
+
+func (serializer *msgpackSerializer) ContentType() string {
+    return "application/msgpack"
+}
+
+func appendMsgpackMapHeader(buf []byte, size int) []byte {
+    switch {
+    case size < 16:
+        return append(buf, 0x80|byte(size))
+    case size < 1<<16:
+        buf = append(buf, 0xde, 0, 0)
+        binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(size))
+    default:
+        buf = append(buf, 0xdf, 0, 0, 0, 0)
+        binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(size))
+    }
+    return buf
+}
+
+func appendMsgpackString(buf []byte, value string) []byte {
+    size := len(value)
+    switch {
+    case size < 32:
+        buf = append(buf, 0xa0|byte(size))
+    case size < 1<<8:
+        buf = append(buf, 0xd9, byte(size))
+    case size < 1<<16:
+        buf = append(buf, 0xda, 0, 0)
+        binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(size))
+    default:
+        buf = append(buf, 0xdb, 0, 0, 0, 0)
+        binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(size))
+    }
+    return append(buf, value...)
+}
+
+func appendMsgpackInt(buf []byte, value int64) []byte {
+    switch {
+    case value >= 0 && value < 128:
+        return append(buf, byte(value))
+    case value < 0 && value >= -32:
+        return append(buf, byte(value))
+    default:
+        buf = append(buf, 0xd3, 0, 0, 0, 0, 0, 0, 0, 0)
+        binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(value))
+        return buf
+    }
+}
@@ -0,0 +1,72 @@
+package serializer
+
+import "encoding/binary"
+
+// Field numbers of AmiEvent in proto/ami_event.proto
+const (
+    protoSchemaVersion = 1
+    protoId            = 2
+    protoEvent         = 3
+    protoHostDeviceId  = 4
+    protoTimestamp     = 5
+    protoFields        = 6
+    protoMapKey        = 1
+    protoMapValue      = 2
+)
+
+const (
+    protoWireVarint = 0
+    protoWireBytes  = 2
+)
+
+// protobufSerializer encodes the AmiEvent message of proto/ami_event.proto. The message only has strings,
+// an int64 and a string map, so it is written directly in the protobuf wire format. Coerced fields keep
+// the canonical text of their type in the string map.
+type protobufSerializer struct {
+}
+
+func (serializer *protobufSerializer) Serialize(event map[string]string) ([]byte, error) {
+    var buf []byte
+    buf = appendProtoString(buf, protoSchemaVersion, SchemaVersion)
+    buf = appendProtoString(buf, protoId, EventId(event))
+    buf = appendProtoString(buf, protoEvent, event["Event"])
+    buf = appendProtoString(buf, protoHostDeviceId, event["host_device_id"])
+    buf = appendProtoTag(buf, protoTimestamp, protoWireVarint)
+    timestamp, _ := EventTime(event)
+    buf = appendUvarint(buf, uint64(timestamp.UnixNano()))
+    for _, key := range sortedKeys(event) {
+        var entry []byte
+        entry = appendProtoString(entry, protoMapKey, key)
+        entry = appendProtoString(entry, protoMapValue, event[key])
+        buf = appendProtoBytes(buf, protoFields, entry)
+    }
+    return buf, nil
+}
+
+func (serializer *protobufSerializer) ContentType() string {
+    return "application/x-protobuf; proto=amireader.v1.AmiEvent"
+}
+
+func appendProtoTag(buf []byte, field int, wireType int) []byte {
+    return appendUvarint(buf, uint64(field<<3|wireType))
+}
+
+func appendProtoBytes(buf []byte, field int, value []byte) []byte {
+    buf = appendProtoTag(buf, field, protoWireBytes)
+    buf = appendUvarint(buf, uint64(len(value)))
+    return append(buf, value...)
+}
+
+// appendProtoString skips empty strings like proto3 does for default values.
+func appendProtoString(buf []byte, field int, value string) []byte {
+    if value == "" {
+        return buf
+    }
+    return appendProtoBytes(buf, field, []byte(value))
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+    var varint [binary.MaxVarintLen64]byte
+    n := binary.PutUvarint(varint[:], value)
+    return append(buf, varint[:n]...)
+}
@@ -0,0 +1,91 @@
+package serializer
+
+import (
+    "ami-reader/transform"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "github.com/pkg/errors"
+    "sort"
+    "time"
+)
+
+// SchemaVersion is embedded in every serialized event. Bump it on event related contract updates.
+const SchemaVersion = "1"
+
+// Serializer turns an event into the body of a message in one wire format.
+type Serializer interface {
+    Serialize(event map[string]string) ([]byte, error)
+    ContentType() string
+}
+
+var serializers = map[string]func(types transform.Typer) Serializer{
+    "json":        func(types transform.Typer) Serializer { return &jsonSerializer{types} },
+    "cloudevents": func(types transform.Typer) Serializer { return &cloudEventsSerializer{types} },
+    "protobuf":    func(types transform.Typer) Serializer { return &protobufSerializer{} },
+    "msgpack":     func(types transform.Typer) Serializer { return &msgpackSerializer{types} },
+}
+
+// New returns the serializer of a format. Fields coerced by the transform pipeline are written with
+// their types in the formats that have them, see types.
+func New(name string, types transform.Typer) (Serializer, error) {
+    factory, found := serializers[name]
+    if !found {
+        names := make([]string, 0, len(serializers))
+        for name := range serializers {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        return nil, errors.Errorf("Unknown format %s. Available formats: %v", name, names)
+    }
+    return factory(types), nil
+}
+
+// EventId hashes the fields of an event. The same event gets the same id when it is serialized again,
+// e.g. after a retry or from a spool, so consumers can deduplicate.
+func EventId(event map[string]string) string {
+    hash := sha256.New()
+    for _, key := range sortedKeys(event) {
+        fmt.Fprintf(hash, "%s\x00%s\x00", key, event[key])
+    }
+    return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// EventTime is the time the reader received the event, whatever type timestamp was coerced to. found is false
+// when the event has no timestamp, e.g. TRANSFORM renamed or dropped it, the current time is returned then.
+func EventTime(event map[string]string) (timestamp time.Time, found bool) {
+    for _, field := range []string{"timestamp", "timestamp_dt"} {
+        if timestamp, ok := transform.ParseTime(event[field]); ok {
+            return timestamp, true
+        }
+    }
+    return time.Now(), false
+}
+
+// typed returns the fields of an event with coerced values as JSON types.
+func typed(event map[string]string, types transform.Typer) map[string]interface{} {
+    eventTypes := typesOf(event, types)
+    fields := make(map[string]interface{}, len(event)+1)
+    for key, value := range event {
+        fields[key] = transform.Typed(value, eventTypes.Of(key))
+    }
+    return fields
+}
+
+// typesOf returns the types of the fields of an event, none without a Typer.
+func typesOf(event map[string]string, types transform.Typer) transform.FieldTypes {
+    if types == nil {
+        return nil
+    }
+    return types.TypesOf(event)
+}
+
+// sortedKeys keeps serialized output stable for the same event.
+func sortedKeys(event map[string]string) []string {
+    keys := make([]string, 0, len(event))
+    for key := range event {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
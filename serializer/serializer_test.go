@@ -0,0 +1,147 @@
+package serializer
+
+import (
+    "ami-reader/transform"
+    "encoding/json"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestEventTime(t *testing.T) {
+    received := time.Date(2020, 3, 1, 10, 30, 0, 0, time.UTC)
+    tests := []struct {
+        name      string
+        event     map[string]string
+        want      time.Time
+        wantFound bool
+    }{
+        {"epoch nanoseconds", map[string]string{"timestamp": "1583058600000000000"}, received, true},
+        {"coerced to epoch_ms", map[string]string{"timestamp": "1583058600000"}, received, true},
+        {"coerced to timestamp", map[string]string{"timestamp": "2020-03-01T10:30:00Z"}, received, true},
+        {"timestamp_dt only", map[string]string{"timestamp_dt": "2020-03-01T10:30:00Z"}, received, true},
+        {"renamed away", map[string]string{"received_at": "1583058600000000000"}, time.Time{}, false},
+        {"invalid", map[string]string{"timestamp": "yesterday"}, time.Time{}, false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            got, found := EventTime(test.event)
+            if found != test.wantFound {
+                t.Fatalf("found = %v, want %v", found, test.wantFound)
+            }
+            if found && !got.Equal(test.want) {
+                t.Fatalf("EventTime = %v, want %v", got, test.want)
+            }
+            // The current time stands in for a missing timestamp
+            if !found && time.Since(got) > time.Minute {
+                t.Fatalf("EventTime without timestamp = %v, want now", got)
+            }
+        })
+    }
+}
+
+func TestEventIdIsStable(t *testing.T) {
+    event := map[string]string{"Event": "Hangup", "Uniqueid": "1584011234.42", "timestamp": "1583058600000000000"}
+    copied := map[string]string{"timestamp": "1583058600000000000", "Uniqueid": "1584011234.42", "Event": "Hangup"}
+    if EventId(event) != EventId(copied) {
+        t.Fatal("same event got different ids")
+    }
+    copied["Cause"] = "16"
+    if EventId(event) == EventId(copied) {
+        t.Fatal("different events got the same id")
+    }
+}
+
+func TestNew(t *testing.T) {
+    for _, test := range []struct {
+        format      string
+        contentType string
+    }{
+        {"json", "application/json"},
+        {"cloudevents", "application/cloudevents+json"},
+        {"protobuf", "application/x-protobuf; proto=amireader.v1.AmiEvent"},
+        {"msgpack", "application/msgpack"},
+    } {
+        serializer, err := New(test.format, nil)
+        if err != nil {
+            t.Fatalf("New(%s): %v", test.format, err)
+        }
+        if serializer.ContentType() != test.contentType {
+            t.Errorf("ContentType of %s = %s, want %s", test.format, serializer.ContentType(), test.contentType)
+        }
+        if _, err = serializer.Serialize(map[string]string{"Event": "Hangup"}); err != nil {
+            t.Errorf("Serialize as %s: %v", test.format, err)
+        }
+    }
+    if _, err := New("xml", nil); err == nil {
+        t.Fatal("New accepted an unknown format")
+    }
+}
+
+func TestJsonSerializerWritesTypes(t *testing.T) {
+    serializer, _ := New("json", transform.FieldTypes{"cause": transform.TypeInt, "Billed": transform.TypeBool})
+    body, err := serializer.Serialize(map[string]string{"Event": "Hangup", "Cause": "16", "Billed": "true", "Exten": "100"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var got map[string]interface{}
+    _ = json.Unmarshal(body, &got)
+    want := map[string]interface{}{"Event": "Hangup", "Cause": float64(16), "Billed": true, "Exten": "100", "schema_version": SchemaVersion}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("Serialize = %v, want %v", got, want)
+    }
+}
+
+func TestJsonSerializerWritesTypesOfEachEvent(t *testing.T) {
+    pipeline, err := transform.New([]transform.StepConf{
+        {Action: transform.ActionCoerce, Events: []string{"Cdr"}, Fields: []string{"Duration"}, Type: transform.TypeInt},
+        {Action: transform.ActionRename, Events: []string{"Cdr"}, Fields: []string{"Duration"}, To: "duration_s"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    serializer, _ := New("json", pipeline)
+    tests := []struct {
+        event map[string]string
+        field string
+        want  interface{}
+    }{
+        {map[string]string{"Event": "Cdr", "Duration": "42"}, "duration_s", float64(42)},
+        {map[string]string{"Event": "QueueMemberStatus", "Duration": "42"}, "Duration", "42"},
+    }
+    for _, test := range tests {
+        pipeline.Apply(test.event)
+        body, err := serializer.Serialize(test.event)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var got map[string]interface{}
+        _ = json.Unmarshal(body, &got)
+        if got[test.field] != test.want {
+            t.Errorf("%s of %s = %#v, want %#v", test.field, test.event["Event"], got[test.field], test.want)
+        }
+    }
+}
+
+func TestCloudEventsSerializer(t *testing.T) {
+    serializer, _ := New("cloudevents", nil)
+    event := map[string]string{"Event": "Hangup", "Uniqueid": "1584011234.42", "host_device_id": "pbx1", "timestamp": "1583058600000000000"}
+    body, err := serializer.Serialize(event)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var got map[string]interface{}
+    _ = json.Unmarshal(body, &got)
+    for key, want := range map[string]interface{}{
+        "specversion": "1.0",
+        "id":          EventId(event),
+        "type":        "ami.Hangup",
+        "source":      "/ami-reader/pbx1",
+        "subject":     "1584011234.42",
+        "time":        "2020-03-01T10:30:00Z",
+    } {
+        if got[key] != want {
+            t.Errorf("%s = %v, want %v", key, got[key], want)
+        }
+    }
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+    "ami-reader/conf"
+    "bufio"
+    "bytes"
+    "fmt"
+    "github.com/pkg/errors"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// AmiField is a line of an AMI message.
+type AmiField struct {
+    Key   string
+    Value string
+}
+
+// AmiMessage is a message read from AMI with its fields in order. A key can show up more than once, e.g.
+// Output of a Command response.
+type AmiMessage []AmiField
+
+// Get returns the first value of a key.
+func (message AmiMessage) Get(key string) string {
+    for _, field := range message {
+        if field.Key == key {
+            return field.Value
+        }
+    }
+    return ""
+}
+
+// Map returns the fields by key, the last value of a key winning as it does for events read by AmiService.
+func (message AmiMessage) Map() map[string]string {
+    fields := make(map[string]string, len(message))
+    for _, field := range message {
+        fields[field.Key] = field.Value
+    }
+    return fields
+}
+
+// AmiClient is a plain AMI connection, without sinks or sequence, for commands that talk to AMI directly,
+// e.g. to send an action or watch events.
+type AmiClient struct {
+    con    net.Conn
+    reader *bufio.Reader
+    // First line sent by AMI, e.g. Asterisk Call Manager/5.0.1
+    banner      string
+    readTimeout time.Duration
+    actionId    int64
+}
+
+// DialAmi connects to AMI_HOST and AMI_PORT, trying DIAL_RETRY times.
+func DialAmi(amiConfig *conf.AmiConf) (*AmiClient, error) {
+    // dial only reads the AMI settings
+    dialer := &amiService{appConfig: &conf.AppConf{AmiConf: amiConfig}}
+    con, err := dialer.dial()
+    if err != nil {
+        return nil, err
+    }
+    client := &AmiClient{con: con, reader: bufio.NewReader(con), readTimeout: *amiConfig.ReadTimeout}
+    deadline := time.Time{}
+    if client.readTimeout > 0 {
+        deadline = time.Now().Add(client.readTimeout)
+    }
+    if err = con.SetReadDeadline(deadline); err == nil {
+        client.banner, err = client.reader.ReadString('\n')
+    }
+    if err != nil {
+        _ = con.Close()
+        return nil, errors.Wrap(err, "Failed to read the AMI banner.")
+    }
+    client.banner = strings.TrimSpace(client.banner)
+    return client, nil
+}
+
+// Banner returns the first line sent by AMI, which tells its version.
+func (client *AmiClient) Banner() string {
+    return client.banner
+}
+
+// Login logs in. Events are only sent afterwards when events is true.
+func (client *AmiClient) Login(user string, secret string, events bool) error {
+    eventMask := "off"
+    if events {
+        eventMask = "on"
+    }
+    response, err := client.Send([]AmiField{
+        {Key: "Action", Value: "Login"},
+        {Key: "Username", Value: user},
+        {Key: "Secret", Value: secret},
+        {Key: "Events", Value: eventMask},
+    }, 0)
+    if err != nil {
+        return err
+    }
+    if response[0].Get("Response") != "Success" {
+        return errors.New(response[0].Get("Message"))
+    }
+    return nil
+}
+
+// Send sends an action and returns its response, followed by the events it lists, if any, e.g. those of
+// CoreShowChannels. An ActionID is added when the action has none. timeout 0 waits as long as READ_TIMEOUT.
+func (client *AmiClient) Send(action []AmiField, timeout time.Duration) ([]AmiMessage, error) {
+    if timeout == 0 {
+        timeout = client.readTimeout
+    }
+    actionId := AmiMessage(action).Get("ActionID")
+    if actionId == "" {
+        hostname, _ := os.Hostname()
+        actionId = fmt.Sprintf("ami-reader-%s-%d-%d", hostname, os.Getpid(), atomic.AddInt64(&client.actionId, 1))
+        action = append(action, AmiField{Key: "ActionID", Value: actionId})
+    }
+    var out bytes.Buffer
+    for _, field := range action {
+        out.WriteString(field.Key + ": " + field.Value + "\r\n")
+    }
+    out.WriteString("\r\n")
+    if _, err := client.con.Write(out.Bytes()); err != nil {
+        return nil, err
+    }
+    var messages []AmiMessage
+    for {
+        message, err := client.Read(timeout)
+        if err != nil {
+            return messages, err
+        }
+        // Events of other actions or sent to every session are skipped
+        if message.Get("ActionID") != actionId {
+            continue
+        }
+        messages = append(messages, message)
+        if len(messages) == 1 && !strings.EqualFold(message.Get("EventList"), "start") {
+            return messages, nil
+        }
+        if strings.EqualFold(message.Get("EventList"), "Complete") {
+            return messages, nil
+        }
+    }
+}
+
+// Read reads the next message, waiting up to timeout. timeout 0 waits forever.
+func (client *AmiClient) Read(timeout time.Duration) (AmiMessage, error) {
+    deadline := time.Time{}
+    if timeout > 0 {
+        deadline = time.Now().Add(timeout)
+    }
+    if err := client.con.SetReadDeadline(deadline); err != nil {
+        return nil, err
+    }
+    var message AmiMessage
+    responseFollows := false
+    for {
+        line, err := client.reader.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        line = strings.TrimRight(line, "\r\n")
+        if line == "" {
+            if len(message) == 0 {
+                continue
+            }
+            return message, nil
+        }
+        key, value := "", line
+        if i := strings.Index(line, ":"); i >= 0 {
+            key, value = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+        }
+        // Output of a Command action on older Asterisk, up to --END COMMAND--
+        if responseFollows && key != "Privilege" && key != "ActionID" {
+            if line != "--END COMMAND--" {
+                message = append(message, AmiField{Key: "Output", Value: line})
+            }
+            continue
+        }
+        if key == "" {
+            continue
+        }
+        if key == "Response" && value == "Follows" {
+            responseFollows = true
+        }
+        message = append(message, AmiField{Key: key, Value: value})
+    }
+}
+
+// Close logs off and closes the connection.
+func (client *AmiClient) Close() error {
+    _, _ = client.con.Write([]byte("Action: Logoff\r\nActionID: " + strconv.FormatInt(atomic.AddInt64(&client.actionId, 1), 10) + "\r\n\r\n"))
+    return client.con.Close()
+}
+
+// Interrupt makes a pending Read return, e.g. on Ctrl+C.
+func (client *AmiClient) Interrupt() {
+    _ = client.con.SetReadDeadline(time.Now())
+}
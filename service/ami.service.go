@@ -2,7 +2,8 @@ package service
 
 import (
     "ami-reader/conf"
-    "ami-reader/util"
+    "ami-reader/sequence"
+    "ami-reader/transform"
     "bufio"
     "bytes"
     "fmt"
@@ -12,6 +13,8 @@ import (
     "os"
     "os/signal"
     "strconv"
+    "strings"
+    "sync"
     "time"
 )
 
@@ -23,6 +26,7 @@ type AmiService interface {
     Connect() error
     Login() error
     Listen() error
+    Reload(appConfig *conf.AppConf, changes []conf.Change) bool
     Disconnect()
     IsConnected() bool
     IsLoggedIn() bool
@@ -35,22 +39,51 @@ type amiService struct {
     connected               bool
     isLoggedIn              bool
     amiEventConsumerService AmiEventConsumer
-    amqpExcludedEvents      *[]string
+    sequencer               *sequence.Sequencer
+    pbxLatency              *histogram
+    clockSkew               *clockSkew
+    // mutex guards the config and the consumer, which a reload replaces, and the connection and its state
+    mutex                   sync.RWMutex
+    reconnect               bool
+    disconnected            bool
 }
 
-func NewAmiService(appConfig *conf.AppConf, amiEventConsumerService AmiEventConsumer) AmiService {
+func NewAmiService(appConfig *conf.AppConf, sequencer *sequence.Sequencer, amiEventConsumerService AmiEventConsumer) AmiService {
     service := amiService{}
     service.appConfig = appConfig
+    service.sequencer = sequencer
+    service.pbxLatency = latencyHistogram("pbx_to_reader")
+    service.clockSkew = newClockSkew(*appConfig.ClockSkewWarn)
     service.dialString = fmt.Sprintf("%s:%d", *appConfig.AmiHost, *appConfig.AmiPort)
     service.amiEventConsumerService = amiEventConsumerService
     return &service
 }
 
 func (service *amiService) Connect() error {
-    appConfig := service.appConfig
+    con, err := service.dial()
+    if err == nil {
+        service.handleCrtlC()
+        service.mutex.Lock()
+        service.con = con
+        service.connected = true
+        service.mutex.Unlock()
+        err = service.amiEventConsumerService.Initialize()
+        if err != nil {
+            return err
+        }
+        if err = service.appConfig.Scripts.Watch(); err != nil {
+            return err
+        }
+    }
+    return err
+}
+
+func (service *amiService) dial() (net.Conn, error) {
+    appConfig := service.config()
     var con net.Conn
     var err error
-    dialString := service.dialString
+    dialString := net.JoinHostPort(*appConfig.AmiHost, strconv.Itoa(*appConfig.AmiPort))
+    service.dialString = dialString
     dialRetry := *appConfig.DialRetry
     i := 1
     for ; i <= dialRetry; i++ {
@@ -67,21 +100,17 @@ func (service *amiService) Connect() error {
             }
         }
     }
-    if err == nil {
-        service.handleCrtlC()
-        service.con = con
-        service.connected = true
-        err = service.amiEventConsumerService.Initialize()
-        if err != nil {
-            return err
-        }
-    }
-    return err
+    return con, err
 }
 
 func (service *amiService) Login() error {
+    service.mutex.RLock()
     con := service.con
     appConfig := service.appConfig
+    service.mutex.RUnlock()
+    if con == nil {
+        return errors.New("Not connected to AMI.")
+    }
     action := map[string]string{
         "Action":   "Login",
         "ActionID": *appConfig.HostDeviceId + " Login",
@@ -102,19 +131,65 @@ func (service *amiService) Login() error {
     if result["Response"] != "Success" && result["Message"] != "Authentication accepted" {
         return errors.New(result["Message"])
     }
+    sessionId, err := service.sequencer.NewSession()
+    if err != nil {
+        return errors.Wrap(err, "Failed to start a new session.")
+    }
+    log.Infof("AMI session %s started.", sessionId)
+    service.mutex.Lock()
     service.isLoggedIn = true
+    service.mutex.Unlock()
     return nil
 }
 
+// Listen reads events until the connection is closed. It connects again when a reload changed the AMI settings.
 func (service *amiService) Listen() error {
-    bufReader := bufio.NewReader(service.con)
-    appConfig := service.appConfig
-    hostDeviceId := *appConfig.HostDeviceId
+    for {
+        err := service.listen()
+        service.mutex.Lock()
+        reconnect := service.reconnect
+        service.reconnect = false
+        service.mutex.Unlock()
+        if !reconnect {
+            return err
+        }
+        log.Info("Reconnecting to AMI with the new settings.")
+        con, err := service.dial()
+        if err != nil {
+            return err
+        }
+        service.mutex.Lock()
+        disconnected := service.disconnected
+        if !disconnected {
+            service.con = con
+            service.connected = true
+        }
+        service.mutex.Unlock()
+        if disconnected {
+            // Disconnect was called meanwhile, e.g. on an interrupt
+            _ = con.Close()
+            return nil
+        }
+        if err = service.Login(); err != nil {
+            return errors.Wrap(err, "Failed to login to Asterisk.")
+        }
+    }
+}
+
+func (service *amiService) listen() error {
+    service.mutex.RLock()
+    con := service.con
+    service.mutex.RUnlock()
+    if con == nil {
+        return nil
+    }
+    bufReader := bufio.NewReader(con)
     var event map[string]string
     var err error
-    for service.isLoggedIn {
+    for service.IsLoggedIn() {
+        appConfig := service.config()
         // Set a deadline for reading. Read operation will fail if no data is received after deadline.
-        err = service.con.SetReadDeadline(time.Now().Add(*service.appConfig.ReadTimeout))
+        err = con.SetReadDeadline(time.Now().Add(*appConfig.ReadTimeout))
         if err != nil {
             err = errors.Wrap(err, fmt.Sprintf("Failed to set read deadline timeout."))
             break
@@ -125,60 +200,193 @@ func (service *amiService) Listen() error {
             log.Debug("No data received or timeout reading from ami socket.")
         } else if err != nil {
             break
-        } else {
-            _, found := util.Find(*service.appConfig.AmqpExcludedEvents, event["Event"])
-            if !found {
-                /*
-                	If current time is 2009-11-10 23:00:00 +0000 UTC m=+0.000000000
-                	nsec = 1257894000000000000
-                	See https://yourbasic.org/golang/current-time/
-                */
-                now := time.Now()
-                nsec := now.UnixNano() // number of nanoseconds since January 1, 1970 UTC
-                event["timestamp"] = strconv.FormatInt(nsec, 10)
-                event["timestamp_dt"] = now.Format("2006-01-02T15:04:05.999999Z07:00")
-                event["host_device_id"] = hostDeviceId
-                service.amiEventConsumerService.Consume(event)
-            }
+        } else if err = service.process(event, time.Now()); err != nil {
+            break
+        }
+        // Suppressed counts are reported once their minute is over, also when no event comes in
+        if err = service.report(time.Now()); err != nil {
+            break
         }
     }
     return err
 }
 
+// process passes an event read at now through the stages of the current config.
+func (service *amiService) process(event map[string]string, now time.Time) error {
+    appConfig, consumer := service.current()
+    if !appConfig.EventFilter.Match(event) || !appConfig.Sampler.Allow(event, now) {
+        return nil
+    }
+    appConfig.Redactor.Redact(event)
+    for _, processed := range appConfig.Scripts.Process(event) {
+        if err := service.dispatch(appConfig, consumer, processed, now); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (service *amiService) report(now time.Time) error {
+    appConfig, consumer := service.current()
+    for _, report := range appConfig.Sampler.Reports(now) {
+        if err := service.dispatch(appConfig, consumer, report, now); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// current returns the current config and consumer. They are used without holding mutex, Consume may block
+// for as long as a sink is stalled and Disconnect or Reload must not wait for it.
+func (service *amiService) current() (*conf.AppConf, AmiEventConsumer) {
+    service.mutex.RLock()
+    defer service.mutex.RUnlock()
+    return service.appConfig, service.amiEventConsumerService
+}
+
+// dispatch stamps an event read at now and hands it over to the consumer.
+func (service *amiService) dispatch(appConfig *conf.AppConf, consumer AmiEventConsumer, event map[string]string, now time.Time) error {
+    /*
+    	If current time is 2009-11-10 23:00:00 +0000 UTC m=+0.000000000
+    	nsec = 1257894000000000000
+    	See https://yourbasic.org/golang/current-time/
+    */
+    nsec := now.UnixNano() // number of nanoseconds since January 1, 1970 UTC
+    event["timestamp"] = strconv.FormatInt(nsec, 10)
+    event["timestamp_dt"] = now.Format("2006-01-02T15:04:05.999999Z07:00")
+    // Sent by Asterisk with timestampevents=yes in manager.conf, as epoch seconds with microseconds
+    if pbxTime, ok := transform.ParseTime(event["Timestamp"]); ok {
+        event["pbx_timestamp"] = strconv.FormatInt(pbxTime.UnixNano(), 10)
+        event["pbx_timestamp_dt"] = pbxTime.Format("2006-01-02T15:04:05.999999Z07:00")
+        service.pbxLatency.observe(now.Sub(pbxTime))
+        service.clockSkew.check(pbxTime, now)
+    }
+    event["host_device_id"] = *appConfig.HostDeviceId
+    // Stamped in read order, before workers may reorder events
+    if err := service.sequencer.Stamp(event); err != nil {
+        return err
+    }
+    consumer.Consume(event)
+    return nil
+}
+
+// Disconnect logs off, closes the connection and the sinks. Only the first call does, e.g. of an interrupt and
+// of main. Logoff is only sent on a session that is still open, not after a failed reconnect.
 func (service *amiService) Disconnect() {
-    if service.con != nil {
-        con := service.con
-        if service.isLoggedIn {
-            log.Info("Logging out from AMI.")
-            appConfig := service.appConfig
-            action := map[string]string{
-                "Action":   "Logoff",
-                "ActionID": *appConfig.HostDeviceId + " Logoff",
-            }
-            serialized := serialize(action)
-            _, err := con.Write(serialized)
-            if err != nil {
-                log.Errorf("Failed to logoff from AMI. Reason: %v.", err)
-            }
-            service.isLoggedIn = false
+    service.mutex.Lock()
+    if service.disconnected {
+        service.mutex.Unlock()
+        return
+    }
+    service.disconnected = true
+    con, isLoggedIn, appConfig := service.con, service.isLoggedIn, service.appConfig
+    service.con, service.connected, service.isLoggedIn = nil, false, false
+    service.mutex.Unlock()
+    if con != nil {
+        if isLoggedIn {
+            logoff(con, appConfig)
         }
-        service.con = nil
-        service.connected = false
-        err := con.Close()
-        if err != nil {
+        if err := con.Close(); err != nil {
             log.Errorf("Failed to close opened connection in %s. Reason: %v", service.dialString, err)
         }
-        // TODO: Graceful shutdown when read message is still in transit to message brokers
+    }
+    // TODO: Graceful shutdown when read message is still in transit to message brokers
+    service.mutex.Lock()
+    service.amiEventConsumerService.Destroy()
+    service.appConfig.Scripts.Close()
+    service.mutex.Unlock()
+    if err := service.sequencer.Close(); err != nil {
+        log.Errorf("Failed to save sequence. Reason: %v", err)
+    }
+}
+
+// logoff ends the AMI session of con, before it is closed.
+func logoff(con net.Conn, appConfig *conf.AppConf) {
+    log.Info("Logging out from AMI.")
+    action := map[string]string{
+        "Action":   "Logoff",
+        "ActionID": *appConfig.HostDeviceId + " Logoff",
+    }
+    serialized := serialize(action)
+    _, err := con.Write(serialized)
+    if err != nil {
+        log.Errorf("Failed to logoff from AMI. Reason: %v.", err)
+    }
+}
+
+// Reload applies a new config. Live settings apply to the next event, sinks are created again when their
+// settings changed and AMI is connected to again when its settings changed. The new sinks are initialized while
+// the current ones still run, events are only held while the current ones deliver what they have queued. The
+// current config is kept when the new sinks can't be created or initialized, Reload then returns false.
+func (service *amiService) Reload(appConfig *conf.AppConf, changes []conf.Change) bool {
+    scopes := make(map[conf.Scope][]string)
+    for _, change := range changes {
+        scope := conf.ScopeOf(change.Key)
+        scopes[scope] = append(scopes[scope], change.Key)
+    }
+    if keys := scopes[conf.ScopeRestart]; len(keys) > 0 {
+        log.Warnf("Changes of %s only apply after a restart.", strings.Join(keys, ", "))
+    }
+    var consumer AmiEventConsumer
+    if len(scopes[conf.ScopeSinks]) > 0 {
+        log.Infof("Creating sinks again for changes of %s.", strings.Join(scopes[conf.ScopeSinks], ", "))
+        var err error
+        if consumer, err = NewAmiEventConsumer(appConfig); err == nil {
+            err = consumer.Initialize()
+        }
+        if err != nil {
+            appConfig.Scripts.Close()
+            log.Errorf("Keeping current configuration, failed to create sinks. Reason: %v", err)
+            return false
+        }
+    }
+    if err := appConfig.Scripts.Watch(); err != nil {
+        log.Errorf("Failed to watch scripts. Reason: %v", err)
+    }
+    service.mutex.Lock()
+    previous := service.appConfig
+    service.appConfig = appConfig
+    if consumer != nil {
         service.amiEventConsumerService.Destroy()
+        service.amiEventConsumerService = consumer
+    }
+    // The current session is taken over here so listen, which reads the connection, stops on it
+    var con net.Conn
+    isLoggedIn := false
+    if len(scopes[conf.ScopeReconnect]) > 0 && service.con != nil {
+        con, isLoggedIn = service.con, service.isLoggedIn
+        service.con, service.connected, service.isLoggedIn = nil, false, false
+        service.reconnect = true
     }
+    service.mutex.Unlock()
+    previous.Scripts.Close()
+    if con != nil {
+        log.Infof("Reconnecting to AMI for changes of %s.", strings.Join(scopes[conf.ScopeReconnect], ", "))
+        if isLoggedIn {
+            logoff(con, previous)
+        }
+        // Makes listen return, Listen connects again
+        _ = con.Close()
+    }
+    return true
+}
 
+// config returns the current config.
+func (service *amiService) config() *conf.AppConf {
+    service.mutex.RLock()
+    defer service.mutex.RUnlock()
+    return service.appConfig
 }
 
 func (service *amiService) IsConnected() bool {
+    service.mutex.RLock()
+    defer service.mutex.RUnlock()
     return service.connected
 }
 
 func (service *amiService) IsLoggedIn() bool {
+    service.mutex.RLock()
+    defer service.mutex.RUnlock()
     return service.isLoggedIn
 }
 
@@ -0,0 +1,313 @@
+package service
+
+import (
+    "ami-reader/conf"
+    "ami-reader/sequence"
+    "bufio"
+    log "github.com/sirupsen/logrus"
+    logtest "github.com/sirupsen/logrus/hooks/test"
+    "github.com/spf13/viper"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// reloadTestService is the service the consumers of the reloadtest sink check the lock of
+var reloadTestService *amiService
+
+type reloadTestConsumer struct {
+    initialized bool
+    destroyed   bool
+    // Whether Initialize ran while the service held its mutex
+    initializedLocked bool
+}
+
+func (consumer *reloadTestConsumer) Initialize() error {
+    consumer.initialized = true
+    if reloadTestService != nil {
+        unlocked := make(chan struct{})
+        go func() {
+            reloadTestService.config()
+            close(unlocked)
+        }()
+        select {
+        case <-unlocked:
+        case <-time.After(time.Second):
+            consumer.initializedLocked = true
+        }
+    }
+    return nil
+}
+
+func (consumer *reloadTestConsumer) Destroy() {
+    consumer.destroyed = true
+}
+
+func (consumer *reloadTestConsumer) Consume(event map[string]string) {
+}
+
+var reloadTestConsumers struct {
+    sync.Mutex
+    created []*reloadTestConsumer
+}
+
+func init() {
+    RegisterAmiEventConsumer("reloadtest", func(appConfig *conf.AppConf, sinkConfig *conf.SinkConf) (AmiEventConsumer, error) {
+        consumer := &reloadTestConsumer{}
+        reloadTestConsumers.Lock()
+        reloadTestConsumers.created = append(reloadTestConsumers.created, consumer)
+        reloadTestConsumers.Unlock()
+        return consumer, nil
+    })
+}
+
+// fakeAmi accepts AMI logins and records the actions of each session.
+type fakeAmi struct {
+    listener net.Listener
+    mutex    sync.Mutex
+    sessions [][]string
+}
+
+func newFakeAmi(t *testing.T) *fakeAmi {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ami := &fakeAmi{listener: listener}
+    go func() {
+        for {
+            con, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go ami.serve(con)
+        }
+    }()
+    return ami
+}
+
+func (ami *fakeAmi) serve(con net.Conn) {
+    defer con.Close()
+    reader := bufio.NewReader(con)
+    ami.mutex.Lock()
+    session := len(ami.sessions)
+    ami.sessions = append(ami.sessions, nil)
+    ami.mutex.Unlock()
+    for {
+        action, err := readMessage(reader)
+        if err != nil {
+            return
+        }
+        ami.mutex.Lock()
+        ami.sessions[session] = append(ami.sessions[session], action["Action"])
+        ami.mutex.Unlock()
+        switch action["Action"] {
+        case "Login":
+            _, _ = con.Write(serialize(map[string]string{"Response": "Success", "Message": "Authentication accepted"}))
+        case "Logoff":
+            _, _ = con.Write(serialize(map[string]string{"Response": "Goodbye", "Message": "Thanks for all the fish."}))
+            return
+        }
+    }
+}
+
+func (ami *fakeAmi) actions(session int) []string {
+    ami.mutex.Lock()
+    defer ami.mutex.Unlock()
+    if session >= len(ami.sessions) {
+        return nil
+    }
+    return append([]string{}, ami.sessions[session]...)
+}
+
+func (ami *fakeAmi) waitFor(t *testing.T, session int, want string) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for strings.Join(ami.actions(session), " ") != want {
+        if time.Now().After(deadline) {
+            t.Fatalf("session %d got %v, want %s", session, ami.actions(session), want)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func newReloadTestConf(t *testing.T, settings map[string]interface{}) *conf.AppConf {
+    t.Helper()
+    for key, value := range settings {
+        viper.Set(key, value)
+    }
+    appConfig, err := conf.NewAppConf()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return appConfig
+}
+
+func TestAmiServiceReload(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "ami")
+    defer os.RemoveAll(dir)
+    ami := newFakeAmi(t)
+    defer ami.listener.Close()
+    port := ami.listener.Addr().(*net.TCPAddr).Port
+    viper.Reset()
+    defer viper.Reset()
+    reloadTestConsumers.Lock()
+    reloadTestConsumers.created = nil
+    reloadTestConsumers.Unlock()
+    appConfig := newReloadTestConf(t, map[string]interface{}{
+        "AMI_HOST":          "127.0.0.1",
+        "AMI_PORT":          port,
+        "AMI_USER":          "reader",
+        "AMI_PASS":          "secret",
+        "HOST_DEVICE_ID":    "pbx1",
+        "SINKS":             "reloadtest",
+        "NUMBER_OF_WORKERS": 1,
+        "NUMBER_OF_JOBS":    1,
+        "READ_TIMEOUT":      "50ms",
+        "DIAL_RETRY":        1,
+    })
+    sequencer, err := sequence.Open(filepath.Join(dir, "sequence.state"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    consumer, err := NewAmiEventConsumer(appConfig)
+    if err != nil {
+        t.Fatal(err)
+    }
+    service := NewAmiService(appConfig, sequencer, consumer).(*amiService)
+    reloadTestService = service
+    defer func() { reloadTestService = nil }()
+    if err = service.Connect(); err != nil {
+        t.Fatal(err)
+    }
+    if err = service.Login(); err != nil {
+        t.Fatal(err)
+    }
+    listened := make(chan error, 1)
+    go func() {
+        listened <- service.Listen()
+    }()
+
+    // New sinks and new AMI settings: the first session is logged off, the sinks are initialized unlocked
+    reloaded := newReloadTestConf(t, map[string]interface{}{"AMI_USER": "other", "NUMBER_OF_WORKERS": 2, "NUMBER_OF_JOBS": 2})
+    if !service.Reload(reloaded, []conf.Change{{Key: "AMI_USER"}, {Key: "NUMBER_OF_WORKERS"}}) {
+        t.Fatal("Reload not applied")
+    }
+    ami.waitFor(t, 0, "Login Logoff")
+    ami.waitFor(t, 1, "Login")
+    reloadTestConsumers.Lock()
+    first, second := reloadTestConsumers.created[0], reloadTestConsumers.created[1]
+    reloadTestConsumers.Unlock()
+    if !first.destroyed || !second.initialized || second.destroyed {
+        t.Fatalf("previous sinks destroyed %v, new sinks initialized %v and destroyed %v", first.destroyed, second.initialized, second.destroyed)
+    }
+    if second.initializedLocked {
+        t.Fatal("new sinks initialized while holding the service mutex")
+    }
+
+    // AMI can't be reached anymore: the second session is logged off and Listen gives up
+    ami.listener.Close()
+    moved := newReloadTestConf(t, map[string]interface{}{"AMI_PORT": strconv.Itoa(port)})
+    if !service.Reload(moved, []conf.Change{{Key: "AMI_PORT"}}) {
+        t.Fatal("Reload not applied")
+    }
+    ami.waitFor(t, 1, "Login Logoff")
+    select {
+    case err = <-listened:
+        if err == nil {
+            t.Fatal("Listen returned no error after a failed reconnect")
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Listen did not return after a failed reconnect")
+    }
+
+    // Nothing is left to log off from
+    hook := logtest.NewGlobal()
+    defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+    service.Disconnect()
+    service.Disconnect()
+    for _, entry := range hook.AllEntries() {
+        if strings.Contains(entry.Message, "logoff") || strings.Contains(entry.Message, "Logging out") {
+            t.Errorf("logged %q after a failed reconnect", entry.Message)
+        }
+    }
+    if !second.destroyed || service.IsConnected() || service.IsLoggedIn() {
+        t.Fatal("Disconnect left the sinks or the connection open")
+    }
+}
+
+// stalledConsumer blocks Consume until it is destroyed, like a sink with OVERFLOW_POLICY=block and a stalled broker.
+type stalledConsumer struct {
+    consuming chan struct{}
+    destroyed chan struct{}
+    once      sync.Once
+}
+
+func (consumer *stalledConsumer) Initialize() error {
+    return nil
+}
+
+func (consumer *stalledConsumer) Destroy() {
+    consumer.once.Do(func() { close(consumer.destroyed) })
+}
+
+func (consumer *stalledConsumer) Consume(event map[string]string) {
+    close(consumer.consuming)
+    <-consumer.destroyed
+}
+
+func TestAmiServiceNotBlockedByStalledSink(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "ami")
+    defer os.RemoveAll(dir)
+    viper.Reset()
+    defer viper.Reset()
+    tests := []struct {
+        name string
+        stop func(service *amiService, appConfig *conf.AppConf)
+    }{
+        {"disconnect", func(service *amiService, appConfig *conf.AppConf) {
+            service.Disconnect()
+        }},
+        {"reload", func(service *amiService, appConfig *conf.AppConf) {
+            service.Reload(appConfig, []conf.Change{{Key: "NUMBER_OF_WORKERS"}})
+        }},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            appConfig := newReloadTestConf(t, map[string]interface{}{
+                "AMI_HOST":       "127.0.0.1",
+                "AMI_USER":       "reader",
+                "AMI_PASS":       "secret",
+                "HOST_DEVICE_ID": "pbx1",
+                "SINKS":          "reloadtest",
+            })
+            sequencer, err := sequence.Open(filepath.Join(dir, test.name+".state"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            consumer := &stalledConsumer{consuming: make(chan struct{}), destroyed: make(chan struct{})}
+            service := NewAmiService(appConfig, sequencer, consumer).(*amiService)
+            go func() {
+                _ = service.process(map[string]string{"Event": "Hangup"}, time.Now())
+            }()
+            <-consumer.consuming
+            stopped := make(chan struct{})
+            go func() {
+                test.stop(service, appConfig)
+                close(stopped)
+            }()
+            select {
+            case <-stopped:
+            case <-time.After(5 * time.Second):
+                t.Fatalf("%s waited for a stalled sink", test.name)
+            }
+            service.Disconnect()
+        })
+    }
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+    "ami-reader/conf"
+    "fmt"
+    "github.com/pkg/errors"
+    "sort"
+)
+
+// AmiEventConsumerFactory creates a consumer from the app config and the settings of its own sink section.
+type AmiEventConsumerFactory func(appConfig *conf.AppConf, sinkConfig *conf.SinkConf) (AmiEventConsumer, error)
+
+var amiEventConsumerFactories = make(map[string]AmiEventConsumerFactory)
+
+// RegisterAmiEventConsumer makes a consumer selectable by name through the SINKS config.
+// It is meant to be called from the init function of the file implementing the consumer.
+func RegisterAmiEventConsumer(name string, factory AmiEventConsumerFactory) {
+    if _, found := amiEventConsumerFactories[name]; found {
+        panic(fmt.Sprintf("AMI event consumer %s is already registered", name))
+    }
+    amiEventConsumerFactories[name] = factory
+}
+
+func RegisteredAmiEventConsumers() []string {
+    names := make([]string, 0, len(amiEventConsumerFactories))
+    for name := range amiEventConsumerFactories {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// sinkChecker is implemented by sinks that rely on a remote service, e.g. a broker, and can make sure it is
+// reachable without consuming events.
+type sinkChecker interface {
+    Check() error
+}
+
+// SinkCheck is the outcome of checking a sink. Checked is false for sinks that don't rely on a remote service.
+type SinkCheck struct {
+    Name    string
+    Checked bool
+    Err     error
+}
+
+// CheckSinks creates the sinks listed in SINKS, without initializing them, and checks those relying on a
+// remote service.
+func CheckSinks(appConfig *conf.AppConf) []SinkCheck {
+    var checks []SinkCheck
+    for _, name := range *appConfig.Sinks {
+        check := SinkCheck{Name: name}
+        factory, found := amiEventConsumerFactories[name]
+        if !found {
+            check.Err = errors.Errorf("Unknown sink %s. Available sinks: %v", name, RegisteredAmiEventConsumers())
+            checks = append(checks, check)
+            continue
+        }
+        sinkConfig := conf.NewSinkConf(name)
+        consumer, err := factory(appConfig, sinkConfig)
+        if sinkErr := sinkConfig.Err(); sinkErr != nil {
+            err = sinkErr
+        }
+        if err != nil {
+            check.Err = err
+        } else if checker, ok := consumer.(sinkChecker); ok {
+            check.Checked = true
+            check.Err = checker.Check()
+        }
+        checks = append(checks, check)
+    }
+    return checks
+}
+
+// NewAmiEventConsumer creates the consumers listed in SINKS. Events are fanned out to every sink
+// when more than one is configured, after being enriched (ENRICH) and going through the TRANSFORM pipeline.
+func NewAmiEventConsumer(appConfig *conf.AppConf) (AmiEventConsumer, error) {
+    sinks := *appConfig.Sinks
+    if len(sinks) == 0 {
+        return nil, errors.New("No sink configured in SINKS")
+    }
+    consumers := make([]AmiEventConsumer, 0, len(sinks))
+    for _, name := range sinks {
+        factory, found := amiEventConsumerFactories[name]
+        if !found {
+            return nil, errors.Errorf("Unknown sink %s. Available sinks: %v", name, RegisteredAmiEventConsumers())
+        }
+        sinkConfig := conf.NewSinkConf(name)
+        consumer, err := factory(appConfig, sinkConfig)
+        // Every invalid value of the sink rather than the first one only
+        if sinkErr := sinkConfig.Err(); sinkErr != nil {
+            err = sinkErr
+        }
+        if err != nil {
+            return nil, errors.Wrap(err, fmt.Sprintf("Failed to create sink %s.", name))
+        }
+        consumers = append(consumers, consumer)
+    }
+    consumer := consumers[0]
+    if len(consumers) > 1 {
+        consumer = newMultiAmiEventConsumer(consumers)
+    }
+    if !appConfig.Transform.Empty() {
+        consumer = newTransformAmiEventConsumer(appConfig.Transform, consumer)
+    }
+    // Enriched first so attributes can be renamed and coerced too
+    if !appConfig.Enricher.Empty() {
+        consumer = newEnrichAmiEventConsumer(appConfig.Enricher, consumer)
+    }
+    return consumer, nil
+}
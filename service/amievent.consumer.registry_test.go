@@ -0,0 +1,122 @@
+package service
+
+import (
+    "github.com/spf13/viper"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestNewAmiEventConsumerSelectsSinks(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "sinks")
+    defer os.RemoveAll(dir)
+    table := filepath.Join(dir, "users.csv")
+    if err := ioutil.WriteFile(table, []byte("ext,user\n1001,alice\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name     string
+        settings map[string]interface{}
+        // Types of the consumer chain, outermost first
+        want []string
+    }{
+        {"one sink", map[string]interface{}{"SINKS": "stdout"}, []string{"*service.defaultAmiEventConsumer"}},
+        {"several sinks", map[string]interface{}{"SINKS": "stdout,reloadtest"}, []string{"*service.multiAmiEventConsumer"}},
+        {
+            "transform",
+            map[string]interface{}{"SINKS": "stdout", "TRANSFORM": []map[string]interface{}{{"action": "drop", "fields": []string{"Privilege"}}}},
+            []string{"*service.transformAmiEventConsumer", "*service.defaultAmiEventConsumer"},
+        },
+        {
+            "enrich then transform",
+            map[string]interface{}{
+                "SINKS":     "stdout",
+                "TRANSFORM": []map[string]interface{}{{"action": "drop", "fields": []string{"Privilege"}}},
+                "ENRICH":    []map[string]interface{}{{"table": table, "fields": []string{"CallerIDNum"}}},
+            },
+            []string{"*service.enrichAmiEventConsumer", "*service.transformAmiEventConsumer", "*service.defaultAmiEventConsumer"},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            viper.Reset()
+            defer viper.Reset()
+            settings := map[string]interface{}{"AMI_HOST": "127.0.0.1", "AMI_PASS": "secret", "HOST_DEVICE_ID": "pbx-1"}
+            for key, value := range test.settings {
+                settings[key] = value
+            }
+            appConfig := newReloadTestConf(t, settings)
+            defer appConfig.Scripts.Close()
+            consumer, err := NewAmiEventConsumer(appConfig)
+            if err != nil {
+                t.Fatal(err)
+            }
+            var chain []string
+            for consumer != nil {
+                chain = append(chain, reflect.TypeOf(consumer).String())
+                switch wrapper := consumer.(type) {
+                case *enrichAmiEventConsumer:
+                    consumer = wrapper.next
+                case *transformAmiEventConsumer:
+                    consumer = wrapper.next
+                default:
+                    consumer = nil
+                }
+            }
+            if !reflect.DeepEqual(chain, test.want) {
+                t.Errorf("created %v, want %v", chain, test.want)
+            }
+        })
+    }
+}
+
+func TestNewAmiEventConsumerFailsOnInvalidSinks(t *testing.T) {
+    tests := []struct {
+        name     string
+        settings map[string]interface{}
+        want     string
+    }{
+        {"unknown sink", map[string]interface{}{"SINKS": "stdout,kafka"}, "Unknown sink kafka. Available sinks: [rabbitmq reloadtest stdout]"},
+        {"invalid sink setting", map[string]interface{}{"SINKS": "stdout", "STDOUT": map[string]interface{}{"FORMAT": "xml"}}, "Failed to create sink stdout."},
+        // Every invalid value of the sink is reported
+        {
+            "invalid values of the sink section",
+            map[string]interface{}{"SINKS": "rabbitmq", "RABBITMQ": map[string]interface{}{"AMQP_URL": "amqp://broker", "AMQP_BATCH_SIZE": "many", "AMQP_PUBLISH_RETRY": "often"}},
+            `AMQP_BATCH_SIZE: "many" is not a whole number
+  RABBITMQ.AMQP_PUBLISH_RETRY: "often" is not a whole number`,
+        },
+        {"missing AMQP_URL", map[string]interface{}{"SINKS": "rabbitmq"}, "AMQP_URL environment variable not found"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            viper.Reset()
+            defer viper.Reset()
+            settings := map[string]interface{}{"AMI_HOST": "127.0.0.1", "AMI_PASS": "secret", "HOST_DEVICE_ID": "pbx-1"}
+            for key, value := range test.settings {
+                settings[key] = value
+            }
+            appConfig := newReloadTestConf(t, settings)
+            defer appConfig.Scripts.Close()
+            consumer, err := NewAmiEventConsumer(appConfig)
+            if err == nil {
+                consumer.Destroy()
+                t.Fatal("NewAmiEventConsumer succeeded")
+            }
+            if !strings.Contains(err.Error(), test.want) {
+                t.Errorf("err = %v, want %s", err, test.want)
+            }
+        })
+    }
+    viper.Reset()
+    defer viper.Reset()
+    appConfig := newReloadTestConf(t, map[string]interface{}{"AMI_HOST": "127.0.0.1", "AMI_PASS": "secret", "HOST_DEVICE_ID": "pbx-1"})
+    defer appConfig.Scripts.Close()
+    // SINKS defaults to rabbitmq when empty
+    appConfig.Sinks = &[]string{}
+    if _, err := NewAmiEventConsumer(appConfig); err == nil || err.Error() != "No sink configured in SINKS" {
+        t.Errorf("err = %v without sinks", err)
+    }
+}
@@ -2,42 +2,87 @@ package service
 
 import (
 	"ami-reader/conf"
-	"encoding/json"
+	"ami-reader/serializer"
+	"encoding/base64"
 	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
 )
 
 type defaultAmiEventConsumer struct {
-	appConfig    *conf.AppConf
-	eventJobChan chan map[string]string
+	appConfig  *conf.AppConf
+	serializer serializer.Serializer
+	lanes      *orderedLanes
+	overflow   *overflowPolicy
+	latency    *histogram
+	workers    sync.WaitGroup
 }
 
-func NewDefaultAmiEventConsumerService(appConfig *conf.AppConf) AmiEventConsumer {
-	return &defaultAmiEventConsumer{appConfig, nil}
+func init() {
+	RegisterAmiEventConsumer("stdout", NewDefaultAmiEventConsumerService)
+}
+
+func NewDefaultAmiEventConsumerService(appConfig *conf.AppConf, sinkConfig *conf.SinkConf) (AmiEventConsumer, error) {
+	eventSerializer, err := serializer.New(sinkConfig.GetString("FORMAT", "json"), appConfig.Transform)
+	if err != nil {
+		return nil, err
+	}
+	overflow, err := newOverflowPolicy(sinkConfig.Name, sinkConfig.GetString("OVERFLOW_POLICY", overflowBlock),
+		sinkConfig.GetStringSlice("LOW_PRIORITY_EVENTS", defaultLowPriorityEvents), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &defaultAmiEventConsumer{
+		appConfig:  appConfig,
+		serializer: eventSerializer,
+		overflow:   overflow,
+		latency:    latencyHistogram("reader_to_" + sinkConfig.Name),
+	}, nil
 }
 
 func (service *defaultAmiEventConsumer) Initialize() error {
 	appConfig := service.appConfig
-	eventJobChan := make(chan map[string]string, *appConfig.NumberOfJobs)
 	numberOfWorkers := *appConfig.NumberOfWorkers
+	lanes := newOrderedLanes(*appConfig.OrderingKeys, numberOfWorkers, *appConfig.NumberOfJobs)
 	for w := 1; w <= numberOfWorkers; w++ {
-		go service.worker(w, eventJobChan)
+		service.workers.Add(1)
+		go service.worker(w, lanes.lane(w-1))
 	}
-	service.eventJobChan = eventJobChan
+	service.lanes = lanes
+	service.overflow.watch(lanes)
 	return nil
 }
 
 func (service *defaultAmiEventConsumer) Destroy() {
-	close(service.eventJobChan)
+	if service.lanes != nil {
+		service.lanes.close()
+		service.workers.Wait()
+	}
 }
 
 func (service *defaultAmiEventConsumer) Consume(event map[string]string) {
-	service.eventJobChan <- event
+	service.overflow.offer(service.lanes, event)
 }
 
 func (service *defaultAmiEventConsumer) worker(id int, eventJobChan <-chan map[string]string) {
+	defer service.workers.Done()
 	for event := range eventJobChan {
-		eventJsonB, _ := json.Marshal(event)
-		eventJson := string(eventJsonB)
-		fmt.Println("worker", id, "event:", eventJson)
+		body, err := service.serializer.Serialize(event)
+		if err != nil {
+			log.Errorf("Failed to serialize event %s. Reason: %v", event["Event"], err)
+			continue
+		}
+		// Binary formats are printed base64 encoded
+		eventText := string(body)
+		if !strings.Contains(service.serializer.ContentType(), "json") {
+			eventText = base64.StdEncoding.EncodeToString(body)
+		}
+		fmt.Println("worker", id, "event:", eventText)
+		// Without a timestamp, e.g. renamed by TRANSFORM, the latency is unknown
+		if timestamp, found := serializer.EventTime(event); found {
+			service.latency.observe(time.Since(timestamp))
+		}
 	}
 }
@@ -0,0 +1,34 @@
+package service
+
+import "ami-reader/enrich"
+
+// enrichAmiEventConsumer adds attributes of lookup tables to events before handing them to the next consumer.
+type enrichAmiEventConsumer struct {
+    enricher *enrich.Enricher
+    next     AmiEventConsumer
+}
+
+func newEnrichAmiEventConsumer(enricher *enrich.Enricher, next AmiEventConsumer) AmiEventConsumer {
+    return &enrichAmiEventConsumer{enricher, next}
+}
+
+func (service *enrichAmiEventConsumer) Initialize() error {
+    if err := service.enricher.Watch(); err != nil {
+        return err
+    }
+    if err := service.next.Initialize(); err != nil {
+        service.enricher.Close()
+        return err
+    }
+    return nil
+}
+
+func (service *enrichAmiEventConsumer) Destroy() {
+    service.next.Destroy()
+    service.enricher.Close()
+}
+
+func (service *enrichAmiEventConsumer) Consume(event map[string]string) {
+    service.enricher.Enrich(event)
+    service.next.Consume(event)
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+    "bytes"
+    "expvar"
+    "fmt"
+    log "github.com/sirupsen/logrus"
+    "math"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Upper bounds in milliseconds of the buckets of latency histograms, the last bucket takes the rest
+var latencyBucketsMs = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Latency histograms, exposed through expvar (see METRICS_ADDR)
+var latencyStats = expvar.NewMap("latency")
+
+var latencyMutex sync.Mutex
+
+// latencyHistogram returns the histogram registered under name, creating it on first use.
+func latencyHistogram(name string) *histogram {
+    latencyMutex.Lock()
+    defer latencyMutex.Unlock()
+    if existing, ok := latencyStats.Get(name).(*histogram); ok {
+        return existing
+    }
+    created := &histogram{counts: make([]int64, len(latencyBucketsMs)+1)}
+    latencyStats.Set(name, created)
+    return created
+}
+
+// histogram counts durations in latencyBucketsMs buckets. It is shown as JSON with approximate percentiles,
+// the upper bound of the bucket they fall in.
+type histogram struct {
+    mutex  sync.Mutex
+    counts []int64
+    count  int64
+    sumMs  float64
+    maxMs  float64
+}
+
+// observe counts a duration, negative ones (clocks apart) are counted as zero.
+func (h *histogram) observe(duration time.Duration) {
+    ms := math.Max(0, float64(duration)/float64(time.Millisecond))
+    bucket := len(latencyBucketsMs)
+    for i, bound := range latencyBucketsMs {
+        if ms <= bound {
+            bucket = i
+            break
+        }
+    }
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    h.counts[bucket]++
+    h.count++
+    h.sumMs += ms
+    h.maxMs = math.Max(h.maxMs, ms)
+}
+
+func (h *histogram) String() string {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, `{"count": %d, "sum_ms": %s, "max_ms": %s`, h.count, formatMs(h.sumMs), formatMs(h.maxMs))
+    for _, quantile := range []float64{0.5, 0.9, 0.99} {
+        fmt.Fprintf(&buf, `, "p%s_ms": %s`, strconv.FormatFloat(quantile*100, 'f', -1, 64), h.quantileLocked(quantile))
+    }
+    buf.WriteString(`, "buckets": {`)
+    for i, count := range h.counts {
+        if i > 0 {
+            buf.WriteString(", ")
+        }
+        fmt.Fprintf(&buf, `"%s": %d`, bucketName(i), count)
+    }
+    buf.WriteString("}}")
+    return buf.String()
+}
+
+// quantileLocked returns the upper bound of the bucket of a quantile as JSON. Caller holds mutex.
+func (h *histogram) quantileLocked(quantile float64) string {
+    if h.count == 0 {
+        return "null"
+    }
+    rank := int64(math.Ceil(quantile * float64(h.count)))
+    var seen int64
+    for i, count := range h.counts {
+        seen += count
+        if seen >= rank && i < len(latencyBucketsMs) {
+            return formatMs(latencyBucketsMs[i])
+        }
+    }
+    // Beyond the last bound
+    return formatMs(h.maxMs)
+}
+
+func bucketName(i int) string {
+    if i < len(latencyBucketsMs) {
+        return "le_" + strconv.FormatFloat(latencyBucketsMs[i], 'f', -1, 64)
+    }
+    return "inf"
+}
+
+func formatMs(ms float64) string {
+    return strconv.FormatFloat(ms, 'f', 3, 64)
+}
+
+// clockSkewWarnInterval limits the clock skew warning to one per interval.
+const clockSkewWarnInterval = time.Minute
+
+// clockSkew warns when the time of the PBX, from the Timestamp header of events, and the time of the reader
+// are further apart than a threshold. The PBX to reader latency is taken as the skew, transit takes far less.
+type clockSkew struct {
+    threshold time.Duration
+    // Last offset measured
+    offsetMs  *expvar.Float
+    mutex     sync.Mutex
+    lastWarn  time.Time
+}
+
+// newClockSkew creates a check warning past threshold, 0 never warns.
+func newClockSkew(threshold time.Duration) *clockSkew {
+    skew := &clockSkew{threshold: threshold, offsetMs: new(expvar.Float)}
+    latencyStats.Set("pbx_offset_ms", skew.offsetMs)
+    return skew
+}
+
+func (skew *clockSkew) check(pbxTime time.Time, readTime time.Time) {
+    offset := readTime.Sub(pbxTime)
+    skew.offsetMs.Set(float64(offset) / float64(time.Millisecond))
+    if skew.threshold <= 0 || (offset < skew.threshold && offset > -skew.threshold) {
+        return
+    }
+    skew.mutex.Lock()
+    defer skew.mutex.Unlock()
+    if readTime.Sub(skew.lastWarn) < clockSkewWarnInterval {
+        return
+    }
+    skew.lastWarn = readTime
+    direction := "behind"
+    if offset < 0 {
+        direction, offset = "ahead of", -offset
+    }
+    log.Warnf("PBX clock is %v %s the reader clock, more than CLOCK_SKEW_WARN. Check NTP on both hosts.", offset.Round(time.Millisecond), direction)
+}
@@ -0,0 +1,34 @@
+package service
+
+type multiAmiEventConsumer struct {
+    consumers []AmiEventConsumer
+}
+
+func newMultiAmiEventConsumer(consumers []AmiEventConsumer) AmiEventConsumer {
+    return &multiAmiEventConsumer{consumers}
+}
+
+func (service *multiAmiEventConsumer) Initialize() error {
+    for i, consumer := range service.consumers {
+        if err := consumer.Initialize(); err != nil {
+            // Release the sinks that were already initialized
+            for _, initialized := range service.consumers[:i] {
+                initialized.Destroy()
+            }
+            return err
+        }
+    }
+    return nil
+}
+
+func (service *multiAmiEventConsumer) Destroy() {
+    for _, consumer := range service.consumers {
+        consumer.Destroy()
+    }
+}
+
+func (service *multiAmiEventConsumer) Consume(event map[string]string) {
+    for _, consumer := range service.consumers {
+        consumer.Consume(event)
+    }
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+    "hash/fnv"
+    "sync"
+    "sync/atomic"
+)
+
+// orderedLanes shards events onto one queue per worker by the value of the first ordering key an event has,
+// e.g. Linkedid then Uniqueid. Events of one call always go through the same lane, so they are handled in the
+// order they were consumed while other calls are handled in parallel. Events without any key are spread
+// round robin.
+type orderedLanes struct {
+    keys  []string
+    lanes []chan map[string]string
+    // Taken by producers that take events off a lane, see overflowPolicy.offer
+    locks []sync.Mutex
+    next  uint32
+    // closeMutex is read locked while an event is offered, so the lanes are not closed under a producer
+    closeMutex sync.RWMutex
+    closed     bool
+    // done is closed first, a producer blocked on a full lane then gives up
+    done chan struct{}
+}
+
+// newOrderedLanes creates count lanes sharing a capacity of jobs events.
+func newOrderedLanes(keys []string, count int, jobs int) *orderedLanes {
+    capacity := jobs / count
+    if capacity < 1 {
+        capacity = 1
+    }
+    lanes := &orderedLanes{keys: keys, lanes: make([]chan map[string]string, count), locks: make([]sync.Mutex, count),
+        done: make(chan struct{})}
+    for i := range lanes.lanes {
+        lanes.lanes[i] = make(chan map[string]string, capacity)
+    }
+    return lanes
+}
+
+func (lanes *orderedLanes) lane(i int) <-chan map[string]string {
+    return lanes.lanes[i]
+}
+
+func (lanes *orderedLanes) laneOf(event map[string]string) chan map[string]string {
+    return lanes.lanes[lanes.indexOf(event)]
+}
+
+// indexOf returns the index of the lane of an event.
+func (lanes *orderedLanes) indexOf(event map[string]string) int {
+    for _, key := range lanes.keys {
+        if value := event[key]; value != "" {
+            hash := fnv.New32a()
+            _, _ = hash.Write([]byte(value))
+            return int(hash.Sum32() % uint32(len(lanes.lanes)))
+        }
+    }
+    return int(atomic.AddUint32(&lanes.next, 1) % uint32(len(lanes.lanes)))
+}
+
+// depth is the number of queued events.
+func (lanes *orderedLanes) depth() int {
+    depth := 0
+    for _, lane := range lanes.lanes {
+        depth += len(lane)
+    }
+    return depth
+}
+
+func (lanes *orderedLanes) capacity() int {
+    return len(lanes.lanes) * cap(lanes.lanes[0])
+}
+
+// close closes the lanes, also while a producer is blocked on a full one, e.g. by a stalled broker. Events
+// offered from then on are dropped.
+func (lanes *orderedLanes) close() {
+    close(lanes.done)
+    lanes.closeMutex.Lock()
+    defer lanes.closeMutex.Unlock()
+    lanes.closed = true
+    for _, lane := range lanes.lanes {
+        close(lane)
+    }
+}
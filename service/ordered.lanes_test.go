@@ -0,0 +1,111 @@
+package service
+
+import (
+    "fmt"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+)
+
+// TestOrderedLanesKeepCallOrder offers the interleaved events of many calls from several goroutines, like the
+// consumers of a multi sink do, and checks every worker sees the events of a call in order whatever the policy.
+func TestOrderedLanesKeepCallOrder(t *testing.T) {
+    const (
+        producers        = 4
+        callsPerProducer = 250
+        eventsPerCall    = 40
+        workers          = 16
+    )
+    for _, name := range []string{overflowBlock, overflowDropNewest, overflowDropOldest, overflowDropLowPriority} {
+        t.Run(name, func(t *testing.T) {
+            policy, err := newOverflowPolicy("test", name, []string{"VarSet"}, nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            // A small queue so the policy kicks in
+            lanes := newOrderedLanes([]string{"Linkedid", "Uniqueid"}, workers, workers*4)
+            var mutex sync.Mutex
+            last := make(map[string]int)
+            var outOfOrder []string
+            var consumers sync.WaitGroup
+            for w := 0; w < workers; w++ {
+                consumers.Add(1)
+                go func(lane <-chan map[string]string) {
+                    defer consumers.Done()
+                    for event := range lane {
+                        seq, _ := strconv.Atoi(event["seq"])
+                        mutex.Lock()
+                        // Dropping policies may skip events, never reorder them
+                        if previous, found := last[event["Linkedid"]]; found && seq <= previous {
+                            outOfOrder = append(outOfOrder, fmt.Sprintf("%s: %d after %d", event["Linkedid"], seq, previous))
+                        }
+                        last[event["Linkedid"]] = seq
+                        mutex.Unlock()
+                        if seq%7 == 0 {
+                            time.Sleep(time.Microsecond)
+                        }
+                    }
+                }(lanes.lane(w))
+            }
+            var producing sync.WaitGroup
+            for p := 0; p < producers; p++ {
+                producing.Add(1)
+                go func(p int) {
+                    defer producing.Done()
+                    // Round robin over the calls of the producer, so the events of calls are interleaved
+                    for seq := 1; seq <= eventsPerCall; seq++ {
+                        for call := 0; call < callsPerProducer; call++ {
+                            event := map[string]string{"Linkedid": fmt.Sprintf("%d.%d", p, call), "seq": strconv.Itoa(seq), "Event": "Newstate"}
+                            if seq%3 == 0 {
+                                event["Event"] = "VarSet"
+                            }
+                            policy.offer(lanes, event)
+                        }
+                    }
+                }(p)
+            }
+            producing.Wait()
+            lanes.close()
+            consumers.Wait()
+            if len(outOfOrder) > 0 {
+                t.Fatalf("%d events out of order, e.g. %s", len(outOfOrder), outOfOrder[0])
+            }
+            if name == overflowBlock {
+                for call, seq := range last {
+                    if seq != eventsPerCall {
+                        t.Fatalf("call %s ended with event %d, want %d", call, seq, eventsPerCall)
+                    }
+                }
+                if len(last) != producers*callsPerProducer {
+                    t.Fatalf("saw %d calls, want %d", len(last), producers*callsPerProducer)
+                }
+            }
+        })
+    }
+}
+
+// TestRetryStaysOnOwningLane checks a nacked event is handed back to the worker of its lane rather than
+// published from elsewhere.
+func TestRetryStaysOnOwningLane(t *testing.T) {
+    lanes := newOrderedLanes([]string{"Linkedid"}, 8, 64)
+    service := &rabbitMQAmiEventConsumer{lanes: lanes, publishRetry: 3, retryDelay: time.Second}
+    for range lanes.lanes {
+        service.retries = append(service.retries, newRetryQueue())
+    }
+    event := map[string]string{"Linkedid": "1584011234.42"}
+    service.handleUndelivered(&pendingPublishing{event: event, attempts: 1}, "nacked")
+    owner := lanes.indexOf(event)
+    for i, queue := range service.retries {
+        retry := queue.pop()
+        if i != owner {
+            if retry != nil {
+                t.Fatalf("retry queued on lane %d, want %d", i, owner)
+            }
+            continue
+        }
+        if retry == nil || retry.attempts != 2 || time.Until(retry.retryAt) <= 0 {
+            t.Fatalf("retry on owning lane = %+v", retry)
+        }
+    }
+}
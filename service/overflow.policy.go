@@ -0,0 +1,170 @@
+package service
+
+import (
+    "expvar"
+    "github.com/pkg/errors"
+    log "github.com/sirupsen/logrus"
+    "sync"
+    "time"
+)
+
+// Policies applied by a sink when the lane of an event is full, see OVERFLOW_POLICY
+const (
+    overflowBlock           = "block"
+    overflowDropNewest      = "drop_newest"
+    overflowDropOldest      = "drop_oldest"
+    overflowDropLowPriority = "drop_low_priority"
+    overflowSpill           = "spill"
+)
+
+// Queue depth and overflow counters of every sink, exposed through expvar (see METRICS_ADDR)
+var queueStats = expvar.NewMap("queue")
+
+// Events dropped first by drop_low_priority unless LOW_PRIORITY_EVENTS is set
+var defaultLowPriorityEvents = []string{"VarSet", "Newexten", "RTCPSent", "RTCPReceived"}
+
+// overflowWarnInterval limits the warning logged while a policy kicks in to one per interval.
+const overflowWarnInterval = time.Minute
+
+// overflowPolicy hands events over to the lanes of a sink and decides what happens when a lane is full,
+// so a slow sink does not have to stall the AMI reader.
+type overflowPolicy struct {
+    sink        string
+    name        string
+    lowPriority map[string]bool
+    spill       func(event map[string]string)
+    stats       *expvar.Map
+    warnMutex   sync.Mutex
+    lastWarn    time.Time
+    overflows   int
+}
+
+// newOverflowPolicy creates the policy of a sink. spill is nil when the sink can't spill events to disk.
+func newOverflowPolicy(sink string, name string, lowPriority []string, spill func(event map[string]string)) (*overflowPolicy, error) {
+    switch name {
+    case overflowBlock, overflowDropNewest, overflowDropOldest, overflowDropLowPriority:
+    case overflowSpill:
+        if spill == nil {
+            return nil, errors.Errorf("OVERFLOW_POLICY %s is not supported by sink %s", name, sink)
+        }
+    default:
+        return nil, errors.Errorf("Unknown OVERFLOW_POLICY %s. Available: block, drop_newest, drop_oldest, drop_low_priority, spill", name)
+    }
+    policy := &overflowPolicy{sink: sink, name: name, lowPriority: make(map[string]bool), spill: spill, stats: new(expvar.Map).Init()}
+    for _, event := range lowPriority {
+        policy.lowPriority[event] = true
+    }
+    return policy, nil
+}
+
+// watch exposes the depth and the capacity of the lanes under the sink's name.
+func (policy *overflowPolicy) watch(lanes *orderedLanes) {
+    policy.stats.Set("depth", expvar.Func(func() interface{} { return lanes.depth() }))
+    policy.stats.Set("capacity", expvar.Func(func() interface{} { return lanes.capacity() }))
+    queueStats.Set(policy.sink, policy.stats)
+}
+
+// offer puts an event on its lane, applying the policy when the lane is full. An event offered while or after
+// the lanes are closed is dropped, the sink is destroyed.
+func (policy *overflowPolicy) offer(lanes *orderedLanes, event map[string]string) {
+    lanes.closeMutex.RLock()
+    defer lanes.closeMutex.RUnlock()
+    if lanes.closed {
+        policy.dropClosed(event)
+        return
+    }
+    i := lanes.indexOf(event)
+    lane := lanes.lanes[i]
+    if policy.name == overflowDropLowPriority {
+        // Evicting takes events off the lane and puts back those kept, nothing else may be put on it meanwhile
+        lanes.locks[i].Lock()
+        defer lanes.locks[i].Unlock()
+    }
+    select {
+    case lane <- event:
+        return
+    default:
+    }
+    policy.stats.Add("overflows", 1)
+    policy.warn()
+    switch policy.name {
+    case overflowDropNewest:
+        policy.stats.Add("dropped_newest", 1)
+    case overflowDropOldest:
+        for {
+            select {
+            case lane <- event:
+                return
+            default:
+            }
+            // A worker may have taken it meanwhile, then there is room already
+            select {
+            case <-lane:
+                policy.stats.Add("dropped_oldest", 1)
+            default:
+            }
+        }
+    case overflowDropLowPriority:
+        if policy.lowPriority[event["Event"]] {
+            policy.stats.Add("dropped_low_priority", 1)
+            return
+        }
+        policy.evictLowPriority(lane)
+        policy.block(lanes, lane, event)
+    case overflowSpill:
+        policy.stats.Add("spilled", 1)
+        policy.spill(event)
+    default:
+        policy.block(lanes, lane, event)
+    }
+}
+
+// evictLowPriority drops the low priority events queued on a lane to make room, the others keep their order.
+func (policy *overflowPolicy) evictLowPriority(lane chan map[string]string) {
+    queued := make([]map[string]string, 0, cap(lane))
+take:
+    for len(queued) < cap(lane) {
+        select {
+        case event := <-lane:
+            queued = append(queued, event)
+        default:
+            break take
+        }
+    }
+    for _, event := range queued {
+        if policy.lowPriority[event["Event"]] {
+            policy.stats.Add("dropped_low_priority", 1)
+            continue
+        }
+        // Can't block, workers only take events off the lane meanwhile
+        lane <- event
+    }
+}
+
+func (policy *overflowPolicy) block(lanes *orderedLanes, lane chan map[string]string, event map[string]string) {
+    policy.stats.Add("blocked", 1)
+    select {
+    case lane <- event:
+    case <-lanes.done:
+        policy.dropClosed(event)
+    }
+}
+
+func (policy *overflowPolicy) dropClosed(event map[string]string) {
+    policy.stats.Add("dropped_closed", 1)
+    log.Warnf("Sink %s is closed, dropping %s event.", policy.sink, event["Event"])
+}
+
+// warn logs that the queue is full, at most once per overflowWarnInterval.
+func (policy *overflowPolicy) warn() {
+    policy.warnMutex.Lock()
+    defer policy.warnMutex.Unlock()
+    policy.overflows++
+    now := time.Now()
+    if now.Sub(policy.lastWarn) < overflowWarnInterval {
+        return
+    }
+    log.Warnf("Queue of sink %s is full, applied OVERFLOW_POLICY %s to %d events since the last warning.", policy.sink, policy.name, policy.overflows)
+    policy.lastWarn = now
+    policy.overflows = 0
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestOverflowPolicy(t *testing.T) {
+    tests := []struct {
+        policy string
+        // Events queued on the full lane, then the one offered
+        queued  []string
+        offered string
+        want    []string
+        spilled []string
+    }{
+        {overflowDropNewest, []string{"Newchannel", "VarSet"}, "Hangup", []string{"Newchannel", "VarSet"}, nil},
+        {overflowDropOldest, []string{"Newchannel", "VarSet"}, "Hangup", []string{"VarSet", "Hangup"}, nil},
+        {overflowDropLowPriority, []string{"Newchannel", "VarSet"}, "Newexten", []string{"Newchannel", "VarSet"}, nil},
+        {overflowDropLowPriority, []string{"VarSet", "Newchannel", "Newexten", "Dial"}, "Hangup", []string{"Newchannel", "Dial", "Hangup"}, nil},
+        {overflowSpill, []string{"Newchannel", "VarSet"}, "Hangup", []string{"Newchannel", "VarSet"}, []string{"Hangup"}},
+    }
+    for _, test := range tests {
+        t.Run(test.policy, func(t *testing.T) {
+            var spilled []string
+            policy, err := newOverflowPolicy("test", test.policy, defaultLowPriorityEvents, func(event map[string]string) {
+                spilled = append(spilled, event["Event"])
+            })
+            if err != nil {
+                t.Fatal(err)
+            }
+            lanes := newOrderedLanes([]string{"Linkedid"}, 1, len(test.queued))
+            for _, name := range append(test.queued, test.offered) {
+                policy.offer(lanes, map[string]string{"Event": name, "Linkedid": "1"})
+            }
+            lanes.close()
+            var got []string
+            for event := range lanes.lane(0) {
+                got = append(got, event["Event"])
+            }
+            if !reflect.DeepEqual(got, test.want) {
+                t.Fatalf("queued %v, want %v", got, test.want)
+            }
+            if !reflect.DeepEqual(spilled, test.spilled) {
+                t.Fatalf("spilled %v, want %v", spilled, test.spilled)
+            }
+        })
+    }
+}
+
+func TestOverflowPolicyUnknown(t *testing.T) {
+    if _, err := newOverflowPolicy("test", "drop_everything", nil, nil); err == nil {
+        t.Fatal("unknown policy accepted")
+    }
+    if _, err := newOverflowPolicy("test", overflowSpill, nil, nil); err == nil {
+        t.Fatal("spill accepted by a sink that can't spill")
+    }
+}
+
+func TestOverflowPolicyGivesUpOnClose(t *testing.T) {
+    policy, err := newOverflowPolicy("test", overflowBlock, nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lanes := newOrderedLanes([]string{"Linkedid"}, 1, 1)
+    policy.offer(lanes, map[string]string{"Event": "Newchannel", "Linkedid": "1"})
+    offered := make(chan struct{})
+    go func() {
+        // Blocks on the full lane, e.g. while the broker is stalled
+        policy.offer(lanes, map[string]string{"Event": "Hangup", "Linkedid": "1"})
+        close(offered)
+    }()
+    time.Sleep(50 * time.Millisecond)
+    lanes.close()
+    select {
+    case <-offered:
+    case <-time.After(5 * time.Second):
+        t.Fatal("offer still blocked after the lanes were closed")
+    }
+    policy.offer(lanes, map[string]string{"Event": "Hangup", "Linkedid": "1"})
+    var got []string
+    for event := range lanes.lane(0) {
+        got = append(got, event["Event"])
+    }
+    if want := []string{"Newchannel"}; !reflect.DeepEqual(got, want) {
+        t.Fatalf("queued %v, want %v", got, want)
+    }
+}
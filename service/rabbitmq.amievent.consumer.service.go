@@ -1,16 +1,23 @@
 package service
 
 import (
+    "ami-reader/compression"
     "ami-reader/conf"
+    "ami-reader/serializer"
     "encoding/json"
+    "expvar"
     "fmt"
     "github.com/pkg/errors"
     log "github.com/sirupsen/logrus"
     "github.com/streadway/amqp"
     "os"
+    "sync"
     "time"
 )
 
+// Delivery outcomes of the rabbitmq sink, exposed through expvar (see METRICS_ADDR)
+var rabbitMQStats = expvar.NewMap("rabbitmq")
+
 type MyJSONFormatter struct {
 }
 
@@ -22,16 +29,145 @@ func (f *MyJSONFormatter) Format(entry *log.Entry) ([]byte, error) {
 }
 
 type rabbitMQAmiEventConsumer struct {
-    appConfig    *conf.AppConf
-    eventJobChan chan map[string]string
-    eventFile    *os.File
-    eventLogger  *log.Logger
-    amqpConn     *amqp.Connection
-    amqpChannel  *amqp.Channel
+    appConfig         *conf.AppConf
+    amqpUrl           string
+    amqpXchName       string
+    amqpXchType       string
+    router            *amqpRouter
+    topology          *amqpTopologyConf
+    properties        *amqpMessageProperties
+    serializer        serializer.Serializer
+    compressor        compression.Compressor
+    batchSize         int
+    batchBytes        int
+    batchLinger       time.Duration
+    batcher           *publishBatcher
+    confirmWindow     int
+    confirmTimeout    time.Duration
+    publishRetry      int
+    retryDelay        time.Duration
+    holdLimit         int
+    reconnectDelay    time.Duration
+    reconnectMaxDelay time.Duration
+    spoolDir          string
+    spoolSegmentSize  int
+    spoolMaxSize      int
+    spoolSync         bool
+    overflow          *overflowPolicy
+    latency           *histogram
+    replayBatchSize   int
+    replayInterval    time.Duration
+    diskSpool         *sharedSpool
+    spoolSignal       chan struct{}
+    replayDone        chan struct{}
+    lanes             *orderedLanes
+    eventFile         *os.File
+    eventLogger       *log.Logger
+    workers           sync.WaitGroup
+    // Publishings to retry by lane, see retryQueueOf
+    retries           []*retryQueue
+    retryMutex        sync.Mutex
+    closing           bool
+    stopWatch         chan struct{}
+    watchDone         chan struct{}
+    // stateMutex guards the connection, the channel, its confirmer (nil while MQ is unavailable) and the held events
+    stateMutex        sync.Mutex
+    amqpConn          *amqp.Connection
+    amqpChannel       *amqp.Channel
+    confirmer         *publishConfirmer
+    held              []*pendingPublishing
+}
+
+func init() {
+    RegisterAmiEventConsumer("rabbitmq", NewRabbitMQAmiEventConsumerService)
 }
 
-func NewRabbitMQAmiEventConsumerService(appConfig *conf.AppConf) AmiEventConsumer {
-    return &rabbitMQAmiEventConsumer{appConfig, nil, nil, nil, nil, nil}
+func NewRabbitMQAmiEventConsumerService(appConfig *conf.AppConf, sinkConfig *conf.SinkConf) (AmiEventConsumer, error) {
+    amqpUrl := sinkConfig.GetSecret("AMQP_URL", "")
+    if amqpUrl == "" {
+        if err := sinkConfig.Err(); err != nil {
+            return nil, err
+        }
+        return nil, errors.New("AMQP_URL environment variable not found")
+    }
+    amqpXchName := sinkConfig.GetString("AMQP_EXCHANGE_NAME", "amq.direct")
+    var routeConfs []amqpRouteConf
+    if err := sinkConfig.Unmarshal("AMQP_ROUTES", &routeConfs); err != nil {
+        return nil, errors.Wrap(err, "Invalid AMQP_ROUTES.")
+    }
+    router, err := newAmqpRouter(amqpXchName, sinkConfig.GetString("AMQP_ROUTING_KEY", "{{host_device_id}}"), routeConfs)
+    if err != nil {
+        return nil, err
+    }
+    topology := &amqpTopologyConf{}
+    if err = sinkConfig.Unmarshal("AMQP_TOPOLOGY", topology); err != nil {
+        return nil, errors.Wrap(err, "Invalid AMQP_TOPOLOGY.")
+    }
+    if err = topology.validate(amqpUrl); err != nil {
+        return nil, errors.Wrap(err, "Invalid AMQP_TOPOLOGY.")
+    }
+    var messageConfs []amqpMessageConf
+    if err = sinkConfig.Unmarshal("AMQP_MESSAGE_PROPERTIES", &messageConfs); err != nil {
+        return nil, errors.Wrap(err, "Invalid AMQP_MESSAGE_PROPERTIES.")
+    }
+    properties, err := newAmqpMessageProperties(int64(sinkConfig.GetInt("AMQP_EXPIRATION", 0)), sinkConfig.GetInt("AMQP_PRIORITY", 0), messageConfs)
+    if err != nil {
+        return nil, err
+    }
+    eventSerializer, err := serializer.New(sinkConfig.GetString("FORMAT", "json"), appConfig.Transform)
+    if err != nil {
+        return nil, err
+    }
+    compressor, err := compression.New(sinkConfig.GetString("AMQP_COMPRESSION", "none"))
+    if err != nil {
+        return nil, err
+    }
+    confirmWindow := sinkConfig.GetInt("AMQP_CONFIRM_WINDOW", 100)
+    if confirmWindow < 1 {
+        return nil, errors.New("AMQP_CONFIRM_WINDOW should be at least 1")
+    }
+    service := &rabbitMQAmiEventConsumer{
+        appConfig:         appConfig,
+        amqpUrl:           amqpUrl,
+        amqpXchName:       amqpXchName,
+        amqpXchType:       sinkConfig.GetString("AMQP_EXCHANGE_TYPE", "direct"),
+        router:            router,
+        topology:          topology,
+        properties:        properties,
+        serializer:        eventSerializer,
+        compressor:        compressor,
+        batchSize:         sinkConfig.GetInt("AMQP_BATCH_SIZE", 0),
+        batchBytes:        sinkConfig.GetInt("AMQP_BATCH_BYTES", 256<<10),
+        batchLinger:       sinkConfig.GetDurationOrMillis("AMQP_BATCH_LINGER", "AMQP_BATCH_LINGER_MS", 200*time.Millisecond),
+        confirmWindow:     confirmWindow,
+        confirmTimeout:    sinkConfig.GetDuration("AMQP_CONFIRM_TIMEOUT", time.Duration(5)*time.Second),
+        publishRetry:      sinkConfig.GetInt("AMQP_PUBLISH_RETRY", 3),
+        retryDelay:        sinkConfig.GetDuration("AMQP_RETRY_DELAY", time.Duration(1)*time.Second),
+        holdLimit:         sinkConfig.GetInt("AMQP_HOLD_LIMIT", 10000),
+        reconnectDelay:    sinkConfig.GetDuration("AMQP_RECONNECT_DELAY", time.Duration(1)*time.Second),
+        reconnectMaxDelay: sinkConfig.GetDuration("AMQP_RECONNECT_MAX_DELAY", time.Duration(60)*time.Second),
+        spoolDir:          sinkConfig.GetString("SPOOL_DIR", "spool_"+sinkConfig.Name),
+        spoolSegmentSize:  sinkConfig.GetInt("SPOOL_SEGMENT_SIZE", 16<<20),
+        spoolMaxSize:      sinkConfig.GetInt("SPOOL_MAX_SIZE", 0),
+        spoolSync:         sinkConfig.GetBool("SPOOL_SYNC"),
+        replayBatchSize:   sinkConfig.GetInt("SPOOL_REPLAY_BATCH", 100),
+        replayInterval:    sinkConfig.GetDuration("SPOOL_REPLAY_INTERVAL", time.Duration(5)*time.Second),
+        latency:           latencyHistogram("reader_to_" + sinkConfig.Name),
+    }
+    // SPOOL_ON_FULL_QUEUE predates OVERFLOW_POLICY
+    overflowDefault := overflowBlock
+    if sinkConfig.GetBool("SPOOL_ON_FULL_QUEUE") {
+        overflowDefault = overflowSpill
+    }
+    service.overflow, err = newOverflowPolicy(sinkConfig.Name, sinkConfig.GetString("OVERFLOW_POLICY", overflowDefault),
+        sinkConfig.GetStringSlice("LOW_PRIORITY_EVENTS", defaultLowPriorityEvents), func(event map[string]string) {
+            // Workers can't keep up, spool it instead of stalling the AMI reader
+            service.spool(&pendingPublishing{event: event}, "busy")
+        })
+    if err != nil {
+        return nil, err
+    }
+    return service, nil
 }
 
 func (service *rabbitMQAmiEventConsumer) Initialize() error {
@@ -52,53 +188,103 @@ func (service *rabbitMQAmiEventConsumer) Initialize() error {
         return errors.Wrap(err, errMsg)
     }
 
+    // Initialize spool of undelivered events
+    diskSpool, err := openSpool(service.spoolDir, int64(service.spoolSegmentSize), int64(service.spoolMaxSize), service.spoolSync)
+    if err != nil {
+        _ = file.Close()
+        log.Errorf("Failed to open spool %s. Reason: %v", service.spoolDir, err)
+        return errors.Wrap(err, fmt.Sprintf("Failed to open spool %s.", service.spoolDir))
+    }
+    service.diskSpool = diskSpool
+    rabbitMQStats.Set("spool_pending", expvar.Func(func() interface{} { return diskSpool.Pending() }))
+    if pending := diskSpool.Pending(); pending > 0 {
+        log.Infof("Found %d spooled events in %s. They will be published once MQ is available.", pending, service.spoolDir)
+    }
+
     // Initial AMQP
     appConfig := service.appConfig
-    amqpUrl := *appConfig.AmqpUrl
-    log.Infof("Connecting to MQ %s", amqpUrl)
-    conn, err := amqp.Dial(amqpUrl)
-    if err != nil {
-        errMsg := fmt.Sprintf("Failed to connect MQ %s.", amqpUrl)
-        log.Error(errMsg)
-        return errors.Wrap(err, errMsg)
+    if err = service.connect(); err != nil {
+        // Released, the sinks kept instead on a reload share the spool
+        _ = diskSpool.Close()
+        _ = file.Close()
+        service.diskSpool, service.eventFile = nil, nil
+        return err
     }
-    log.Info("Successfully connected to MQ")
-    service.amqpConn = conn
-    ch, err := conn.Channel()
-    if err != nil {
-        log.Error("Failed to open a channel.")
-        return errors.Wrap(err, "Failed to open a channel.")
-    }
-    service.amqpChannel = ch
-    err = ch.ExchangeDeclarePassive(
-        *appConfig.AmqpXchName, // name
-        *appConfig.AmqpXchType, // type
-        true,                   // durable
-        false,                  // auto-deleted
-        false,                  // internal
-        false,                  // no-wait
-        nil,                    // arguments
-    )
-    if err != nil {
-        log.Errorf("Failed to declare amq.direct exchange. Reason %v", err)
-        return errors.Wrap(err, "Failed to declare amq.direct exchange.")
+    service.stopWatch = make(chan struct{})
+    service.watchDone = make(chan struct{})
+    service.spoolSignal = make(chan struct{}, 1)
+    service.replayDone = make(chan struct{})
+    go service.watch()
+    go service.replaySpool()
+    rabbitMQStats.Set("bytes_saved", expvar.Func(func() interface{} {
+        return statValue("bytes_serialized") - statValue("bytes_published")
+    }))
+    if service.batchSize > 1 {
+        service.batcher = newPublishBatcher(service.batchSize, service.batchBytes, service.batchLinger, service.serializer.ContentType(), service.flushBatch, service.retry)
     }
     log.Info("Done initializing MQ")
     // Initialize workers
-    eventJobChan := make(chan map[string]string, *appConfig.NumberOfJobs)
     numberOfWorkers := *appConfig.NumberOfWorkers
+    lanes := newOrderedLanes(*appConfig.OrderingKeys, numberOfWorkers, *appConfig.NumberOfJobs)
+    service.lanes = lanes
+    service.retries = make([]*retryQueue, numberOfWorkers)
     for w := 1; w <= numberOfWorkers; w++ {
-        go service.worker(w, eventJobChan)
+        service.retries[w-1] = newRetryQueue()
+        service.workers.Add(1)
+        go service.worker(w, lanes.lane(w-1), service.retries[w-1])
     }
-    service.eventJobChan = eventJobChan
+    service.overflow.watch(lanes)
     return nil
 }
 
 func (service *rabbitMQAmiEventConsumer) Destroy() {
-    log.Info("Closing unseen event log file.")
-    if service.eventFile != nil {
-        if err := service.eventFile.Close(); err != nil {
-            log.Errorf("Failed to close file %s. Reason: %v.", service.eventFile.Name(), err)
+    log.Info("Closing workers.")
+    if service.lanes != nil {
+        service.lanes.close()
+        service.workers.Wait()
+    }
+    if service.batcher != nil {
+        log.Info("Flushing MQ batches.")
+        service.batcher.close()
+    }
+    // From here on undelivered events are spooled right away instead of being retried. Retries the workers and
+    // the batch flusher did not get to are spooled as well.
+    service.retryMutex.Lock()
+    service.closing = true
+    service.retryMutex.Unlock()
+    retries := service.retries
+    if service.batcher != nil {
+        retries = append(retries, service.batcher.retries)
+    }
+    for _, queue := range retries {
+        for _, pending := range queue.take() {
+            service.spool(pending, "retry")
+        }
+    }
+    if service.stopWatch != nil {
+        close(service.stopWatch)
+        <-service.watchDone
+        <-service.replayDone
+    }
+    service.stateMutex.Lock()
+    confirmer := service.confirmer
+    held := service.held
+    service.held = nil
+    service.stateMutex.Unlock()
+    if confirmer != nil {
+        log.Info("Waiting for MQ publisher confirms.")
+        // Whatever is still unconfirmed is written to the unsent event log
+        for _, pending := range confirmer.drain(service.confirmTimeout) {
+            service.spool(pending, "unconfirmed")
+        }
+    }
+    for _, pending := range held {
+        service.spool(pending, "held")
+    }
+    if service.diskSpool != nil {
+        log.Infof("Closing spool with %d pending events.", service.diskSpool.Pending())
+        if err := service.diskSpool.Close(); err != nil {
+            log.Errorf("Failed to close spool %s. Reason: %v.", service.spoolDir, err)
         }
     }
     log.Info("Closing MQ channel.")
@@ -113,38 +299,230 @@ func (service *rabbitMQAmiEventConsumer) Destroy() {
             log.Errorf("Failed to close amqp connection. Reason: %v.", err)
         }
     }
-    log.Info("Closing workers.")
-    if service.eventJobChan != nil {
-        close(service.eventJobChan)
+    log.Info("Closing unseen event log file.")
+    if service.eventFile != nil {
+        if err := service.eventFile.Close(); err != nil {
+            log.Errorf("Failed to close file %s. Reason: %v.", service.eventFile.Name(), err)
+        }
+    }
+    if serialized := statValue("bytes_serialized"); serialized > 0 {
+        published := statValue("bytes_published")
+        log.Infof("Published %d bytes for %d bytes of events, saved %.1f%%.", published, serialized, float64(serialized-published)*100/float64(serialized))
     }
+    log.Infof("MQ delivery stats: %s", rabbitMQStats.String())
 }
 
 func (service *rabbitMQAmiEventConsumer) Consume(event map[string]string) {
-    service.eventJobChan <- event
+    service.overflow.offer(service.lanes, event)
 }
 
-func (service *rabbitMQAmiEventConsumer) worker(id int, eventJobChan <-chan map[string]string) {
+// worker publishes the events of its lane. Publishings of the lane to retry go first, so a retried event is
+// published again before the events of the same call that follow it.
+func (service *rabbitMQAmiEventConsumer) worker(id int, eventJobChan <-chan map[string]string, retries *retryQueue) {
+    defer service.workers.Done()
     appConfig := service.appConfig
     logEvents := *appConfig.LogEvents
-    for event := range eventJobChan {
+    for {
+        if pending := retries.pop(); pending != nil {
+            service.retry(pending)
+            continue
+        }
+        var event map[string]string
+        select {
+        case <-retries.signal:
+            continue
+        case received, ok := <-eventJobChan:
+            if !ok {
+                for pending := retries.pop(); pending != nil; pending = retries.pop() {
+                    service.retry(pending)
+                }
+                return
+            }
+            event = received
+        }
         eventJsonB, _ := json.Marshal(event)
         eventJson := string(eventJsonB)
         fmt.Println("worker", id, "event:", eventJson)
-        err := service.amqpChannel.Publish(
-            *appConfig.AmqpXchName,   // exchange
-            * appConfig.HostDeviceId, // routing key
-            true,                     // undelivered when no queue is bound that matches the routing key
-            false,                    // deliver even if no consumer on the matched queue is ready to accept the delivery
-            amqp.Publishing{
-                DeliveryMode: amqp.Persistent,
-                ContentType: "application/json",
-                Body:        eventJsonB,
-            })
-        if logEvents || err != nil {
-            if err != nil {
-                log.Errorf("Failed to send event: %s", eventJson)
-            }
+        if service.batcher != nil {
+            service.addToBatch(event)
+        } else {
+            service.publish(&pendingPublishing{event: event})
+        }
+        if logEvents {
             service.eventLogger.Info(eventJson)
         }
     }
 }
+
+// addToBatch serializes an event into the batch of events sharing its exchange, routing key and message properties.
+func (service *rabbitMQAmiEventConsumer) addToBatch(event map[string]string) {
+    body, err := service.serializer.Serialize(event)
+    if err != nil {
+        log.Errorf("Failed to serialize event. Reason: %v", err)
+        service.handleUndelivered(&pendingPublishing{event: event}, "failed")
+        return
+    }
+    exchange, routingKey := service.router.route(event)
+    expiration, priority := service.properties.resolve(event)
+    service.batcher.add(fmt.Sprintf("%s\x00%s\x00%d\x00%d", exchange, routingKey, expiration, priority), event, body)
+}
+
+func (service *rabbitMQAmiEventConsumer) flushBatch(eventBatch *eventBatch) {
+    rabbitMQStats.Add("batches", 1)
+    service.publish(&pendingPublishing{event: eventBatch.events[0], batch: eventBatch})
+}
+
+func (service *rabbitMQAmiEventConsumer) publish(pending *pendingPublishing) {
+    for {
+        service.stateMutex.Lock()
+        confirmer := service.confirmer
+        if confirmer == nil {
+            service.holdLocked(pending)
+            service.stateMutex.Unlock()
+            return
+        }
+        service.stateMutex.Unlock()
+        err := service.publishTo(confirmer, pending)
+        if err == nil {
+            return
+        }
+        if err != amqp.ErrClosed {
+            log.Errorf("Failed to publish event. Reason: %v", err)
+            service.handleUndelivered(pending, "failed")
+            return
+        }
+        service.stateMutex.Lock()
+        if service.confirmer == confirmer || service.confirmer == nil {
+            // The channel is gone, keep the event until the watcher reconnects
+            service.holdLocked(pending)
+            service.stateMutex.Unlock()
+            return
+        }
+        // Already reconnected, try the new channel
+        service.stateMutex.Unlock()
+    }
+}
+
+// publishingOf serializes and compresses an event or a batch the first time it is published, then fills the
+// properties of its message.
+func (service *rabbitMQAmiEventConsumer) publishingOf(pending *pendingPublishing) (amqp.Publishing, error) {
+    if pending.body == nil {
+        var body []byte
+        var err error
+        if pending.batch != nil {
+            body, err = pending.batch.builder.Bytes()
+            pending.messageId = pending.batch.id()
+        } else {
+            body, err = service.serializer.Serialize(pending.event)
+            pending.messageId = serializer.EventId(pending.event)
+        }
+        if err != nil {
+            return amqp.Publishing{}, errors.Wrap(err, "Failed to serialize event.")
+        }
+        pending.size = len(body)
+        if pending.body, err = service.compressor.Compress(body); err != nil {
+            return amqp.Publishing{}, errors.Wrap(err, "Failed to compress event.")
+        }
+    }
+    var publishing amqp.Publishing
+    if pending.batch != nil {
+        publishing = service.properties.batchPublishing(pending.batch.events, pending.messageId, pending.body)
+    } else {
+        publishing = service.properties.publishing(pending.event, service.serializer.ContentType(), pending.messageId, pending.body)
+    }
+    publishing.ContentEncoding = service.compressor.Encoding()
+    return publishing, nil
+}
+
+func (service *rabbitMQAmiEventConsumer) publishTo(confirmer *publishConfirmer, pending *pendingPublishing) error {
+    publishing, err := service.publishingOf(pending)
+    if err != nil {
+        return err
+    }
+    // Events of a batch share the route and properties of the first one
+    exchange, routingKey := service.router.route(pending.event)
+    publishedAt := time.Now()
+    publishing.Headers["published_at"] = publishedAt.UTC().Format(time.RFC3339Nano)
+    err = confirmer.publish(pending, func(ch *amqp.Channel) error {
+        return ch.Publish(
+            exchange,   // exchange
+            routingKey, // routing key
+            true,       // undelivered when no queue is bound that matches the routing key
+            false,      // deliver even if no consumer on the matched queue is ready to accept the delivery
+            publishing)
+    })
+    if err == nil {
+        rabbitMQStats.Add("published", pending.count())
+        rabbitMQStats.Add("bytes_serialized", int64(pending.size))
+        rabbitMQStats.Add("bytes_published", int64(len(pending.body)))
+        for _, event := range pending.events() {
+            if timestamp, found := serializer.EventTime(event); found {
+                service.latency.observe(publishedAt.Sub(timestamp))
+            }
+        }
+    }
+    return err
+}
+
+// holdLocked keeps an event while MQ is unavailable. Events beyond AMQP_HOLD_LIMIT are spooled. Caller holds stateMutex.
+func (service *rabbitMQAmiEventConsumer) holdLocked(pending *pendingPublishing) {
+    if len(service.held) >= service.holdLimit {
+        service.spool(pending, "overflow")
+        return
+    }
+    rabbitMQStats.Add("held", pending.count())
+    service.held = append(service.held, pending)
+}
+
+// handleUndelivered retries a failed, nacked or returned publishing and spools it once retries are exhausted.
+// The retry is handed to the goroutine owning the publishing, see retryQueueOf.
+func (service *rabbitMQAmiEventConsumer) handleUndelivered(pending *pendingPublishing, outcome string) {
+    rabbitMQStats.Add(outcome, pending.count())
+    service.retryMutex.Lock()
+    defer service.retryMutex.Unlock()
+    if service.closing || pending.attempts >= service.publishRetry {
+        service.spool(pending, outcome)
+        return
+    }
+    retry := &pendingPublishing{event: pending.event, batch: pending.batch, body: pending.body, size: pending.size, messageId: pending.messageId, attempts: pending.attempts}
+    if outcome == "unconfirmed" {
+        // The channel was lost before the broker confirmed. Publish again right away without spending a retry,
+        // it is held if MQ is still unavailable.
+        service.retryQueueOf(pending).push(retry)
+        return
+    }
+    rabbitMQStats.Add("retried", pending.count())
+    retry.attempts++
+    retry.retryAt = time.Now().Add(service.retryDelay)
+    service.retryQueueOf(pending).push(retry)
+}
+
+// spool keeps an event that could not be delivered in the disk spool, it is published again by replaySpool.
+// The events of a batch are spooled one by one. The unsent event log is the last resort when the spool does not accept an event.
+func (service *rabbitMQAmiEventConsumer) spool(pending *pendingPublishing, outcome string) {
+    for _, event := range pending.events() {
+        // Spooled and unsent events are kept as flat JSON, whatever the wire format, so they can be replayed
+        eventJsonB, _ := json.Marshal(event)
+        err := service.diskSpool.Append(eventJsonB)
+        if err == nil {
+            rabbitMQStats.Add("spooled", 1)
+            select {
+            case service.spoolSignal <- struct{}{}:
+            default:
+            }
+            continue
+        }
+        rabbitMQStats.Add("logged", 1)
+        eventJson := string(eventJsonB)
+        log.Errorf("Failed to spool event (%s after %d retries). Reason: %v. Event: %s", outcome, pending.attempts, err, eventJson)
+        service.eventLogger.Info(eventJson)
+    }
+}
+
+// statValue reads a counter of rabbitMQStats.
+func statValue(name string) int64 {
+    if value, ok := rabbitMQStats.Get(name).(*expvar.Int); ok {
+        return value.Value()
+    }
+    return 0
+}
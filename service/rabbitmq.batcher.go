@@ -0,0 +1,156 @@
+package service
+
+import (
+    "ami-reader/batch"
+    "ami-reader/serializer"
+    "crypto/sha256"
+    "encoding/hex"
+    "sort"
+    "sync"
+    "time"
+)
+
+// maxReadyBatches is how many full batches may wait for the flusher before workers adding events block.
+const maxReadyBatches = 4
+
+// eventBatch collects events published to the same exchange with the same routing key and message properties.
+type eventBatch struct {
+    events  []map[string]string
+    builder *batch.Builder
+    started time.Time
+}
+
+// id hashes the ids of the packed events, so a batch keeps its message id when it is published again.
+func (eventBatch *eventBatch) id() string {
+    hash := sha256.New()
+    for _, entry := range eventBatch.builder.Manifest().Events {
+        hash.Write([]byte(entry.Id))
+    }
+    return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// publishBatcher groups events into batches. A batch is flushed once it holds maxEvents events or maxBytes bytes
+// of serialized events, or linger after its first event was added. Every batch is flushed, and retried, by a
+// single goroutine in the order batches were completed, so batches never overtake each other.
+type publishBatcher struct {
+    maxEvents   int
+    maxBytes    int
+    linger      time.Duration
+    contentType string
+    flush       func(eventBatch *eventBatch)
+    republish   func(pending *pendingPublishing)
+    mutex       sync.Mutex
+    batches     map[string]*eventBatch
+    // Full batches waiting for the flusher, oldest first
+    ready     []*eventBatch
+    readyCond *sync.Cond
+    // Batches to publish again, they go before new ones
+    retries *retryQueue
+    stop    chan struct{}
+    done    chan struct{}
+}
+
+func newPublishBatcher(maxEvents int, maxBytes int, linger time.Duration, contentType string, flush func(eventBatch *eventBatch), republish func(pending *pendingPublishing)) *publishBatcher {
+    batcher := &publishBatcher{
+        maxEvents:   maxEvents,
+        maxBytes:    maxBytes,
+        linger:      linger,
+        contentType: contentType,
+        flush:       flush,
+        republish:   republish,
+        batches:     make(map[string]*eventBatch),
+        retries:     newRetryQueue(),
+        stop:        make(chan struct{}),
+        done:        make(chan struct{}),
+    }
+    batcher.readyCond = sync.NewCond(&batcher.mutex)
+    go batcher.run()
+    return batcher
+}
+
+// add puts a serialized event in the batch of key. A full batch is handed over to the flusher, add blocks while
+// maxReadyBatches are waiting already, e.g. on the confirm window.
+func (batcher *publishBatcher) add(key string, event map[string]string, body []byte) {
+    batcher.mutex.Lock()
+    defer batcher.mutex.Unlock()
+    current, found := batcher.batches[key]
+    if !found {
+        current = &eventBatch{builder: batch.NewBuilder(serializer.SchemaVersion, batcher.contentType), started: time.Now()}
+        batcher.batches[key] = current
+    }
+    current.events = append(current.events, event)
+    current.builder.Add(serializer.EventId(event), event["Event"], body)
+    if current.builder.Len() < batcher.maxEvents && current.builder.Size() < batcher.maxBytes {
+        return
+    }
+    delete(batcher.batches, key)
+    for len(batcher.ready) >= maxReadyBatches {
+        batcher.readyCond.Wait()
+    }
+    batcher.ready = append(batcher.ready, current)
+    select {
+    case batcher.retries.signal <- struct{}{}:
+    default:
+    }
+}
+
+func (batcher *publishBatcher) run() {
+    defer close(batcher.done)
+    interval := batcher.linger / 2
+    if interval < 10*time.Millisecond {
+        interval = 10 * time.Millisecond
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-batcher.stop:
+            return
+        case <-batcher.retries.signal:
+        case <-ticker.C:
+        }
+        batcher.flushDue(time.Now().Add(-batcher.linger))
+    }
+}
+
+// flushDue publishes the batches to retry, then the full batches and those started before the given time.
+func (batcher *publishBatcher) flushDue(startedBefore time.Time) {
+    for {
+        for pending := batcher.retries.pop(); pending != nil; pending = batcher.retries.pop() {
+            batcher.republish(pending)
+        }
+        due := batcher.take(startedBefore)
+        if len(due) == 0 {
+            return
+        }
+        for _, eventBatch := range due {
+            batcher.flush(eventBatch)
+        }
+    }
+}
+
+// take removes the full batches, then the batches started before the given time, oldest first. A batch still
+// filling up is always newer than the full batches of its key.
+func (batcher *publishBatcher) take(startedBefore time.Time) []*eventBatch {
+    batcher.mutex.Lock()
+    defer batcher.mutex.Unlock()
+    taken := batcher.ready
+    batcher.ready = nil
+    batcher.readyCond.Broadcast()
+    var expired []*eventBatch
+    for key, eventBatch := range batcher.batches {
+        if eventBatch.started.Before(startedBefore) {
+            expired = append(expired, eventBatch)
+            delete(batcher.batches, key)
+        }
+    }
+    sort.Slice(expired, func(i, j int) bool { return expired[i].started.Before(expired[j].started) })
+    return append(taken, expired...)
+}
+
+// close stops the flusher once it published what is left.
+func (batcher *publishBatcher) close() {
+    close(batcher.stop)
+    <-batcher.done
+    batcher.flushDue(time.Now().Add(time.Hour))
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+    "ami-reader/batch"
+    "ami-reader/compression"
+    "ami-reader/serializer"
+    "encoding/json"
+    "fmt"
+    "github.com/streadway/amqp"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestPublishBatcherFlushesInOrderFromOneGoroutine(t *testing.T) {
+    var flushing int32
+    var mutex sync.Mutex
+    var flushed []string
+    flush := func(eventBatch *eventBatch) {
+        if atomic.AddInt32(&flushing, 1) != 1 {
+            t.Error("two batches flushed at the same time")
+        }
+        mutex.Lock()
+        for _, event := range eventBatch.events {
+            flushed = append(flushed, event["seq"])
+        }
+        mutex.Unlock()
+        // Lets the linger timer expire batches meanwhile
+        time.Sleep(time.Millisecond)
+        atomic.AddInt32(&flushing, -1)
+    }
+    batcher := newPublishBatcher(5, 1<<20, 5*time.Millisecond, "application/json", flush, func(pending *pendingPublishing) {})
+    const events = 500
+    for i := 1; i <= events; i++ {
+        batcher.add("key", map[string]string{"seq": strconv.Itoa(i)}, []byte("{}"))
+        if i%17 == 0 {
+            // Batches left to linger
+            time.Sleep(7 * time.Millisecond)
+        }
+    }
+    batcher.close()
+    if len(flushed) != events {
+        t.Fatalf("flushed %d events, want %d", len(flushed), events)
+    }
+    for i, seq := range flushed {
+        if seq != strconv.Itoa(i+1) {
+            t.Fatalf("event %d flushed as %s: %v", i+1, seq, flushed[:i+1])
+        }
+    }
+}
+
+func TestPublishBatcherRetriesBeforeNewBatches(t *testing.T) {
+    var order []string
+    flushing, release := make(chan struct{}), make(chan struct{})
+    var batcher *publishBatcher
+    batcher = newPublishBatcher(1, 1<<20, time.Hour, "application/json", func(eventBatch *eventBatch) {
+        seq := eventBatch.events[0]["seq"]
+        order = append(order, seq)
+        if seq == "1" {
+            // The first batch is nacked while the second one waits
+            batcher.retries.push(&pendingPublishing{event: eventBatch.events[0], batch: eventBatch})
+            close(flushing)
+            <-release
+        }
+    }, func(pending *pendingPublishing) {
+        order = append(order, "retry "+pending.event["seq"])
+    })
+    batcher.add("key", map[string]string{"seq": "1"}, []byte("{}"))
+    <-flushing
+    batcher.add("key", map[string]string{"seq": "2"}, []byte("{}"))
+    close(release)
+    batcher.close()
+    if fmt.Sprint(order) != "[1 retry 1 2]" {
+        t.Fatalf("order = %v", order)
+    }
+}
+
+func TestCompressedBatchDecodesAsPublished(t *testing.T) {
+    eventSerializer, err := serializer.New("json", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    compressor, err := compression.New("zstd")
+    if err != nil {
+        t.Fatal(err)
+    }
+    properties, _ := newAmqpMessageProperties(0, 0, nil)
+    consumer := &rabbitMQAmiEventConsumer{serializer: eventSerializer, compressor: compressor, properties: properties}
+    var publishings []amqp.Publishing
+    batcher := newPublishBatcher(3, 1<<20, time.Hour, eventSerializer.ContentType(), func(eventBatch *eventBatch) {
+        publishing, err := consumer.publishingOf(&pendingPublishing{event: eventBatch.events[0], batch: eventBatch})
+        if err != nil {
+            t.Error(err)
+        }
+        publishings = append(publishings, publishing)
+    }, func(pending *pendingPublishing) {})
+    events := []map[string]string{
+        {"Event": "Newchannel", "Uniqueid": "1.1", "host_device_id": "pbx-1"},
+        {"Event": "DialBegin", "Uniqueid": "1.1", "host_device_id": "pbx-1"},
+        {"Event": "Hangup", "Uniqueid": "1.1", "host_device_id": "pbx-1", "Cause": "16"},
+    }
+    for _, event := range events {
+        body, _ := eventSerializer.Serialize(event)
+        batcher.add("key", event, body)
+    }
+    batcher.close()
+    if len(publishings) != 1 {
+        t.Fatalf("published %d batches, want 1", len(publishings))
+    }
+    publishing := publishings[0]
+    if publishing.ContentType != batch.ContentType || publishing.ContentEncoding != "zstd" || publishing.Headers["batch_count"] != int32(3) {
+        t.Errorf("published %s encoded %s with headers %v", publishing.ContentType, publishing.ContentEncoding, publishing.Headers)
+    }
+    // As a consumer unpacks it
+    decompressor, err := compression.ForEncoding(publishing.ContentEncoding)
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, err := decompressor.Decompress(publishing.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    manifest, serialized, err := batch.Decode(body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if manifest.ContentType != "application/json" || manifest.Count != len(events) {
+        t.Fatalf("manifest %+v", manifest)
+    }
+    for i, data := range serialized {
+        var decoded map[string]interface{}
+        if err = json.Unmarshal(data, &decoded); err != nil {
+            t.Fatalf("event %d: %v", i, err)
+        }
+        if decoded["Event"] != events[i]["Event"] || manifest.Events[i].Type != events[i]["Event"] || manifest.Events[i].Id != serializer.EventId(events[i]) {
+            t.Errorf("event %d decoded as %v, listed as %+v", i, decoded, manifest.Events[i])
+        }
+    }
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+    "fmt"
+    "github.com/pkg/errors"
+    log "github.com/sirupsen/logrus"
+    "github.com/streadway/amqp"
+    "net/url"
+    "time"
+)
+
+// withoutUserinfo returns a URL without its credentials, to be logged. A URL that can't be parsed is not shown
+// at all, a password could be left in.
+func withoutUserinfo(rawUrl string) string {
+    parsed, err := url.Parse(rawUrl)
+    if err != nil {
+        return "(invalid URL)"
+    }
+    parsed.User = nil
+    return parsed.String()
+}
+
+// withoutUrl drops the URL, along with its credentials, from an error of url.Parse.
+func withoutUrl(err error) error {
+    if urlErr, ok := err.(*url.Error); ok {
+        return urlErr.Err
+    }
+    return err
+}
+
+// dialAmqp connects to the broker of amqpUrl. The error doesn't show the credentials of amqpUrl.
+func dialAmqp(amqpUrl string) (*amqp.Connection, error) {
+    conn, err := amqp.Dial(amqpUrl)
+    if err != nil {
+        return nil, errors.Wrap(withoutUrl(err), fmt.Sprintf("Failed to connect MQ %s.", withoutUserinfo(amqpUrl)))
+    }
+    return conn, nil
+}
+
+// connect opens the connection and a confirm mode channel and verifies the exchange.
+func (service *rabbitMQAmiEventConsumer) connect() error {
+    log.Infof("Connecting to MQ %s", withoutUserinfo(service.amqpUrl))
+    conn, err := dialAmqp(service.amqpUrl)
+    if err != nil {
+        log.Error(err)
+        return err
+    }
+    log.Info("Successfully connected to MQ")
+    switch service.topology.Mode {
+    case topologyModeDeclare:
+        err = declareTopology(conn, service.topology)
+    case topologyModeVerify:
+        err = verifyTopology(conn, service.topology)
+    }
+    if err != nil {
+        _ = conn.Close()
+        log.Errorf("MQ topology check failed. Reason: %v", err)
+        return err
+    }
+    ch, err := conn.Channel()
+    if err != nil {
+        _ = conn.Close()
+        log.Error("Failed to open a channel.")
+        return errors.Wrap(err, "Failed to open a channel.")
+    }
+    for _, exchange := range service.router.exchanges() {
+        err = ch.ExchangeDeclarePassive(
+            exchange,            // name
+            service.amqpXchType, // type
+            true,                // durable
+            false,               // auto-deleted
+            false,               // internal
+            false,               // no-wait
+            nil,                 // arguments
+        )
+        if err != nil {
+            _ = conn.Close()
+            log.Errorf("Failed to declare %s exchange. Reason %v", exchange, err)
+            return errors.Wrap(err, fmt.Sprintf("Failed to declare %s exchange.", exchange))
+        }
+    }
+    // Put the channel in confirm mode so nacked and returned (unroutable) messages are not lost silently
+    if err = ch.Confirm(false); err != nil {
+        _ = conn.Close()
+        log.Errorf("Failed to put channel in confirm mode. Reason %v", err)
+        return errors.Wrap(err, "Failed to put channel in confirm mode.")
+    }
+    confirmer := newPublishConfirmer(ch, service.confirmWindow, service.handleUndelivered)
+    service.stateMutex.Lock()
+    service.amqpConn = conn
+    service.amqpChannel = ch
+    service.stateMutex.Unlock()
+    if err = service.resume(confirmer); err != nil {
+        _ = conn.Close()
+        return err
+    }
+    return nil
+}
+
+// Check connects to the broker and makes sure the exchanges events are published to exist, along with the
+// topology in verify mode. Exchanges the topology declares are not expected to exist yet in declare mode.
+// Nothing is published.
+func (service *rabbitMQAmiEventConsumer) Check() error {
+    conn, err := dialAmqp(service.amqpUrl)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    if service.topology.Mode == topologyModeVerify {
+        if err = verifyTopology(conn, service.topology); err != nil {
+            return err
+        }
+    }
+    declared := make(map[string]bool)
+    if service.topology.Mode == topologyModeDeclare {
+        for _, exchange := range service.topology.Exchanges {
+            declared[exchange.Name] = true
+        }
+    }
+    for _, exchange := range service.router.exchanges() {
+        if declared[exchange] {
+            continue
+        }
+        // A failed passive declare closes the channel
+        ch, err := conn.Channel()
+        if err != nil {
+            return errors.Wrap(err, "Failed to open a channel.")
+        }
+        if err = ch.ExchangeDeclarePassive(exchange, service.amqpXchType, true, false, false, false, nil); err != nil {
+            return errors.Wrap(err, fmt.Sprintf("Failed to declare %s exchange.", exchange))
+        }
+        _ = ch.Close()
+    }
+    return nil
+}
+
+// resume publishes the events held during an outage, oldest first, then lets the workers publish again.
+func (service *rabbitMQAmiEventConsumer) resume(confirmer *publishConfirmer) error {
+    for {
+        service.stateMutex.Lock()
+        held := service.held
+        service.held = nil
+        if len(held) == 0 {
+            service.confirmer = confirmer
+            service.stateMutex.Unlock()
+            return nil
+        }
+        service.stateMutex.Unlock()
+        log.Infof("Publishing %d events held while MQ was unavailable.", len(held))
+        for i, pending := range held {
+            if err := service.publishTo(confirmer, pending); err != nil {
+                // Lost the channel again, keep the rest for the next attempt
+                service.stateMutex.Lock()
+                service.held = append(held[i:], service.held...)
+                service.stateMutex.Unlock()
+                return err
+            }
+        }
+    }
+}
+
+// watch reconnects with an exponential backoff whenever the connection or the channel is closed by the broker.
+func (service *rabbitMQAmiEventConsumer) watch() {
+    defer close(service.watchDone)
+    for {
+        service.stateMutex.Lock()
+        connClosed := service.amqpConn.NotifyClose(make(chan *amqp.Error, 1))
+        chClosed := service.amqpChannel.NotifyClose(make(chan *amqp.Error, 1))
+        service.stateMutex.Unlock()
+        var reason *amqp.Error
+        select {
+        case <-service.stopWatch:
+            return
+        case reason = <-connClosed:
+        case reason = <-chClosed:
+        }
+        log.Warnf("MQ connection lost. Reason: %v. Holding events until it is back.", reason)
+        rabbitMQStats.Add("disconnects", 1)
+        service.stateMutex.Lock()
+        service.confirmer = nil
+        conn := service.amqpConn
+        service.stateMutex.Unlock()
+        _ = conn.Close()
+        delay := service.reconnectDelay
+        for {
+            select {
+            case <-service.stopWatch:
+                return
+            case <-time.After(delay):
+            }
+            err := service.connect()
+            if err == nil {
+                log.Info("Reconnected to MQ.")
+                rabbitMQStats.Add("reconnects", 1)
+                break
+            }
+            log.Warnf("Failed to reconnect to MQ, retrying in %v. Reason: %v", delay, err)
+            if delay *= 2; delay > service.reconnectMaxDelay {
+                delay = service.reconnectMaxDelay
+            }
+        }
+    }
+}
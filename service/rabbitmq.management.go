@@ -0,0 +1,191 @@
+package service
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/pkg/errors"
+    "github.com/streadway/amqp"
+    "net"
+    "net/http"
+    "net/url"
+    "sort"
+    "strings"
+    "time"
+)
+
+const amqpManagementTimeout = 10 * time.Second
+
+// amqpManagement reads the settings of exchanges, queues and bindings from the RabbitMQ management HTTP API,
+// which AMQP has no way to look up without declaring them.
+type amqpManagement struct {
+    url      string
+    vhost    string
+    username string
+    password string
+    client   *http.Client
+}
+
+type amqpManagedExchange struct {
+    Type       string                 `json:"type"`
+    Durable    bool                   `json:"durable"`
+    AutoDelete bool                   `json:"auto_delete"`
+    Internal   bool                   `json:"internal"`
+    Arguments  map[string]interface{} `json:"arguments"`
+}
+
+type amqpManagedQueue struct {
+    Durable    bool                   `json:"durable"`
+    AutoDelete bool                   `json:"auto_delete"`
+    Exclusive  bool                   `json:"exclusive"`
+    Arguments  map[string]interface{} `json:"arguments"`
+}
+
+type amqpManagedBinding struct {
+    RoutingKey string                 `json:"routing_key"`
+    Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// newAmqpManagement creates the client of the management API of the broker of amqpUrl. managementUrl defaults
+// to the host of amqpUrl on port 15672, or 15671 over TLS, and the credentials of amqpUrl are used unless it
+// has its own.
+func newAmqpManagement(amqpUrl string, managementUrl string) (*amqpManagement, error) {
+    uri, err := amqp.ParseURI(amqpUrl)
+    if err != nil {
+        return nil, errors.Wrap(withoutUrl(err), "Invalid AMQP_URL.")
+    }
+    if managementUrl == "" {
+        scheme, port := "http", "15672"
+        if uri.Scheme == "amqps" {
+            scheme, port = "https", "15671"
+        }
+        managementUrl = scheme + "://" + net.JoinHostPort(uri.Host, port)
+    }
+    parsed, err := url.Parse(managementUrl)
+    if err != nil || parsed.Host == "" {
+        return nil, errors.Errorf("Invalid management_url %s", withoutUserinfo(managementUrl))
+    }
+    management := &amqpManagement{vhost: uri.Vhost, username: uri.Username, password: uri.Password, client: &http.Client{Timeout: amqpManagementTimeout}}
+    if parsed.User != nil {
+        management.username = parsed.User.Username()
+        management.password, _ = parsed.User.Password()
+        parsed.User = nil
+    }
+    management.url = strings.TrimSuffix(parsed.String(), "/")
+    return management, nil
+}
+
+// get reads a resource of the API, found is false when the broker does not know it.
+func (management *amqpManagement) get(out interface{}, resource string, names ...string) (bool, error) {
+    path := "/api/" + resource + "/" + url.PathEscape(management.vhost)
+    for _, name := range names {
+        path += "/" + url.PathEscape(name)
+    }
+    request, err := http.NewRequest(http.MethodGet, management.url+path, nil)
+    if err != nil {
+        return false, err
+    }
+    request.SetBasicAuth(management.username, management.password)
+    response, err := management.client.Do(request)
+    if err != nil {
+        return false, errors.Wrap(err, fmt.Sprintf("Failed to query MQ management API %s.", management.url))
+    }
+    defer response.Body.Close()
+    if response.StatusCode == http.StatusNotFound {
+        return false, nil
+    }
+    if response.StatusCode != http.StatusOK {
+        return false, errors.Errorf("MQ management API %s answered %s to GET %s", management.url, response.Status, path)
+    }
+    if err = json.NewDecoder(response.Body).Decode(out); err != nil {
+        return false, errors.Wrap(err, fmt.Sprintf("Invalid answer of MQ management API to GET %s.", path))
+    }
+    return true, nil
+}
+
+// compareExchange lists how the exchange on the broker differs from its configuration.
+func (management *amqpManagement) compareExchange(exchange amqpExchangeConf) ([]string, error) {
+    var managed amqpManagedExchange
+    found, err := management.get(&managed, "exchanges", exchange.Name)
+    if err != nil || !found {
+        return missing(found, "exchange "+exchange.Name), err
+    }
+    what := "exchange " + exchange.Name
+    differences := compareSetting(nil, what, "type", managed.Type, exchange.Type)
+    differences = compareSetting(differences, what, "durable", managed.Durable, exchange.Durable)
+    differences = compareSetting(differences, what, "auto_delete", managed.AutoDelete, exchange.AutoDelete)
+    differences = compareSetting(differences, what, "internal", managed.Internal, exchange.Internal)
+    return compareArguments(differences, what, managed.Arguments, toAmqpTable(exchange.Arguments)), nil
+}
+
+// compareQueue lists how the queue on the broker differs from its configuration.
+func (management *amqpManagement) compareQueue(queue amqpQueueConf) ([]string, error) {
+    var managed amqpManagedQueue
+    found, err := management.get(&managed, "queues", queue.Name)
+    if err != nil || !found {
+        return missing(found, "queue "+queue.Name), err
+    }
+    what := "queue " + queue.Name
+    differences := compareSetting(nil, what, "durable", managed.Durable, queue.Durable)
+    differences = compareSetting(differences, what, "auto_delete", managed.AutoDelete, queue.AutoDelete)
+    differences = compareSetting(differences, what, "exclusive", managed.Exclusive, queue.Exclusive)
+    return compareArguments(differences, what, managed.Arguments, queue.arguments()), nil
+}
+
+// compareBinding tells whether the queue is bound to the exchange with the configured routing key and arguments.
+func (management *amqpManagement) compareBinding(binding amqpBindingConf) ([]string, error) {
+    var managed []amqpManagedBinding
+    if _, err := management.get(&managed, "bindings", "e", binding.Exchange, "q", binding.Queue); err != nil {
+        return nil, err
+    }
+    arguments := toAmqpTable(binding.Arguments)
+    for _, candidate := range managed {
+        if candidate.RoutingKey == binding.RoutingKey && len(compareArguments(nil, "", candidate.Arguments, arguments)) == 0 {
+            return nil, nil
+        }
+    }
+    return []string{fmt.Sprintf("binding of queue %s to exchange %s with routing key '%s' is missing", binding.Queue, binding.Exchange, binding.RoutingKey)}, nil
+}
+
+func missing(found bool, what string) []string {
+    if found {
+        return nil
+    }
+    return []string{what + " is missing"}
+}
+
+func compareSetting(differences []string, what string, setting string, actual interface{}, expected interface{}) []string {
+    if actual != expected {
+        differences = append(differences, fmt.Sprintf("%s has %s %v, expected %v", what, setting, actual, expected))
+    }
+    return differences
+}
+
+// compareArguments reports every argument missing, unexpected or with another value. JSON numbers are compared
+// as the integers they are configured as.
+func compareArguments(differences []string, what string, actual map[string]interface{}, expected amqp.Table) []string {
+    actualTable := toAmqpTable(actual)
+    for _, key := range sortedKeys(expected) {
+        value := expected[key]
+        actualValue, found := actualTable[key]
+        if !found {
+            differences = append(differences, fmt.Sprintf("%s has no argument %s, expected %v", what, key, value))
+        } else if fmt.Sprint(actualValue) != fmt.Sprint(value) {
+            differences = append(differences, fmt.Sprintf("%s has argument %s %v, expected %v", what, key, actualValue, value))
+        }
+    }
+    for _, key := range sortedKeys(actualTable) {
+        if _, found := expected[key]; !found {
+            differences = append(differences, fmt.Sprintf("%s has argument %s %v, which is not configured", what, key, actualTable[key]))
+        }
+    }
+    return differences
+}
+
+func sortedKeys(table amqp.Table) []string {
+    keys := make([]string, 0, len(table))
+    for key := range table {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+    "ami-reader/batch"
+    "ami-reader/serializer"
+    "fmt"
+    "github.com/pkg/errors"
+    "github.com/streadway/amqp"
+    "path"
+    "strconv"
+)
+
+const appId = "ami-reader"
+
+// AppVersion is sent as part of the AppId of published messages. It is set by main.
+var AppVersion = "dev"
+
+type amqpMessageConf struct {
+    Events     []string `mapstructure:"events" json:"events"`
+    Expiration int64    `mapstructure:"expiration" json:"expiration"`
+    Priority   uint8    `mapstructure:"priority" json:"priority"`
+}
+
+// amqpMessageProperties fills the properties and headers of published messages. Expiration (milliseconds) and
+// priority come from the first rule whose events pattern matches the AMI event name, else from the defaults.
+type amqpMessageProperties struct {
+    rules             []amqpMessageConf
+    defaultExpiration int64
+    defaultPriority   uint8
+}
+
+func newAmqpMessageProperties(defaultExpiration int64, defaultPriority int, rules []amqpMessageConf) (*amqpMessageProperties, error) {
+    if defaultPriority < 0 || defaultPriority > 255 {
+        return nil, errors.New("AMQP_PRIORITY should be between 0 and 255")
+    }
+    for i, rule := range rules {
+        for _, pattern := range rule.Events {
+            if _, err := path.Match(pattern, ""); err != nil {
+                return nil, errors.Wrap(err, fmt.Sprintf("Invalid event pattern %s in AMQP_MESSAGE_PROPERTIES[%d].", pattern, i))
+            }
+        }
+    }
+    return &amqpMessageProperties{rules, defaultExpiration, uint8(defaultPriority)}, nil
+}
+
+// resolve returns the expiration and priority of an event.
+func (properties *amqpMessageProperties) resolve(event map[string]string) (int64, uint8) {
+    for _, rule := range properties.rules {
+        if matchesAny(rule.Events, event["Event"]) {
+            return rule.Expiration, rule.Priority
+        }
+    }
+    return properties.defaultExpiration, properties.defaultPriority
+}
+
+func (properties *amqpMessageProperties) publishing(event map[string]string, contentType string, messageId string, body []byte) amqp.Publishing {
+    expiration, priority := properties.resolve(event)
+    timestamp, _ := serializer.EventTime(event)
+    publishing := amqp.Publishing{
+        DeliveryMode: amqp.Persistent,
+        ContentType:  contentType,
+        MessageId:    messageId,
+        Timestamp:    timestamp,
+        Type:         event["Event"],
+        AppId:        appId + "/" + AppVersion,
+        Priority:     priority,
+        Headers:      amqp.Table{},
+        Body:         body,
+    }
+    if expiration > 0 {
+        publishing.Expiration = strconv.FormatInt(expiration, 10)
+    }
+    for _, header := range []string{"host_device_id", "Linkedid", "Uniqueid"} {
+        if value, found := event[header]; found {
+            publishing.Headers[header] = value
+        }
+    }
+    return publishing
+}
+
+// batchPublishing fills the properties of a batch from its first event, events are only batched together
+// when they have the same expiration and priority. Event headers are replaced by the number of events.
+func (properties *amqpMessageProperties) batchPublishing(events []map[string]string, messageId string, body []byte) amqp.Publishing {
+    publishing := properties.publishing(events[0], batch.ContentType, messageId, body)
+    publishing.Type = "batch"
+    publishing.Headers = amqp.Table{"batch_count": int32(len(events))}
+    if value, found := events[0]["host_device_id"]; found {
+        publishing.Headers["host_device_id"] = value
+    }
+    return publishing
+}
+
+func matchesAny(patterns []string, value string) bool {
+    for _, pattern := range patterns {
+        if matched, _ := path.Match(pattern, value); matched {
+            return true
+        }
+    }
+    return false
+}
+
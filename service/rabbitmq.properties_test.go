@@ -0,0 +1,95 @@
+package service
+
+import (
+    "ami-reader/batch"
+    "github.com/streadway/amqp"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestAmqpMessagePropertiesPublishing(t *testing.T) {
+    properties, err := newAmqpMessageProperties(60000, 1, []amqpMessageConf{
+        {Events: []string{"Hangup", "Cdr"}, Expiration: 0, Priority: 9},
+        {Events: []string{"Var*"}, Expiration: 5000, Priority: 0},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    AppVersion = "1.2.3"
+    defer func() { AppVersion = "dev" }()
+    timestamp := time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC)
+    tests := []struct {
+        name           string
+        event          map[string]string
+        wantExpiration string
+        wantPriority   uint8
+        wantHeaders    amqp.Table
+    }{
+        {
+            name:           "defaults",
+            event:          map[string]string{"Event": "Newchannel", "host_device_id": "pbx-1", "Linkedid": "1.1", "Uniqueid": "1.2", "timestamp": timestamp.Format(time.RFC3339Nano)},
+            wantExpiration: "60000",
+            wantPriority:   1,
+            wantHeaders:    amqp.Table{"host_device_id": "pbx-1", "Linkedid": "1.1", "Uniqueid": "1.2"},
+        },
+        {
+            name:         "first matching rule, no expiration",
+            event:        map[string]string{"Event": "Hangup", "Uniqueid": "1.2", "timestamp": timestamp.Format(time.RFC3339Nano)},
+            wantPriority: 9,
+            wantHeaders:  amqp.Table{"Uniqueid": "1.2"},
+        },
+        {
+            name:           "pattern",
+            event:          map[string]string{"Event": "VarSet", "timestamp": timestamp.Format(time.RFC3339Nano)},
+            wantExpiration: "5000",
+            wantHeaders:    amqp.Table{},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            body := []byte("{}")
+            publishing := properties.publishing(test.event, "application/json", "message-1", body)
+            want := amqp.Publishing{
+                DeliveryMode: amqp.Persistent,
+                ContentType:  "application/json",
+                MessageId:    "message-1",
+                Timestamp:    timestamp,
+                Type:         test.event["Event"],
+                AppId:        "ami-reader/1.2.3",
+                Priority:     test.wantPriority,
+                Expiration:   test.wantExpiration,
+                Headers:      test.wantHeaders,
+                Body:         body,
+            }
+            if !reflect.DeepEqual(publishing, want) {
+                t.Errorf("publishing = %+v, want %+v", publishing, want)
+            }
+        })
+    }
+}
+
+func TestAmqpMessagePropertiesBatchPublishing(t *testing.T) {
+    properties, _ := newAmqpMessageProperties(0, 0, []amqpMessageConf{{Events: []string{"Hangup"}, Priority: 9}})
+    events := []map[string]string{
+        {"Event": "Hangup", "host_device_id": "pbx-1", "Uniqueid": "1.1"},
+        {"Event": "Hangup", "host_device_id": "pbx-1", "Uniqueid": "1.2"},
+    }
+    publishing := properties.batchPublishing(events, "batch-1", []byte("batch"))
+    if publishing.ContentType != batch.ContentType || publishing.Type != "batch" || publishing.MessageId != "batch-1" || publishing.Priority != 9 {
+        t.Errorf("publishing = %+v", publishing)
+    }
+    // Headers of single events are replaced by the number of events
+    if want := (amqp.Table{"batch_count": int32(2), "host_device_id": "pbx-1"}); !reflect.DeepEqual(publishing.Headers, want) {
+        t.Errorf("headers = %v, want %v", publishing.Headers, want)
+    }
+}
+
+func TestNewAmqpMessagePropertiesFailsOnInvalidSettings(t *testing.T) {
+    if _, err := newAmqpMessageProperties(0, 256, nil); err == nil {
+        t.Error("accepted AMQP_PRIORITY 256")
+    }
+    if _, err := newAmqpMessageProperties(0, 0, []amqpMessageConf{{Events: []string{"[Hangup"}}}); err == nil {
+        t.Error("accepted an invalid event pattern")
+    }
+}
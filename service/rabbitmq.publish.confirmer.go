@@ -0,0 +1,210 @@
+package service
+
+import (
+    "bytes"
+    "github.com/streadway/amqp"
+    "sort"
+    "sync"
+    "time"
+)
+
+type pendingPublishing struct {
+    // First event of a batch when batch is set
+    event     map[string]string
+    batch     *eventBatch
+    body      []byte
+    // Size of the body before compression
+    size      int
+    messageId string
+    attempts  int
+    // Not published again before then when retried
+    retryAt   time.Time
+    returned  bool
+    // When set, the outcome (acked, nacked, returned or unconfirmed) is reported here instead of being handled by the confirmer
+    result chan string
+}
+
+func (pending *pendingPublishing) events() []map[string]string {
+    if pending.batch != nil {
+        return pending.batch.events
+    }
+    return []map[string]string{pending.event}
+}
+
+// count is what delivery outcomes are counted by, the number of events published.
+func (pending *pendingPublishing) count() int64 {
+    if pending.batch != nil {
+        return int64(len(pending.batch.events))
+    }
+    return 1
+}
+
+func (pending *pendingPublishing) report(outcome string) {
+    select {
+    case pending.result <- outcome:
+    default:
+    }
+}
+
+// publishConfirmer tracks publishings on a channel in confirm mode. At most window publishings
+// wait for a confirm at a time, publish blocks until a slot is released by an ack or nack.
+type publishConfirmer struct {
+    channel       *amqp.Channel
+    mutex         sync.Mutex
+    deliveryTag   uint64
+    pending       map[uint64]*pendingPublishing
+    window        chan struct{}
+    done          chan struct{}
+    onUndelivered func(pending *pendingPublishing, outcome string)
+}
+
+func newPublishConfirmer(channel *amqp.Channel, window int, onUndelivered func(pending *pendingPublishing, outcome string)) *publishConfirmer {
+    confirmer := &publishConfirmer{
+        channel:       channel,
+        pending:       make(map[uint64]*pendingPublishing),
+        window:        make(chan struct{}, window),
+        done:          make(chan struct{}),
+        onUndelivered: onUndelivered,
+    }
+    confirms := channel.NotifyPublish(make(chan amqp.Confirmation, window))
+    // Unbuffered on purpose: the client library blocks on it, so a return is always seen before the ack that follows it
+    returns := channel.NotifyReturn(make(chan amqp.Return))
+    go confirmer.listen(confirms, returns)
+    return confirmer
+}
+
+func (confirmer *publishConfirmer) publish(pending *pendingPublishing, publish func(ch *amqp.Channel) error) error {
+    select {
+    case confirmer.window <- struct{}{}:
+    case <-confirmer.done:
+        return amqp.ErrClosed
+    }
+    confirmer.mutex.Lock()
+    // Delivery tags are assigned by the broker in publish order, so publishing and counting must happen together
+    err := publish(confirmer.channel)
+    if err == nil {
+        confirmer.deliveryTag++
+        confirmer.pending[confirmer.deliveryTag] = pending
+    }
+    confirmer.mutex.Unlock()
+    if err != nil {
+        <-confirmer.window
+    }
+    return err
+}
+
+func (confirmer *publishConfirmer) listen(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+    defer confirmer.close()
+    for {
+        select {
+        case ret, ok := <-returns:
+            if !ok {
+                returns = nil
+                continue
+            }
+            confirmer.handleReturn(ret)
+        case confirm, ok := <-confirms:
+            if !ok {
+                // Channel is closed, nothing left will be confirmed
+                return
+            }
+            confirmer.handleConfirm(confirm)
+        }
+    }
+}
+
+func (confirmer *publishConfirmer) handleReturn(ret amqp.Return) {
+    confirmer.mutex.Lock()
+    var returned *pendingPublishing
+    for _, pending := range confirmer.pending {
+        if !pending.returned && pending.messageId == ret.MessageId && bytes.Equal(pending.body, ret.Body) {
+            pending.returned = true
+            returned = pending
+            break
+        }
+    }
+    confirmer.mutex.Unlock()
+    // Reported once its ack arrives
+    if returned != nil && returned.result == nil {
+        confirmer.onUndelivered(returned, "returned")
+    }
+}
+
+func (confirmer *publishConfirmer) handleConfirm(confirm amqp.Confirmation) {
+    confirmer.mutex.Lock()
+    pending, found := confirmer.pending[confirm.DeliveryTag]
+    delete(confirmer.pending, confirm.DeliveryTag)
+    confirmer.mutex.Unlock()
+    if !found {
+        return
+    }
+    <-confirmer.window
+    if pending.result != nil {
+        if pending.returned {
+            pending.report("returned")
+        } else if confirm.Ack {
+            pending.report("acked")
+        } else {
+            pending.report("nacked")
+        }
+        return
+    }
+    if pending.returned {
+        // Already handed over when it was returned
+        return
+    }
+    if confirm.Ack {
+        rabbitMQStats.Add("acked", pending.count())
+    } else {
+        confirmer.onUndelivered(pending, "nacked")
+    }
+}
+
+// close releases publishers waiting for a slot and hands over what will never be confirmed on this channel.
+func (confirmer *publishConfirmer) close() {
+    close(confirmer.done)
+    for _, pending := range confirmer.takeUnconfirmed() {
+        confirmer.onUndelivered(pending, "unconfirmed")
+    }
+}
+
+// drain waits up to timeout for outstanding confirms and returns the publishings that were not confirmed.
+func (confirmer *publishConfirmer) drain(timeout time.Duration) []*pendingPublishing {
+    deadline := time.Now().Add(timeout)
+    for time.Now().Before(deadline) && confirmer.inFlight() > 0 {
+        select {
+        case <-confirmer.done:
+            deadline = time.Now()
+        case <-time.After(100 * time.Millisecond):
+        }
+    }
+    return confirmer.takeUnconfirmed()
+}
+
+func (confirmer *publishConfirmer) takeUnconfirmed() []*pendingPublishing {
+    confirmer.mutex.Lock()
+    defer confirmer.mutex.Unlock()
+    tags := make([]uint64, 0, len(confirmer.pending))
+    for tag := range confirmer.pending {
+        tags = append(tags, tag)
+    }
+    // Keep publish order so spooled events stay in sequence
+    sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+    unconfirmed := make([]*pendingPublishing, 0, len(tags))
+    for _, tag := range tags {
+        pending := confirmer.pending[tag]
+        delete(confirmer.pending, tag)
+        if pending.result != nil {
+            pending.report("unconfirmed")
+        } else if !pending.returned {
+            unconfirmed = append(unconfirmed, pending)
+        }
+    }
+    return unconfirmed
+}
+
+func (confirmer *publishConfirmer) inFlight() int {
+    confirmer.mutex.Lock()
+    defer confirmer.mutex.Unlock()
+    return len(confirmer.pending)
+}
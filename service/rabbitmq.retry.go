@@ -0,0 +1,68 @@
+package service
+
+import (
+    "sync"
+    "time"
+)
+
+// retryQueue holds publishings to retry until the goroutine owning them, the worker of their lane or the batch
+// flusher, gets to them. Pushing never blocks, so the confirm listener can hand over nacked and returned
+// publishings without waiting on the confirm window it is meant to release.
+type retryQueue struct {
+    mutex   sync.Mutex
+    pending []*pendingPublishing
+    // signal wakes the owner up when a publishing is pushed
+    signal chan struct{}
+}
+
+func newRetryQueue() *retryQueue {
+    return &retryQueue{signal: make(chan struct{}, 1)}
+}
+
+func (queue *retryQueue) push(pending *pendingPublishing) {
+    queue.mutex.Lock()
+    queue.pending = append(queue.pending, pending)
+    queue.mutex.Unlock()
+    select {
+    case queue.signal <- struct{}{}:
+    default:
+    }
+}
+
+// pop returns the oldest publishing, nil when there is none.
+func (queue *retryQueue) pop() *pendingPublishing {
+    queue.mutex.Lock()
+    defer queue.mutex.Unlock()
+    if len(queue.pending) == 0 {
+        return nil
+    }
+    pending := queue.pending[0]
+    queue.pending[0] = nil
+    queue.pending = queue.pending[1:]
+    return pending
+}
+
+// take removes every publishing left.
+func (queue *retryQueue) take() []*pendingPublishing {
+    queue.mutex.Lock()
+    defer queue.mutex.Unlock()
+    pending := queue.pending
+    queue.pending = nil
+    return pending
+}
+
+// retryQueueOf returns the queue of the goroutine owning a publishing: the batch flusher for a batch, the worker
+// of its lane otherwise.
+func (service *rabbitMQAmiEventConsumer) retryQueueOf(pending *pendingPublishing) *retryQueue {
+    if pending.batch != nil {
+        return service.batcher.retries
+    }
+    return service.retries[service.lanes.indexOf(pending.event)]
+}
+
+// retry publishes a publishing again once its retry delay is over. It runs on the owning goroutine, which
+// publishes nothing else meanwhile, so the events of a call keep their order.
+func (service *rabbitMQAmiEventConsumer) retry(pending *pendingPublishing) {
+    time.Sleep(time.Until(pending.retryAt))
+    service.publish(pending)
+}
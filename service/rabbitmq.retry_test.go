@@ -0,0 +1,141 @@
+package service
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/streadway/amqp"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestRetryQueueKeepsOrder(t *testing.T) {
+    queue := newRetryQueue()
+    for i := 1; i <= 5; i++ {
+        // Never blocks, the signal is only kept once
+        queue.push(&pendingPublishing{event: map[string]string{"seq": strconv.Itoa(i)}})
+    }
+    select {
+    case <-queue.signal:
+    default:
+        t.Fatal("push didn't signal")
+    }
+    select {
+    case <-queue.signal:
+        t.Fatal("signaled once per push")
+    default:
+    }
+    for i := 1; i <= 3; i++ {
+        if pending := queue.pop(); pending == nil || pending.event["seq"] != strconv.Itoa(i) {
+            t.Fatalf("pop %d = %v", i, pending)
+        }
+    }
+    left := queue.take()
+    if len(left) != 2 || left[0].event["seq"] != "4" || left[1].event["seq"] != "5" {
+        t.Fatalf("take = %v", left)
+    }
+    if pending := queue.pop(); pending != nil {
+        t.Fatalf("pop of an empty queue = %v", pending)
+    }
+}
+
+func TestHandleUndeliveredRetriesOnOwningLane(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "retry")
+    defer os.RemoveAll(dir)
+    diskSpool, err := openSpool(filepath.Join(dir, "rabbitmq"), 1<<20, 0, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer diskSpool.Close()
+    const lanes = 4
+    service := &rabbitMQAmiEventConsumer{
+        publishRetry: 2,
+        retryDelay:   time.Second,
+        lanes:        newOrderedLanes([]string{"Linkedid"}, lanes, lanes),
+        retries:      make([]*retryQueue, lanes),
+        diskSpool:    diskSpool,
+        spoolSignal:  make(chan struct{}, 1),
+    }
+    for i := range service.retries {
+        service.retries[i] = newRetryQueue()
+    }
+    event := func(seq string) map[string]string {
+        return map[string]string{"Event": "Newchannel", "Linkedid": "1700000000.1", "seq": seq}
+    }
+    retries := service.retries[service.lanes.indexOf(event(""))]
+    before := time.Now()
+    service.handleUndelivered(&pendingPublishing{event: event("1"), body: []byte("1")}, "nacked")
+    service.handleUndelivered(&pendingPublishing{event: event("2"), body: []byte("2"), attempts: 1}, "returned")
+    // Lost with the channel, published again right away
+    service.handleUndelivered(&pendingPublishing{event: event("3"), body: []byte("3"), attempts: 1}, "unconfirmed")
+    // Retries exhausted
+    service.handleUndelivered(&pendingPublishing{event: event("4"), body: []byte("4"), attempts: 2}, "nacked")
+    tests := []struct {
+        seq          string
+        attempts     int
+        retryDelayed bool
+    }{
+        {"1", 1, true},
+        {"2", 2, true},
+        {"3", 1, false},
+    }
+    for _, test := range tests {
+        pending := retries.pop()
+        if pending == nil {
+            t.Fatalf("event %s is not on the queue of its lane", test.seq)
+        }
+        if pending.event["seq"] != test.seq || pending.attempts != test.attempts || string(pending.body) != test.seq {
+            t.Errorf("popped event %s with %d attempts, want %s with %d", pending.event["seq"], pending.attempts, test.seq, test.attempts)
+        }
+        if delayed := pending.retryAt.After(before.Add(900 * time.Millisecond)); delayed != test.retryDelayed {
+            t.Errorf("event %s retried at %v, delayed %v", test.seq, pending.retryAt, test.retryDelayed)
+        }
+    }
+    for i, queue := range service.retries {
+        if pending := queue.pop(); pending != nil {
+            t.Errorf("lane %d queued %v", i, pending.event)
+        }
+    }
+    record, _, err := diskSpool.Next()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var spooled map[string]string
+    if err = json.Unmarshal(record, &spooled); err != nil || spooled["seq"] != "4" {
+        t.Fatalf("spooled %s, want event 4", record)
+    }
+}
+
+func TestPublishConfirmerHandsOverUndelivered(t *testing.T) {
+    var undelivered []string
+    confirmer := &publishConfirmer{
+        pending: make(map[uint64]*pendingPublishing),
+        window:  make(chan struct{}, 5),
+        done:    make(chan struct{}),
+        onUndelivered: func(pending *pendingPublishing, outcome string) {
+            undelivered = append(undelivered, outcome+" "+pending.messageId)
+        },
+    }
+    // As publish leaves them
+    for tag, id := range []string{"acked", "returned", "nacked", "lost-1", "lost-2"} {
+        confirmer.window <- struct{}{}
+        confirmer.pending[uint64(tag+1)] = &pendingPublishing{messageId: id, body: []byte(id)}
+    }
+    confirmer.handleReturn(amqp.Return{MessageId: "returned", Body: []byte("returned")})
+    confirmer.handleConfirm(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+    // A returned publishing is acked afterwards, it is handed over once
+    confirmer.handleConfirm(amqp.Confirmation{DeliveryTag: 2, Ack: true})
+    confirmer.handleConfirm(amqp.Confirmation{DeliveryTag: 3, Ack: false})
+    if len(confirmer.window) != 2 || confirmer.inFlight() != 2 {
+        t.Errorf("%d slots taken and %d in flight after 3 confirms", len(confirmer.window), confirmer.inFlight())
+    }
+    // The channel is gone, what is left is handed over in publish order
+    confirmer.close()
+    want := "[returned returned nacked nacked unconfirmed lost-1 unconfirmed lost-2]"
+    if fmt.Sprint(undelivered) != want {
+        t.Errorf("handed over %v, want %s", undelivered, want)
+    }
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+    "ami-reader/transform"
+    "ami-reader/util"
+    "fmt"
+    "github.com/pkg/errors"
+    "path"
+    "strings"
+)
+
+type amqpRouteConf struct {
+    Match      map[string]string `mapstructure:"match" json:"match"`
+    Exchange   string            `mapstructure:"exchange" json:"exchange"`
+    RoutingKey string            `mapstructure:"routing_key" json:"routing_key"`
+}
+
+type amqpRoute struct {
+    // Patterns by lowercased field name. Field names are not case sensitive, as in templates, config keys of
+    // nested objects are lowercased when loaded anyway.
+    match      map[string]string
+    exchange   string
+    routingKey transform.Template
+}
+
+// matches tells whether the fields of an event, by lowercased name, match the route.
+func (route *amqpRoute) matches(fields map[string]string) bool {
+    for field, pattern := range route.match {
+        if matched, _ := path.Match(pattern, fields[field]); !matched {
+            return false
+        }
+    }
+    return true
+}
+
+// amqpRouter picks the exchange and routing key of an event. The first matching route wins,
+// events matching no route use the sink's exchange and routing key.
+type amqpRouter struct {
+    routes          []amqpRoute
+    defaultExchange string
+    defaultKey      transform.Template
+    // Whether a route matches on fields, events are then indexed by lowercased field name
+    matchesFields bool
+}
+
+func newAmqpRouter(exchange string, routingKey string, routeConfs []amqpRouteConf) (*amqpRouter, error) {
+    defaultKey, err := transform.ParseTemplate(routingKey)
+    if err != nil {
+        return nil, errors.Wrap(err, "Invalid AMQP_ROUTING_KEY.")
+    }
+    router := &amqpRouter{defaultExchange: exchange, defaultKey: defaultKey}
+    for i, routeConf := range routeConfs {
+        route := amqpRoute{match: make(map[string]string), exchange: routeConf.Exchange, routingKey: defaultKey}
+        if route.exchange == "" {
+            route.exchange = exchange
+        }
+        if routeConf.RoutingKey != "" {
+            if route.routingKey, err = transform.ParseTemplate(routeConf.RoutingKey); err != nil {
+                return nil, errors.Wrap(err, fmt.Sprintf("Invalid routing_key in AMQP_ROUTES[%d].", i))
+            }
+        }
+        for field, pattern := range routeConf.Match {
+            if _, err = path.Match(pattern, ""); err != nil {
+                return nil, errors.Wrap(err, fmt.Sprintf("Invalid pattern %s for %s in AMQP_ROUTES[%d].", pattern, field, i))
+            }
+            route.match[strings.ToLower(field)] = pattern
+            router.matchesFields = true
+        }
+        router.routes = append(router.routes, route)
+    }
+    return router, nil
+}
+
+func (router *amqpRouter) route(event map[string]string) (string, string) {
+    var fields map[string]string
+    if router.matchesFields {
+        fields = make(map[string]string, len(event))
+        for key, value := range event {
+            fields[strings.ToLower(key)] = value
+        }
+    }
+    for i := range router.routes {
+        route := &router.routes[i]
+        if route.matches(fields) {
+            return route.exchange, route.routingKey.Execute(event)
+        }
+    }
+    return router.defaultExchange, router.defaultKey.Execute(event)
+}
+
+// exchanges lists every exchange events can be published to.
+func (router *amqpRouter) exchanges() []string {
+    exchanges := []string{router.defaultExchange}
+    for _, route := range router.routes {
+        if _, found := util.Find(exchanges, route.exchange); !found {
+            exchanges = append(exchanges, route.exchange)
+        }
+    }
+    return exchanges
+}
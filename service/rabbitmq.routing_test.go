@@ -0,0 +1,57 @@
+package service
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestAmqpRouterRoute(t *testing.T) {
+    router, err := newAmqpRouter("events", "{{host_device_id}}.{{Event}}", []amqpRouteConf{
+        // Keys of nested objects are lowercased when read from a config file
+        {Match: map[string]string{"event": "Hangup"}, Exchange: "calls"},
+        {Match: map[string]string{"Event": "Queue*", "QUEUE": "sales"}, Exchange: "queues", RoutingKey: "{{queue}}.{{Event}}"},
+        {Match: map[string]string{"Event": "Cdr"}, RoutingKey: "cdr.{{Disposition|unknown}}"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        event        map[string]string
+        wantExchange string
+        wantKey      string
+    }{
+        {map[string]string{"Event": "Hangup", "host_device_id": "pbx1"}, "calls", "pbx1.Hangup"},
+        {map[string]string{"Event": "QueueCallerJoin", "Queue": "sales"}, "queues", "sales.QueueCallerJoin"},
+        {map[string]string{"Event": "QueueCallerJoin", "Queue": "support", "host_device_id": "pbx1"}, "events", "pbx1.QueueCallerJoin"},
+        {map[string]string{"event": "Cdr"}, "events", "cdr.unknown"},
+        {map[string]string{"Event": "Newchannel"}, "events", ".Newchannel"},
+    }
+    for _, test := range tests {
+        exchange, key := router.route(test.event)
+        if exchange != test.wantExchange || key != test.wantKey {
+            t.Errorf("route(%v) = %s %s, want %s %s", test.event, exchange, key, test.wantExchange, test.wantKey)
+        }
+    }
+    if want := []string{"events", "calls", "queues"}; !reflect.DeepEqual(router.exchanges(), want) {
+        t.Errorf("exchanges() = %v, want %v", router.exchanges(), want)
+    }
+}
+
+func TestNewAmqpRouterFailsOnInvalidRoute(t *testing.T) {
+    tests := []struct {
+        name       string
+        routingKey string
+        routes     []amqpRouteConf
+    }{
+        {"routing key", "{{Event", nil},
+        {"route routing key", "{{Event}}", []amqpRouteConf{{RoutingKey: "Event}}"}}},
+        {"pattern", "{{Event}}", []amqpRouteConf{{Match: map[string]string{"Event": "[Hangup"}}}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if _, err := newAmqpRouter("events", test.routingKey, test.routes); err == nil {
+                t.Fatal("newAmqpRouter succeeded")
+            }
+        })
+    }
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+    "ami-reader/spool"
+    "encoding/json"
+    "io"
+    log "github.com/sirupsen/logrus"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// openSpools are the spools open by directory. Sinks created again on a reload are initialized while the
+// previous ones still run, so they share the spool of their directory rather than opening it twice.
+var openSpools = struct {
+    mutex  sync.Mutex
+    spools map[string]*sharedSpool
+}{spools: make(map[string]*sharedSpool)}
+
+// sharedSpool is a spool along with the number of sinks using it. A spool opened already keeps the segment
+// size, max size and sync settings it was opened with.
+type sharedSpool struct {
+    *spool.Spool
+    dir  string
+    refs int
+    // replaying lets a single sink replay at a time, Rewind would go back over the batch of another one
+    replaying sync.Mutex
+}
+
+func openSpool(dir string, segmentSize int64, maxSize int64, syncWrites bool) (*sharedSpool, error) {
+    dir = filepath.Clean(dir)
+    openSpools.mutex.Lock()
+    defer openSpools.mutex.Unlock()
+    if shared, found := openSpools.spools[dir]; found {
+        shared.refs++
+        return shared, nil
+    }
+    diskSpool, err := spool.Open(dir, segmentSize, maxSize, syncWrites)
+    if err != nil {
+        return nil, err
+    }
+    shared := &sharedSpool{Spool: diskSpool, dir: dir, refs: 1}
+    openSpools.spools[dir] = shared
+    return shared, nil
+}
+
+// Close closes the spool once no sink uses it anymore.
+func (shared *sharedSpool) Close() error {
+    openSpools.mutex.Lock()
+    defer openSpools.mutex.Unlock()
+    if shared.refs--; shared.refs > 0 {
+        return nil
+    }
+    delete(openSpools.spools, shared.dir)
+    return shared.Spool.Close()
+}
+
+type replayedRecord struct {
+    record []byte
+    pos    spool.Position
+    result chan string
+}
+
+// replaySpool publishes spooled events in order whenever MQ is available. The spool is committed once
+// the broker confirmed them, events of an unconfirmed batch are published again (at least once delivery).
+func (service *rabbitMQAmiEventConsumer) replaySpool() {
+    defer close(service.replayDone)
+    for {
+        select {
+        case <-service.stopWatch:
+            return
+        case <-service.spoolSignal:
+        case <-time.After(service.replayInterval):
+        }
+        for service.replayBatch() {
+        }
+    }
+}
+
+// replayBatch returns true when a whole batch was delivered and more may be waiting.
+func (service *rabbitMQAmiEventConsumer) replayBatch() bool {
+    service.stateMutex.Lock()
+    confirmer := service.confirmer
+    service.stateMutex.Unlock()
+    if confirmer == nil {
+        return false
+    }
+    service.diskSpool.replaying.Lock()
+    defer service.diskSpool.replaying.Unlock()
+    var batch []replayedRecord
+    for len(batch) < service.replayBatchSize {
+        record, pos, err := service.diskSpool.Next()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            log.Errorf("Failed to read spooled event. Reason: %v", err)
+            break
+        }
+        replayed := replayedRecord{record, pos, make(chan string, 1)}
+        batch = append(batch, replayed)
+        var event map[string]string
+        if err = json.Unmarshal(record, &event); err != nil {
+            // Can't be published, keep it in the unsent event log rather than blocking the spool
+            log.Errorf("Skipping invalid spooled event %s. Reason: %v", string(record), err)
+            service.eventLogger.Info(string(record))
+            replayed.result <- "skipped"
+            continue
+        }
+        if err = service.publishTo(confirmer, &pendingPublishing{event: event, result: replayed.result}); err != nil {
+            replayed.result <- "failed"
+            break
+        }
+    }
+    if len(batch) == 0 {
+        return false
+    }
+    delivered := 0
+outcomes:
+    for _, replayed := range batch {
+        var outcome string
+        select {
+        case outcome = <-replayed.result:
+        case <-service.stopWatch:
+            service.diskSpool.Rewind()
+            return false
+        }
+        switch outcome {
+        case "acked", "skipped":
+        case "returned":
+            // Publishing it again won't help until a queue is bound, keep it in the unsent event log
+            log.Errorf("Spooled event is unroutable: %s", string(replayed.record))
+            service.eventLogger.Info(string(replayed.record))
+        default:
+            break outcomes
+        }
+        delivered++
+    }
+    if delivered > 0 {
+        if err := service.diskSpool.Commit(batch[delivered-1].pos); err != nil {
+            log.Errorf("Failed to commit spool. Reason: %v", err)
+        }
+        rabbitMQStats.Add("replayed", int64(delivered))
+    }
+    if delivered < len(batch) {
+        service.diskSpool.Rewind()
+        return false
+    }
+    return true
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestOpenSpoolIsSharedByDirectory(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "spool")
+    defer os.RemoveAll(dir)
+    first, err := openSpool(filepath.Join(dir, "rabbitmq"), 1<<20, 0, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // e.g. the sinks of a reload, initialized while the current ones run
+    second, err := openSpool(filepath.Join(dir, "rabbitmq")+"/", 1<<20, 0, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if first != second {
+        t.Fatal("the spool of a directory was opened twice")
+    }
+    if err = first.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err = second.Append([]byte(`{"Event":"Hangup"}`)); err != nil {
+        t.Fatalf("spool closed while still used: %v", err)
+    }
+    if err = second.Close(); err != nil {
+        t.Fatal(err)
+    }
+    reopened, err := openSpool(filepath.Join(dir, "rabbitmq"), 1<<20, 0, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer reopened.Close()
+    if reopened == first || reopened.Pending() != 1 {
+        t.Fatalf("reopened spool shared %v with %d pending events, want a new one with 1", reopened == first, reopened.Pending())
+    }
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+    "fmt"
+    "github.com/pkg/errors"
+    log "github.com/sirupsen/logrus"
+    "github.com/streadway/amqp"
+    "strings"
+)
+
+const (
+    topologyModeDeclare = "declare"
+    topologyModeVerify  = "verify"
+)
+
+type amqpExchangeConf struct {
+    Name       string                 `mapstructure:"name" json:"name"`
+    Type       string                 `mapstructure:"type" json:"type"`
+    Durable    bool                   `mapstructure:"durable" json:"durable"`
+    AutoDelete bool                   `mapstructure:"auto_delete" json:"auto_delete"`
+    Internal   bool                   `mapstructure:"internal" json:"internal"`
+    Arguments  map[string]interface{} `mapstructure:"arguments" json:"arguments"`
+}
+
+type amqpQueueConf struct {
+    Name                 string                 `mapstructure:"name" json:"name"`
+    Durable              bool                   `mapstructure:"durable" json:"durable"`
+    AutoDelete           bool                   `mapstructure:"auto_delete" json:"auto_delete"`
+    Exclusive            bool                   `mapstructure:"exclusive" json:"exclusive"`
+    DeadLetterExchange   string                 `mapstructure:"dead_letter_exchange" json:"dead_letter_exchange"`
+    DeadLetterRoutingKey string                 `mapstructure:"dead_letter_routing_key" json:"dead_letter_routing_key"`
+    MessageTtl           int64                  `mapstructure:"message_ttl" json:"message_ttl"`
+    MaxLength            int64                  `mapstructure:"max_length" json:"max_length"`
+    MaxLengthBytes       int64                  `mapstructure:"max_length_bytes" json:"max_length_bytes"`
+    Overflow             string                 `mapstructure:"overflow" json:"overflow"`
+    Arguments            map[string]interface{} `mapstructure:"arguments" json:"arguments"`
+}
+
+type amqpBindingConf struct {
+    Queue      string                 `mapstructure:"queue" json:"queue"`
+    Exchange   string                 `mapstructure:"exchange" json:"exchange"`
+    RoutingKey string                 `mapstructure:"routing_key" json:"routing_key"`
+    Arguments  map[string]interface{} `mapstructure:"arguments" json:"arguments"`
+}
+
+// amqpTopologyConf describes the exchanges, queues and bindings the reader relies on. In declare mode they
+// are created when missing, in verify mode they are only checked and every difference is reported.
+type amqpTopologyConf struct {
+    Mode          string             `mapstructure:"mode" json:"mode"`
+    ManagementUrl string             `mapstructure:"management_url" json:"management_url"`
+    Exchanges     []amqpExchangeConf `mapstructure:"exchanges" json:"exchanges"`
+    Queues        []amqpQueueConf    `mapstructure:"queues" json:"queues"`
+    Bindings      []amqpBindingConf  `mapstructure:"bindings" json:"bindings"`
+    // Reads the settings checked in verify mode
+    management *amqpManagement
+}
+
+func (topology *amqpTopologyConf) validate(amqpUrl string) error {
+    if topology.Mode != "" && topology.Mode != topologyModeDeclare && topology.Mode != topologyModeVerify {
+        return errors.Errorf("Unknown mode %s, expected %s or %s", topology.Mode, topologyModeDeclare, topologyModeVerify)
+    }
+    if topology.Mode == topologyModeVerify {
+        management, err := newAmqpManagement(amqpUrl, topology.ManagementUrl)
+        if err != nil {
+            return err
+        }
+        topology.management = management
+    }
+    for i := range topology.Exchanges {
+        exchange := &topology.Exchanges[i]
+        if exchange.Name == "" {
+            return errors.Errorf("Missing name of exchanges[%d]", i)
+        }
+        if exchange.Type == "" {
+            exchange.Type = amqp.ExchangeDirect
+        }
+    }
+    for i, queue := range topology.Queues {
+        if queue.Name == "" {
+            return errors.Errorf("Missing name of queues[%d]", i)
+        }
+    }
+    for i, binding := range topology.Bindings {
+        if binding.Queue == "" || binding.Exchange == "" {
+            return errors.Errorf("Missing queue or exchange of bindings[%d]", i)
+        }
+    }
+    return nil
+}
+
+func (queue *amqpQueueConf) arguments() amqp.Table {
+    args := toAmqpTable(queue.Arguments)
+    if queue.DeadLetterExchange != "" {
+        args["x-dead-letter-exchange"] = queue.DeadLetterExchange
+    }
+    if queue.DeadLetterRoutingKey != "" {
+        args["x-dead-letter-routing-key"] = queue.DeadLetterRoutingKey
+    }
+    if queue.MessageTtl > 0 {
+        args["x-message-ttl"] = queue.MessageTtl
+    }
+    if queue.MaxLength > 0 {
+        args["x-max-length"] = queue.MaxLength
+    }
+    if queue.MaxLengthBytes > 0 {
+        args["x-max-length-bytes"] = queue.MaxLengthBytes
+    }
+    if queue.Overflow != "" {
+        args["x-overflow"] = queue.Overflow
+    }
+    return args
+}
+
+// toAmqpTable converts config values to types the AMQP table encoder accepts. JSON numbers are decoded as float64.
+func toAmqpTable(values map[string]interface{}) amqp.Table {
+    table := make(amqp.Table, len(values))
+    for key, value := range values {
+        if number, ok := value.(float64); ok && number == float64(int64(number)) {
+            table[key] = int64(number)
+        } else if number, ok := value.(int); ok {
+            table[key] = int64(number)
+        } else {
+            table[key] = value
+        }
+    }
+    return table
+}
+
+func declareTopology(conn *amqp.Connection, topology *amqpTopologyConf) error {
+    ch, err := conn.Channel()
+    if err != nil {
+        return err
+    }
+    defer ch.Close()
+    for _, exchange := range topology.Exchanges {
+        err = ch.ExchangeDeclare(exchange.Name, exchange.Type, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, toAmqpTable(exchange.Arguments))
+        if err != nil {
+            return errors.Wrap(err, fmt.Sprintf("Failed to declare exchange %s.", exchange.Name))
+        }
+    }
+    for _, queue := range topology.Queues {
+        _, err = ch.QueueDeclare(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, queue.arguments())
+        if err != nil {
+            return errors.Wrap(err, fmt.Sprintf("Failed to declare queue %s.", queue.Name))
+        }
+    }
+    for _, binding := range topology.Bindings {
+        err = ch.QueueBind(binding.Queue, binding.RoutingKey, binding.Exchange, false, toAmqpTable(binding.Arguments))
+        if err != nil {
+            return errors.Wrap(err, fmt.Sprintf("Failed to bind queue %s to exchange %s with %s.", binding.Queue, binding.Exchange, binding.RoutingKey))
+        }
+    }
+    log.Infof("Declared MQ topology: %d exchanges, %d queues, %d bindings.", len(topology.Exchanges), len(topology.Queues), len(topology.Bindings))
+    return nil
+}
+
+// verifyTopology checks every exchange, queue and binding without creating anything. Whether an exchange or
+// a queue exists is checked with a passive declare, on its own channel since a failed one closes it. Their
+// settings and the bindings are read from the management API, AMQP having no way to look them up.
+func verifyTopology(conn *amqp.Connection, topology *amqpTopologyConf) error {
+    var differences []string
+    exists := func(what string, passive func(ch *amqp.Channel) error) (bool, error) {
+        ch, err := conn.Channel()
+        if err != nil {
+            return false, err
+        }
+        err = passive(ch)
+        if _, ok := err.(*amqp.Error); ok {
+            differences = append(differences, fmt.Sprintf("%s is missing", what))
+            return false, nil
+        } else if err != nil {
+            return false, err
+        }
+        _ = ch.Close()
+        return true, nil
+    }
+    for _, exchange := range topology.Exchanges {
+        exchange := exchange
+        found, err := exists(fmt.Sprintf("exchange %s", exchange.Name), func(ch *amqp.Channel) error {
+            return ch.ExchangeDeclarePassive(exchange.Name, exchange.Type, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, nil)
+        })
+        if err != nil {
+            return err
+        }
+        if found {
+            exchangeDifferences, err := topology.management.compareExchange(exchange)
+            if err != nil {
+                return err
+            }
+            differences = append(differences, exchangeDifferences...)
+        }
+    }
+    for _, queue := range topology.Queues {
+        queue := queue
+        found, err := exists(fmt.Sprintf("queue %s", queue.Name), func(ch *amqp.Channel) error {
+            _, err := ch.QueueDeclarePassive(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, nil)
+            return err
+        })
+        if err != nil {
+            return err
+        }
+        if found {
+            queueDifferences, err := topology.management.compareQueue(queue)
+            if err != nil {
+                return err
+            }
+            differences = append(differences, queueDifferences...)
+        }
+    }
+    for _, binding := range topology.Bindings {
+        bindingDifferences, err := topology.management.compareBinding(binding)
+        if err != nil {
+            return err
+        }
+        differences = append(differences, bindingDifferences...)
+    }
+    if len(differences) > 0 {
+        for _, difference := range differences {
+            log.Errorf("MQ topology: %s", difference)
+        }
+        return errors.Errorf("MQ topology does not match: %s", strings.Join(differences, "; "))
+    }
+    log.Info("Verified MQ topology.")
+    return nil
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+    "ami-reader/transform"
+    "expvar"
+)
+
+var transformStats = expvar.NewMap("transform")
+
+// transformAmiEventConsumer runs events through the transform pipeline before handing them to the next consumer.
+type transformAmiEventConsumer struct {
+    pipeline *transform.Pipeline
+    next     AmiEventConsumer
+}
+
+func newTransformAmiEventConsumer(pipeline *transform.Pipeline, next AmiEventConsumer) AmiEventConsumer {
+    return &transformAmiEventConsumer{pipeline, next}
+}
+
+func (service *transformAmiEventConsumer) Initialize() error {
+    return service.next.Initialize()
+}
+
+func (service *transformAmiEventConsumer) Destroy() {
+    service.next.Destroy()
+}
+
+func (service *transformAmiEventConsumer) Consume(event map[string]string) {
+    transformStats.Add("transformed", 1)
+    if failed := service.pipeline.Apply(event); failed > 0 {
+        transformStats.Add("coerce_failed", int64(failed))
+    }
+    service.next.Consume(event)
+}
@@ -0,0 +1,18 @@
+// +build !windows
+
+package spool
+
+import (
+    "os"
+    "syscall"
+)
+
+// lockFile takes an exclusive lock on file without waiting, ErrLocked when another process holds it. The
+// lock is released when file is closed or the process exits.
+func lockFile(file *os.File) error {
+    err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+    if err == syscall.EWOULDBLOCK {
+        return ErrLocked
+    }
+    return err
+}
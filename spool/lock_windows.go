@@ -0,0 +1,17 @@
+package spool
+
+import (
+    "golang.org/x/sys/windows"
+    "os"
+)
+
+// lockFile takes an exclusive lock on file without waiting, ErrLocked when another process holds it. The
+// lock is released when file is closed or the process exits.
+func lockFile(file *os.File) error {
+    overlapped := &windows.Overlapped{}
+    err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, overlapped)
+    if err == windows.ERROR_LOCK_VIOLATION {
+        return ErrLocked
+    }
+    return err
+}
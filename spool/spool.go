@@ -0,0 +1,414 @@
+package spool
+
+import (
+    "encoding/binary"
+    "fmt"
+    "github.com/pkg/errors"
+    log "github.com/sirupsen/logrus"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+const (
+    segmentExt = ".spool"
+    cursorFile = "cursor"
+    lockName   = "lock"
+    headerSize = 8 // record length + crc32, both uint32 big endian
+    maxRecord  = 64 << 20
+)
+
+var ErrFull = errors.New("Spool is full")
+
+// ErrLocked is returned by Open when another process has the spool open, e.g. ami-reader replay run in the
+// working directory of ami-reader run.
+var ErrLocked = errors.New("Spool is in use by another process, each process needs its own SPOOL_DIR")
+
+// Position points right after a record in the spool.
+type Position struct {
+    Segment uint64
+    Offset  int64
+}
+
+// Spool is a durable FIFO of records kept in append only segment files. Records are read in the order
+// they were appended and stay on disk until committed. The committed position is kept in the cursor
+// file so pending records survive a restart. Segments that are fully committed are deleted.
+type Spool struct {
+    dir         string
+    segmentSize int64
+    maxSize     int64
+    syncWrites  bool
+    mutex       sync.Mutex
+    segments    []uint64
+    writer      *os.File
+    writeOffset int64
+    size        int64
+    pending     int64
+    committed   Position
+    read        Position
+    reader      *os.File
+    // lock is the lock file held while the spool is open, see ErrLocked
+    lock *os.File
+}
+
+// Open opens or creates the spool in dir. A segment is rotated once it grows beyond segmentSize.
+// Appends are rejected with ErrFull when the segments on disk exceed maxSize, zero means no limit.
+// With syncWrites every append is flushed to disk before it returns. A spool can only be open in one process
+// at a time, Open fails with ErrLocked otherwise.
+func Open(dir string, segmentSize int64, maxSize int64, syncWrites bool) (*Spool, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, errors.Wrap(err, fmt.Sprintf("Failed to create spool directory %s.", dir))
+    }
+    lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_CREATE|os.O_RDWR, 0644)
+    if err != nil {
+        return nil, errors.Wrap(err, fmt.Sprintf("Failed to open lock file of spool directory %s.", dir))
+    }
+    if err = lockFile(lock); err != nil {
+        _ = lock.Close()
+        return nil, errors.Wrap(err, fmt.Sprintf("Failed to lock spool directory %s.", dir))
+    }
+    spool, err := open(dir, segmentSize, maxSize, syncWrites)
+    if err != nil {
+        _ = lock.Close()
+        return nil, err
+    }
+    spool.lock = lock
+    return spool, nil
+}
+
+func open(dir string, segmentSize int64, maxSize int64, syncWrites bool) (*Spool, error) {
+    spool := &Spool{dir: dir, segmentSize: segmentSize, maxSize: maxSize, syncWrites: syncWrites}
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    for _, file := range files {
+        if !strings.HasSuffix(file.Name(), segmentExt) {
+            continue
+        }
+        id, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentExt), 10, 64)
+        if err != nil {
+            continue
+        }
+        spool.segments = append(spool.segments, id)
+        spool.size += file.Size()
+    }
+    sort.Slice(spool.segments, func(i, j int) bool { return spool.segments[i] < spool.segments[j] })
+    if len(spool.segments) == 0 {
+        spool.segments = append(spool.segments, 1)
+    }
+    if err := spool.readCursor(); err != nil {
+        return nil, err
+    }
+    if err := spool.recover(); err != nil {
+        return nil, err
+    }
+    last := spool.segments[len(spool.segments)-1]
+    writer, err := os.OpenFile(spool.segmentPath(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    info, err := writer.Stat()
+    if err != nil {
+        _ = writer.Close()
+        return nil, err
+    }
+    spool.writer = writer
+    spool.writeOffset = info.Size()
+    spool.read = spool.committed
+    return spool, nil
+}
+
+func (spool *Spool) segmentPath(id uint64) string {
+    return filepath.Join(spool.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+func (spool *Spool) readCursor() error {
+    spool.committed = Position{Segment: spool.segments[0]}
+    data, err := ioutil.ReadFile(filepath.Join(spool.dir, cursorFile))
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    var cursor Position
+    if _, err := fmt.Sscanf(string(data), "%d %d", &cursor.Segment, &cursor.Offset); err != nil {
+        return errors.Wrap(err, "Invalid spool cursor.")
+    }
+    // Ignore a cursor pointing to a segment that is not on disk anymore
+    for _, id := range spool.segments {
+        if id == cursor.Segment {
+            spool.committed = cursor
+        }
+    }
+    return nil
+}
+
+// recover counts the pending records and truncates every segment at its last valid record, dropping a record
+// left half written by a crash as well as what follows a corrupted record, so damage to one segment does not
+// keep the spool from opening. The records lost are logged.
+func (spool *Spool) recover() error {
+    for i, id := range spool.segments {
+        if id < spool.committed.Segment {
+            continue
+        }
+        file, err := os.OpenFile(spool.segmentPath(id), os.O_CREATE|os.O_RDWR, 0644)
+        if err != nil {
+            return err
+        }
+        var offset int64
+        if id == spool.committed.Segment {
+            offset = spool.committed.Offset
+        }
+        if _, err = file.Seek(offset, io.SeekStart); err != nil {
+            _ = file.Close()
+            return err
+        }
+        for {
+            _, err = readRecord(file)
+            if err != nil {
+                break
+            }
+            offset, _ = file.Seek(0, io.SeekCurrent)
+            spool.pending++
+        }
+        if err != io.EOF {
+            if info, statErr := file.Stat(); statErr == nil {
+                lost := info.Size() - offset
+                spool.size -= lost
+                // A crash while appending only leaves a partial record at the end of the segment being written
+                if i < len(spool.segments)-1 {
+                    log.Errorf("Spool segment %s is damaged (%v), dropped %d bytes after offset %d.", spool.segmentPath(id), err, lost, offset)
+                } else {
+                    log.Warnf("Spool segment %s ends with an invalid record (%v), dropped %d bytes after offset %d.", spool.segmentPath(id), err, lost, offset)
+                }
+            }
+            err = file.Truncate(offset)
+        } else {
+            err = nil
+        }
+        closeErr := file.Close()
+        if err != nil {
+            return errors.Wrap(err, fmt.Sprintf("Failed to recover spool segment %s.", spool.segmentPath(id)))
+        }
+        if closeErr != nil {
+            return closeErr
+        }
+    }
+    return nil
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+    header := make([]byte, headerSize)
+    if _, err := io.ReadFull(r, header); err != nil {
+        if err == io.ErrUnexpectedEOF {
+            return nil, errors.New("Truncated record header")
+        }
+        return nil, err
+    }
+    length := binary.BigEndian.Uint32(header[:4])
+    if length > maxRecord {
+        return nil, errors.New("Corrupted record header")
+    }
+    record := make([]byte, length)
+    if _, err := io.ReadFull(r, record); err != nil {
+        return nil, errors.New("Truncated record")
+    }
+    if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:]) {
+        return nil, errors.New("Corrupted record")
+    }
+    return record, nil
+}
+
+// Append writes a record at the end of the spool.
+func (spool *Spool) Append(record []byte) error {
+    spool.mutex.Lock()
+    defer spool.mutex.Unlock()
+    if spool.writer == nil {
+        return os.ErrClosed
+    }
+    recordSize := int64(headerSize + len(record))
+    if spool.maxSize > 0 && spool.size+recordSize > spool.maxSize {
+        return ErrFull
+    }
+    if spool.writeOffset > 0 && spool.writeOffset+recordSize > spool.segmentSize {
+        if err := spool.rotate(); err != nil {
+            return err
+        }
+    }
+    buf := make([]byte, recordSize)
+    binary.BigEndian.PutUint32(buf[:4], uint32(len(record)))
+    binary.BigEndian.PutUint32(buf[4:headerSize], crc32.ChecksumIEEE(record))
+    copy(buf[headerSize:], record)
+    if _, err := spool.writer.Write(buf); err != nil {
+        return err
+    }
+    if spool.syncWrites {
+        if err := spool.writer.Sync(); err != nil {
+            return err
+        }
+    }
+    spool.writeOffset += recordSize
+    spool.size += recordSize
+    spool.pending++
+    return nil
+}
+
+func (spool *Spool) rotate() error {
+    if err := spool.writer.Sync(); err != nil {
+        return err
+    }
+    if err := spool.writer.Close(); err != nil {
+        return err
+    }
+    next := spool.segments[len(spool.segments)-1] + 1
+    writer, err := os.OpenFile(spool.segmentPath(next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        spool.writer = nil
+        return err
+    }
+    spool.segments = append(spool.segments, next)
+    spool.writer = writer
+    spool.writeOffset = 0
+    return nil
+}
+
+// Next returns the record after the last one read and the position to commit once it is acknowledged.
+// io.EOF is returned when every record has been read.
+func (spool *Spool) Next() ([]byte, Position, error) {
+    spool.mutex.Lock()
+    defer spool.mutex.Unlock()
+    for {
+        if spool.reader == nil {
+            reader, err := os.Open(spool.segmentPath(spool.read.Segment))
+            if err != nil {
+                return nil, spool.read, err
+            }
+            if _, err = reader.Seek(spool.read.Offset, io.SeekStart); err != nil {
+                _ = reader.Close()
+                return nil, spool.read, err
+            }
+            spool.reader = reader
+        }
+        record, err := readRecord(spool.reader)
+        if err == nil {
+            spool.read.Offset += int64(headerSize + len(record))
+            return record, spool.read, nil
+        }
+        if err != io.EOF {
+            return nil, spool.read, err
+        }
+        if spool.read.Segment >= spool.segments[len(spool.segments)-1] {
+            // Reached the segment being written, reopen on the next call to see new records
+            spool.closeReader()
+            return nil, spool.read, io.EOF
+        }
+        spool.closeReader()
+        spool.read = Position{Segment: spool.read.Segment + 1}
+    }
+}
+
+// Commit acknowledges every record up to pos and deletes the segments that are no longer needed.
+func (spool *Spool) Commit(pos Position) error {
+    spool.mutex.Lock()
+    defer spool.mutex.Unlock()
+    committed, err := spool.countRecords(spool.committed, pos)
+    if err != nil {
+        return err
+    }
+    tmpFile := filepath.Join(spool.dir, cursorFile+".tmp")
+    if err := ioutil.WriteFile(tmpFile, []byte(fmt.Sprintf("%d %d", pos.Segment, pos.Offset)), 0644); err != nil {
+        return err
+    }
+    if err := os.Rename(tmpFile, filepath.Join(spool.dir, cursorFile)); err != nil {
+        return err
+    }
+    spool.committed = pos
+    spool.pending -= committed
+    for len(spool.segments) > 1 && spool.segments[0] < pos.Segment {
+        path := spool.segmentPath(spool.segments[0])
+        if info, err := os.Stat(path); err == nil {
+            spool.size -= info.Size()
+        }
+        if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        spool.segments = spool.segments[1:]
+    }
+    return nil
+}
+
+// countRecords counts the records between two positions by walking their headers.
+func (spool *Spool) countRecords(from Position, to Position) (int64, error) {
+    var count int64
+    for segment := from.Segment; segment <= to.Segment; segment++ {
+        file, err := os.Open(spool.segmentPath(segment))
+        if err != nil {
+            return count, err
+        }
+        offset := int64(0)
+        if segment == from.Segment {
+            offset = from.Offset
+        }
+        end := int64(-1)
+        if segment == to.Segment {
+            end = to.Offset
+        }
+        header := make([]byte, headerSize)
+        for end < 0 || offset < end {
+            if _, err = file.ReadAt(header, offset); err != nil {
+                break
+            }
+            offset += int64(headerSize) + int64(binary.BigEndian.Uint32(header[:4]))
+            count++
+        }
+        _ = file.Close()
+    }
+    return count, nil
+}
+
+// Rewind makes Next start again from the last committed position.
+func (spool *Spool) Rewind() {
+    spool.mutex.Lock()
+    defer spool.mutex.Unlock()
+    spool.closeReader()
+    spool.read = spool.committed
+}
+
+// Pending returns the number of records not committed yet.
+func (spool *Spool) Pending() int64 {
+    spool.mutex.Lock()
+    defer spool.mutex.Unlock()
+    return spool.pending
+}
+
+func (spool *Spool) closeReader() {
+    if spool.reader != nil {
+        _ = spool.reader.Close()
+        spool.reader = nil
+    }
+}
+
+func (spool *Spool) Close() error {
+    spool.mutex.Lock()
+    defer spool.mutex.Unlock()
+    spool.closeReader()
+    if spool.writer == nil {
+        return nil
+    }
+    writer := spool.writer
+    spool.writer = nil
+    // Released once the segment is synced, another process may open the spool then
+    defer spool.lock.Close()
+    if err := writer.Sync(); err != nil {
+        _ = writer.Close()
+        return err
+    }
+    return writer.Close()
+}
@@ -0,0 +1,221 @@
+package spool
+
+import (
+    "fmt"
+    "github.com/pkg/errors"
+    "io"
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+func openSpool(t *testing.T, dir string, segmentSize int64, maxSize int64) *Spool {
+    t.Helper()
+    spool, err := Open(dir, segmentSize, maxSize, false)
+    if err != nil {
+        t.Fatalf("Open: %v", err)
+    }
+    return spool
+}
+
+func appendRecords(t *testing.T, spool *Spool, records ...string) {
+    t.Helper()
+    for _, record := range records {
+        if err := spool.Append([]byte(record)); err != nil {
+            t.Fatalf("Append %s: %v", record, err)
+        }
+    }
+}
+
+// readAll reads every record left and returns them with the position after the last one.
+func readAll(t *testing.T, spool *Spool) ([]string, Position) {
+    t.Helper()
+    var records []string
+    var last Position
+    for {
+        record, pos, err := spool.Next()
+        if err == io.EOF {
+            return records, last
+        }
+        if err != nil {
+            t.Fatalf("Next: %v", err)
+        }
+        records = append(records, string(record))
+        last = pos
+    }
+}
+
+func assertRecords(t *testing.T, got []string, want ...string) {
+    t.Helper()
+    if fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Fatalf("records = %v, want %v", got, want)
+    }
+}
+
+func TestSpoolReadsInOrderAcrossSegments(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "spool")
+    defer os.RemoveAll(dir)
+    spool := openSpool(t, dir, 32, 0)
+    defer spool.Close()
+    appendRecords(t, spool, "one", "two", "three", "four", "five")
+    if len(spool.segments) < 2 {
+        t.Fatalf("segments = %d, want a rotation", len(spool.segments))
+    }
+    records, _ := readAll(t, spool)
+    assertRecords(t, records, "one", "two", "three", "four", "five")
+    if pending := spool.Pending(); pending != 5 {
+        t.Fatalf("Pending = %d, want 5", pending)
+    }
+}
+
+func TestSpoolKeepsUncommittedRecordsAcrossRestart(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "spool")
+    defer os.RemoveAll(dir)
+    spool := openSpool(t, dir, 32, 0)
+    appendRecords(t, spool, "one", "two", "three", "four")
+    _, pos, _ := spool.Next()
+    _, pos, _ = spool.Next()
+    if err := spool.Commit(pos); err != nil {
+        t.Fatalf("Commit: %v", err)
+    }
+    if pending := spool.Pending(); pending != 2 {
+        t.Fatalf("Pending = %d, want 2", pending)
+    }
+    _ = spool.Close()
+
+    spool = openSpool(t, dir, 32, 0)
+    defer spool.Close()
+    if pending := spool.Pending(); pending != 2 {
+        t.Fatalf("Pending after restart = %d, want 2", pending)
+    }
+    records, _ := readAll(t, spool)
+    assertRecords(t, records, "three", "four")
+}
+
+func TestSpoolRewind(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "spool")
+    defer os.RemoveAll(dir)
+    spool := openSpool(t, dir, 1024, 0)
+    defer spool.Close()
+    appendRecords(t, spool, "one", "two")
+    readAll(t, spool)
+    spool.Rewind()
+    records, _ := readAll(t, spool)
+    assertRecords(t, records, "one", "two")
+}
+
+func TestSpoolCommitDeletesReadSegments(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "spool")
+    defer os.RemoveAll(dir)
+    spool := openSpool(t, dir, 16, 0)
+    defer spool.Close()
+    appendRecords(t, spool, "one", "two", "three")
+    _, last := readAll(t, spool)
+    if err := spool.Commit(last); err != nil {
+        t.Fatalf("Commit: %v", err)
+    }
+    if len(spool.segments) != 1 {
+        t.Fatalf("segments = %v, want only the one being written", spool.segments)
+    }
+    if pending := spool.Pending(); pending != 0 {
+        t.Fatalf("Pending = %d, want 0", pending)
+    }
+}
+
+func TestSpoolFull(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "spool")
+    defer os.RemoveAll(dir)
+    spool := openSpool(t, dir, 1024, 2*(headerSize+3))
+    defer spool.Close()
+    appendRecords(t, spool, "one", "two")
+    if err := spool.Append([]byte("six")); err != ErrFull {
+        t.Fatalf("Append = %v, want ErrFull", err)
+    }
+}
+
+func TestSpoolRecover(t *testing.T) {
+    tests := []struct {
+        name string
+        // damage changes the segment files once the records are written
+        damage func(spool *Spool)
+        want   []string
+    }{
+        {
+            name:   "intact",
+            damage: func(spool *Spool) {},
+            want:   []string{"one", "two", "three", "four", "five", "six"},
+        },
+        {
+            name: "half written last record",
+            damage: func(spool *Spool) {
+                last := spool.segmentPath(spool.segments[len(spool.segments)-1])
+                file, _ := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+                _, _ = file.Write([]byte{0, 0, 0, 9, 1, 2})
+                _ = file.Close()
+            },
+            want: []string{"one", "two", "three", "four", "five", "six"},
+        },
+        {
+            name: "corrupted record in the first segment",
+            damage: func(spool *Spool) {
+                // Flips a byte of the second record of the first segment
+                first := spool.segmentPath(spool.segments[0])
+                file, _ := os.OpenFile(first, os.O_WRONLY, 0644)
+                _, _ = file.WriteAt([]byte("X"), headerSize+3+headerSize)
+                _ = file.Close()
+            },
+            want: []string{"one", "three", "four", "five", "six"},
+        },
+        {
+            name: "corrupted header in the middle segment",
+            damage: func(spool *Spool) {
+                middle := spool.segmentPath(spool.segments[1])
+                file, _ := os.OpenFile(middle, os.O_WRONLY, 0644)
+                _, _ = file.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+                _ = file.Close()
+            },
+            want: []string{"one", "two", "five", "six"},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            dir, _ := ioutil.TempDir("", "spool")
+            defer os.RemoveAll(dir)
+            // Two records per segment
+            spool := openSpool(t, dir, 2*(headerSize+5), 0)
+            appendRecords(t, spool, "one", "two", "three", "four", "five", "six")
+            _ = spool.Close()
+            test.damage(spool)
+
+            spool = openSpool(t, dir, 2*(headerSize+5), 0)
+            defer spool.Close()
+            if pending := spool.Pending(); pending != int64(len(test.want)) {
+                t.Fatalf("Pending = %d, want %d", pending, len(test.want))
+            }
+            records, _ := readAll(t, spool)
+            assertRecords(t, records, test.want...)
+            appendRecords(t, spool, "seven")
+            records, _ = readAll(t, spool)
+            assertRecords(t, records, "seven")
+        })
+    }
+}
+
+func TestSpoolIsLockedWhileOpen(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "spool")
+    defer os.RemoveAll(dir)
+    spool := openSpool(t, dir, 1<<20, 0)
+    appendRecords(t, spool, "a")
+    // e.g. ami-reader replay opening the spool of a running ami-reader run
+    if _, err := Open(dir, 1<<20, 0, false); errors.Cause(err) != ErrLocked {
+        t.Fatalf("Open of an open spool: %v, want ErrLocked", err)
+    }
+    if err := spool.Close(); err != nil {
+        t.Fatal(err)
+    }
+    reopened := openSpool(t, dir, 1<<20, 0)
+    defer reopened.Close()
+    if records, _ := readAll(t, reopened); len(records) != 1 {
+        t.Fatalf("read %v after the spool was reopened, want a", records)
+    }
+}
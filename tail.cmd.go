@@ -0,0 +1,160 @@
+package main
+
+import (
+	"ami-reader/conf"
+	"ami-reader/service"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/pflag"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const tailUsage = `Usage: ami-reader tail [flags]
+
+Prints live AMI events, as AMI sends them once REDACT rules are applied. Events are not handed to the sinks.
+
+Examples:
+  ami-reader tail --event 'Dial*' --event Hangup
+  ami-reader tail --match Channel='PJSIP/1001-*' --json
+
+Flags:
+`
+
+func runTail(args []string) int {
+	flags := pflag.NewFlagSet("tail", pflag.ContinueOnError)
+	events := flags.StringSlice("event", nil, "Print only these events, names or patterns (*, ?, [...])")
+	matches := flags.StringSlice("match", nil, "Print only events with a field matching a pattern, e.g. Channel='PJSIP/*'. Repeat to require several")
+	asJson := flags.Bool("json", false, "Print an event per line as a JSON object")
+	count := flags.Int("count", 0, "Stop after printing that many events, 0 for no limit")
+	conf.RegisterFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, tailUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	fieldPatterns, err := parseFieldPatterns(*matches)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	patterns := append([]string{}, *events...)
+	for _, pattern := range fieldPatterns {
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid pattern %s: %v\n", pattern, err)
+			return 2
+		}
+	}
+	amiConfig, err := loadAmiConfig(flags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	client, err := service.DialAmi(amiConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer client.Close()
+	if err = client.Login(*amiConfig.AmiUsername, *amiConfig.AmiPassword, true); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to login to Asterisk: %v\n", err)
+		return 1
+	}
+	var interrupted int32
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		<-signalChan
+		atomic.StoreInt32(&interrupted, 1)
+		client.Interrupt()
+	}()
+	for printed := 0; *count == 0 || printed < *count; {
+		message, err := client.Read(0)
+		if err != nil {
+			if atomic.LoadInt32(&interrupted) == 1 {
+				return 0
+			}
+			fmt.Fprintf(os.Stderr, "Failed to read events: %v\n", err)
+			return 1
+		}
+		name := message.Get("Event")
+		if name == "" || !matchesPatterns(*events, name) {
+			continue
+		}
+		event := message.Map()
+		if !matchesFields(fieldPatterns, event) {
+			continue
+		}
+		amiConfig.Redactor.Redact(event)
+		if *asJson {
+			line, _ := json.Marshal(event)
+			fmt.Println(string(line))
+		} else {
+			printEvent(message, event)
+		}
+		printed++
+	}
+	return 0
+}
+
+// parseFieldPatterns reads --match values, field=pattern.
+func parseFieldPatterns(matches []string) (map[string]string, error) {
+	fieldPatterns := make(map[string]string)
+	for _, match := range matches {
+		i := strings.Index(match, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid --match %s, expected field=pattern", match)
+		}
+		fieldPatterns[match[:i]] = match[i+1:]
+	}
+	return fieldPatterns, nil
+}
+
+// matchesPatterns tells whether a name matches one of patterns, no pattern matching every name.
+func matchesPatterns(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFields tells whether every field of fieldPatterns is in the event and matches its pattern.
+func matchesFields(fieldPatterns map[string]string, event map[string]string) bool {
+	for field, pattern := range fieldPatterns {
+		value, found := event[field]
+		if matched, _ := path.Match(pattern, value); !found || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// printEvent prints the fields of an event in the order AMI sent them, leaving out those redacted away.
+func printEvent(message service.AmiMessage, event map[string]string) {
+	var out strings.Builder
+	out.WriteString(time.Now().Format("15:04:05.000") + " " + event["Event"] + "\n")
+	printed := make(map[string]bool)
+	for _, field := range message {
+		value, found := event[field.Key]
+		if field.Key == "Event" || !found || printed[field.Key] {
+			continue
+		}
+		printed[field.Key] = true
+		out.WriteString("    " + field.Key + ": " + value + "\n")
+	}
+	fmt.Println(out.String())
+}
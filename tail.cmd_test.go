@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFieldPatterns(t *testing.T) {
+	fieldPatterns, err := parseFieldPatterns([]string{"Channel=PJSIP/*", "Context=from=trunk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Channel": "PJSIP/*", "Context": "from=trunk"}
+	if !reflect.DeepEqual(fieldPatterns, want) {
+		t.Errorf("parseFieldPatterns = %v, want %v", fieldPatterns, want)
+	}
+	for _, match := range []string{"Channel", "=PJSIP/*"} {
+		if _, err = parseFieldPatterns([]string{match}); err == nil {
+			t.Errorf("parseFieldPatterns accepted %s", match)
+		}
+	}
+}
+
+func TestMatchesPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{nil, "Hangup", true},
+		{[]string{"Hangup"}, "Hangup", true},
+		{[]string{"Hangup"}, "HangupRequest", false},
+		{[]string{"Dial*", "Hangup"}, "DialBegin", true},
+		{[]string{"Dial*", "Hangup"}, "Newchannel", false},
+		{[]string{"Agent?alled"}, "AgentCalled", true},
+	}
+	for _, test := range tests {
+		if got := matchesPatterns(test.patterns, test.name); got != test.want {
+			t.Errorf("matchesPatterns(%v, %s) = %v, want %v", test.patterns, test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchesFields(t *testing.T) {
+	event := map[string]string{"Event": "Newchannel", "Channel": "PJSIP/1001-00000001", "Context": ""}
+	tests := []struct {
+		fieldPatterns map[string]string
+		want          bool
+	}{
+		{nil, true},
+		{map[string]string{"Channel": "PJSIP/*"}, true},
+		{map[string]string{"Channel": "PJSIP/*", "Event": "Hangup"}, false},
+		{map[string]string{"Channel": "SIP/*"}, false},
+		{map[string]string{"Context": ""}, true},
+		{map[string]string{"Context": "*"}, true},
+		// Field names are as AMI sends them
+		{map[string]string{"channel": "*"}, false},
+		{map[string]string{"Linkedid": "*"}, false},
+	}
+	for _, test := range tests {
+		if got := matchesFields(test.fieldPatterns, event); got != test.want {
+			t.Errorf("matchesFields(%v) = %v, want %v", test.fieldPatterns, got, test.want)
+		}
+	}
+}
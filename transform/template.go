@@ -0,0 +1,71 @@
+package transform
+
+import (
+    "github.com/pkg/errors"
+    "strings"
+)
+
+type templatePart struct {
+    literal    string
+    field      string
+    defaultVal string
+}
+
+// Template renders text such as {{host_device_id}}.{{Event}}.{{Context|none}}. A field missing
+// from the event renders as its default, the text after "|", or as an empty string. Field names are not case
+// sensitive, as in the steps of the pipeline.
+type Template []templatePart
+
+func ParseTemplate(template string) (Template, error) {
+    var parts Template
+    rest := template
+    for rest != "" {
+        start := strings.Index(rest, "{{")
+        if start < 0 {
+            if strings.Contains(rest, "}}") {
+                return nil, errors.Errorf("Unexpected }} in template %s", template)
+            }
+            parts = append(parts, templatePart{literal: rest})
+            break
+        }
+        if strings.Contains(rest[:start], "}}") {
+            return nil, errors.Errorf("Unexpected }} in template %s", template)
+        }
+        if start > 0 {
+            parts = append(parts, templatePart{literal: rest[:start]})
+        }
+        end := strings.Index(rest[start:], "}}")
+        if end < 0 {
+            return nil, errors.Errorf("Missing }} in template %s", template)
+        }
+        field := rest[start+2 : start+end]
+        defaultVal := ""
+        if i := strings.Index(field, "|"); i >= 0 {
+            field, defaultVal = field[:i], field[i+1:]
+        }
+        field = strings.TrimSpace(field)
+        if field == "" || strings.Contains(field, "{{") {
+            return nil, errors.Errorf("Invalid field in template %s", template)
+        }
+        parts = append(parts, templatePart{field: field, defaultVal: defaultVal})
+        rest = rest[start+end+2:]
+    }
+    if len(parts) == 0 {
+        return nil, errors.New("Template is empty")
+    }
+    return parts, nil
+}
+
+func (template Template) Execute(event map[string]string) string {
+    var key strings.Builder
+    for _, part := range template {
+        if part.field == "" {
+            key.WriteString(part.literal)
+        } else if value, found := Field(event, part.field); found && value != "" {
+            key.WriteString(value)
+        } else {
+            key.WriteString(part.defaultVal)
+        }
+    }
+    return key.String()
+}
@@ -0,0 +1,277 @@
+package transform
+
+import (
+    "fmt"
+    "github.com/pkg/errors"
+    "path"
+    "strconv"
+    "strings"
+)
+
+const (
+    ActionRename = "rename"
+    ActionDrop   = "drop"
+    ActionSet    = "set"
+    ActionDiff   = "diff"
+    ActionCoerce = "coerce"
+)
+
+// StepConf is one step of the pipeline, applied to the events its events patterns match.
+type StepConf struct {
+    Action string `mapstructure:"action" json:"action"`
+    // Event names or patterns (*, ?, [...]). No events means every event.
+    Events []string `mapstructure:"events" json:"events"`
+    // Fields the step reads. Not case sensitive.
+    Fields []string `mapstructure:"fields" json:"fields"`
+    // Field the step writes, for rename, set and diff
+    To string `mapstructure:"to" json:"to"`
+    // Constant value or template of set
+    Value    string `mapstructure:"value" json:"value"`
+    Template string `mapstructure:"template" json:"template"`
+    // Type of coerce
+    Type string `mapstructure:"type" json:"type"`
+}
+
+// FieldTypes are the types fields were coerced to, by field name. Field names are not case sensitive.
+type FieldTypes map[string]string
+
+// Typer returns the types the fields of an event were coerced to.
+type Typer interface {
+    TypesOf(event map[string]string) FieldTypes
+}
+
+// TypesOf returns the same types for every event.
+func (types FieldTypes) TypesOf(event map[string]string) FieldTypes {
+    return types
+}
+
+// Of returns the type of a field, an empty string when it is not coerced.
+func (types FieldTypes) Of(field string) string {
+    if fieldType, found := types[field]; found {
+        return fieldType
+    }
+    return types[strings.ToLower(field)]
+}
+
+type step struct {
+    action    string
+    events    []string
+    fields    []string
+    to        string
+    value     string
+    template  Template
+    fieldType string
+}
+
+func (step *step) matches(event map[string]string) bool {
+    if len(step.events) == 0 {
+        return true
+    }
+    for _, pattern := range step.events {
+        if matched, _ := path.Match(pattern, event["Event"]); matched {
+            return true
+        }
+    }
+    return false
+}
+
+// Pipeline renames, drops, sets, computes and coerces event fields with steps applied in order. Values stay
+// strings in the event, coerced ones in the canonical form of their type, and are typed when serialized.
+type Pipeline struct {
+    steps []step
+    // typesOnly keeps the steps to type fields with, without applying them, see WithoutSteps
+    typesOnly bool
+}
+
+func New(steps []StepConf) (*Pipeline, error) {
+    pipeline := &Pipeline{}
+    for i, stepConf := range steps {
+        name := fmt.Sprintf("TRANSFORM[%d]", i)
+        compiled := step{action: stepConf.Action, events: stepConf.Events, fields: stepConf.Fields, to: stepConf.To, value: stepConf.Value, fieldType: stepConf.Type}
+        for _, pattern := range stepConf.Events {
+            if _, err := path.Match(pattern, ""); err != nil {
+                return nil, errors.Wrap(err, fmt.Sprintf("Invalid event pattern %s in %s.", pattern, name))
+            }
+        }
+        switch stepConf.Action {
+        case ActionRename:
+            if len(stepConf.Fields) != 1 || stepConf.To == "" {
+                return nil, errors.Errorf("%s should rename one field to another", name)
+            }
+        case ActionDrop:
+            if len(stepConf.Fields) == 0 {
+                return nil, errors.Errorf("Missing fields in %s", name)
+            }
+            compiled.fields = nil
+            for _, field := range stepConf.Fields {
+                if _, err := path.Match(field, ""); err != nil {
+                    return nil, errors.Wrap(err, fmt.Sprintf("Invalid field pattern %s in %s.", field, name))
+                }
+                compiled.fields = append(compiled.fields, strings.ToLower(field))
+            }
+        case ActionSet:
+            if stepConf.To == "" || (stepConf.Value == "") == (stepConf.Template == "") {
+                return nil, errors.Errorf("%s should set a field to either a value or a template", name)
+            }
+            if stepConf.Template != "" {
+                template, err := ParseTemplate(stepConf.Template)
+                if err != nil {
+                    return nil, errors.Wrap(err, fmt.Sprintf("Invalid template in %s.", name))
+                }
+                compiled.template = template
+            }
+        case ActionDiff:
+            if len(stepConf.Fields) != 2 || stepConf.To == "" {
+                return nil, errors.Errorf("%s should set a field to the difference of two fields", name)
+            }
+        case ActionCoerce:
+            if len(stepConf.Fields) == 0 {
+                return nil, errors.Errorf("Missing fields in %s", name)
+            }
+            if !isType(stepConf.Type) {
+                return nil, errors.Errorf("Unknown type %s in %s. Available types: %v", stepConf.Type, name, types)
+            }
+        default:
+            return nil, errors.Errorf("Unknown action %s in %s, expected %s, %s, %s, %s or %s", stepConf.Action, name, ActionRename, ActionDrop, ActionSet, ActionDiff, ActionCoerce)
+        }
+        pipeline.steps = append(pipeline.steps, compiled)
+    }
+    return pipeline, nil
+}
+
+// Empty tells whether the pipeline leaves events as they are.
+func (pipeline *Pipeline) Empty() bool {
+    return pipeline.typesOnly || len(pipeline.steps) == 0
+}
+
+// WithoutSteps keeps the field types only, for events that went through the pipeline already.
+func (pipeline *Pipeline) WithoutSteps() *Pipeline {
+    return &Pipeline{steps: pipeline.steps, typesOnly: true}
+}
+
+// TypesOf returns the types the steps coerced the fields of a transformed event to. They follow the fields as
+// the steps run: a renamed field keeps its type, a field set or dropped afterwards loses it. Steps are matched
+// by the name the event has once transformed.
+func (pipeline *Pipeline) TypesOf(event map[string]string) FieldTypes {
+    types := make(FieldTypes)
+    if pipeline == nil {
+        return types
+    }
+    for i := range pipeline.steps {
+        step := &pipeline.steps[i]
+        if !step.matches(event) {
+            continue
+        }
+        switch step.action {
+        case ActionRename:
+            from, to := strings.ToLower(step.fields[0]), strings.ToLower(step.to)
+            fieldType, found := types[from]
+            delete(types, from)
+            delete(types, to)
+            if found {
+                types[to] = fieldType
+            }
+        case ActionDrop:
+            for field := range types {
+                for _, pattern := range step.fields {
+                    if matched, _ := path.Match(pattern, field); matched {
+                        delete(types, field)
+                        break
+                    }
+                }
+            }
+        case ActionSet:
+            delete(types, strings.ToLower(step.to))
+        case ActionDiff:
+            types[strings.ToLower(step.to)] = TypeFloat
+        case ActionCoerce:
+            for _, field := range step.fields {
+                types[strings.ToLower(field)] = step.fieldType
+            }
+        }
+    }
+    return types
+}
+
+// Apply transforms an event in place and returns the number of values that could not be coerced, which are left as they were.
+func (pipeline *Pipeline) Apply(event map[string]string) int {
+    if pipeline.typesOnly {
+        return 0
+    }
+    failed := 0
+    for i := range pipeline.steps {
+        step := &pipeline.steps[i]
+        if !step.matches(event) {
+            continue
+        }
+        switch step.action {
+        case ActionRename:
+            if key, found := lookup(event, step.fields[0]); found {
+                value := event[key]
+                delete(event, key)
+                event[step.to] = value
+            }
+        case ActionDrop:
+            for key := range event {
+                lowerKey := strings.ToLower(key)
+                for _, pattern := range step.fields {
+                    if matched, _ := path.Match(pattern, lowerKey); matched {
+                        delete(event, key)
+                        break
+                    }
+                }
+            }
+        case ActionSet:
+            if step.template != nil {
+                event[step.to] = step.template.Execute(event)
+            } else {
+                event[step.to] = step.value
+            }
+        case ActionDiff:
+            from, fromFound := lookup(event, step.fields[0])
+            to, toFound := lookup(event, step.fields[1])
+            if !fromFound || !toFound {
+                continue
+            }
+            fromTime, fromOk := ParseTime(event[from])
+            toTime, toOk := ParseTime(event[to])
+            if !fromOk || !toOk {
+                failed++
+                continue
+            }
+            event[step.to] = strconv.FormatFloat(fromTime.Sub(toTime).Seconds(), 'f', -1, 64)
+        case ActionCoerce:
+            for _, field := range step.fields {
+                key, found := lookup(event, field)
+                if !found || event[key] == "" {
+                    continue
+                }
+                if coerced, ok := Coerce(event[key], step.fieldType); ok {
+                    event[key] = coerced
+                } else {
+                    failed++
+                }
+            }
+        }
+    }
+    return failed
+}
+
+// Field returns the value of a field whatever its case, see lookup.
+func Field(event map[string]string, field string) (string, bool) {
+    key, found := lookup(event, field)
+    return event[key], found
+}
+
+// lookup finds the key of a field whatever its case, AMI is not consistent, e.g. CallerIDNum and CallerIdNum.
+func lookup(event map[string]string, field string) (string, bool) {
+    if _, found := event[field]; found {
+        return field, true
+    }
+    for key := range event {
+        if strings.EqualFold(key, field) {
+            return key, true
+        }
+    }
+    return "", false
+}
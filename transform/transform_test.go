@@ -0,0 +1,248 @@
+package transform
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestPipelineApply(t *testing.T) {
+    tests := []struct {
+        name       string
+        steps      []StepConf
+        event      map[string]string
+        want       map[string]string
+        wantFailed int
+    }{
+        {
+            name:  "rename whatever the case",
+            steps: []StepConf{{Action: ActionRename, Fields: []string{"calleridnum"}, To: "caller"}},
+            event: map[string]string{"Event": "Newchannel", "CallerIDNum": "1001"},
+            want:  map[string]string{"Event": "Newchannel", "caller": "1001"},
+        },
+        {
+            name:  "drop by pattern",
+            steps: []StepConf{{Action: ActionDrop, Fields: []string{"ConnectedLine*", "Language"}}},
+            event: map[string]string{"Event": "Newchannel", "ConnectedLineNum": "1002", "ConnectedLineName": "Bob", "language": "en", "Exten": "100"},
+            want:  map[string]string{"Event": "Newchannel", "Exten": "100"},
+        },
+        {
+            name: "set a value and a template",
+            steps: []StepConf{
+                {Action: ActionSet, To: "source", Value: "pbx"},
+                {Action: ActionSet, To: "route", Template: "{{source}}.{{Event}}.{{Context|none}}"},
+            },
+            event: map[string]string{"Event": "Hangup"},
+            want:  map[string]string{"Event": "Hangup", "source": "pbx", "route": "pbx.Hangup.none"},
+        },
+        {
+            name:  "diff",
+            steps: []StepConf{{Action: ActionDiff, Fields: []string{"EndTime", "StartTime"}, To: "duration"}},
+            event: map[string]string{"Event": "Cdr", "StartTime": "2020-03-01 10:30:00", "EndTime": "2020-03-01 10:31:30"},
+            want:  map[string]string{"Event": "Cdr", "StartTime": "2020-03-01 10:30:00", "EndTime": "2020-03-01 10:31:30", "duration": "90"},
+        },
+        {
+            name:       "diff of an invalid time",
+            steps:      []StepConf{{Action: ActionDiff, Fields: []string{"EndTime", "StartTime"}, To: "duration"}},
+            event:      map[string]string{"Event": "Cdr", "StartTime": "later", "EndTime": "2020-03-01 10:31:30"},
+            want:       map[string]string{"Event": "Cdr", "StartTime": "later", "EndTime": "2020-03-01 10:31:30"},
+            wantFailed: 1,
+        },
+        {
+            name:       "coerce",
+            steps:      []StepConf{{Action: ActionCoerce, Fields: []string{"Cause", "Priority", "Billed"}, Type: TypeInt}},
+            event:      map[string]string{"Event": "Hangup", "Cause": " 16", "Priority": "1.0", "Billed": "yes", "Exten": "100"},
+            want:       map[string]string{"Event": "Hangup", "Cause": "16", "Priority": "1", "Billed": "yes", "Exten": "100"},
+            wantFailed: 1,
+        },
+        {
+            name: "steps of other events",
+            steps: []StepConf{
+                {Action: ActionDrop, Events: []string{"Var*"}, Fields: []string{"*"}},
+                {Action: ActionSet, Events: []string{"Hangup", "Newchannel"}, To: "seen", Value: "yes"},
+            },
+            event: map[string]string{"Event": "Hangup"},
+            want:  map[string]string{"Event": "Hangup", "seen": "yes"},
+        },
+        {
+            name: "steps in order",
+            steps: []StepConf{
+                {Action: ActionRename, Fields: []string{"Uniqueid"}, To: "call_id"},
+                {Action: ActionSet, To: "key", Template: "{{call_id}}/{{Uniqueid|gone}}"},
+            },
+            event: map[string]string{"Event": "Hangup", "Uniqueid": "1584011234.42"},
+            want:  map[string]string{"Event": "Hangup", "call_id": "1584011234.42", "key": "1584011234.42/gone"},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            pipeline, err := New(test.steps)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if failed := pipeline.Apply(test.event); failed != test.wantFailed {
+                t.Errorf("Apply failed on %d values, want %d", failed, test.wantFailed)
+            }
+            if !reflect.DeepEqual(test.event, test.want) {
+                t.Fatalf("Apply = %v, want %v", test.event, test.want)
+            }
+        })
+    }
+}
+
+func TestPipelineTypes(t *testing.T) {
+    pipeline, err := New([]StepConf{
+        {Action: ActionCoerce, Fields: []string{"Cause"}, Type: TypeInt},
+        {Action: ActionCoerce, Events: []string{"Cdr"}, Fields: []string{"Duration", "BillableSeconds"}, Type: TypeInt},
+        {Action: ActionRename, Events: []string{"Cdr"}, Fields: []string{"billableseconds"}, To: "billsec"},
+        {Action: ActionDiff, Events: []string{"Hangup"}, Fields: []string{"EndTime", "StartTime"}, To: "Duration"},
+        {Action: ActionSet, Events: []string{"Hangup"}, To: "Cause", Value: "normal"},
+        {Action: ActionDrop, Events: []string{"Cdr"}, Fields: []string{"dur*"}},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        event string
+        want  FieldTypes
+    }{
+        // A coerce step of Cdr events does not type the fields of other events
+        {"Newchannel", FieldTypes{"cause": TypeInt}},
+        // A renamed field keeps its type, a dropped one loses it
+        {"Cdr", FieldTypes{"cause": TypeInt, "billsec": TypeInt}},
+        // A field set after it was coerced loses its type
+        {"Hangup", FieldTypes{"duration": TypeFloat}},
+    }
+    for _, test := range tests {
+        types := pipeline.TypesOf(map[string]string{"Event": test.event})
+        if !reflect.DeepEqual(types, test.want) {
+            t.Errorf("types of %s = %v, want %v", test.event, types, test.want)
+        }
+    }
+    if got := pipeline.TypesOf(map[string]string{"Event": "Cdr"}).Of("BillSec"); got != TypeInt {
+        t.Errorf("type of BillSec = %q, want %q", got, TypeInt)
+    }
+    withoutSteps := pipeline.WithoutSteps()
+    event := map[string]string{"Event": "Cdr", "BillableSeconds": "12"}
+    if !withoutSteps.Empty() || withoutSteps.Apply(event) != 0 || event["BillableSeconds"] != "12" {
+        t.Error("WithoutSteps should not transform events")
+    }
+    if got := withoutSteps.TypesOf(map[string]string{"Event": "Cdr"}); !reflect.DeepEqual(got, tests[1].want) {
+        t.Errorf("WithoutSteps types of Cdr = %v, want %v", got, tests[1].want)
+    }
+}
+
+func TestNewFailsOnInvalidStep(t *testing.T) {
+    tests := []struct {
+        name string
+        step StepConf
+    }{
+        {"unknown action", StepConf{Action: "upper", Fields: []string{"Exten"}}},
+        {"invalid event pattern", StepConf{Action: ActionDrop, Events: []string{"[Hangup"}, Fields: []string{"Exten"}}},
+        {"rename of two fields", StepConf{Action: ActionRename, Fields: []string{"Exten", "Context"}, To: "to"}},
+        {"rename without target", StepConf{Action: ActionRename, Fields: []string{"Exten"}}},
+        {"drop without fields", StepConf{Action: ActionDrop}},
+        {"drop of an invalid pattern", StepConf{Action: ActionDrop, Fields: []string{"[Exten"}}},
+        {"set of both a value and a template", StepConf{Action: ActionSet, To: "to", Value: "a", Template: "{{Event}}"}},
+        {"set of neither", StepConf{Action: ActionSet, To: "to"}},
+        {"set of an invalid template", StepConf{Action: ActionSet, To: "to", Template: "{{Event"}},
+        {"diff of one field", StepConf{Action: ActionDiff, Fields: []string{"EndTime"}, To: "to"}},
+        {"coerce to an unknown type", StepConf{Action: ActionCoerce, Fields: []string{"Cause"}, Type: "decimal"}},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            if _, err := New([]StepConf{test.step}); err == nil {
+                t.Fatal("New accepted an invalid step")
+            }
+        })
+    }
+}
+
+func TestParseTemplate(t *testing.T) {
+    event := map[string]string{"host_device_id": "pbx1", "Event": "Hangup", "Context": ""}
+    tests := []struct {
+        template string
+        want     string
+        wantErr  bool
+    }{
+        {template: "{{host_device_id}}.{{Event}}.{{Context|none}}", want: "pbx1.Hangup.none"},
+        {template: "ami.{{ Event }}", want: "ami.Hangup"},
+        {template: "{{HOST_DEVICE_ID}}.{{event}}", want: "pbx1.Hangup"},
+        {template: "{{Missing}}-", want: "-"},
+        {template: "static", want: "static"},
+        {template: "", wantErr: true},
+        {template: "{{Event", wantErr: true},
+        {template: "Event}}", wantErr: true},
+        {template: "{{}}", wantErr: true},
+        {template: "{{a{{b}}", wantErr: true},
+    }
+    for _, test := range tests {
+        template, err := ParseTemplate(test.template)
+        if (err != nil) != test.wantErr {
+            t.Errorf("ParseTemplate(%q) error = %v, want error %v", test.template, err, test.wantErr)
+            continue
+        }
+        if err == nil && template.Execute(event) != test.want {
+            t.Errorf("%q rendered %q, want %q", test.template, template.Execute(event), test.want)
+        }
+    }
+}
+
+func TestCoerce(t *testing.T) {
+    tests := []struct {
+        value     string
+        fieldType string
+        want      string
+        wantOk    bool
+    }{
+        {"42", TypeInt, "42", true},
+        {"12.0", TypeInt, "12", true},
+        {"12.5", TypeInt, "12.5", false},
+        {"1e30", TypeInt, "1e30", false},
+        {"0.50", TypeFloat, "0.5", true},
+        {"NaN", TypeFloat, "NaN", false},
+        {"Yes", TypeBool, "true", true},
+        {"off", TypeBool, "false", true},
+        {"maybe", TypeBool, "maybe", false},
+        {"1583058600", TypeTimestamp, "2020-03-01T10:30:00Z", true},
+        {"1583058600.25", TypeTimestamp, "2020-03-01T10:30:00.25Z", true},
+        {"2020-03-01T11:30:00+01:00", TypeEpochMs, "1583058600000", true},
+        {"1583058600000000", TypeEpochMs, "1583058600000", true},
+        {"soon", TypeEpochMs, "soon", false},
+        {" as is ", TypeString, " as is ", true},
+    }
+    for _, test := range tests {
+        got, ok := Coerce(test.value, test.fieldType)
+        if got != test.want || ok != test.wantOk {
+            t.Errorf("Coerce(%q, %s) = %q, %v, want %q, %v", test.value, test.fieldType, got, ok, test.want, test.wantOk)
+        }
+    }
+}
+
+func TestParseTimeOfLocalTime(t *testing.T) {
+    got, ok := ParseTime("2020-03-01 10:30:00")
+    if want := time.Date(2020, 3, 1, 10, 30, 0, 0, time.Local); !ok || !got.Equal(want) {
+        t.Fatalf("ParseTime = %v, %v, want %v", got, ok, want)
+    }
+}
+
+func TestTyped(t *testing.T) {
+    tests := []struct {
+        value     string
+        fieldType string
+        want      interface{}
+    }{
+        {"42", TypeInt, int64(42)},
+        {"1583058600000", TypeEpochMs, int64(1583058600000)},
+        {"0.5", TypeFloat, 0.5},
+        {"true", TypeBool, true},
+        {"yes", TypeBool, "yes"},
+        {"12.5", TypeInt, "12.5"},
+        {"42", "", "42"},
+    }
+    for _, test := range tests {
+        if got := Typed(test.value, test.fieldType); got != test.want {
+            t.Errorf("Typed(%q, %s) = %#v, want %#v", test.value, test.fieldType, got, test.want)
+        }
+    }
+}
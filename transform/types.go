@@ -0,0 +1,126 @@
+package transform
+
+import (
+    "math"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Field types values can be coerced to
+const (
+    TypeString    = "string"
+    TypeInt       = "int"
+    TypeFloat     = "float"
+    TypeBool      = "bool"
+    TypeTimestamp = "timestamp" // RFC3339 with nanoseconds, UTC
+    TypeEpochMs   = "epoch_ms"  // milliseconds since January 1, 1970 UTC
+)
+
+var types = []string{TypeString, TypeInt, TypeFloat, TypeBool, TypeTimestamp, TypeEpochMs}
+
+func isType(fieldType string) bool {
+    for _, known := range types {
+        if known == fieldType {
+            return true
+        }
+    }
+    return false
+}
+
+// localTimeLayout is used by AMI and CDR fields such as StartTime
+const localTimeLayout = "2006-01-02 15:04:05"
+
+// ParseTime reads RFC3339 times, AMI local times and epoch times in seconds (with a fraction or not),
+// milliseconds, microseconds or nanoseconds, the unit being told apart by magnitude.
+func ParseTime(value string) (time.Time, bool) {
+    value = strings.TrimSpace(value)
+    if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+        switch abs := math.Abs(float64(epoch)); {
+        case abs >= 1e17:
+            return time.Unix(0, epoch), true
+        case abs >= 1e14:
+            return time.Unix(0, epoch*int64(time.Microsecond)), true
+        case abs >= 1e11:
+            return time.Unix(0, epoch*int64(time.Millisecond)), true
+        default:
+            return time.Unix(epoch, 0), true
+        }
+    }
+    if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+        sec, frac := math.Modf(seconds)
+        return time.Unix(int64(sec), int64(frac*1e9)), true
+    }
+    if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+        return parsed, true
+    }
+    if parsed, err := time.ParseInLocation(localTimeLayout, value, time.Local); err == nil {
+        return parsed, true
+    }
+    return time.Time{}, false
+}
+
+func parseBool(value string) (bool, bool) {
+    switch strings.ToLower(strings.TrimSpace(value)) {
+    case "1", "true", "yes", "on", "y", "t":
+        return true, true
+    case "0", "false", "no", "off", "n", "f":
+        return false, true
+    }
+    return false, false
+}
+
+// Coerce rewrites a value in the canonical form of a type. It returns false, leaving the value as is,
+// when the value can't be read as that type.
+func Coerce(value string, fieldType string) (string, bool) {
+    trimmed := strings.TrimSpace(value)
+    switch fieldType {
+    case TypeInt:
+        if i, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+            return strconv.FormatInt(i, 10), true
+        }
+        // e.g. 12.0
+        if f, err := strconv.ParseFloat(trimmed, 64); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+            return strconv.FormatInt(int64(f), 10), true
+        }
+    case TypeFloat:
+        if f, err := strconv.ParseFloat(trimmed, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+            return strconv.FormatFloat(f, 'f', -1, 64), true
+        }
+    case TypeBool:
+        if b, ok := parseBool(trimmed); ok {
+            return strconv.FormatBool(b), true
+        }
+    case TypeTimestamp:
+        if t, ok := ParseTime(trimmed); ok {
+            return t.UTC().Format(time.RFC3339Nano), true
+        }
+    case TypeEpochMs:
+        if t, ok := ParseTime(trimmed); ok {
+            return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10), true
+        }
+    case TypeString:
+        return value, true
+    }
+    return value, false
+}
+
+// Typed returns the value of a coerced field as a JSON type. Values not in the canonical form of
+// their type, e.g. that failed to be coerced, are returned as strings.
+func Typed(value string, fieldType string) interface{} {
+    switch fieldType {
+    case TypeInt, TypeEpochMs:
+        if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+            return i
+        }
+    case TypeFloat:
+        if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+            return f
+        }
+    case TypeBool:
+        if b, err := strconv.ParseBool(value); err == nil {
+            return b
+        }
+    }
+    return value
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"ami-reader/service"
+	"fmt"
+	"github.com/spf13/pflag"
+	"os"
+	"runtime"
+	"strings"
+)
+
+func runVersion(args []string) int {
+	flags := pflag.NewFlagSet("version", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, "Usage: ami-reader version\n\nPrints build information.\n")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	fmt.Printf("ami-reader %s\n", version)
+	fmt.Printf("commit:  %s\n", commit)
+	fmt.Printf("built:   %s\n", buildDate)
+	fmt.Printf("go:      %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("sinks:   %s\n", strings.Join(service.RegisteredAmiEventConsumers(), ", "))
+	return 0
+}